@@ -58,6 +58,9 @@ Logging Options:
 JetStream Options:
     -js, --jetstream                 Enable JetStream functionality
     -sd, --store_dir <dir>           Set the storage directory
+        --inspect <dir>              Inspect a stream directory in the store and exit
+        --rebuild_index              Rebuild the index files of the inspected stream
+        --truncate_tail              Truncate a torn write at the end of the inspected stream
 
 Authorization Options:
         --user <user>                User required for connections
@@ -114,6 +117,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Inspect a stream store and exit.
+	if opts.InspectStore != "" {
+		if err := server.InspectStreamStore(opts, os.Stdout); err != nil {
+			server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+		}
+		os.Exit(0)
+	}
+
 	// Create the server with appropriate options.
 	s, err := server.NewServer(opts)
 	if err != nil {
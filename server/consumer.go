@@ -38,19 +38,33 @@ const (
 	JSPullRequestPendingBytes = "Nats-Pending-Bytes"
 )
 
+// Header sent with messages delivered to the pinned client of a priority group.
+const JSPullRequestNatsPinId = "Nats-Pin-Id"
+
 type ConsumerInfo struct {
-	Stream         string          `json:"stream_name"`
-	Name           string          `json:"name"`
-	Created        time.Time       `json:"created"`
-	Config         *ConsumerConfig `json:"config,omitempty"`
-	Delivered      SequenceInfo    `json:"delivered"`
-	AckFloor       SequenceInfo    `json:"ack_floor"`
-	NumAckPending  int             `json:"num_ack_pending"`
-	NumRedelivered int             `json:"num_redelivered"`
-	NumWaiting     int             `json:"num_waiting"`
-	NumPending     uint64          `json:"num_pending"`
-	Cluster        *ClusterInfo    `json:"cluster,omitempty"`
-	PushBound      bool            `json:"push_bound,omitempty"`
+	Stream         string               `json:"stream_name"`
+	Name           string               `json:"name"`
+	Created        time.Time            `json:"created"`
+	Config         *ConsumerConfig      `json:"config,omitempty"`
+	Delivered      SequenceInfo         `json:"delivered"`
+	AckFloor       SequenceInfo         `json:"ack_floor"`
+	NumAckPending  int                  `json:"num_ack_pending"`
+	NumRedelivered int                  `json:"num_redelivered"`
+	NumWaiting     int                  `json:"num_waiting"`
+	NumPending     uint64               `json:"num_pending"`
+	Cluster        *ClusterInfo         `json:"cluster,omitempty"`
+	PushBound      bool                 `json:"push_bound,omitempty"`
+	NumScheduled   uint64               `json:"num_scheduled,omitempty"`
+	Paused         bool                 `json:"paused,omitempty"`
+	PauseRemaining time.Duration        `json:"pause_remaining,omitempty"`
+	PriorityGroups []PriorityGroupState `json:"priority_groups,omitempty"`
+}
+
+// PriorityGroupState is the current state of a priority group.
+type PriorityGroupState struct {
+	Group          string    `json:"group"`
+	PinnedClientID string    `json:"pinned_client_id,omitempty"`
+	PinnedTS       time.Time `json:"pinned_ts,omitempty"`
 }
 
 type ConsumerConfig struct {
@@ -66,6 +80,7 @@ type ConsumerConfig struct {
 	MaxDeliver      int             `json:"max_deliver,omitempty"`
 	BackOff         []time.Duration `json:"backoff,omitempty"`
 	FilterSubject   string          `json:"filter_subject,omitempty"`
+	FilterSubjects  []string        `json:"filter_subjects,omitempty"`
 	ReplayPolicy    ReplayPolicy    `json:"replay_policy"`
 	RateLimit       uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
 	SampleFrequency string          `json:"sample_freq,omitempty"`
@@ -94,8 +109,35 @@ type ConsumerConfig struct {
 
 	// Don't add to general clients.
 	Direct bool `json:"direct,omitempty"`
+
+	// Do not deliver any messages until this time.
+	PauseUntil *time.Time `json:"pause_until,omitempty"`
+
+	// Republish messages that exceeded MaxDeliver or were terminated.
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+
+	// Priority groups for pull consumers.
+	PriorityGroups []string       `json:"priority_groups,omitempty"`
+	PriorityPolicy PriorityPolicy `json:"priority_policy,omitempty"`
+	PinnedTTL      time.Duration  `json:"priority_timeout,omitempty"`
+}
+
+// DeadLetter is for republishing messages a consumer gave up on.
+// Messages are published to Subject in the stream's account, so a stream
+// that listens on Subject will capture them.
+// The last NAK reason is best effort. It is only kept in memory on the consumer
+// leader and is not replicated, so it will be missing after a leader change or restart.
+type DeadLetter struct {
+	Subject     string `json:"subject"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
 }
 
+// Reasons placed in the JSDeadLetterReason header.
+const (
+	deadLetterMaxDeliveries = "MaxDeliveries"
+	deadLetterTerminated    = "Terminated"
+)
+
 // SequenceInfo has both the consumer and the stream sequence and last activity.
 type SequenceInfo struct {
 	Consumer uint64     `json:"consumer_seq"`
@@ -110,7 +152,8 @@ type CreateConsumerRequest struct {
 
 // ConsumerNakOptions is for optional NAK values, e.g. delay.
 type ConsumerNakOptions struct {
-	Delay time.Duration `json:"delay"`
+	Delay  time.Duration `json:"delay"`
+	Reason string        `json:"reason,omitempty"`
 }
 
 // DeliverPolicy determines how the consumer should select the first message to deliver.
@@ -192,6 +235,30 @@ func (r ReplayPolicy) String() string {
 	}
 }
 
+// PriorityPolicy determines how a pull consumer selects between waiting requests of a priority group.
+type PriorityPolicy int
+
+const (
+	// PriorityNone serves waiting requests in the order they were received.
+	PriorityNone PriorityPolicy = iota
+	// PriorityPinnedClient only serves requests from a single pinned client, identified by the
+	// Nats-Pin-Id header. Another client will be pinned if the current one goes inactive.
+	PriorityPinnedClient
+	// PriorityOverflow serves requests that set minimum pending thresholds only once those are exceeded.
+	PriorityOverflow
+)
+
+func (p PriorityPolicy) String() string {
+	switch p {
+	case PriorityPinnedClient:
+		return "pinned_client"
+	case PriorityOverflow:
+		return "overflow"
+	default:
+		return "none"
+	}
+}
+
 // OK
 const OK = "+OK"
 
@@ -266,6 +333,7 @@ type consumer struct {
 	rdq               []uint64
 	rdqi              map[uint64]struct{}
 	rdc               map[uint64]uint64
+	nakr              map[uint64]string // Last NAK reasons, only tracked for dead letters and not replicated.
 	maxdc             uint64
 	waiting           *waitQueue
 	cfg               ConsumerConfig
@@ -274,7 +342,12 @@ type consumer struct {
 	active            bool
 	replay            bool
 	filterWC          bool
+	subjf             []string // Subject filters, nil if not filtered.
 	dtmr              *time.Timer
+	uptmr             *time.Timer // Resumes delivery when paused.
+	pinId             string      // Pinned client of our priority group.
+	pinTS             time.Time
+	pinLast           time.Time // Last activity of the pinned client.
 	gwdtmr            *time.Timer
 	dthresh           time.Duration
 	mch               chan struct{}
@@ -307,8 +380,8 @@ type consumer struct {
 	// Ack queue
 	ackMsgs *ipQueue
 
-	// For stream signaling.
-	sigSub *subscription
+	// For stream signaling, one per subject filter.
+	sigSubs []*subscription
 }
 
 type proposal struct {
@@ -327,6 +400,9 @@ const (
 	JsFlowControlMaxPending = 32 * 1024 * 1024
 	// JsDefaultMaxAckPending is set for consumers with explicit ack that do not set the max ack pending.
 	JsDefaultMaxAckPending = 1000
+	// JsDefaultPinnedTTL is the default time a pinned client of a priority group can be inactive
+	// before another client gets pinned.
+	JsDefaultPinnedTTL = 2 * time.Minute
 )
 
 // Helper function to set consumer config defaults from above.
@@ -362,6 +438,10 @@ func setConsumerConfigDefaults(config *ConsumerConfig, lim *JSLimitOpts, accLim
 	if config.DeliverSubject == _EMPTY_ && config.MaxRequestBatch == 0 && lim.MaxRequestBatch > 0 {
 		config.MaxRequestBatch = lim.MaxRequestBatch
 	}
+	// Set the default inactivity period for pinned clients.
+	if config.PriorityPolicy == PriorityPinnedClient && config.PinnedTTL == 0 {
+		config.PinnedTTL = JsDefaultPinnedTTL
+	}
 }
 
 // Check the consumer config. If we are recovering don't check filter subjects.
@@ -466,19 +546,68 @@ func checkConsumerCfg(
 		}
 	}
 
-	// As best we can make sure the filtered subject is valid.
-	if config.FilterSubject != _EMPTY_ {
-		subjects := copyStrings(cfg.Subjects)
+	if config.FilterSubject != _EMPTY_ && len(config.FilterSubjects) > 0 {
+		return NewJSConsumerMultipleFiltersNotAllowedError()
+	}
+
+	// As best we can make sure the filtered subjects are valid.
+	if filters := config.filters(); len(filters) > 0 {
+		subjects := cfg.storedSubjects()
 		// explicitly skip validFilteredSubject when recovering
 		hasExt := isRecovering
 		if !isRecovering {
 			subjects, hasExt = gatherSourceMirrorSubjects(subjects, cfg, acc)
 		}
-		if !hasExt && !validFilteredSubject(config.FilterSubject, subjects) {
-			return NewJSConsumerFilterNotSubsetError()
+		for i, filter := range filters {
+			if filter == _EMPTY_ {
+				return NewJSConsumerEmptyFilterError()
+			}
+			if !hasExt && !validFilteredSubject(filter, subjects) {
+				return NewJSConsumerFilterNotSubsetError()
+			}
+			for _, ofilter := range filters[:i] {
+				if SubjectsCollide(ofilter, filter) {
+					return NewJSConsumerOverlappingSubjectFiltersError()
+				}
+			}
 		}
 	}
 
+	if dl := config.DeadLetter; dl != nil {
+		if !IsValidPublishSubject(dl.Subject) {
+			return NewJSConsumerDeadLetterInvalidSubjectError()
+		}
+		if config.AckPolicy == AckNone {
+			return NewJSConsumerDeadLetterRequiresAckError()
+		}
+		// Make sure we would not be delivered our own dead letters.
+		subjects := config.filters()
+		if len(subjects) == 0 {
+			subjects = cfg.storedSubjects()
+		}
+		for _, subj := range subjects {
+			if SubjectsCollide(subj, dl.Subject) {
+				return NewJSConsumerDeadLetterCycleError()
+			}
+		}
+	}
+
+	if config.PriorityPolicy != PriorityNone || len(config.PriorityGroups) > 0 {
+		if config.DeliverSubject != _EMPTY_ {
+			return NewJSConsumerPushWithPriorityGroupError()
+		}
+		if config.PriorityPolicy == PriorityNone {
+			return NewJSConsumerPriorityGroupWithPolicyNoneError()
+		}
+		// We only support a single group for now.
+		if len(config.PriorityGroups) != 1 || !isValidName(config.PriorityGroups[0]) {
+			return NewJSConsumerInvalidPriorityGroupError()
+		}
+	}
+	if config.PinnedTTL < 0 || (config.PinnedTTL > 0 && config.PriorityPolicy != PriorityPinnedClient) {
+		return NewJSConsumerPinnedTTLInvalidError()
+	}
+
 	// Helper function to formulate similar errors.
 	badStart := func(dp, start string) error {
 		return fmt.Errorf("consumer delivery policy is deliver %s, but optional start %s is also set", dp, start)
@@ -510,7 +639,7 @@ func checkConsumerCfg(
 		if config.OptStartTime != nil {
 			return NewJSConsumerInvalidPolicyError(badStart("last per subject", "time"))
 		}
-		if config.FilterSubject == _EMPTY_ {
+		if len(config.filters()) == 0 {
 			return NewJSConsumerInvalidPolicyError(notSet("last per subject", "filter subject"))
 		}
 	case DeliverNew:
@@ -659,10 +788,10 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		}
 
 		if len(mset.consumers) > 0 {
-			if config.FilterSubject == _EMPTY_ {
+			if filters := config.filters(); len(filters) == 0 {
 				mset.mu.Unlock()
 				return nil, NewJSConsumerWQMultipleUnfilteredError()
-			} else if !mset.partitionUnique(config.FilterSubject) {
+			} else if !mset.partitionUnique(filters) {
 				// Prior to v2.9.7, on a stream with WorkQueue policy, the servers
 				// were not catching the error of having multiple consumers with
 				// overlapping filter subjects depending on the scope, for instance
@@ -748,10 +877,8 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		o.waiting = newWaitQueue(config.MaxWaiting)
 	}
 
-	// Check if we have  filtered subject that is a wildcard.
-	if config.FilterSubject != _EMPTY_ && subjectHasWildcard(config.FilterSubject) {
-		o.filterWC = true
-	}
+	// Setup our subject filters and check if any are wildcards.
+	o.setSubjectFilters(config.filters())
 
 	// already under lock, mset.Name() would deadlock
 	o.stream = mset.cfg.Name
@@ -1070,6 +1197,10 @@ func (o *consumer) setLeader(isLeader bool) {
 		if node != nil && o.pch == nil {
 			o.pch = make(chan struct{}, 1)
 		}
+		// If we are paused make sure we resume on time.
+		o.updatePauseState(&o.cfg)
+		// Our pinned client, if any, was replicated to us. Give it time to find us before we unpin it.
+		o.pinLast = time.Now()
 		o.mu.Unlock()
 
 		// Snapshot initial info.
@@ -1102,6 +1233,7 @@ func (o *consumer) setLeader(isLeader bool) {
 		}
 		// Make sure to clear out any re delivery queues
 		stopAndClearTimer(&o.ptmr)
+		stopAndClearTimer(&o.uptmr)
 		o.rdq, o.rdqi = nil, nil
 		o.pending = nil
 		// ok if they are nil, we protect inside unsubscribe()
@@ -1191,6 +1323,31 @@ func (o *consumer) sendDeleteAdvisoryLocked() {
 	o.sendAdvisory(subj, j)
 }
 
+// Lock should be held.
+func (o *consumer) sendPauseAdvisoryLocked(cfg *ConsumerConfig) {
+	e := JSConsumerPauseAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerPauseAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Domain:   o.srv.getOpts().JetStreamDomain,
+	}
+	if e.Paused, _ = cfg.pauseState(); e.Paused {
+		e.PauseUntil = cfg.PauseUntil.UTC()
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerPausePre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
 func (o *consumer) sendCreateAdvisory() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -1520,6 +1677,9 @@ func (acc *Account) checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
 	if cfg.MaxWaiting != ncfg.MaxWaiting {
 		return errors.New("max waiting can not be updated")
 	}
+	if cfg.PriorityPolicy != ncfg.PriorityPolicy {
+		return errors.New("priority policy can not be updated")
+	}
 
 	// Deliver Subject is conditional on if its bound.
 	if cfg.DeliverSubject != ncfg.DeliverSubject {
@@ -1601,16 +1761,29 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 		}
 	}
 
-	if o.cfg.FilterSubject != cfg.FilterSubject {
-		if cfg.FilterSubject != _EMPTY_ {
-			o.filterWC = subjectHasWildcard(cfg.FilterSubject)
-		}
-		// Make sure we have correct signaling setup.
+	if o.cfg.FilterSubject != cfg.FilterSubject || !reflect.DeepEqual(o.cfg.FilterSubjects, cfg.FilterSubjects) {
+		filters := cfg.filters()
+		// Swap our filters and make sure we have correct signaling setup.
 		// Consumer lock can not be held.
 		mset := o.mset
 		o.mu.Unlock()
-		mset.swapSigSubs(o, cfg.FilterSubject)
+		mset.swapSigSubs(o, filters)
 		o.mu.Lock()
+		// Recalculate our num pending for the new filters.
+		o.streamNumPending()
+	}
+
+	// PauseUntil
+	if pu, opu := cfg.PauseUntil, o.cfg.PauseUntil; (pu == nil) != (opu == nil) || pu != nil && !pu.Equal(*opu) {
+		o.updatePauseState(cfg)
+		if o.isLeader() {
+			o.sendPauseAdvisoryLocked(cfg)
+		}
+	}
+
+	// Only track NAK reasons while we have a dead letter subject.
+	if cfg.DeadLetter == nil {
+		o.nakr = nil
 	}
 
 	// Record new config for others that do not need special handling.
@@ -1725,8 +1898,8 @@ func (o *consumer) processAck(subject, reply string, hdr int, rmsg []byte) {
 		o.processNak(sseq, dseq, dc, msg)
 	case bytes.Equal(msg, AckProgress):
 		o.progressUpdate(sseq)
-	case bytes.Equal(msg, AckTerm):
-		o.processTerm(sseq, dseq, dc)
+	case bytes.HasPrefix(msg, AckTerm):
+		o.processTerm(sseq, dseq, dc, string(bytes.TrimSpace(msg[len(AckTerm):])))
 	}
 
 	// Ack the ack if requested.
@@ -1978,6 +2151,20 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 		}
 	}
 
+	// Check to see if we have options attached, e.g. a delay or reason.
+	var arg []byte
+	var nd ConsumerNakOptions
+	var nerr error
+	if len(nak) > len(AckNak) {
+		if arg = bytes.TrimSpace(nak[len(AckNak):]); len(arg) > 0 {
+			if arg[0] == '{' {
+				nerr = json.Unmarshal(arg, &nd)
+			} else {
+				nd.Delay, nerr = time.ParseDuration(string(arg))
+			}
+		}
+	}
+
 	// Deliver an advisory
 	e := JSConsumerDeliveryNakAdvisory{
 		TypedEvent: TypedEvent{
@@ -1991,6 +2178,7 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 		StreamSeq:   sseq,
 		Deliveries:  dc,
 		Domain:      o.srv.getOpts().JetStreamDomain,
+		Reason:      nd.Reason,
 	}
 
 	j, err := json.Marshal(e)
@@ -2000,41 +2188,37 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 
 	o.sendAdvisory(o.nakEventT, j)
 
+	// Remember the reason in case this ends up as a dead letter.
+	// This is best effort, a new leader will not know about reasons we received.
+	if o.cfg.DeadLetter != nil && nd.Reason != _EMPTY_ {
+		if o.nakr == nil {
+			o.nakr = make(map[uint64]string)
+		}
+		o.nakr[sseq] = nd.Reason
+	}
+
 	// Check to see if we have delays attached.
-	if len(nak) > len(AckNak) {
-		arg := bytes.TrimSpace(nak[len(AckNak):])
-		if len(arg) > 0 {
-			var d time.Duration
-			var err error
-			if arg[0] == '{' {
-				var nd ConsumerNakOptions
-				if err = json.Unmarshal(arg, &nd); err == nil {
-					d = nd.Delay
-				}
-			} else {
-				d, err = time.ParseDuration(string(arg))
-			}
-			if err != nil {
-				// Treat this as normal NAK.
-				o.srv.Warnf("JetStream consumer '%s > %s > %s' bad NAK delay value: %q", o.acc.Name, o.stream, o.name, arg)
-			} else {
-				// We have a parsed duration that the user wants us to wait before retrying.
-				// Make sure we are not on the rdq.
-				o.removeFromRedeliverQueue(sseq)
-				if p, ok := o.pending[sseq]; ok {
-					// now - ackWait is expired now, so offset from there.
-					p.Timestamp = time.Now().Add(-o.cfg.AckWait).Add(d).UnixNano()
-					// Update store system which will update followers as well.
-					o.updateDelivered(p.Sequence, sseq, dc, p.Timestamp)
-					if o.ptmr != nil {
-						// Want checkPending to run and figure out the next timer ttl.
-						// TODO(dlc) - We could optimize this maybe a bit more and track when we expect the timer to fire.
-						o.ptmr.Reset(10 * time.Millisecond)
-					}
+	if len(arg) > 0 {
+		if nerr != nil {
+			// Treat this as normal NAK.
+			o.srv.Warnf("JetStream consumer '%s > %s > %s' bad NAK delay value: %q", o.acc.Name, o.stream, o.name, arg)
+		} else {
+			// We have a parsed duration that the user wants us to wait before retrying.
+			// Make sure we are not on the rdq.
+			o.removeFromRedeliverQueue(sseq)
+			if p, ok := o.pending[sseq]; ok {
+				// now - ackWait is expired now, so offset from there.
+				p.Timestamp = time.Now().Add(-o.cfg.AckWait).Add(nd.Delay).UnixNano()
+				// Update store system which will update followers as well.
+				o.updateDelivered(p.Sequence, sseq, dc, p.Timestamp)
+				if o.ptmr != nil {
+					// Want checkPending to run and figure out the next timer ttl.
+					// TODO(dlc) - We could optimize this maybe a bit more and track when we expect the timer to fire.
+					o.ptmr.Reset(10 * time.Millisecond)
 				}
-				// Nothing else for use to do now so return.
-				return
 			}
+			// Nothing else for use to do now so return.
+			return
 		}
 	}
 
@@ -2047,13 +2231,25 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 }
 
 // Process a TERM
-func (o *consumer) processTerm(sseq, dseq, dc uint64) {
+func (o *consumer) processTerm(sseq, dseq, dc uint64, reason string) {
+	// Grab the dead letter before the ack below, which could remove the message.
+	var dlm *jsPubMsg
+	o.mu.Lock()
+	if _, ok := o.pending[sseq]; ok && o.cfg.DeadLetter != nil {
+		dlm = o.deadLetterMsg(sseq, dc, deadLetterTerminated, reason)
+	}
+	o.mu.Unlock()
+
 	// Treat like an ack to suppress redelivery.
 	o.processAckMsg(sseq, dseq, dc, false)
 
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
+	if dlm != nil {
+		o.outq.send(dlm)
+	}
+
 	// Deliver an advisory
 	e := JSConsumerDeliveryTerminatedAdvisory{
 		TypedEvent: TypedEvent{
@@ -2067,6 +2263,7 @@ func (o *consumer) processTerm(sseq, dseq, dc uint64) {
 		StreamSeq:   sseq,
 		Deliveries:  dc,
 		Domain:      o.srv.getOpts().JetStreamDomain,
+		Reason:      reason,
 	}
 
 	j, err := json.Marshal(e)
@@ -2125,6 +2322,38 @@ func (o *consumer) readStoredState(slseq uint64) error {
 	return err
 }
 
+// Rewind our stored state so we are not ahead of the stream's last sequence.
+// Used when a stream is restored to a point in time.
+// Lock should be held.
+func (o *consumer) rewindStoredState(slseq uint64) error {
+	if o.store == nil {
+		return nil
+	}
+	state, err := o.store.State()
+	if err != nil || state == nil || state.Delivered.Stream <= slseq {
+		return err
+	}
+	state.Delivered.Stream = slseq
+	if state.AckFloor.Stream > slseq {
+		state.AckFloor.Stream = slseq
+	}
+	for seq := range state.Pending {
+		if seq > slseq {
+			delete(state.Pending, seq)
+		}
+	}
+	for seq := range state.Redelivered {
+		if seq > slseq {
+			delete(state.Redelivered, seq)
+		}
+	}
+	// Applying our state will not move us backwards, so do that here.
+	if o.sseq > slseq+1 {
+		o.sseq = slseq + 1
+	}
+	return o.store.Update(state)
+}
+
 // Apply the consumer stored state.
 // Lock should be held.
 func (o *consumer) applyState(state *ConsumerState) {
@@ -2262,6 +2491,24 @@ func (o *consumer) infoWithSnapAndReply(snap bool, reply string) *ConsumerInfo {
 		NumPending:     o.streamNumPending(),
 		PushBound:      o.isPushMode() && o.active,
 	}
+	info.Paused, info.PauseRemaining = o.cfg.pauseState()
+	for _, group := range o.cfg.PriorityGroups {
+		pgs := PriorityGroupState{Group: group}
+		if o.cfg.PriorityPolicy == PriorityPinnedClient && o.pinId != _EMPTY_ {
+			pgs.PinnedClientID, pgs.PinnedTS = o.pinId, o.pinTS.UTC()
+		}
+		info.PriorityGroups = append(info.PriorityGroups, pgs)
+	}
+	// Messages scheduled for later delivery are not considered pending yet.
+	if o.mset != nil {
+		var above uint64
+		info.NumScheduled, above = o.mset.sched.count(o.sseq, o.subjf)
+		if above < info.NumPending {
+			info.NumPending -= above
+		} else {
+			info.NumPending = 0
+		}
+	}
 	// Adjust active based on non-zero etc. Also make UTC here.
 	if !o.ldt.IsZero() {
 		ldt := o.ldt.UTC() // This copies as well.
@@ -2384,6 +2631,7 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 		}
 		// We do these regardless.
 		delete(o.rdc, sseq)
+		delete(o.nakr, sseq)
 		o.removeFromRedeliverQueue(sseq)
 	case AckAll:
 		// no-op
@@ -2399,6 +2647,7 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 		for seq := sseq; seq > sseq-sagap; seq-- {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.nakr, seq)
 			o.removeFromRedeliverQueue(seq)
 		}
 	case AckNone:
@@ -2438,7 +2687,7 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 // even if the stream only has a single non-wildcard subject designation.
 // Read lock should be held.
 func (o *consumer) isFiltered() bool {
-	if o.cfg.FilterSubject == _EMPTY_ {
+	if len(o.subjf) == 0 {
 		return false
 	}
 	// If we are here we want to check if the filtered subject is
@@ -2447,8 +2696,8 @@ func (o *consumer) isFiltered() bool {
 	if mset == nil {
 		return true
 	}
-	if len(mset.cfg.Subjects) == 1 {
-		return o.cfg.FilterSubject != mset.cfg.Subjects[0]
+	if len(mset.cfg.Subjects) == 1 && len(o.subjf) == 1 {
+		return o.subjf[0] != mset.cfg.Subjects[0]
 	}
 	// All else return true.
 	return true
@@ -2515,36 +2764,43 @@ func (o *consumer) needAck(sseq uint64, subj string) bool {
 }
 
 // Helper for the next message requests.
-func nextReqFromMsg(msg []byte) (time.Time, int, int, bool, time.Duration, time.Time, error) {
+func nextReqFromMsg(msg []byte) (time.Time, int, int, bool, time.Duration, time.Time, *PriorityGroup, error) {
 	req := bytes.TrimSpace(msg)
 
 	switch {
 	case len(req) == 0:
-		return time.Time{}, 1, 0, false, 0, time.Time{}, nil
+		return time.Time{}, 1, 0, false, 0, time.Time{}, nil, nil
 
 	case req[0] == '{':
 		var cr JSApiConsumerGetNextRequest
 		if err := json.Unmarshal(req, &cr); err != nil {
-			return time.Time{}, -1, 0, false, 0, time.Time{}, err
+			return time.Time{}, -1, 0, false, 0, time.Time{}, nil, err
 		}
 		var hbt time.Time
 		if cr.Heartbeat > 0 {
 			if cr.Heartbeat*2 > cr.Expires {
-				return time.Time{}, 1, 0, false, 0, time.Time{}, errors.New("heartbeat value too large")
+				return time.Time{}, 1, 0, false, 0, time.Time{}, nil, errors.New("heartbeat value too large")
 			}
 			hbt = time.Now().Add(cr.Heartbeat)
 		}
+		var pg *PriorityGroup
+		if cr.PriorityGroup != (PriorityGroup{}) {
+			if cr.MinPending < 0 || cr.MinAckPending < 0 {
+				return time.Time{}, 1, 0, false, 0, time.Time{}, nil, errors.New("priority group thresholds can not be negative")
+			}
+			pg = &cr.PriorityGroup
+		}
 		if cr.Expires == time.Duration(0) {
-			return time.Time{}, cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, nil
+			return time.Time{}, cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, pg, nil
 		}
-		return time.Now().Add(cr.Expires), cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, nil
+		return time.Now().Add(cr.Expires), cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, pg, nil
 	default:
 		if n, err := strconv.Atoi(string(req)); err == nil {
-			return time.Time{}, n, 0, false, 0, time.Time{}, nil
+			return time.Time{}, n, 0, false, 0, time.Time{}, nil, nil
 		}
 	}
 
-	return time.Time{}, 1, 0, false, 0, time.Time{}, nil
+	return time.Time{}, 1, 0, false, 0, time.Time{}, nil, nil
 }
 
 // Represents a request that is on the internal waiting queue
@@ -2560,6 +2816,7 @@ type waitingRequest struct {
 	hb       time.Duration
 	hbt      time.Time
 	noWait   bool
+	priority *PriorityGroup
 }
 
 // sync.Pool for waiting requests.
@@ -2581,7 +2838,7 @@ func (wr *waitingRequest) recycleIfDone() bool {
 // Force a recycle.
 func (wr *waitingRequest) recycle() {
 	if wr != nil {
-		wr.acc, wr.interest, wr.reply = nil, _EMPTY_, _EMPTY_
+		wr.acc, wr.interest, wr.reply, wr.priority = nil, _EMPTY_, _EMPTY_, nil
 		wrPool.Put(wr)
 	}
 }
@@ -2726,10 +2983,23 @@ func (o *consumer) nextWaiting(sz int) *waitingRequest {
 	if o.waiting == nil || o.waiting.isEmpty() {
 		return nil
 	}
+	if o.cfg.PriorityPolicy == PriorityPinnedClient {
+		o.checkPinnedClient()
+	}
+	var skipped int
 	for wr := o.waiting.peek(); !o.waiting.isEmpty(); wr = o.waiting.peek() {
 		if wr == nil {
 			break
 		}
+		// Requests that can not be served right now due to our priority policy are moved to the back.
+		if o.cfg.PriorityPolicy != PriorityNone && !o.isPriorityEligible(wr) {
+			if skipped++; skipped >= o.waiting.len() {
+				return nil
+			}
+			o.waiting.removeCurrent()
+			o.waiting.add(wr)
+			continue
+		}
 		// Check if we have max bytes set.
 		if wr.b > 0 {
 			if sz <= wr.b {
@@ -2757,11 +3027,11 @@ func (o *consumer) nextWaiting(sz int) *waitingRequest {
 		if wr.expires.IsZero() || time.Now().Before(wr.expires) {
 			rr := wr.acc.sl.Match(wr.interest)
 			if len(rr.psubs)+len(rr.qsubs) > 0 {
-				return o.waiting.pop()
+				return o.popWaiting()
 			} else if time.Since(wr.received) < defaultGatewayRecentSubExpiration && (o.srv.leafNodeEnabled || o.srv.gateway.enabled) {
-				return o.waiting.pop()
+				return o.popWaiting()
 			} else if o.srv.gateway.enabled && o.srv.hasGatewayInterest(wr.acc.Name, wr.interest) {
-				return o.waiting.pop()
+				return o.popWaiting()
 			}
 		}
 		if wr.interest != wr.reply {
@@ -2779,6 +3049,100 @@ func (o *consumer) nextWaiting(sz int) *waitingRequest {
 	return nil
 }
 
+// Pop the next waiting request, pinning its client if our priority group has none pinned.
+// Lock should be held.
+func (o *consumer) popWaiting() *waitingRequest {
+	if o.cfg.PriorityPolicy == PriorityPinnedClient && o.pinId == _EMPTY_ {
+		if wr := o.waiting.peek(); wr != nil && wr.priority != nil {
+			o.pinId, o.pinTS, o.pinLast = nuid.Next(), time.Now(), time.Now()
+			wr.priority.Id = o.pinId
+			o.proposePin()
+		}
+	}
+	return o.waiting.pop()
+}
+
+// Check if a waiting request can be served under our priority policy.
+// Lock should be held.
+func (o *consumer) isPriorityEligible(wr *waitingRequest) bool {
+	if wr.priority == nil {
+		return false
+	}
+	switch o.cfg.PriorityPolicy {
+	case PriorityPinnedClient:
+		// Anyone can be pinned if no one is right now.
+		return o.pinId == _EMPTY_ || wr.priority.Id == o.pinId
+	case PriorityOverflow:
+		pg := wr.priority
+		if pg.MinPending == 0 && pg.MinAckPending == 0 {
+			return true
+		}
+		if pg.MinPending > 0 && o.numPending()+uint64(len(o.rdq)) >= uint64(pg.MinPending) {
+			return true
+		}
+		return pg.MinAckPending > 0 && int64(len(o.pending)) >= pg.MinAckPending
+	}
+	return true
+}
+
+// Unpin the pinned client of our priority group if it has been inactive for longer than
+// the configured PinnedTTL, which allows another waiting client to be pinned.
+// Lock should be held.
+func (o *consumer) checkPinnedClient() {
+	if o.pinId == _EMPTY_ || time.Since(o.pinLast) < o.cfg.PinnedTTL {
+		return
+	}
+	// Still active if the pinned client has any valid requests waiting.
+	now := time.Now()
+	for i, rp := 0, o.waiting.rp; i < o.waiting.n; i++ {
+		if wr := o.waiting.reqs[rp]; wr != nil && wr.priority != nil && wr.priority.Id == o.pinId {
+			if wr.expires.IsZero() || now.Before(wr.expires) {
+				o.pinLast = now
+				return
+			}
+		}
+		rp = (rp + 1) % cap(o.waiting.reqs)
+	}
+	o.pinId, o.pinTS = _EMPTY_, time.Time{}
+	o.proposePin()
+}
+
+// Unpin the pinned client of our priority group, if any, so the next waiting client will be pinned.
+// Returns false if the group is not a pinned priority group of this consumer.
+func (o *consumer) unpin(group string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cfg.PriorityPolicy != PriorityPinnedClient || len(o.cfg.PriorityGroups) == 0 || o.cfg.PriorityGroups[0] != group {
+		return false
+	}
+	o.pinId, o.pinTS = _EMPTY_, time.Time{}
+	o.proposePin()
+	o.signalNewMessages()
+	return true
+}
+
+// Pins are replicated as an updatePinOp entry, which servers before this version can not apply.
+var pinMinVersion = [3]int{2, 10, 0}
+
+// Communicate to the cluster the pinned client of our priority group, so a new
+// leader will only serve the same client. While any peer is older the pin is
+// only known to us.
+// Lock should be held.
+func (o *consumer) proposePin() {
+	if o.node == nil || !o.peersVersionAtLeast(pinMinVersion) {
+		return
+	}
+	var ts int64
+	if !o.pinTS.IsZero() {
+		ts = o.pinTS.UnixNano()
+	}
+	b := make([]byte, 9+len(o.pinId))
+	b[0] = byte(updatePinOp)
+	binary.LittleEndian.PutUint64(b[1:], uint64(ts))
+	copy(b[9:], o.pinId)
+	o.propose(b)
+}
+
 // processNextMsgReq will process a request for the next message available. A nil message payload means deliver
 // a single message. If the payload is a formal request or a number parseable with Atoi(), then we will send a
 // batch of messages without requiring another request to this endpoint, or an ACK.
@@ -2823,12 +3187,28 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	}
 
 	// Check payload here to see if they sent in batch size or a formal request.
-	expires, batchSize, maxBytes, noWait, hb, hbt, err := nextReqFromMsg(msg)
+	expires, batchSize, maxBytes, noWait, hb, hbt, pg, err := nextReqFromMsg(msg)
 	if err != nil {
 		sendErr(400, fmt.Sprintf("Bad Request - %v", err))
 		return
 	}
 
+	// Check the priority group, if any, for this request.
+	if len(o.cfg.PriorityGroups) > 0 || pg != nil {
+		if len(o.cfg.PriorityGroups) == 0 || pg == nil || pg.Group != o.cfg.PriorityGroups[0] {
+			sendErr(400, "Bad Request - Invalid Priority Group")
+			return
+		}
+		if o.cfg.PriorityPolicy == PriorityPinnedClient && pg.Id != _EMPTY_ {
+			o.checkPinnedClient()
+			if pg.Id != o.pinId {
+				sendErr(423, "Nats-Pin-Id mismatch")
+				return
+			}
+			o.pinLast = time.Now()
+		}
+	}
+
 	// Check for request limits
 	if o.cfg.MaxRequestBatch > 0 && batchSize > o.cfg.MaxRequestBatch {
 		sendErr(409, fmt.Sprintf("Exceeded MaxRequestBatch of %d", o.cfg.MaxRequestBatch))
@@ -2854,9 +3234,9 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	// If the request is for noWait and we have pending requests already, check if we have room.
 	if noWait {
 		msgsPending := o.numPending() + uint64(len(o.rdq))
-		// If no pending at all, decide what to do with request.
+		// If no pending at all or we are paused, decide what to do with request.
 		// If no expires was set then fail.
-		if msgsPending == 0 && expires.IsZero() {
+		if (msgsPending == 0 || o.isPaused()) && expires.IsZero() {
 			o.waiting.last = time.Now()
 			sendErr(404, "No Messages")
 			return
@@ -2881,6 +3261,7 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	wr.acc, wr.interest, wr.reply, wr.n, wr.d, wr.noWait, wr.expires, wr.hb, wr.hbt = acc, interest, reply, batchSize, 0, noWait, expires, hb, hbt
 	wr.b = maxBytes
 	wr.received = time.Now()
+	wr.priority = pg
 
 	if err := o.waiting.add(wr); err != nil {
 		sendErr(409, "Exceeded MaxWaiting")
@@ -2946,19 +3327,139 @@ func (o *consumer) notifyDeliveryExceeded(sseq, dc uint64) {
 	o.sendAdvisory(o.deliveryExcEventT, j)
 }
 
+// Build the message to republish to our dead letter subject.
+// Returns nil if the message is no longer available.
+// Lock should be held.
+func (o *consumer) deadLetterMsg(sseq, dc uint64, reason, termReason string) *jsPubMsg {
+	if o.mset == nil || o.mset.store == nil || o.cfg.DeadLetter == nil {
+		return nil
+	}
+	var smv StoreMsg
+	sm, err := o.mset.store.LoadMsg(sseq, &smv)
+	if sm == nil || err != nil {
+		return nil
+	}
+
+	// Strip headers that would have a dead letter stream reject or alter the message.
+	hdr := copyBytes(sm.hdr)
+	for _, key := range []string{JSMsgId, JSExpectedStream, JSExpectedLastSeq, JSExpectedLastSubjSeq, JSExpectedLastMsgId, JSMsgRollup, JSMessageTTL} {
+		hdr = removeHeaderIfPresent(hdr, key)
+	}
+	hdr = genHeader(hdr, JSStream, o.stream)
+	hdr = genHeader(hdr, JSSubject, sm.subj)
+	hdr = genHeader(hdr, JSSequence, strconv.FormatUint(sm.seq, 10))
+	hdr = genHeader(hdr, JSTimeStamp, time.Unix(0, sm.ts).UTC().Format(time.RFC3339Nano))
+	hdr = genHeader(hdr, JSDeadLetterConsumer, o.name)
+	hdr = genHeader(hdr, JSDeadLetterDeliveries, strconv.FormatUint(dc, 10))
+	hdr = genHeader(hdr, JSDeadLetterReason, reason)
+	if nr := o.nakr[sseq]; nr != _EMPTY_ {
+		hdr = genHeader(hdr, JSDeadLetterNakReason, nr)
+	}
+	if termReason != _EMPTY_ {
+		hdr = genHeader(hdr, JSDeadLetterTermReason, termReason)
+	}
+
+	var msg []byte
+	if o.cfg.DeadLetter.HeadersOnly {
+		hdr = genHeader(hdr, JSMsgSize, strconv.Itoa(len(sm.msg)))
+	} else {
+		msg = copyBytes(sm.msg)
+	}
+	return newJSPubMsg(o.cfg.DeadLetter.Subject, _EMPTY_, _EMPTY_, hdr, msg, nil, 0)
+}
+
 // Check to see if the candidate subject matches a filter if its present.
 // Lock should be held.
 func (o *consumer) isFilteredMatch(subj string) bool {
 	// No filter is automatic match.
-	if o.cfg.FilterSubject == _EMPTY_ {
+	if len(o.subjf) == 0 {
 		return true
 	}
 	if !o.filterWC {
-		return subj == o.cfg.FilterSubject
+		for _, filter := range o.subjf {
+			if subj == filter {
+				return true
+			}
+		}
+		return false
 	}
 	// If we are here we have a wildcard filter subject.
 	// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
-	return subjectIsSubsetMatch(subj, o.cfg.FilterSubject)
+	return subjectIsSubsetMatchAny(subj, o.subjf)
+}
+
+// Checks if all of our subject filters are equal to or a subset of the subject.
+// Unfiltered consumers never are.
+func (o *consumer) isFilteredSubsetOf(subject string) bool {
+	if len(o.subjf) == 0 {
+		return false
+	}
+	for _, filter := range o.subjf {
+		if !subjectIsSubsetMatch(filter, subject) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets our subject filters and whether any of them are wildcards.
+// Lock should be held.
+func (o *consumer) setSubjectFilters(filters []string) {
+	o.subjf, o.filterWC = filters, false
+	for _, filter := range filters {
+		if subjectHasWildcard(filter) {
+			o.filterWC = true
+			break
+		}
+	}
+}
+
+// Returns our single subject filter, or empty if we have none or more than one.
+// Lock should be held.
+func (o *consumer) singleFilter() string {
+	if len(o.subjf) == 1 {
+		return o.subjf[0]
+	}
+	return _EMPTY_
+}
+
+// Returns the subjects state across all of our subject filters.
+// Lock should be held.
+func (o *consumer) filteredSubjectsState() map[string]SimpleState {
+	if len(o.subjf) <= 1 {
+		return o.mset.store.SubjectsState(o.singleFilter())
+	}
+	mss := make(map[string]SimpleState)
+	for _, filter := range o.subjf {
+		for subj, ss := range o.mset.store.SubjectsState(filter) {
+			mss[subj] = ss
+		}
+	}
+	return mss
+}
+
+// Returns the filtered state from the given sequence across all of our subject filters.
+// Our filters do not overlap so we can simply combine them.
+// Lock should be held.
+func (o *consumer) filteredState(sseq uint64) SimpleState {
+	if len(o.subjf) <= 1 {
+		return o.mset.store.FilteredState(sseq, o.singleFilter())
+	}
+	var state SimpleState
+	for _, filter := range o.subjf {
+		ss := o.mset.store.FilteredState(sseq, filter)
+		if ss.Msgs == 0 {
+			continue
+		}
+		if state.First == 0 || ss.First < state.First {
+			state.First = ss.First
+		}
+		if ss.Last > state.Last {
+			state.Last = ss.Last
+		}
+		state.Msgs += ss.Msgs
+	}
+	return state
 }
 
 var (
@@ -2983,9 +3484,15 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 				// Only send once
 				if dc == o.maxdc+1 {
 					o.notifyDeliveryExceeded(seq, dc-1)
+					if o.cfg.DeadLetter != nil {
+						if dlm := o.deadLetterMsg(seq, dc-1, deadLetterMaxDeliveries, _EMPTY_); dlm != nil {
+							o.outq.send(dlm)
+						}
+					}
 				}
 				// Make sure to remove from pending.
 				delete(o.pending, seq)
+				delete(o.nakr, seq)
 				continue
 			}
 			if seq > 0 {
@@ -3004,14 +3511,7 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 	// Don't make it a "else" because it is possible that there were redeliveries
 	// but we exhausted the redelivery count and are back to try deliver the next message.
 	if o.hasSkipListPending() {
-		seq = o.lss.seqs[0]
-		if len(o.lss.seqs) == 1 {
-			o.sseq = o.lss.resume
-			o.lss = nil
-			o.updateSkipped()
-		} else {
-			o.lss.seqs = o.lss.seqs[1:]
-		}
+		seq = o.nextSkipListSeq()
 	}
 
 	// Check if we have max pending.
@@ -3023,21 +3523,58 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 
 	// Grab next message applicable to us.
 	pmsg := getJSPubMsgFromPool()
-	sm, sseq, err := o.mset.store.LoadNextMsg(o.cfg.FilterSubject, o.filterWC, seq, &pmsg.StoreMsg)
+	for {
+		var sm *StoreMsg
+		var sseq uint64
+		var err error
+		if len(o.subjf) > 1 {
+			sm, sseq, err = loadNextMsgMulti(o.mset.store, o.subjf, seq, &pmsg.StoreMsg)
+		} else {
+			sm, sseq, err = o.mset.store.LoadNextMsg(o.singleFilter(), o.filterWC, seq, &pmsg.StoreMsg)
+		}
 
-	if sseq >= o.sseq {
-		o.sseq = sseq + 1
-		if err == ErrStoreEOF {
-			o.updateSkipped()
+		if sseq >= o.sseq {
+			o.sseq = sseq + 1
+			if err == ErrStoreEOF {
+				o.updateSkipped()
+			}
 		}
-	}
 
-	if sm == nil {
-		pmsg.returnToPool()
-		return nil, 0, err
+		if sm == nil {
+			pmsg.returnToPool()
+			return nil, 0, err
+		}
+
+		// Messages scheduled for later delivery are skipped here, the stream
+		// will place a copy back into the stream once they are due.
+		if o.mset.sched.isScheduled(sm.seq) {
+			if o.npcm > 0 {
+				o.npc--
+			}
+			if o.hasSkipListPending() {
+				seq = o.nextSkipListSeq()
+			} else {
+				seq = o.sseq
+			}
+			continue
+		}
+
+		return pmsg, dc, err
 	}
+}
 
-	return pmsg, dc, err
+// Pops the next sequence from our skip list.
+// Lock should be held.
+func (o *consumer) nextSkipListSeq() uint64 {
+	seq := o.lss.seqs[0]
+	if len(o.lss.seqs) == 1 {
+		o.sseq = o.lss.resume
+		o.lss = nil
+		o.updateSkipped()
+	} else {
+		o.lss.seqs = o.lss.seqs[1:]
+	}
+	return seq
 }
 
 // Will check for expiration and lack of interest on waiting requests.
@@ -3247,6 +3784,11 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		// Clear last error.
 		err = nil
 
+		// If we are paused do not deliver anything. We will be signaled when the pause ends.
+		if o.isPaused() {
+			goto waitForMsgs
+		}
+
 		// If we are in push mode and not active or under flowcontrol let's stop sending.
 		if o.isPushMode() {
 			if !o.active || (o.maxpb > 0 && o.pbytes > o.maxpb) {
@@ -3290,6 +3832,11 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			dsubj = o.dsubj
 		} else if wr := o.nextWaiting(sz); wr != nil {
 			dsubj = wr.reply
+			// Let the pinned client know its id, it needs to send it with any further requests.
+			if o.pinId != _EMPTY_ {
+				addHeader(pmsg, JSPullRequestNatsPinId, o.pinId)
+				o.pinLast = time.Now()
+			}
 			if done := wr.recycleIfDone(); done && o.node != nil {
 				o.removeClusterPendingRequest(dsubj)
 			} else if !done && wr.hb > 0 {
@@ -3361,6 +3908,12 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		if o.isPullMode() {
 			// Dont expire oneshots if we are here because of max ack pending limit.
 			_, _, _, fexp := o.processWaiting(err != errMaxAckPending)
+			// Wake up when our pinned client would time out so another one can be pinned.
+			if o.pinId != _EMPTY_ {
+				if pexp := o.pinLast.Add(o.cfg.PinnedTTL); fexp.IsZero() || pexp.Before(fexp) {
+					fexp = pexp
+				}
+			}
 			if !fexp.IsZero() {
 				expires := time.Until(fexp)
 				if expires <= 0 {
@@ -3445,7 +3998,7 @@ func (o *consumer) streamNumPending() uint64 {
 		o.npc, o.npcm = 0, 0
 	} else if o.cfg.DeliverPolicy == DeliverLastPerSubject {
 		o.npc, o.npcm = 0, 0
-		for _, ss := range o.mset.store.SubjectsState(o.cfg.FilterSubject) {
+		for _, ss := range o.filteredSubjectsState() {
 			if o.sseq <= ss.Last {
 				o.npc++
 				if ss.Last > o.npcm {
@@ -3454,12 +4007,21 @@ func (o *consumer) streamNumPending() uint64 {
 			}
 		}
 	} else {
-		ss := o.mset.store.FilteredState(o.sseq, o.cfg.FilterSubject)
+		ss := o.filteredState(o.sseq)
 		o.npc, o.npcm = ss.Msgs, ss.Last
 	}
 	return o.npc
 }
 
+// Add a header to a message we are about to deliver.
+func addHeader(pmsg *jsPubMsg, key, value string) {
+	hdr := genHeader(pmsg.hdr, key, value)
+	// The underlying buf holds the wire contents, so rebuild it.
+	buf := make([]byte, 0, len(hdr)+len(pmsg.msg))
+	buf = append(append(buf, hdr...), pmsg.msg...)
+	pmsg.buf, pmsg.hdr, pmsg.msg = buf, buf[:len(hdr)], buf[len(hdr):]
+}
+
 func convertToHeadersOnly(pmsg *jsPubMsg) {
 	// If headers only do not send msg payload.
 	// Add in msg size itself as header.
@@ -3763,6 +4325,7 @@ func (o *consumer) checkPending() {
 		if seq < fseq {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.nakr, seq)
 			o.removeFromRedeliverQueue(seq)
 			shouldUpdateState = true
 			continue
@@ -3935,12 +4498,12 @@ func (o *consumer) selectStartingSeqNo() {
 			} else if o.cfg.DeliverPolicy == DeliverLast {
 				o.sseq = state.LastSeq
 				// If we are partitioned here this will be properly set when we become leader.
-				if o.cfg.FilterSubject != _EMPTY_ {
-					ss := o.mset.store.FilteredState(1, o.cfg.FilterSubject)
+				if len(o.subjf) > 0 {
+					ss := o.filteredState(1)
 					o.sseq = ss.Last
 				}
 			} else if o.cfg.DeliverPolicy == DeliverLastPerSubject {
-				if mss := o.mset.store.SubjectsState(o.cfg.FilterSubject); len(mss) > 0 {
+				if mss := o.filteredSubjectsState(); len(mss) > 0 {
 					o.lss = &lastSeqSkipList{
 						resume: state.LastSeq,
 						seqs:   createLastSeqSkipList(mss),
@@ -3984,6 +4547,131 @@ func (o *consumer) selectStartingSeqNo() {
 	}
 }
 
+// Resets are replicated as a resetSeqOp entry, which servers before this version can not apply.
+var resetMinVersion = [3]int{2, 10, 0}
+
+// Returns true if all peers of our group are known to run at least the given version.
+// Lock should be held.
+func (o *consumer) peersVersionAtLeast(v [3]int) bool {
+	for _, p := range o.node.Peers() {
+		if !o.srv.peerVersionAtLeast(p.ID, v[0], v[1], v[2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reset the consumer to deliver from the given stream sequence, or from the first message
+// at or after start if set. All pending and redelivery state is cleared, but the delivery
+// sequence keeps going so acks for earlier deliveries are ignored.
+// Returns the starting sequence used.
+func (o *consumer) resetStartingSeq(sseq uint64, start *time.Time) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || o.mset == nil || o.mset.store == nil {
+		return 0, errBadConsumer
+	}
+	// Resets are replicated as their own entry type, which older servers would not be able to apply.
+	if o.node != nil && !o.peersVersionAtLeast(resetMinVersion) {
+		return 0, NewJSConsumerResetUnsupportedPeersError()
+	}
+	if start != nil {
+		sseq = o.mset.store.GetSeqFromTime(*start)
+	}
+	var state StreamState
+	o.mset.store.FastState(&state)
+	if state.FirstSeq == 0 {
+		sseq = 1
+	} else if sseq < state.FirstSeq {
+		sseq = state.FirstSeq
+	} else if sseq > state.LastSeq {
+		sseq = state.LastSeq + 1
+	}
+
+	o.applyReset(sseq, o.dseq)
+
+	// Replicate to our followers.
+	if o.node != nil {
+		var b [17]byte
+		b[0] = byte(resetSeqOp)
+		var le = binary.LittleEndian
+		le.PutUint64(b[1:], sseq)
+		le.PutUint64(b[9:], o.dseq)
+		o.propose(b[:])
+	}
+	o.signalNewMessages()
+
+	return sseq, nil
+}
+
+// Lock should be held.
+func (o *consumer) applyReset(sseq, dseq uint64) {
+	o.sseq, o.dseq = sseq, dseq
+	o.adflr, o.asflr = dseq-1, sseq-1
+	o.pending, o.rdc, o.nakr = nil, nil, nil
+	o.rdq, o.rdqi = nil, nil
+	o.lss = nil
+	stopAndClearTimer(&o.ptmr)
+	o.streamNumPending()
+	o.writeStoreStateUnlocked()
+}
+
+// Returns if this config is paused as of now and for how much longer.
+func (cc *ConsumerConfig) pauseState() (bool, time.Duration) {
+	if cc.PauseUntil == nil {
+		return false, 0
+	}
+	if remaining := time.Until(*cc.PauseUntil); remaining > 0 {
+		return true, remaining
+	}
+	return false, 0
+}
+
+// Check if we are paused.
+// Lock should be held.
+func (o *consumer) isPaused() bool {
+	paused, _ := o.cfg.pauseState()
+	return paused
+}
+
+// Sets up our timer to resume delivery if the config is paused,
+// otherwise make sure we are delivering.
+// Lock should be held.
+func (o *consumer) updatePauseState(cfg *ConsumerConfig) {
+	stopAndClearTimer(&o.uptmr)
+	if !o.isLeader() {
+		return
+	}
+	paused, remaining := cfg.pauseState()
+	if !paused {
+		o.signalNewMessages()
+		return
+	}
+	o.uptmr = time.AfterFunc(remaining, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		// Check we were not stopped or paused again in the meantime.
+		if o.mset == nil || !o.isLeader() || o.isPaused() {
+			return
+		}
+		o.uptmr = nil
+		o.sendPauseAdvisoryLocked(&o.cfg)
+		o.signalNewMessages()
+	})
+}
+
+// Returns the subject filters for this config, if any.
+func (cc *ConsumerConfig) filters() []string {
+	if len(cc.FilterSubjects) > 0 {
+		return cc.FilterSubjects
+	}
+	if cc.FilterSubject != _EMPTY_ {
+		return []string{cc.FilterSubject}
+	}
+	return nil
+}
+
 // Test whether a config represents a durable subscriber.
 func isDurableConsumer(config *ConsumerConfig) bool {
 	return config != nil && config.Durable != _EMPTY_
@@ -4169,6 +4857,7 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
 	stopAndClearTimer(&o.gwdtmr)
+	stopAndClearTimer(&o.uptmr)
 	delivery := o.cfg.DeliverSubject
 	o.waiting = nil
 	// Break us out of the readLoop.
@@ -4346,7 +5035,7 @@ func (o *consumer) decStreamPending(sseq uint64, subj string) {
 	// TODO(dlc) - we could do a term here instead with a reason to generate the advisory.
 	if wasPending {
 		// We could have lock for stream so do this in a go routine.
-		go o.processTerm(sseq, p.Sequence, rdc)
+		go o.processTerm(sseq, p.Sequence, rdc, _EMPTY_)
 	}
 }
 
@@ -4357,21 +5046,28 @@ func (o *consumer) account() *Account {
 	return a
 }
 
-func (o *consumer) signalSub() *subscription {
+func (o *consumer) signalSubs() []*subscription {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
-	if o.sigSub != nil {
-		return o.sigSub
+	if o.sigSubs != nil {
+		return o.sigSubs
 	}
+	o.sigSubs = o.newSignalSubs(o.subjf)
+	return o.sigSubs
+}
 
-	subject := o.cfg.FilterSubject
-	if subject == _EMPTY_ {
-		subject = fwcs
+// Creates the signaling subscriptions for the given subject filters.
+// Lock should be held.
+func (o *consumer) newSignalSubs(filters []string) []*subscription {
+	if len(filters) == 0 {
+		return []*subscription{{subject: []byte(fwcs), icb: o.processStreamSignal}}
+	}
+	subs := make([]*subscription, 0, len(filters))
+	for _, filter := range filters {
+		subs = append(subs, &subscription{subject: []byte(filter), icb: o.processStreamSignal})
 	}
-	sub := &subscription{subject: []byte(subject), icb: o.processStreamSignal}
-	o.sigSub = sub
-	return sub
+	return subs
 }
 
 // This is what will be called when our parent stream wants to kick us regarding a new message.
@@ -54,10 +54,26 @@ type FileStoreConfig struct {
 	CacheExpire time.Duration
 	// SyncInterval is how often we sync to disk in the background.
 	SyncInterval time.Duration
+	// ScrubInterval is how often we verify our sealed blocks in the background.
+	// A negative value disables scrubbing.
+	ScrubInterval time.Duration
+	// CompactInterval is how often we look for sparse sealed blocks to rewrite in the background.
+	// A negative value disables background compaction.
+	CompactInterval time.Duration
+	// CompactThreshold is the ratio of live to total bytes below which a sealed block is rewritten.
+	CompactThreshold float64
+	// CompactMaxRate is the maximum bytes per second we will rewrite when compacting in the background.
+	CompactMaxRate int64
+	// SubjectIndexInterval is how often we persist our per subject index in the background, in
+	// addition to on a clean shutdown. A negative value only persists it on shutdown.
+	SubjectIndexInterval time.Duration
 	// AsyncFlush allows async flush to batch write operations.
 	AsyncFlush bool
 	// Cipher is the cipher to use when encrypting.
 	Cipher StoreCipher
+	// ArchiveDir is where sealed blocks older than the stream's ArchiveAfter are moved to.
+	// Index and key files are kept in StoreDir and blocks are loaded from here on demand.
+	ArchiveDir string
 }
 
 // FileStreamInfo allows us to remember created time.
@@ -104,26 +120,56 @@ type psi struct {
 }
 
 type fileStore struct {
-	mu      sync.RWMutex
-	state   StreamState
-	ld      *LostStreamData
-	scb     StorageUpdateHandler
-	ageChk  *time.Timer
-	syncTmr *time.Timer
-	cfg     FileStreamInfo
-	fcfg    FileStoreConfig
-	prf     keyGen
-	aek     cipher.AEAD
-	lmb     *msgBlock
-	blks    []*msgBlock
-	bim     map[uint32]*msgBlock
-	psim    map[string]*psi
-	hh      hash.Hash64
-	qch     chan struct{}
-	cfs     []ConsumerStore
-	sips    int
-	closed  bool
-	fip     bool
+	mu       sync.RWMutex
+	state    StreamState
+	ld       *LostStreamData
+	scb      StorageUpdateHandler
+	ageChk   *time.Timer
+	ttls     msgTTLs
+	ttlChk   *time.Timer
+	syncTmr  *time.Timer
+	cfg      FileStreamInfo
+	fcfg     FileStoreConfig
+	prf      keyGen
+	oldprf   keyGen
+	aek      cipher.AEAD
+	lmb      *msgBlock
+	blks     []*msgBlock
+	bim      map[uint32]*msgBlock
+	psim     map[string]*psi
+	hh       hash.Hash64
+	qch      chan struct{}
+	cfs      []ConsumerStore
+	sips     int
+	rot      keyRotation
+	scrub    scrubStats
+	scrubTmr *time.Timer
+	cmpct    compactStats
+	cmpctTmr *time.Timer
+	archTmr  *time.Timer
+	archMu   sync.Mutex
+	encMu    sync.Mutex // Held while re-encrypting or rewriting a block outside of its lock.
+	abytes   uint64     // Bytes in archived blocks, updated atomically.
+	sidx     *subjectIndex
+	sidxTmr  *time.Timer
+	sidxMu   sync.Mutex
+	rtime    time.Duration
+	rsidx    bool
+	ccb      func(first, last uint64)
+	ecb      func(err error)
+	cmpq     []*msgBlock
+	cmpw     bool
+	closed   bool
+	fip      bool
+}
+
+// Tracks the progress of re-encrypting our existing blocks after a key rotation.
+type keyRotation struct {
+	active bool
+	gen    uint64
+	total  int
+	done   int
+	err    error
 }
 
 // Represents a message store block and its data.
@@ -137,6 +183,8 @@ type msgBlock struct {
 	bek     cipher.Stream
 	seed    []byte
 	nonce   []byte
+	sc      StoreCipher      // Cipher the block is encrypted with.
+	cmp     StoreCompression // Compression of the block on disk.
 	mfn     string
 	mfd     *os.File
 	ifn     string
@@ -167,8 +215,15 @@ type msgBlock struct {
 	loading bool
 	flusher bool
 	noTrack bool
+	rotate  bool
+	fssChk  bool
 	closed  bool
 
+	// Our block file has been moved to the archive directory.
+	archived bool
+	// How many of our bytes are counted in our store's archived bytes.
+	abytes uint64
+
 	// Used to mock write failures.
 	mockWriteErr bool
 }
@@ -212,6 +267,10 @@ const (
 	fssScan = "%d.fss"
 	// used to store our block encryption key.
 	keyScan = "%d.key"
+	// used to persist our per message TTL tracking.
+	ttlIndexFile = "ttls.idx"
+	// used to persist our global per subject index.
+	subjectIndexFile = "subjects.idx"
 	// to look for orphans
 	keyScanAll = "*.key"
 	// This is where we keep state on consumers.
@@ -226,6 +285,28 @@ const (
 	defaultCacheBufferExpiration = 5 * time.Second
 	// default sync interval
 	defaultSyncInterval = 60 * time.Second
+	// default scrub interval
+	defaultScrubInterval = 2 * time.Hour
+	// Maximum bytes per second we will verify when scrubbing in the background.
+	scrubMaxRate = 64 * 1024 * 1024
+	// Bytes we will verify while holding a block's lock when scrubbing.
+	scrubChunkSize = 256 * 1024
+	// default compact interval
+	defaultCompactInterval = 5 * time.Minute
+	// default ratio of live bytes below which we compact a block.
+	defaultCompactThreshold = 0.5
+	// default maximum bytes per second we will rewrite when compacting in the background.
+	defaultCompactMaxRate = 32 * 1024 * 1024
+	// Maximum bytes per second we will rewrite when compressing sealed blocks.
+	compressMaxRate = 32 * 1024 * 1024
+	// How often we look for cold blocks to move to our archive directory.
+	defaultArchiveInterval = time.Minute
+	// Maximum bytes per second we will copy when archiving blocks.
+	archiveMaxRate = 32 * 1024 * 1024
+	// Bytes we will copy at a time when archiving blocks.
+	archiveChunkSize = 256 * 1024
+	// default interval to persist our per subject index.
+	defaultSubjectIndexInterval = 5 * time.Minute
 	// default idle timeout to close FDs.
 	closeFDsIdle = 30 * time.Second
 	// coalesceMinimum
@@ -272,6 +353,12 @@ func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
 }
 
 func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf keyGen) (*fileStore, error) {
+	return newFileStoreWithKeys(fcfg, cfg, created, prf, nil)
+}
+
+// Create a file store that can also recover anything still encrypted with our previous key,
+// which will then be re-encrypted with our current key.
+func newFileStoreWithKeys(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf, oldprf keyGen) (*fileStore, error) {
 	if cfg.Name == _EMPTY_ {
 		return nil, fmt.Errorf("name required")
 	}
@@ -291,6 +378,21 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.ScrubInterval == 0 {
+		fcfg.ScrubInterval = defaultScrubInterval
+	}
+	if fcfg.CompactInterval == 0 {
+		fcfg.CompactInterval = defaultCompactInterval
+	}
+	if fcfg.CompactThreshold <= 0 || fcfg.CompactThreshold > 1 {
+		fcfg.CompactThreshold = defaultCompactThreshold
+	}
+	if fcfg.CompactMaxRate <= 0 {
+		fcfg.CompactMaxRate = defaultCompactMaxRate
+	}
+	if fcfg.SubjectIndexInterval == 0 {
+		fcfg.SubjectIndexInterval = defaultSubjectIndexInterval
+	}
 
 	// Check the directory
 	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
@@ -308,12 +410,13 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	os.Remove(tmpfile.Name())
 
 	fs := &fileStore{
-		fcfg: fcfg,
-		psim: make(map[string]*psi),
-		bim:  make(map[uint32]*msgBlock),
-		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
-		prf:  prf,
-		qch:  make(chan struct{}),
+		fcfg:   fcfg,
+		psim:   make(map[string]*psi),
+		bim:    make(map[uint32]*msgBlock),
+		cfg:    FileStreamInfo{Created: created, StreamConfig: cfg},
+		prf:    prf,
+		oldprf: oldprf,
+		qch:    make(chan struct{}),
 	}
 
 	// Set flush in place to AsyncFlush which by default is false.
@@ -337,9 +440,11 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	}
 
 	// Recover our message state.
+	start := time.Now()
 	if err := fs.recoverMsgs(); err != nil {
 		return nil, err
 	}
+	fs.rtime = time.Since(start)
 
 	// Write our meta data if it does not exist or is zero'd out.
 	meta := filepath.Join(fcfg.StoreDir, JetStreamMetaFile)
@@ -354,14 +459,36 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	// This can happen on snapshot restores or conversions.
 	if fs.prf != nil {
 		keyFile := filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileKey)
-		if _, err := os.Stat(keyFile); err != nil && os.IsNotExist(err) {
+		if ekey, err := os.ReadFile(keyFile); err != nil && os.IsNotExist(err) {
 			if err := fs.writeStreamMeta(); err != nil {
 				return nil, err
 			}
+		} else if _, _, _, old, err := fs.openKeyFile(fs.cfg.Name, ekey); err == nil && old {
+			// Still using our previous key, so rewrite with our current one.
+			if err := fs.rotateStreamMeta(); err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	// Re-encrypt any blocks still using our previous key.
+	fs.mu.Lock()
+	fs.startKeyRotation()
+	fs.mu.Unlock()
+
 	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if fs.fcfg.ScrubInterval > 0 {
+		fs.scrubTmr = time.AfterFunc(fs.fcfg.ScrubInterval, fs.scrubBlocks)
+	}
+	if fs.fcfg.CompactInterval > 0 {
+		fs.cmpctTmr = time.AfterFunc(fs.fcfg.CompactInterval, fs.compactBlocks)
+	}
+	if fs.fcfg.ArchiveDir != _EMPTY_ {
+		fs.archTmr = time.AfterFunc(defaultArchiveInterval, fs.archiveBlocks)
+	}
+	if fs.fcfg.SubjectIndexInterval > 0 {
+		fs.sidxTmr = time.AfterFunc(fs.fcfg.SubjectIndexInterval, fs.persistSubjectIndex)
+	}
 
 	return fs, nil
 }
@@ -477,17 +604,20 @@ func genEncryptionKey(sc StoreCipher, seed []byte) (ek cipher.AEAD, err error) {
 
 // Generate an asset encryption key from the context and server PRF.
 func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek cipher.Stream, seed, encrypted []byte, err error) {
-	if fs.prf == nil {
+	return genEncryptionKeys(fs.prf, fs.fcfg.Cipher, context)
+}
+
+// Generate an asset encryption key from the context and the given PRF and cipher.
+func genEncryptionKeys(prf keyGen, sc StoreCipher, context string) (aek cipher.AEAD, bek cipher.Stream, seed, encrypted []byte, err error) {
+	if prf == nil {
 		return nil, nil, nil, nil, errNoEncryption
 	}
 	// Generate key encryption key.
-	rb, err := fs.prf([]byte(context))
+	rb, err := prf([]byte(context))
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	sc := fs.fcfg.Cipher
-
 	kek, err := genEncryptionKey(sc, rb)
 	if err != nil {
 		return nil, nil, nil, nil, err
@@ -578,6 +708,337 @@ func (fs *fileStore) writeStreamMeta() error {
 	return nil
 }
 
+// Prefix for the new versions of files that need to be replaced together.
+const rotPrefix = "rot-"
+
+func rotFile(fn string) string {
+	return filepath.Join(filepath.Dir(fn), rotPrefix+filepath.Base(fn))
+}
+
+// Replace a set of files that need to stay consistent with each other, e.g. encrypted
+// files and their key file. All new contents are written out before anything is renamed,
+// so once the last file has been written the set is complete and recoverFilesAtomic will
+// finish any renames that were interrupted. Otherwise the new files will be discarded.
+func writeFilesAtomic(fns []string, bufs [][]byte) error {
+	for i, fn := range fns {
+		if err := writeFileWithSync(rotFile(fn), bufs[i]); err != nil {
+			for _, fn := range fns[:i+1] {
+				os.Remove(rotFile(fn))
+			}
+			return err
+		}
+	}
+	for _, fn := range fns {
+		if err := os.Rename(rotFile(fn), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish or discard any replacement by writeFilesAtomic that was interrupted.
+// The files need to be in the same order, but can include files that were not written.
+func recoverFilesAtomic(fns ...string) {
+	if _, err := os.Stat(rotFile(fns[len(fns)-1])); err == nil {
+		for _, fn := range fns {
+			if _, err := os.Stat(rotFile(fn)); err == nil {
+				os.Rename(rotFile(fn), fn)
+			}
+		}
+		return
+	}
+	for _, fn := range fns {
+		os.Remove(rotFile(fn))
+	}
+}
+
+func writeFileWithSync(fn string, buf []byte) error {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func otherCipher(sc StoreCipher) StoreCipher {
+	if sc == AES {
+		return ChaCha
+	}
+	return AES
+}
+
+// Recover the seed and nonce from an encrypted key file. We try our current key and cipher first,
+// then the other cipher in case of a conversion and lastly our previous key in case of a rotation.
+// Returns the cipher the key file was written with and whether it used our previous key.
+func openKeyFile(prf, oldprf keyGen, sc StoreCipher, context string, ekey []byte) (seed, nonce []byte, osc StoreCipher, old bool, err error) {
+	for i, kg := range []keyGen{prf, oldprf} {
+		if kg == nil {
+			continue
+		}
+		rb, err := kg([]byte(context))
+		if err != nil {
+			return nil, nil, sc, false, err
+		}
+		for _, osc := range []StoreCipher{sc, otherCipher(sc)} {
+			kek, err := genEncryptionKey(osc, rb)
+			if err != nil {
+				return nil, nil, sc, false, err
+			}
+			ns := kek.NonceSize()
+			if len(ekey) < ns {
+				return nil, nil, sc, false, errBadKeySize
+			}
+			if seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil); err == nil {
+				return seed, ekey[:ns], osc, i > 0, nil
+			}
+		}
+	}
+	return nil, nil, sc, false, errNoKeyMatch
+}
+
+// Recover the seed and nonce from one of our key files.
+// Lock should be held.
+func (fs *fileStore) openKeyFile(context string, ekey []byte) (seed, nonce []byte, sc StoreCipher, old bool, err error) {
+	return openKeyFile(fs.prf, fs.oldprf, fs.fcfg.Cipher, context, ekey)
+}
+
+// Returns our current and previous key generators along with our cipher.
+func (fs *fileStore) keyGens() (prf, oldprf keyGen, sc StoreCipher) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.prf, fs.oldprf, fs.fcfg.Cipher
+}
+
+// Rewrite our meta data with a new key, replacing all files at once.
+// Lock should be held.
+func (fs *fileStore) rotateStreamMeta() error {
+	key, _, _, encrypted, err := fs.genEncryptionKeys(fs.cfg.Name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(fs.cfg)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, key.NonceSize(), key.NonceSize()+len(b)+key.Overhead())
+	mrand.Read(nonce)
+	b = key.Seal(nonce, nonce, b, nil)
+	fs.hh.Reset()
+	fs.hh.Write(b)
+	checksum := hex.EncodeToString(fs.hh.Sum(nil))
+
+	fns := []string{
+		filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFile),
+		filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileSum),
+		filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileKey),
+	}
+	if err := writeFilesAtomic(fns, [][]byte{b, []byte(checksum), encrypted}); err != nil {
+		return err
+	}
+	fs.aek = key
+	return nil
+}
+
+// Rotate our encryption key and cipher. Our meta data and consumer state are rewritten
+// right away and new blocks will use the new key, while existing blocks are re-encrypted
+// in the background.
+func (fs *fileStore) rotateEncryption(prf, oldprf keyGen, sc StoreCipher) error {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if fs.prf == nil || prf == nil {
+		fs.mu.Unlock()
+		return errNoEncryption
+	}
+	fs.prf, fs.oldprf, fs.fcfg.Cipher = prf, oldprf, sc
+	if err := fs.rotateStreamMeta(); err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	fs.rot.gen++
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		mb.rotate = true
+		mb.mu.Unlock()
+	}
+	fs.startKeyRotation()
+	cfs := append([]ConsumerStore(nil), fs.cfs...)
+	fs.mu.Unlock()
+
+	for _, o := range cfs {
+		if o, ok := o.(*consumerFileStore); ok {
+			if err := o.rotateEncryption(prf, sc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Start re-encrypting any blocks still using a previous key or cipher in the background.
+// Lock should be held.
+func (fs *fileStore) startKeyRotation() {
+	var n int
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.rotate {
+			n++
+		}
+		mb.mu.RUnlock()
+	}
+	if n == 0 {
+		return
+	}
+	fs.rot.err = nil
+	if fs.rot.active {
+		fs.rot.total = fs.rot.done + n
+		return
+	}
+	fs.rot.active, fs.rot.total, fs.rot.done = true, n, 0
+	go fs.rotateBlocks()
+}
+
+// Re-encrypt our blocks one at a time with our current key and cipher.
+func (fs *fileStore) rotateBlocks() {
+	for {
+		fs.mu.Lock()
+		var mb *msgBlock
+		for _, b := range fs.blks {
+			b.mu.RLock()
+			rotate := b.rotate
+			b.mu.RUnlock()
+			if rotate {
+				mb = b
+				break
+			}
+		}
+		if mb == nil || fs.closed {
+			fs.rot.active = false
+			fs.mu.Unlock()
+			return
+		}
+		prf, sc, gen := fs.prf, fs.fcfg.Cipher, fs.rot.gen
+		context := fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)
+		fs.mu.Unlock()
+
+		fs.encMu.Lock()
+		mb.mu.Lock()
+		err := mb.rotateEncryption(prf, sc, context)
+		cmp := mb.cmp
+		mb.mu.Unlock()
+		fs.encMu.Unlock()
+
+		fs.mu.Lock()
+		if err != nil {
+			fs.rot.active, fs.rot.err = false, err
+			fs.mu.Unlock()
+			return
+		}
+		// Our compression worker skips blocks waiting to be re-encrypted.
+		if mb != fs.lmb && fs.cfg.Compression != NoCompression && cmp != fs.cfg.Compression {
+			fs.queueCompress(mb)
+		}
+		// If we were rotated again in the meantime we need to redo this block.
+		if gen != fs.rot.gen {
+			mb.mu.Lock()
+			mb.rotate = !mb.closed
+			mb.mu.Unlock()
+		} else {
+			fs.rot.done++
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// Returns the progress of re-encrypting our blocks.
+func (fs *fileStore) keyRotationState() keyRotation {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.rot
+}
+
+// Re-encrypt our block and index file with new keys, replacing our key file.
+// Lock should be held.
+func (mb *msgBlock) rotateEncryption(prf keyGen, sc StoreCipher, context string) error {
+	if mb.closed || !mb.rotate {
+		return nil
+	}
+	// Make sure everything is on disk first.
+	if _, err := mb.flushPendingMsgsLocked(); err != nil {
+		return err
+	}
+
+	// Read in and decrypt our block and index file with our current keys.
+	buf, err := mb.loadBlock(nil)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	defer recycleMsgBlockBuf(buf)
+	if len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
+		if err != nil {
+			return err
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+	ibuf, err := os.ReadFile(mb.ifn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(ibuf) > 0 {
+		if ibuf, err = mb.aek.Open(ibuf[:0], mb.nonce, ibuf, nil); err != nil {
+			return err
+		}
+	}
+
+	// Now encrypt with our new keys.
+	aek, bek, seed, encrypted, err := genEncryptionKeys(prf, sc, context)
+	if err != nil {
+		return err
+	}
+	nonce := encrypted[:aek.NonceSize()]
+	// This will also leave the counter where it needs to be for future writes.
+	bek.XORKeyStream(buf, buf)
+
+	fns, bufs := []string{mb.mfn}, [][]byte{buf}
+	if len(ibuf) > 0 {
+		fns, bufs = append(fns, mb.ifn), append(bufs, aek.Seal(ibuf[:0], nonce, ibuf, nil))
+	}
+	keyFile := filepath.Join(mb.fs.fcfg.StoreDir, msgDir, fmt.Sprintf(keyScan, mb.index))
+	fns, bufs = append(fns, keyFile), append(bufs, encrypted)
+
+	hadFD := mb.mfd != nil
+	mb.closeFDsLockedNoCheck()
+	if err := writeFilesAtomic(fns, bufs); err != nil {
+		return err
+	}
+	mb.aek, mb.bek, mb.seed, mb.nonce, mb.sc, mb.kfn = aek, bek, seed, nonce, sc, keyFile
+	mb.rotate = false
+	return mb.reopenForWriting(hadFD)
+}
+
+// Reopen our block file after it was replaced if we had it open for writing.
+// Lock should be held.
+func (mb *msgBlock) reopenForWriting(hadFD bool) error {
+	if !hadFD {
+		return nil
+	}
+	mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	mb.mfd = mfd
+	return nil
+}
+
 // Pools to recycle the blocks to help with memory pressure.
 var blkPoolBig sync.Pool    // 16MB
 var blkPoolMedium sync.Pool // 8MB
@@ -644,11 +1105,11 @@ func (fs *fileStore) noTrackSubjects() bool {
 }
 
 // Lock held on entry
-func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, error) {
+func (fs *fileStore) recoverMsgBlock(mfn string, index uint32) (*msgBlock, error) {
 	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects()}
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
-	mb.mfn = filepath.Join(mdir, fi.Name())
+	mb.mfn, mb.archived = mfn, filepath.Dir(mfn) != mdir
 	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, index))
 	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, index))
 
@@ -661,7 +1122,10 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 
 	// Check if encryption is enabled.
 	if fs.prf != nil {
-		ekey, err := os.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)))
+		keyFile := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+		// Finish or discard any re-encryption of this block that was interrupted.
+		recoverFilesAtomic(mb.mfn, mb.ifn, keyFile)
+		ekey, err := os.ReadFile(keyFile)
 		if err != nil {
 			// We do not seem to have keys even though we should. Could be a plaintext conversion.
 			// Create the keys and we will double check below.
@@ -673,27 +1137,21 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 			if len(ekey) < minBlkKeySize {
 				return nil, errBadKeySize
 			}
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)))
-			if err != nil {
-				return nil, err
-			}
-
-			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
+			seed, nonce, sc, old, err := fs.openKeyFile(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index), ekey)
 			if err != nil {
 				return nil, err
 			}
-			ns := kek.NonceSize()
-			seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
-			if err != nil {
-				// We may be here on a cipher conversion, so attempt to convert.
+			if sc != fs.fcfg.Cipher && !old {
+				// We are here on a cipher conversion, so convert.
 				if err = mb.convertCipher(); err != nil {
 					return nil, err
 				}
+				sc = fs.fcfg.Cipher
 			} else {
-				mb.seed, mb.nonce = seed, ekey[:ns]
+				// If still using our previous key this will be re-encrypted in the background.
+				mb.seed, mb.nonce, mb.rotate = seed, nonce, old
 			}
+			mb.sc = sc
 			mb.aek, err = genEncryptionKey(sc, mb.seed)
 			if err != nil {
 				return nil, err
@@ -727,13 +1185,23 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 	// Grab last checksum from main block file.
 	var lchk [8]byte
 	if mb.rbytes >= checksumSize {
-		if mb.bek != nil {
+		magic := make([]byte, len(cmpBlkMagic))
+		file.ReadAt(magic, 0)
+		if mb.bek != nil || bytes.Equal(magic, cmpBlkMagic) {
 			if buf, _ := mb.loadBlock(nil); len(buf) >= checksumSize {
-				mb.bek.XORKeyStream(buf, buf)
-				copy(lchk[0:], buf[len(buf)-checksumSize:])
+				if mb.bek != nil {
+					mb.bek.XORKeyStream(buf, buf)
+				}
+				// Compressed blocks need to be decompressed first.
+				if buf, cmp, err := decompressBlock(buf); err == nil {
+					mb.cmp, mb.rbytes = cmp, uint64(len(buf))
+					if len(buf) >= checksumSize {
+						copy(lchk[0:], buf[len(buf)-checksumSize:])
+					}
+				}
 			}
 		} else {
-			file.ReadAt(lchk[:], fi.Size()-checksumSize)
+			file.ReadAt(lchk[:], int64(mb.rbytes)-checksumSize)
 		}
 	}
 
@@ -744,7 +1212,7 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 		// Quick sanity check here.
 		// Note this only checks that the message blk file is not newer then this file, or is empty and we expect empty.
 		if (mb.rbytes == 0 && mb.msgs == 0) || bytes.Equal(lchk[:], mb.lchk[:]) {
-			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil && !fs.checkSubjectIndex(mb) {
 				fs.populateGlobalPerSubjectInfo(mb)
 				// Try to dump any state we needed on recovery.
 				mb.tryForceExpireCacheLocked()
@@ -758,7 +1226,7 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, e
 	if ld, _ := mb.rebuildState(); ld != nil {
 		fs.addLostData(ld)
 	}
-	if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+	if mb.msgs > 0 && !mb.noTrack && fs.psim != nil && !fs.checkSubjectIndex(mb) {
 		fs.populateGlobalPerSubjectInfo(mb)
 		// Try to dump any state we needed on recovery.
 		mb.tryForceExpireCacheLocked()
@@ -868,7 +1336,11 @@ func (mb *msgBlock) convertCipher() error {
 	buf, _ := mb.loadBlock(nil)
 	bek.XORKeyStream(buf, buf)
 	// Make sure we can parse with old cipher and key file.
-	if err = mb.indexCacheBuf(buf); err != nil {
+	pbuf, _, err := decompressBlock(buf)
+	if err != nil {
+		return err
+	}
+	if err = mb.indexCacheBuf(pbuf); err != nil {
 		return err
 	}
 	// Reset the cache since we just read everything in.
@@ -901,7 +1373,11 @@ func (mb *msgBlock) convertToEncrypted() error {
 	if err != nil {
 		return err
 	}
-	if err := mb.indexCacheBuf(buf); err != nil {
+	pbuf, _, err := decompressBlock(buf)
+	if err != nil {
+		return err
+	}
+	if err := mb.indexCacheBuf(pbuf); err != nil {
 		// This likely indicates this was already encrypted or corrupt.
 		mb.cache = nil
 		return err
@@ -932,6 +1408,7 @@ func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
 
 func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	startLastSeq := mb.last.seq
+	defer mb.updateArchivedBytes()
 
 	buf, err := mb.loadBlock(nil)
 	if err != nil || len(buf) == 0 {
@@ -961,13 +1438,18 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	// Check if we need to decrypt.
 	if mb.bek != nil && len(buf) > 0 {
 		// Recreate to reset counter.
-		mb.bek, err = genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		mb.bek, err = genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return nil, err
 		}
 		mb.bek.XORKeyStream(buf, buf)
 	}
 
+	// Check if we need to decompress.
+	if buf, mb.cmp, err = decompressBlock(buf); err != nil {
+		return nil, err
+	}
+
 	mb.rbytes = uint64(len(buf))
 
 	addToDmap := func(seq uint64) {
@@ -983,6 +1465,13 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	var le = binary.LittleEndian
 
 	truncate := func(index uint32) {
+		// Compressed blocks need to be rewritten.
+		if mb.cmp != NoCompression {
+			if err := mb.writeBlock(buf[:index], mb.cmp); err == nil && index >= 8 {
+				copy(mb.lchk[0:], buf[index-8:index])
+			}
+			return
+		}
 		var fd *os.File
 		if mb.mfd != nil {
 			fd = mb.mfd
@@ -1142,36 +1631,80 @@ func (fs *fileStore) recoverMsgs() error {
 		return errNotReadable
 	}
 
+	recoverBlock := func(mfn string, index uint32) error {
+		mb, err := fs.recoverMsgBlock(mfn, index)
+		if err != nil || mb == nil {
+			return err
+		}
+		if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
+			fs.state.FirstSeq = mb.first.seq
+			fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
+		}
+		if mb.last.seq > fs.state.LastSeq {
+			fs.state.LastSeq = mb.last.seq
+			fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
+		}
+		fs.state.Msgs += mb.msgs
+		fs.state.Bytes += mb.bytes
+		return nil
+	}
+
+	// Any blocks that have been moved to our archive directory.
+	archived := fs.archivedBlockFiles()
+
+	// If we have a persisted subject index we can skip rebuilding per subject state from our blocks.
+	fs.sidx = fs.loadSubjectIndex()
+
 	// Recover all of the msg blocks.
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint32
 		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
-			finfo, err := fi.Info()
-			if err != nil {
-				return err
+			// If we were interrupted while archiving, our local copy wins.
+			if afn, ok := archived[index]; ok {
+				os.Remove(afn)
+				delete(archived, index)
 			}
-			if mb, err := fs.recoverMsgBlock(finfo, index); err == nil && mb != nil {
-				if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
-					fs.state.FirstSeq = mb.first.seq
-					fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
-				}
-				if mb.last.seq > fs.state.LastSeq {
-					fs.state.LastSeq = mb.last.seq
-					fs.state.LastTime = time.Unix(0, mb.last.ts).UTC()
-				}
-				fs.state.Msgs += mb.msgs
-				fs.state.Bytes += mb.bytes
-			} else {
+			if err := recoverBlock(filepath.Join(mdir, fi.Name()), index); err != nil {
 				return err
 			}
 		}
 	}
+	for index, afn := range archived {
+		if err := recoverBlock(afn, index); err != nil {
+			return err
+		}
+	}
 
 	// Now make sure to sort blks for efficient lookup later with selectMsgBlock().
 	if len(fs.blks) > 0 {
 		sort.Slice(fs.blks, func(i, j int) bool { return fs.blks[i].index < fs.blks[j].index })
+	}
+
+	// Use our subject index if it matched all of our blocks, otherwise rebuild from them.
+	if si := fs.sidx; si != nil {
+		fs.sidx = nil
+		if !si.stale && si.matched == len(si.blks) {
+			fs.psim, fs.rsidx = si.psim, true
+			for _, mb := range fs.blks {
+				mb.fssChk = true
+			}
+		} else {
+			for _, mb := range fs.blks {
+				if mb.msgs > 0 && !mb.noTrack {
+					fs.populateGlobalPerSubjectInfo(mb)
+					mb.tryForceExpireCacheLocked()
+				}
+			}
+		}
+	}
+
+	if len(fs.blks) > 0 {
 		fs.lmb = fs.blks[len(fs.blks)-1]
+		// Compressed blocks are sealed, so we need a new one to write to.
+		if fs.lmb.cmp != NoCompression {
+			_, err = fs.newMsgBlockForWrite()
+		}
 	} else {
 		_, err = fs.newMsgBlockForWrite()
 	}
@@ -1231,9 +1764,214 @@ func (fs *fileStore) recoverMsgs() error {
 		fs.enforceMsgPerSubjectLimit()
 	}
 
+	// Rebuild any per message TTLs, these will be expired out of band.
+	if fs.cfg.AllowMsgTTL {
+		fs.recoverMsgTTLs()
+	}
+
 	return nil
 }
 
+// Will rebuild per message TTL tracking from our persisted TTL index, and from the
+// messages headers for any blocks the index does not cover.
+// Should only be called on startup.
+// Lock should be held.
+func (fs *fileStore) recoverMsgTTLs() {
+	ti := fs.loadTTLIndex()
+	var smv StoreMsg
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		if mb.msgs == 0 {
+			mb.mu.Unlock()
+			continue
+		}
+		if tb, ok := ti[mb.index]; ok && tb.matches(mb) {
+			for _, e := range tb.ttls {
+				fs.ttls.track(e.seq, e.expires)
+			}
+			mb.mu.Unlock()
+			continue
+		}
+		if err := mb.loadMsgsWithLock(); err != nil {
+			mb.mu.Unlock()
+			continue
+		}
+		for seq := mb.first.seq; seq <= mb.last.seq; seq++ {
+			sm, err := mb.cacheLookup(seq, &smv)
+			if err != nil || sm == nil || len(sm.hdr) == 0 {
+				continue
+			}
+			if expires := msgTTLExpires(sm.hdr, sm.ts); expires > 0 {
+				fs.ttls.track(seq, expires)
+			}
+		}
+		mb.tryForceExpireCacheLocked()
+		mb.mu.Unlock()
+	}
+	fs.resetTTLChk()
+}
+
+// The per message TTLs held by a block, along with the state of the block they were taken from.
+type ttlIndexBlock struct {
+	first uint64
+	last  uint64
+	msgs  uint64
+	lchk  [8]byte
+	ttls  []msgTTL
+}
+
+// Any change to the messages held in a block will change its sequences, msgs or last checksum.
+// Lock should be held.
+func (tb *ttlIndexBlock) matches(mb *msgBlock) bool {
+	return tb.first == mb.first.seq && tb.last == mb.last.seq && tb.msgs == mb.msgs && tb.lchk == mb.lchk
+}
+
+// Hash used to detect a corrupt TTL index.
+func (fs *fileStore) ttlIndexHash() hash.Hash64 {
+	key := sha256.Sum256([]byte(fs.cfg.Name))
+	hh, _ := highwayhash.New64(key[:])
+	return hh
+}
+
+// Encode our per message TTL tracking grouped by block, along with the state of each block.
+// Blocks without any TTLs are included so they can be skipped on recovery.
+// Returns nil if we do not allow per message TTLs.
+// Lock should be held.
+func (fs *fileStore) encodeTTLIndex() []byte {
+	if !fs.cfg.AllowMsgTTL || len(fs.blks) == 0 {
+		return nil
+	}
+	byBlk := make(map[uint32][]msgTTL)
+	for _, e := range fs.ttls {
+		if mb := fs.selectMsgBlock(e.seq); mb != nil {
+			byBlk[mb.index] = append(byBlk[mb.index], e)
+		}
+	}
+
+	var scratch [4 * binary.MaxVarintLen64]byte
+	var b bytes.Buffer
+	b.WriteByte(magic)
+	b.WriteByte(version)
+	n := binary.PutUvarint(scratch[0:], uint64(len(fs.blks)))
+	b.Write(scratch[0:n])
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		first, last, msgs, lchk := mb.first.seq, mb.last.seq, mb.msgs, mb.lchk
+		mb.mu.RUnlock()
+		ttls := byBlk[mb.index]
+		n := binary.PutUvarint(scratch[0:], uint64(mb.index))
+		n += binary.PutUvarint(scratch[n:], first)
+		n += binary.PutUvarint(scratch[n:], last)
+		n += binary.PutUvarint(scratch[n:], msgs)
+		b.Write(scratch[0:n])
+		b.Write(lchk[:])
+		n = binary.PutUvarint(scratch[0:], uint64(len(ttls)))
+		b.Write(scratch[0:n])
+		for _, e := range ttls {
+			n := binary.PutUvarint(scratch[0:], e.seq)
+			n += binary.PutVarint(scratch[n:], e.expires)
+			b.Write(scratch[0:n])
+		}
+	}
+	hh := fs.ttlIndexHash()
+	hh.Write(b.Bytes())
+	b.Write(hh.Sum(nil))
+	return b.Bytes()
+}
+
+// Write out our encoded TTL index, or remove any stale one if we have nothing to write.
+// We write to a new file and rename it so a partial write is never picked up.
+func (fs *fileStore) writeTTLIndex(buf []byte) error {
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, ttlIndexFile)
+	if len(buf) == 0 {
+		os.Remove(fn)
+		return nil
+	}
+	tmp := fn + ".tmp"
+	<-dios
+	err := os.WriteFile(tmp, buf, defaultFilePerms)
+	dios <- struct{}{}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Load our persisted TTL index on recovery. This is only trusted once, since it is only
+// written when we stop cleanly, and only for blocks whose state has not changed since.
+// Lock should be held.
+func (fs *fileStore) loadTTLIndex() map[uint32]ttlIndexBlock {
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, ttlIndexFile)
+	os.Remove(fn + ".tmp")
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	os.Remove(fn)
+
+	if len(buf) < hdrLen+checksumSize || checkHeader(buf) != nil {
+		return nil
+	}
+	hh := fs.ttlIndexHash()
+	hh.Write(buf[:len(buf)-checksumSize])
+	if !bytes.Equal(hh.Sum(nil), buf[len(buf)-checksumSize:]) {
+		return nil
+	}
+	buf = buf[:len(buf)-checksumSize]
+
+	bi := hdrLen
+	readU64 := func() uint64 {
+		if bi < 0 || bi >= len(buf) {
+			bi = -1
+			return 0
+		}
+		num, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+	readI64 := func() int64 {
+		if bi < 0 || bi >= len(buf) {
+			bi = -1
+			return 0
+		}
+		num, n := binary.Varint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+
+	numBlks := readU64()
+	ti := make(map[uint32]ttlIndexBlock, numBlks)
+	for i := uint64(0); i < numBlks && bi >= 0; i++ {
+		index := uint32(readU64())
+		tb := ttlIndexBlock{first: readU64(), last: readU64(), msgs: readU64()}
+		if bi < 0 || bi+len(tb.lchk) > len(buf) {
+			return nil
+		}
+		bi += copy(tb.lchk[:], buf[bi:])
+		numTTLs := readU64()
+		for j := uint64(0); j < numTTLs && bi >= 0; j++ {
+			seq, expires := readU64(), readI64()
+			tb.ttls = append(tb.ttls, msgTTL{seq, expires})
+		}
+		ti[index] = tb
+	}
+	if bi != len(buf) {
+		return nil
+	}
+	return ti
+}
+
 // Will expire msgs that have aged out on restart.
 // We will treat this differently in case we have a recovery
 // that will expire alot of messages on startup.
@@ -1328,7 +2066,7 @@ func (fs *fileStore) expireMsgsOnRecover() {
 			// Delete the message here.
 			if mb.msgs > 0 {
 				sz := fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
-				mb.bytes -= sz
+				mb.removeBytes(sz)
 				bytes += sz
 				mb.msgs--
 				purged++
@@ -1511,6 +2249,86 @@ func (mb *msgBlock) firstMatching(filter string, wc bool, start uint64, sm *Stor
 	return nil, false, ErrStoreMsgNotFound
 }
 
+// Find the first matching message against any of the filters, which are expected to not overlap.
+func (mb *msgBlock) firstMatchingMulti(filters []string, start uint64, sm *StoreMsg) (*StoreMsg, bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err := mb.ensurePerSubjectInfoLoaded(); err != nil {
+		return nil, false, err
+	}
+
+	var wc bool
+	for _, filter := range filters {
+		if subjectHasWildcard(filter) {
+			wc = true
+			break
+		}
+	}
+
+	// Same heuristics as firstMatching for when to skip the scan of mb.fss.
+	const linearScanMaxFSS = 32
+	fseq := start
+	doLinearScan := 2*int(mb.last.seq-start) < len(mb.fss) || (wc && len(mb.fss) > linearScanMaxFSS)
+
+	if !doLinearScan {
+		fseq = mb.last.seq + 1
+		update := func(ss *SimpleState) {
+			if start > ss.Last || ss.First >= fseq {
+				return
+			}
+			if ss.First < start {
+				fseq = start
+			} else {
+				fseq = ss.First
+			}
+		}
+		if wc {
+			for subj, ss := range mb.fss {
+				if subjectIsSubsetMatchAny(subj, filters) {
+					update(ss)
+				}
+			}
+		} else {
+			for _, filter := range filters {
+				if ss := mb.fss[filter]; ss != nil {
+					update(ss)
+				}
+			}
+		}
+	}
+
+	if fseq > mb.last.seq {
+		return nil, false, ErrStoreMsgNotFound
+	}
+
+	if mb.cacheNotLoaded() {
+		if err := mb.loadMsgsWithLock(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if sm == nil {
+		sm = new(StoreMsg)
+	}
+
+	for seq := fseq; seq <= mb.last.seq; seq++ {
+		llseq := mb.llseq
+		fsm, err := mb.cacheLookup(seq, sm)
+		if err != nil {
+			continue
+		}
+		if subjectIsSubsetMatchAny(fsm.subj, filters) {
+			expireOk := seq == mb.last.seq && mb.llseq == seq
+			return fsm, expireOk, nil
+		}
+		// If we are here we did not match, so put the llseq back.
+		mb.llseq = llseq
+	}
+
+	return nil, false, ErrStoreMsgNotFound
+}
+
 // This will traverse a message block and generate the filtered pending.
 func (mb *msgBlock) filteredPending(subj string, wc bool, seq uint64) (total, first, last uint64) {
 	mb.mu.Lock()
@@ -1805,6 +2623,11 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 			lmb.writeIndexInfo()
 		}
 
+		// This block is now sealed, so compress it if configured.
+		if fs.cfg.Compression != NoCompression {
+			fs.queueCompress(lmb)
+		}
+
 		// Determine if we can reclaim any resources here.
 		if fs.fip {
 			lmb.mu.Lock()
@@ -1890,7 +2713,7 @@ func (fs *fileStore) genEncryptionKeysForBlock(mb *msgBlock) error {
 	if err != nil {
 		return err
 	}
-	mb.aek, mb.bek, mb.seed, mb.nonce = key, bek, seed, encrypted[:key.NonceSize()]
+	mb.aek, mb.bek, mb.seed, mb.nonce, mb.sc = key, bek, seed, encrypted[:key.NonceSize()], fs.fcfg.Cipher
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
 	keyFile := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
 	if _, err := os.Stat(keyFile); err != nil && !os.IsNotExist(err) {
@@ -2004,6 +2827,16 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		fs.startAgeChk()
 	}
 
+	// Track any per message TTL.
+	if fs.cfg.AllowMsgTTL {
+		if expires := msgTTLExpires(hdr, ts); expires > 0 {
+			fs.ttls.track(seq, expires)
+			if fs.ttlChk == nil || fs.ttls.next() == expires {
+				fs.resetTTLChk()
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -2097,6 +2930,51 @@ func (fs *fileStore) SkipMsg() uint64 {
 	return seq
 }
 
+// Gaps larger than this are skipped by starting a new block instead of
+// placing a record for every sequence.
+const skipMsgsNewBlockThresh = 1024
+
+// skipMsgs will use the next num sequences but not store anything.
+func (fs *fileStore) skipMsgs(num uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	if num == 0 {
+		return nil
+	}
+	lmb := fs.lmb
+	lmb.mu.RLock()
+	hasMsgs := lmb.msgs > 0
+	lmb.mu.RUnlock()
+
+	// An empty block only needs its meta data updated, no matter how many we skip.
+	if hasMsgs && num > skipMsgsNewBlockThresh {
+		var err error
+		if lmb, err = fs.newMsgBlockForWrite(); err != nil {
+			return err
+		}
+		hasMsgs = false
+	}
+
+	now := time.Now().UTC()
+	seq, lseq := fs.state.LastSeq+1, fs.state.LastSeq+num
+	if hasMsgs {
+		for ; seq <= lseq; seq++ {
+			lmb.skipMsg(seq, now)
+		}
+	} else {
+		lmb.skipMsg(lseq, now)
+	}
+	fs.state.LastSeq, fs.state.LastTime = lseq, now
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq, fs.state.FirstTime = lseq+1, now
+	}
+	return nil
+}
+
 // Lock should be held.
 func (fs *fileStore) rebuildFirst() {
 	if len(fs.blks) == 0 {
@@ -2364,7 +3242,7 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 
 	// Now local mb updates.
 	mb.msgs--
-	mb.bytes -= msz
+	mb.removeBytes(msz)
 
 	// If we are tracking subjects here make sure we update that accounting.
 	mb.ensurePerSubjectInfoLoaded()
@@ -2563,27 +3441,11 @@ func (mb *msgBlock) compact() {
 		index += rl
 	}
 
-	// Check for encryption.
-	if mb.bek != nil && len(nbuf) > 0 {
-		// Recreate to reset counter.
-		rbek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
-		if err != nil {
-			return
-		}
-		rbek.XORKeyStream(nbuf, nbuf)
-	}
-
 	// Close FDs first.
 	mb.closeFDsLocked()
 
-	// We will write to a new file and mv/rename it in case of failure.
-	mfn := filepath.Join(filepath.Join(mb.fs.fcfg.StoreDir, msgDir), fmt.Sprintf(newScan, mb.index))
-	if err := os.WriteFile(mfn, nbuf, defaultFilePerms); err != nil {
-		os.Remove(mfn)
-		return
-	}
-	if err := os.Rename(mfn, mb.mfn); err != nil {
-		os.Remove(mfn)
+	// Keep the compression we had.
+	if err := mb.writeBlock(nbuf, mb.cmp); err != nil {
 		return
 	}
 
@@ -2744,6 +3606,9 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 	}
 }
 
+// Overwrites the message record with random data.
+// For compressed blocks this means rewriting the whole block, so every
+// erase costs a full block write.
 // Lock should be held.
 func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 	var le = binary.LittleEndian
@@ -2781,6 +3646,11 @@ func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 		copy(buf, nbytes)
 	}
 
+	// Compressed blocks can not be patched in place so need to be rewritten as a whole.
+	if mb.cmp != NoCompression {
+		return mb.writeBlock(mb.cache.buf, mb.cmp)
+	}
+
 	// Disk
 	if mb.cache.off+mb.cache.wp > ri {
 		mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms)
@@ -2837,7 +3707,7 @@ func (mb *msgBlock) truncate(sm *StoreMsg) (nmsgs, nbytes uint64, err error) {
 			if mb.msgs > 0 {
 				rl := fileStoreMsgSize(m.subj, m.hdr, m.msg)
 				mb.msgs--
-				mb.bytes -= rl
+				mb.removeBytes(rl)
 				mb.rbytes -= rl
 				// For return accounting.
 				purged++
@@ -2847,7 +3717,20 @@ func (mb *msgBlock) truncate(sm *StoreMsg) (nmsgs, nbytes uint64, err error) {
 	}
 
 	// Truncate our msgs and close file.
-	if mb.mfd != nil {
+	if mb.cmp != NoCompression {
+		// We will be the last block, so write back out uncompressed.
+		if mb.cacheNotLoaded() {
+			if err := mb.loadMsgsWithLock(); err != nil {
+				mb.mu.Unlock()
+				return 0, 0, err
+			}
+		}
+		if err := mb.writeBlock(mb.cache.buf[:eof], NoCompression); err != nil {
+			mb.mu.Unlock()
+			return 0, 0, err
+		}
+		copy(mb.lchk[0:], mb.cache.buf[eof-8:eof])
+	} else if mb.mfd != nil {
 		mb.mfd.Truncate(eof)
 		mb.mfd.Sync()
 		// Update our checksum.
@@ -3145,43 +4028,710 @@ func (fs *fileStore) expireMsgs() {
 	}
 }
 
+// Will (re)arm the per message TTL timer for the next expiration.
 // Lock should be held.
-func (fs *fileStore) checkAndFlushAllBlocks() {
-	for _, mb := range fs.blks {
-		if mb.pendingWriteSize() > 0 {
-			// Since fs lock is held need to pull this apart in case we need to rebuild state.
-			mb.mu.Lock()
-			ld, _ := mb.flushPendingMsgsLocked()
-			mb.mu.Unlock()
-			if ld != nil {
-				fs.rebuildStateLocked(ld)
-			}
-		}
-		if mb.indexNeedsUpdate() {
-			mb.writeIndexInfo()
-		}
+func (fs *fileStore) resetTTLChk() {
+	next := fs.ttls.next()
+	if next == 0 {
+		fs.cancelTTLChk()
+		return
+	}
+	fireIn := time.Duration(next - time.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if fs.ttlChk != nil {
+		fs.ttlChk.Reset(fireIn)
+	} else {
+		fs.ttlChk = time.AfterFunc(fireIn, fs.expireMsgTTLs)
 	}
 }
 
-// This will check all the checksums on messages and report back any sequence numbers with errors.
-func (fs *fileStore) checkMsgs() *LostStreamData {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
+// Lock should be held.
+func (fs *fileStore) cancelTTLChk() {
+	if fs.ttlChk != nil {
+		fs.ttlChk.Stop()
+		fs.ttlChk = nil
+	}
+}
+
+// Will expire msgs whose individual TTL has passed.
+func (fs *fileStore) expireMsgTTLs() {
+	fs.mu.Lock()
+	expired := fs.ttls.expired(time.Now().UnixNano())
+	fs.mu.Unlock()
+
+	var smv StoreMsg
+	var retry []msgTTL
+	for _, e := range expired {
+		// Make sure this is still the message we were tracking.
+		sm, _ := fs.msgForSeq(e.seq, &smv)
+		if sm == nil || msgTTLExpires(sm.hdr, sm.ts) != e.expires {
+			continue
+		}
+		if _, err := fs.removeMsg(e.seq, false, true); err == ErrStoreSnapshotInProgress {
+			retry = append(retry, e)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return
+	}
+	for _, e := range retry {
+		fs.ttls.track(e.seq, e.expires)
+	}
+	if len(retry) > 0 {
+		// Try again once the snapshot has had a chance to complete.
+		if fs.ttlChk == nil {
+			fs.ttlChk = time.AfterFunc(time.Second, fs.expireMsgTTLs)
+		} else {
+			fs.ttlChk.Reset(time.Second)
+		}
+	} else {
+		fs.resetTTLChk()
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) checkAndFlushAllBlocks() {
+	for _, mb := range fs.blks {
+		if mb.pendingWriteSize() > 0 {
+			// Since fs lock is held need to pull this apart in case we need to rebuild state.
+			mb.mu.Lock()
+			ld, _ := mb.flushPendingMsgsLocked()
+			mb.mu.Unlock()
+			if ld != nil {
+				fs.rebuildStateLocked(ld)
+			}
+		}
+		if mb.indexNeedsUpdate() {
+			mb.writeIndexInfo()
+		}
+	}
+}
+
+// This will check all the checksums on messages and report back any sequence numbers with errors.
+func (fs *fileStore) checkMsgs() *LostStreamData {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
 	fs.checkAndFlushAllBlocks()
 
-	// Clear any global subject state.
-	fs.psim = make(map[string]*psi)
+	// Clear any global subject state.
+	fs.psim = make(map[string]*psi)
+
+	for _, mb := range fs.blks {
+		if ld, err := mb.rebuildState(); err != nil && ld != nil {
+			// Rebuild fs state too.
+			mb.fs.rebuildStateLocked(ld)
+		}
+		fs.populateGlobalPerSubjectInfo(mb)
+	}
+
+	return fs.ld
+}
+
+// A range of message sequences, inclusive.
+type seqRange struct {
+	first uint64
+	last  uint64
+}
+
+// Tracks the results of verifying our blocks in the background.
+type scrubStats struct {
+	runs     uint64
+	blocks   uint64
+	ranges   uint64
+	msgs     uint64
+	repaired uint64
+	last     time.Time
+}
+
+// Register a callback for when scrubbing finds a range of corrupt messages.
+func (fs *fileStore) registerCorruptHandler(cb func(first, last uint64)) {
+	fs.mu.Lock()
+	fs.ccb = cb
+	fs.mu.Unlock()
+}
+
+// Register a callback for errors from our background work that no caller will see.
+func (fs *fileStore) registerErrorHandler(cb func(err error)) {
+	fs.mu.Lock()
+	fs.ecb = cb
+	fs.mu.Unlock()
+}
+
+// Report an error from our background work.
+func (fs *fileStore) reportError(err error) {
+	fs.mu.RLock()
+	cb := fs.ecb
+	fs.mu.RUnlock()
+	if cb != nil {
+		cb(err)
+	}
+}
+
+// Returns the results of verifying our blocks so far.
+func (fs *fileStore) scrubState() scrubStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.scrub
+}
+
+// Verify all of our sealed blocks, reporting any corrupt ranges of messages.
+// This does not change any state, damaged messages will fail their checksum
+// when loaded until repaired.
+func (fs *fileStore) scrubBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks, lmb := append([]*msgBlock(nil), fs.blks...), fs.lmb
+	fs.mu.RUnlock()
+
+	var bad []seqRange
+	var n uint64
+	for _, mb := range blks {
+		// Our last block is still being written to.
+		if mb == lmb {
+			continue
+		}
+		if fs.isClosed() {
+			return
+		}
+		rs, err := mb.scrub()
+		if err != nil {
+			continue
+		}
+		n++
+		bad = append(bad, rs...)
+	}
+
+	fs.mu.Lock()
+	fs.scrub.runs++
+	fs.scrub.blocks += n
+	fs.scrub.ranges += uint64(len(bad))
+	for _, r := range bad {
+		fs.scrub.msgs += r.last - r.first + 1
+	}
+	fs.scrub.last = time.Now().UTC()
+	cb := fs.ccb
+	if !fs.closed && fs.fcfg.ScrubInterval > 0 {
+		fs.scrubTmr = time.AfterFunc(fs.fcfg.ScrubInterval, fs.scrubBlocks)
+	}
+	fs.mu.Unlock()
+
+	if cb != nil {
+		for _, r := range bad {
+			cb(r.first, r.last)
+		}
+	}
+}
+
+// Tracks the results of rewriting sparse blocks in the background.
+type compactStats struct {
+	runs      uint64
+	blocks    uint64
+	reclaimed uint64
+	last      time.Time
+}
+
+// Returns the results of compacting our blocks so far.
+func (fs *fileStore) compactState() compactStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.cmpct
+}
+
+// Rewrite any sealed blocks whose live bytes have dropped below our threshold to reclaim
+// the space held by deleted messages. Sequences and interior deletes are preserved.
+// We throttle based on what we rewrite so we do not starve other I/O.
+//
+// This complements the inline compaction done by removeMsg, which only rewrites blocks
+// over compactMinimum once they drop below 25% live bytes. Those are rewritten on the
+// delete that crosses that ratio, so we will mostly be left with smaller blocks and ones
+// that emptied from the front or sit between that ratio and our threshold. Either way
+// a block is rewritten while holding its lock, so writers to it will wait, but
+// the time held is bounded by our block size.
+func (fs *fileStore) compactBlocks() {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	blks, lmb, threshold, rate := append([]*msgBlock(nil), fs.blks...), fs.lmb, fs.fcfg.CompactThreshold, fs.fcfg.CompactMaxRate
+	fs.mu.RUnlock()
+
+	var n, reclaimed uint64
+	for _, mb := range blks {
+		// Our last block is still being written to.
+		if mb == lmb {
+			continue
+		}
+		if fs.isClosed() {
+			return
+		}
+		written, freed := mb.compactIfSparse(threshold)
+		if freed == 0 {
+			continue
+		}
+		n++
+		reclaimed += freed
+		time.Sleep(time.Duration(written) * time.Second / time.Duration(rate))
+	}
+
+	fs.mu.Lock()
+	fs.cmpct.runs++
+	fs.cmpct.blocks += n
+	fs.cmpct.reclaimed += reclaimed
+	fs.cmpct.last = time.Now().UTC()
+	if !fs.closed && fs.fcfg.CompactInterval > 0 {
+		fs.cmpctTmr = time.AfterFunc(fs.fcfg.CompactInterval, fs.compactBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Compact this block if its ratio of live to total bytes is below threshold.
+// Returns the bytes written and reclaimed, if any.
+func (mb *msgBlock) compactIfSparse(threshold float64) (written, reclaimed uint64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed || mb.msgs == 0 || mb.rbytes == 0 {
+		return 0, 0
+	}
+	if mb.mfd != nil && mb.cache != nil && len(mb.cache.buf) > mb.cache.wp {
+		return 0, 0
+	}
+	// Interior deletes remain as empty records once compacted.
+	if csz := mb.bytes + uint64(len(mb.dmap)*emptyRecordLen); csz >= mb.rbytes {
+		return 0, 0
+	}
+	if float64(mb.bytes) >= threshold*float64(mb.rbytes) {
+		return 0, 0
+	}
+	rbytes := mb.rbytes
+	mb.compact()
+	if mb.rbytes >= rbytes {
+		return 0, 0
+	}
+	mb.writeIndexInfoLocked()
+	return mb.rbytes, rbytes - mb.rbytes
+}
+
+// Load our block from disk and return the plaintext, decrypting and decompressing as needed.
+// The returned buffer should be recycled.
+// Lock should be held.
+func (mb *msgBlock) loadPlaintextBlock() ([]byte, error) {
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return nil, err
+	}
+	// Use our own key stream so we do not disturb the one used for writes.
+	if mb.bek != nil && len(buf) > 0 {
+		bek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
+		if err != nil {
+			recycleMsgBlockBuf(buf)
+			return nil, err
+		}
+		bek.XORKeyStream(buf, buf)
+	}
+	pbuf, cmp, err := decompressBlock(buf)
+	if cmp != NoCompression || err != nil {
+		recycleMsgBlockBuf(buf)
+	}
+	return pbuf, err
+}
+
+// Checks that a record is well formed and returns its length, sequence and whether it is an erased or skipped message.
+func parseMsgRecord(buf []byte, index int) (rl int, seq uint64, erased, ok bool) {
+	if index+msgHdrSize > len(buf) {
+		return 0, 0, false, false
+	}
+	var le = binary.LittleEndian
+	hdr := buf[index : index+msgHdrSize]
+	l, slen := le.Uint32(hdr[0:])&^hbit, le.Uint16(hdr[20:])
+	dlen := int(l) - msgHdrSize
+	if dlen < 0 || int(slen) > dlen || l > rlBadThresh || index+int(l) > len(buf) {
+		return 0, 0, false, false
+	}
+	seq = le.Uint64(hdr[4:])
+	return int(l), seq &^ ebit, seq == 0 || seq&ebit != 0, true
+}
+
+// Checks the hash of a well formed record.
+// Lock should be held.
+func (mb *msgBlock) checkMsgRecord(rec []byte) bool {
+	var le = binary.LittleEndian
+	hasHeaders := le.Uint32(rec[0:])&hbit != 0
+	slen, dlen := int(le.Uint16(rec[20:])), len(rec)-msgHdrSize
+	data := rec[msgHdrSize:]
+	if hasHeaders && slen+4 > dlen-8 {
+		return false
+	}
+	mb.hh.Reset()
+	mb.hh.Write(rec[4:20])
+	mb.hh.Write(data[:slen])
+	if hasHeaders {
+		mb.hh.Write(data[slen+4 : dlen-8])
+	} else {
+		mb.hh.Write(data[slen : dlen-8])
+	}
+	return bytes.Equal(mb.hh.Sum(nil), data[dlen-8:])
+}
+
+// Verify the checksums of all our records and that they agree with our index info.
+// Returns any ranges of sequences that are damaged.
+// We check our records in chunks and release our lock in between, throttled
+// to scrubMaxRate so we do not hold up writers or starve other I/O.
+func (mb *msgBlock) scrub() ([]seqRange, error) {
+	mb.mu.Lock()
+	if mb.closed {
+		mb.mu.Unlock()
+		return nil, errNoMsgBlk
+	}
+	if mb.mfd != nil && mb.cache != nil && len(mb.cache.buf) > mb.cache.wp {
+		mb.mu.Unlock()
+		return nil, errPendingData
+	}
+	first, last, nmsgs, rbytes := mb.first.seq, mb.last.seq, mb.msgs, mb.rbytes
+	if first == 0 || first > last {
+		mb.mu.Unlock()
+		return nil, nil
+	}
+	buf, err := mb.loadPlaintextBlock()
+	mb.mu.Unlock()
+	if err == errBadCmpBlk {
+		return []seqRange{{first, last}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	var bad []seqRange
+	// The last sequence we know is good and if we are inside a damaged range.
+	lseq, inBad := first-1, false
+	markBad := func() {
+		if !inBad {
+			bad, inBad = append(bad, seqRange{lseq + 1, last}), true
+		}
+	}
+	markGood := func(seq uint64) {
+		if inBad {
+			bad[len(bad)-1].last, inBad = seq-1, false
+		}
+		lseq = seq
+	}
+
+	var msgs uint64
+	for index, done := 0, false; index < len(buf) && !done; {
+		start := index
+		mb.mu.Lock()
+		// If we were changed since we loaded our records we will be checked on the next run.
+		if mb.closed || mb.msgs != nmsgs || mb.rbytes != rbytes || mb.first.seq != first {
+			mb.mu.Unlock()
+			return nil, errScrubBlkChanged
+		}
+		for index < len(buf) && index-start < scrubChunkSize {
+			rl, seq, erased, ok := parseMsgRecord(buf, index)
+			if !ok {
+				// We can not find the next record, so everything after is suspect.
+				markBad()
+				done = true
+				break
+			}
+			rec := buf[index : index+rl]
+			index += rl
+
+			// Deleted messages at the head of the block.
+			if seq == 0 || seq < first {
+				continue
+			}
+			// Sequences need to increase and stay within our index info.
+			if seq <= lseq || seq > last {
+				markBad()
+				continue
+			}
+			if erased {
+				markGood(seq)
+				continue
+			}
+			if _, deleted := mb.dmap[seq]; !deleted {
+				if !mb.checkMsgRecord(rec) {
+					markBad()
+					continue
+				}
+				msgs++
+			}
+			markGood(seq)
+		}
+		mb.mu.Unlock()
+		time.Sleep(time.Duration(index-start) * time.Second / scrubMaxRate)
+	}
+	// Anything missing at the end is damaged as well.
+	if !inBad && lseq < last {
+		bad = append(bad, seqRange{lseq + 1, last})
+	}
+	// If all records check out our index info should agree.
+	if len(bad) == 0 && msgs != nmsgs {
+		bad = append(bad, seqRange{first, last})
+	}
+	return bad, nil
+}
+
+// Replace a damaged range of messages in one of our sealed blocks with copies from another replica.
+// Sequences in the range without a message are treated as deleted.
+func (fs *fileStore) repairMsgs(first, last uint64, msgs []*StoreMsg) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	mb := fs.selectMsgBlock(first)
+	if mb == nil || mb == fs.lmb {
+		return ErrStoreMsgNotFound
+	}
+
+	mb.mu.Lock()
+	if last > mb.last.seq || first < mb.first.seq {
+		mb.mu.Unlock()
+		return ErrInvalidSequence
+	}
+	buf, err := mb.loadPlaintextBlock()
+	if err != nil && err != errBadCmpBlk {
+		mb.mu.Unlock()
+		return err
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	repaired := make(map[uint64]*StoreMsg, len(msgs))
+	for _, sm := range msgs {
+		if sm.seq >= first && sm.seq <= last {
+			repaired[sm.seq] = sm
+		}
+	}
+	nbuf := make([]byte, 0, len(buf))
+	appendRange := func() {
+		for seq := first; seq <= last; seq++ {
+			_, deleted := mb.dmap[seq]
+			if sm := repaired[seq]; sm != nil && !deleted {
+				nbuf = mb.appendMsgRecord(nbuf, seq, sm.subj, sm.hdr, sm.msg, sm.ts)
+			} else {
+				nbuf = mb.appendMsgRecord(nbuf, seq|ebit, _EMPTY_, nil, nil, 0)
+			}
+		}
+	}
+
+	// Keep all records outside of the range as is, any other damaged ones will be repaired on their own.
+	var added bool
+	for index := 0; index < len(buf); {
+		rl, seq, _, ok := parseMsgRecord(buf, index)
+		if !ok {
+			// Nothing past the range should be lost.
+			if last < mb.last.seq {
+				mb.mu.Unlock()
+				return errBadMsg
+			}
+			break
+		}
+		rec := buf[index : index+rl]
+		index += rl
+
+		if seq >= first && seq <= last {
+			continue
+		}
+		if seq > last && !added {
+			appendRange()
+			added = true
+		}
+		nbuf = append(nbuf, rec...)
+	}
+	if !added {
+		appendRange()
+	}
+
+	// Remember our subjects so we can adjust our global per subject info afterwards.
+	var ofss map[string]uint64
+	if mb.ensurePerSubjectInfoLoaded() == nil && mb.fss != nil {
+		ofss = make(map[string]uint64, len(mb.fss))
+		for subj, ss := range mb.fss {
+			ofss[subj] = ss.Msgs
+		}
+	}
+	msgsBefore, bytesBefore := mb.msgs, mb.bytes
+	if err := mb.writeBlock(nbuf, mb.cmp); err != nil {
+		mb.mu.Unlock()
+		return err
+	}
+	mb.clearCacheAndOffset()
+	mb.updateStateFromRecords(nbuf)
+	mb.writeIndexInfoLocked()
+	mb.writePerSubjectInfo()
+	msgsAfter, bytesAfter := mb.msgs, mb.bytes
+	if ofss != nil {
+		fs.adjustPerSubjectInfo(mb.index, ofss, mb.fss)
+	}
+	mb.mu.Unlock()
+
+	fs.state.Msgs = fs.state.Msgs - msgsBefore + msgsAfter
+	fs.state.Bytes = fs.state.Bytes - bytesBefore + bytesAfter
+	if mb == fs.blks[0] {
+		fs.selectNextFirst()
+	}
+	// If we could not tell what subjects we had before we need to rebuild our global per subject info.
+	if ofss == nil {
+		fs.psim = make(map[string]*psi)
+		for _, mb := range fs.blks {
+			fs.populateGlobalPerSubjectInfo(mb)
+		}
+	}
+	fs.scrub.repaired += last - first + 1
+
+	if bytesAfter != bytesBefore && fs.scb != nil {
+		cb := fs.scb
+		fs.mu.Unlock()
+		cb(int64(msgsAfter)-int64(msgsBefore), int64(bytesAfter)-int64(bytesBefore), 0, _EMPTY_)
+		fs.mu.Lock()
+	}
+	return nil
+}
+
+// Adjust our global per subject info for a block whose subjects changed from ofss to nfss.
+// Lock should be held.
+func (fs *fileStore) adjustPerSubjectInfo(index uint32, ofss map[string]uint64, nfss map[string]*SimpleState) {
+	for subj, msgs := range ofss {
+		if len(subj) == 0 {
+			continue
+		}
+		if ss := nfss[subj]; ss != nil {
+			if ss.Msgs >= msgs {
+				continue
+			}
+			msgs -= ss.Msgs
+		}
+		if info, ok := fs.psim[subj]; ok {
+			if info.total <= msgs {
+				delete(fs.psim, subj)
+			} else {
+				info.total -= msgs
+			}
+		}
+	}
+	for subj, ss := range nfss {
+		if len(subj) == 0 || ss.Msgs <= ofss[subj] {
+			continue
+		}
+		msgs := ss.Msgs - ofss[subj]
+		if info, ok := fs.psim[subj]; ok {
+			info.total += msgs
+			if index < info.fblk {
+				info.fblk = index
+			}
+			if index > info.lblk {
+				info.lblk = index
+			}
+		} else {
+			fs.psim[subj] = &psi{total: msgs, fblk: index, lblk: index}
+		}
+	}
+}
+
+// Update our state from the plaintext contents of our block without checking any
+// checksums, so that damaged records are left in place and tracked as normal.
+// Lock should be held.
+func (mb *msgBlock) updateStateFromRecords(buf []byte) {
+	var le = binary.LittleEndian
+	var first msgId
+	var msgs, bytes uint64
+	fss := make(map[string]*SimpleState)
 
-	for _, mb := range fs.blks {
-		if ld, err := mb.rebuildState(); err != nil && ld != nil {
-			// Rebuild fs state too.
-			mb.fs.rebuildStateLocked(ld)
+	for index := 0; index < len(buf); {
+		rl, seq, erased, ok := parseMsgRecord(buf, index)
+		if !ok {
+			break
+		}
+		rec := buf[index : index+rl]
+		index += rl
+
+		if seq == 0 || seq < mb.first.seq {
+			continue
+		}
+		if erased {
+			if mb.dmap == nil {
+				mb.dmap = make(map[uint64]struct{})
+			}
+			mb.dmap[seq] = struct{}{}
+			continue
+		}
+		if _, deleted := mb.dmap[seq]; deleted {
+			continue
+		}
+		if first.seq == 0 {
+			first = msgId{seq, int64(le.Uint64(rec[12:]))}
+		}
+		msgs++
+		bytes += uint64(rl)
+		if slen := int(le.Uint16(rec[20:])); slen > 0 {
+			subj := rec[msgHdrSize : msgHdrSize+slen]
+			if ss := fss[string(subj)]; ss != nil {
+				ss.Msgs++
+				ss.Last = seq
+			} else {
+				fss[mb.subjString(subj)] = &SimpleState{Msgs: 1, First: seq, Last: seq}
+			}
 		}
-		fs.populateGlobalPerSubjectInfo(mb)
 	}
 
-	return fs.ld
+	if first.seq != 0 {
+		mb.first = first
+	} else {
+		mb.first.seq = mb.last.seq + 1
+	}
+	mb.msgs, mb.bytes, mb.rbytes, mb.fss = msgs, bytes, uint64(len(buf)), fss
+	if len(buf) >= checksumSize {
+		copy(mb.lchk[0:], buf[len(buf)-checksumSize:])
+	}
+}
+
+// Append a message record in our block format to buf.
+// Lock should be held.
+func (mb *msgBlock) appendMsgRecord(buf []byte, seq uint64, subj string, mhdr, msg []byte, ts int64) []byte {
+	var le = binary.LittleEndian
+	var hdr [msgHdrSize]byte
+
+	l := uint32(fileStoreMsgSize(subj, mhdr, msg))
+	hasHeaders := len(mhdr) > 0
+	if hasHeaders {
+		l |= hbit
+	}
+	le.PutUint32(hdr[0:], l)
+	le.PutUint64(hdr[4:], seq)
+	le.PutUint64(hdr[12:], uint64(ts))
+	le.PutUint16(hdr[20:], uint16(len(subj)))
+
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, subj...)
+	if hasHeaders {
+		var hlen [4]byte
+		le.PutUint32(hlen[0:], uint32(len(mhdr)))
+		buf = append(buf, hlen[:]...)
+		buf = append(buf, mhdr...)
+	}
+	buf = append(buf, msg...)
+
+	mb.hh.Reset()
+	mb.hh.Write(hdr[4:20])
+	mb.hh.Write([]byte(subj))
+	if hasHeaders {
+		mb.hh.Write(mhdr)
+	}
+	mb.hh.Write(msg)
+	return mb.hh.Sum(buf)
 }
 
 // Lock should be held.
@@ -3484,6 +5034,163 @@ func (fs *fileStore) syncBlocks() {
 	fs.mu.Unlock()
 }
 
+// Returns the block files in our archive directory by index.
+// Lock should be held.
+func (fs *fileStore) archivedBlockFiles() map[uint32]string {
+	if fs.fcfg.ArchiveDir == _EMPTY_ {
+		return nil
+	}
+	// Check for any left over purged messages.
+	apdir := filepath.Join(fs.fcfg.ArchiveDir, purgeDir)
+	if _, err := os.Stat(apdir); err == nil {
+		os.RemoveAll(apdir)
+	}
+	adir := filepath.Join(fs.fcfg.ArchiveDir, msgDir)
+	fis, err := os.ReadDir(adir)
+	if err != nil {
+		return nil
+	}
+	archived := make(map[uint32]string)
+	for _, fi := range fis {
+		var index uint32
+		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+			archived[index] = filepath.Join(adir, fi.Name())
+		} else if n, err := fmt.Sscanf(fi.Name(), newScan, &index); err == nil && n == 1 {
+			// An interrupted archive of this block.
+			os.Remove(filepath.Join(adir, fi.Name()))
+		}
+	}
+	return archived
+}
+
+// Move sealed blocks whose messages are all older than our stream's ArchiveAfter to our archive directory.
+// This is called from a timer and we throttle based on what we copy so we do not starve other I/O.
+func (fs *fileStore) archiveBlocks() {
+	// Only one pass at a time since we copy to the same temporary files.
+	fs.archMu.Lock()
+	defer fs.archMu.Unlock()
+
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return
+	}
+	var blks []*msgBlock
+	adir := filepath.Join(fs.fcfg.ArchiveDir, msgDir)
+	cutoff := time.Now().Add(-fs.cfg.ArchiveAfter).UnixNano()
+	if fs.cfg.ArchiveAfter > 0 {
+		for _, mb := range fs.blks {
+			// Our last block is still being written to.
+			if mb != fs.lmb {
+				blks = append(blks, mb)
+			}
+		}
+	}
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		if fs.isClosed() {
+			return
+		}
+		mb.mu.RLock()
+		cold := !mb.closed && !mb.archived && mb.msgs > 0 && mb.last.ts < cutoff
+		mb.mu.RUnlock()
+		if cold {
+			// We will try again on our next pass if this fails.
+			fs.encMu.Lock()
+			mb.archive(adir)
+			fs.encMu.Unlock()
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed {
+		fs.cancelArchiveTimer()
+		fs.archTmr = time.AfterFunc(defaultArchiveInterval, fs.archiveBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// Copy our block file to adir and remove our local copy once it is safely stored.
+// We only hold our lock to swap in our archived copy, so if we were changed or
+// re-encrypted while copying we return errArchBlkChanged and will be archived on a
+// later pass. The same goes for blocks still waiting to be re-encrypted.
+func (mb *msgBlock) archive(adir string) error {
+	mb.mu.Lock()
+	if mb.closed || mb.archived {
+		mb.mu.Unlock()
+		return nil
+	}
+	if mb.rotate {
+		mb.mu.Unlock()
+		return errArchBlkChanged
+	}
+	if mb.mfd != nil && mb.cache != nil && len(mb.cache.buf) > mb.cache.wp {
+		mb.mu.Unlock()
+		return errPendingData
+	}
+	mfn, first, nmsgs, rbytes, cmp := mb.mfn, mb.first.seq, mb.msgs, mb.rbytes, mb.cmp
+	sc, seed := mb.sc, mb.seed
+	mb.mu.Unlock()
+
+	if err := os.MkdirAll(adir, defaultDirPerms); err != nil {
+		return err
+	}
+	src, err := os.Open(mfn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	afn := filepath.Join(adir, filepath.Base(mfn))
+	tmp := filepath.Join(adir, fmt.Sprintf(newScan, mb.index))
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	for {
+		var n int64
+		<-dios
+		n, err = io.CopyN(dst, src, archiveChunkSize)
+		dios <- struct{}{}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		time.Sleep(time.Duration(n) * time.Second / archiveMaxRate)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed || mb.archived || mb.mfn != mfn || mb.cmp != cmp || mb.first.seq != first || mb.msgs != nmsgs || mb.rbytes != rbytes ||
+		mb.rotate || mb.sc != sc || !bytes.Equal(mb.seed, seed) {
+		os.Remove(tmp)
+		return errArchBlkChanged
+	}
+	mb.closeFDsLockedNoCheck()
+	if err := os.Rename(tmp, afn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Our archived copy is what will be used from now on.
+	os.Remove(mfn)
+	mb.mfn, mb.archived = afn, true
+	mb.updateArchivedBytes()
+	return nil
+}
+
 // Select the message block where this message should be found.
 // Return nil if not in the set.
 // Read lock should be held.
@@ -3801,6 +5508,229 @@ func (mb *msgBlock) loadBlock(buf []byte) ([]byte, error) {
 	return buf[:n], err
 }
 
+// Compressed message blocks start with this magic, followed by the algorithm, the
+// uvarint encoded size of the original contents and then the compressed contents.
+// Read as a message record length this would be above rlBadThresh, so it can never
+// be mistaken for the start of an uncompressed block.
+var cmpBlkMagic = []byte{'c', 'm', 'p', 0xff}
+
+// Compress the plaintext contents of a message block.
+func compressBlock(alg StoreCompression, buf []byte) ([]byte, error) {
+	switch alg {
+	case NoCompression:
+		return buf, nil
+	case S2Compression:
+		hdr := append(append([]byte(nil), cmpBlkMagic...), byte(alg))
+		hdr = binary.AppendUvarint(hdr, uint64(len(buf)))
+		nbuf := make([]byte, len(hdr)+s2.MaxEncodedLen(len(buf)))
+		copy(nbuf, hdr)
+		cbuf := s2.Encode(nbuf[len(hdr):], buf)
+		return nbuf[:len(hdr)+len(cbuf)], nil
+	default:
+		return nil, fmt.Errorf("unknown compression %v", alg)
+	}
+}
+
+// Returns the plaintext contents of a message block along with the compression
+// that was used. Uncompressed blocks are returned as is.
+func decompressBlock(buf []byte) ([]byte, StoreCompression, error) {
+	if !bytes.HasPrefix(buf, cmpBlkMagic) {
+		return buf, NoCompression, nil
+	}
+	buf = buf[len(cmpBlkMagic):]
+	if len(buf) < 2 {
+		return nil, NoCompression, errBadCmpBlk
+	}
+	alg := StoreCompression(buf[0])
+	sz, n := binary.Uvarint(buf[1:])
+	if n <= 0 || uint64(int(sz)) != sz {
+		return nil, NoCompression, errBadCmpBlk
+	}
+	buf = buf[1+n:]
+
+	switch alg {
+	case S2Compression:
+		if dlen, err := s2.DecodedLen(buf); err != nil || uint64(dlen) != sz {
+			return nil, NoCompression, errBadCmpBlk
+		}
+		nbuf := getMsgBlockBuf(int(sz))
+		if int(sz) > cap(nbuf) {
+			recycleMsgBlockBuf(nbuf)
+			nbuf = make([]byte, sz)
+		}
+		nbuf, err := s2.Decode(nbuf[:sz], buf)
+		if err != nil {
+			return nil, NoCompression, errBadCmpBlk
+		}
+		return nbuf, alg, nil
+	default:
+		return nil, NoCompression, fmt.Errorf("unknown compression %v", alg)
+	}
+}
+
+// Will write out the plaintext contents of the block with the given compression,
+// encrypting if needed. This goes to a new file first that is then renamed in
+// case of failure.
+// Lock should be held.
+func (mb *msgBlock) writeBlock(buf []byte, alg StoreCompression) error {
+	nbuf, err := compressBlock(alg, buf)
+	if err != nil {
+		return err
+	}
+
+	// Check for encryption.
+	if mb.bek != nil && len(nbuf) > 0 {
+		// Leave the original alone.
+		if alg == NoCompression {
+			nbuf = copyBytes(nbuf)
+		}
+		// Recreate to reset counter.
+		bek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
+		if err != nil {
+			return err
+		}
+		// For future writes make sure to set mb.bek to keep counter correct.
+		mb.bek = bek
+		mb.bek.XORKeyStream(nbuf, nbuf)
+	}
+
+	hadFD := mb.mfd != nil
+	mb.closeFDsLockedNoCheck()
+
+	// Keep our new file next to our block, which may be archived.
+	mfn := filepath.Join(filepath.Dir(mb.mfn), fmt.Sprintf(newScan, mb.index))
+	if err := os.WriteFile(mfn, nbuf, defaultFilePerms); err != nil {
+		os.Remove(mfn)
+		return err
+	}
+	if err := os.Rename(mfn, mb.mfn); err != nil {
+		os.Remove(mfn)
+		return err
+	}
+	mb.cmp = alg
+	return mb.reopenForWriting(hadFD)
+}
+
+// Queue a sealed block to be compressed by our background worker.
+// Lock should be held.
+func (fs *fileStore) queueCompress(mb *msgBlock) {
+	fs.cmpq = append(fs.cmpq, mb)
+	if !fs.cmpw {
+		fs.cmpw = true
+		go fs.compressBlocks()
+	}
+}
+
+// Compress our queued blocks one at a time, throttled so we do not starve other I/O.
+func (fs *fileStore) compressBlocks() {
+	for {
+		fs.mu.Lock()
+		if fs.closed || len(fs.cmpq) == 0 {
+			fs.cmpq, fs.cmpw = nil, false
+			fs.mu.Unlock()
+			return
+		}
+		mb, alg := fs.cmpq[0], fs.cfg.Compression
+		fs.cmpq[0] = nil
+		fs.cmpq = fs.cmpq[1:]
+		// We may have been made writable again by a truncate.
+		isLast := mb == fs.lmb
+		fs.mu.Unlock()
+
+		if isLast || alg == NoCompression {
+			continue
+		}
+		fs.encMu.Lock()
+		written, err := mb.compressIfNeeded(alg)
+		fs.encMu.Unlock()
+		if err == errCmpBlkChanged {
+			// Try again once we have worked through the rest.
+			fs.mu.Lock()
+			fs.cmpq = append(fs.cmpq, mb)
+			fs.mu.Unlock()
+		} else if err != nil {
+			fs.reportError(fmt.Errorf("compressing message block %d: %w", mb.index, err))
+		}
+		time.Sleep(time.Duration(written) * time.Second / compressMaxRate)
+	}
+}
+
+// Compress the block on disk if it is not already using the given compression.
+// Should only be called once the block is sealed and no longer written to.
+// We only hold our lock to read the block and to swap in the rewritten file, so
+// if we were changed or re-encrypted in between we return errCmpBlkChanged and leave
+// the block as is. Blocks waiting to be re-encrypted are skipped, they will be queued
+// again once they were. Returns the bytes we read and wrote.
+func (mb *msgBlock) compressIfNeeded(alg StoreCompression) (uint64, error) {
+	mb.mu.Lock()
+	if mb.closed || mb.mfn == _EMPTY_ || mb.cmp == alg || mb.rotate {
+		mb.mu.Unlock()
+		return 0, nil
+	}
+	// Make sure everything is on disk first.
+	if _, err := mb.flushPendingMsgsLocked(); err != nil {
+		mb.mu.Unlock()
+		return 0, err
+	}
+	mfn, first, nmsgs, rbytes, cmp := mb.mfn, mb.first.seq, mb.msgs, mb.rbytes, mb.cmp
+	sc, seed, nonce, encrypted := mb.sc, mb.seed, mb.nonce, mb.bek != nil
+	buf, err := mb.loadPlaintextBlock()
+	mb.mu.Unlock()
+	if err != nil || len(buf) == 0 {
+		return 0, err
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	nbuf, err := compressBlock(alg, buf)
+	if err != nil {
+		return 0, err
+	}
+	var bek cipher.Stream
+	if encrypted {
+		if alg == NoCompression {
+			nbuf = copyBytes(nbuf)
+		}
+		if bek, err = genBlockEncryptionKey(sc, seed, nonce); err != nil {
+			return 0, err
+		}
+		bek.XORKeyStream(nbuf, nbuf)
+	}
+	written := uint64(len(buf) + len(nbuf))
+
+	// Keep our new file next to our block, which may be archived.
+	tmp := filepath.Join(filepath.Dir(mfn), fmt.Sprintf(newScan, mb.index))
+	<-dios
+	err = os.WriteFile(tmp, nbuf, defaultFilePerms)
+	dios <- struct{}{}
+	if err != nil {
+		os.Remove(tmp)
+		return written, err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed || mb.mfn != mfn || mb.cmp != cmp || mb.first.seq != first || mb.msgs != nmsgs || mb.rbytes != rbytes ||
+		mb.sc != sc || !bytes.Equal(mb.seed, seed) || !bytes.Equal(mb.nonce, nonce) {
+		os.Remove(tmp)
+		if mb.closed || mb.cmp == alg {
+			return written, nil
+		}
+		return written, errCmpBlkChanged
+	}
+	// We are sealed so no need to keep our files open.
+	mb.closeFDsLockedNoCheck()
+	if err := os.Rename(tmp, mfn); err != nil {
+		os.Remove(tmp)
+		return written, err
+	}
+	mb.cmp = alg
+	// Keep our key stream in step for anything we write after a truncate.
+	if bek != nil {
+		mb.bek = bek
+	}
+	return written, nil
+}
+
 // Lock should be held.
 func (mb *msgBlock) loadMsgsWithLock() error {
 	// Check to see if we are loading already.
@@ -3854,7 +5784,7 @@ checkCache:
 
 	// Check if we need to decrypt.
 	if mb.bek != nil && len(buf) > 0 {
-		bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		bek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return err
 		}
@@ -3862,6 +5792,17 @@ checkCache:
 		mb.bek.XORKeyStream(buf, buf)
 	}
 
+	// Check if we need to decompress.
+	pbuf, cmp, err := decompressBlock(buf)
+	if err != nil {
+		return err
+	}
+	if cmp != NoCompression {
+		recycleMsgBlockBuf(buf)
+		buf = pbuf
+	}
+	mb.cmp = cmp
+
 	if err := mb.indexCacheBuf(buf); err != nil {
 		if err == errCorruptState {
 			var ld *LostStreamData
@@ -3905,19 +5846,24 @@ func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error)
 }
 
 var (
-	errNoCache       = errors.New("no message cache")
-	errBadMsg        = errors.New("malformed or corrupt message")
-	errDeletedMsg    = errors.New("deleted message")
-	errPartialCache  = errors.New("partial cache")
-	errNoPending     = errors.New("message block does not have pending data")
-	errNotReadable   = errors.New("storage directory not readable")
-	errCorruptState  = errors.New("corrupt state file")
-	errPendingData   = errors.New("pending data still present")
-	errNoEncryption  = errors.New("encryption not enabled")
-	errBadKeySize    = errors.New("encryption bad key size")
-	errNoMsgBlk      = errors.New("no message block")
-	errMsgBlkTooBig  = errors.New("message block size exceeded int capacity")
-	errUnknownCipher = errors.New("unknown cipher")
+	errNoCache         = errors.New("no message cache")
+	errBadMsg          = errors.New("malformed or corrupt message")
+	errDeletedMsg      = errors.New("deleted message")
+	errPartialCache    = errors.New("partial cache")
+	errNoPending       = errors.New("message block does not have pending data")
+	errNotReadable     = errors.New("storage directory not readable")
+	errCorruptState    = errors.New("corrupt state file")
+	errPendingData     = errors.New("pending data still present")
+	errNoEncryption    = errors.New("encryption not enabled")
+	errBadKeySize      = errors.New("encryption bad key size")
+	errNoMsgBlk        = errors.New("no message block")
+	errMsgBlkTooBig    = errors.New("message block size exceeded int capacity")
+	errUnknownCipher   = errors.New("unknown cipher")
+	errBadCmpBlk       = errors.New("malformed or corrupt compressed message block")
+	errNoKeyMatch      = errors.New("encryption key does not match")
+	errScrubBlkChanged = errors.New("message block changed while scrubbing")
+	errCmpBlkChanged   = errors.New("message block changed while compressing")
+	errArchBlkChanged  = errors.New("message block changed while archiving")
 )
 
 // Used for marking messages that have had their checksums checked.
@@ -4255,6 +6201,37 @@ func (fs *fileStore) LoadNextMsg(filter string, wc bool, start uint64, sm *Store
 	return nil, fs.state.LastSeq, ErrStoreEOF
 }
 
+// LoadNextMsgMulti will find the next message matching any of the filter subjects starting at the start sequence.
+// The filters are expected to not overlap.
+func (fs *fileStore) LoadNextMsgMulti(filters []string, start uint64, sm *StoreMsg) (*StoreMsg, uint64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if fs.closed {
+		return nil, 0, ErrStoreClosed
+	}
+	if start < fs.state.FirstSeq {
+		start = fs.state.FirstSeq
+	}
+
+	for _, mb := range fs.blks {
+		// Skip blocks that are less than our starting sequence.
+		if start > atomic.LoadUint64(&mb.last.seq) {
+			continue
+		}
+		if sm, expireOk, err := mb.firstMatchingMulti(filters, start, sm); err == nil {
+			if expireOk && mb != fs.lmb {
+				mb.tryForceExpireCache()
+			}
+			return sm, sm.seq, nil
+		} else if err != ErrStoreMsgNotFound {
+			return nil, 0, err
+		}
+	}
+
+	return nil, fs.state.LastSeq, ErrStoreEOF
+}
+
 // Type returns the type of the underlying store.
 func (fs *fileStore) Type() StorageType {
 	return FileStorage
@@ -4284,9 +6261,39 @@ func (fs *fileStore) FastState(state *StreamState) {
 	}
 	state.Consumers = len(fs.cfs)
 	state.NumSubjects = fs.numSubjects()
+	state.ArchivedBytes = fs.archivedBytes()
 	fs.mu.RUnlock()
 }
 
+// Returns how many of our bytes are in archived blocks.
+func (fs *fileStore) archivedBytes() uint64 {
+	return atomic.LoadUint64(&fs.abytes)
+}
+
+// Remove bytes from our block, keeping our store's archived bytes in line.
+// Lock should be held.
+func (mb *msgBlock) removeBytes(n uint64) {
+	mb.bytes -= n
+	mb.updateArchivedBytes()
+}
+
+// Make sure our bytes are counted in our store's archived bytes if we are archived.
+// Lock should be held.
+func (mb *msgBlock) updateArchivedBytes() {
+	if mb.archived {
+		mb.setArchivedBytes(mb.bytes)
+	}
+}
+
+// Set how many of our bytes are counted in our store's archived bytes.
+// Lock should be held.
+func (mb *msgBlock) setArchivedBytes(n uint64) {
+	if n != mb.abytes {
+		atomic.AddUint64(&mb.fs.abytes, n-mb.abytes)
+		mb.abytes = n
+	}
+}
+
 // State returns the current state of the stream.
 func (fs *fileStore) State() StreamState {
 	fs.mu.RLock()
@@ -4319,6 +6326,7 @@ func (fs *fileStore) State() StreamState {
 			mb.mu.Unlock()
 		}
 	}
+	state.ArchivedBytes = fs.archivedBytes()
 	fs.mu.RUnlock()
 
 	state.Lost = fs.lostData()
@@ -4471,8 +6479,17 @@ func (mb *msgBlock) readIndexInfo() error {
 		}
 	}
 
+	// If something is off remove the index file and we will rebuild.
+	if err := mb.parseIndexInfo(buf); err != nil {
+		os.Remove(mb.ifn)
+		return err
+	}
+	return nil
+}
+
+// parseIndexInfo will load the index information for the message block from buf.
+func (mb *msgBlock) parseIndexInfo(buf []byte) error {
 	if err := checkHeader(buf); err != nil {
-		defer os.Remove(mb.ifn)
 		return fmt.Errorf("bad index file")
 	}
 
@@ -4514,13 +6531,11 @@ func (mb *msgBlock) readIndexInfo() error {
 
 	// Check if this is a short write index file.
 	if bi < 0 || bi+checksumSize > len(buf) {
-		os.Remove(mb.ifn)
 		return fmt.Errorf("short index file")
 	}
 
-	// Check for consistency if accounting. If something is off bail and we will rebuild.
+	// Check for consistency if accounting.
 	if mb.msgs != (mb.last.seq-mb.first.seq+1)-dmapLen {
-		os.Remove(mb.ifn)
 		return fmt.Errorf("accounting inconsistent")
 	}
 
@@ -4702,7 +6717,7 @@ func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint
 					fs.state.Msgs--
 					fs.state.Bytes -= rl
 					mb.msgs--
-					mb.bytes -= rl
+					mb.removeBytes(rl)
 					purged++
 				}
 				// FSS updates.
@@ -4783,6 +6798,7 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 
 	fs.blks = nil
 	fs.lmb = nil
+	atomic.StoreUint64(&fs.abytes, 0)
 	fs.bim = make(map[uint32]*msgBlock)
 
 	// Move the msgs directory out of the way, will delete out of band.
@@ -4799,6 +6815,18 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 	// Create new one.
 	os.MkdirAll(mdir, defaultDirPerms)
 
+	// Same for any archived blocks.
+	if fs.fcfg.ArchiveDir != _EMPTY_ {
+		adir := filepath.Join(fs.fcfg.ArchiveDir, msgDir)
+		apdir := filepath.Join(fs.fcfg.ArchiveDir, purgeDir)
+		if _, err := os.Stat(apdir); err == nil {
+			os.RemoveAll(apdir)
+		}
+		if err := os.Rename(adir, apdir); err == nil {
+			go os.RemoveAll(apdir)
+		}
+	}
+
 	// Make sure we have a lmb to write to.
 	if _, err := fs.newMsgBlockForWrite(); err != nil {
 		fs.mu.Unlock()
@@ -4818,6 +6846,8 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 
 	// Clear any per subject tracking.
 	fs.psim = make(map[string]*psi)
+	// Clear any per message TTLs.
+	fs.ttls.reset()
 
 	cb := fs.scb
 	fs.mu.Unlock()
@@ -4895,7 +6925,7 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 		} else if sm != nil {
 			sz := fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
 			if smb.msgs > 0 {
-				smb.bytes -= sz
+				smb.removeBytes(sz)
 				bytes += sz
 				smb.msgs--
 				purged++
@@ -4934,18 +6964,7 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 			nbuf := getMsgBlockBuf(len(buf))
 			nbuf = append(nbuf, buf...)
 			smb.closeFDsLockedNoCheck()
-			// Check for encryption.
-			if smb.bek != nil && len(nbuf) > 0 {
-				// Recreate to reset counter.
-				bek, err := genBlockEncryptionKey(smb.fs.fcfg.Cipher, smb.seed, smb.nonce)
-				if err != nil {
-					goto SKIP
-				}
-				// For future writes make sure to set smb.bek to keep counter correct.
-				smb.bek = bek
-				smb.bek.XORKeyStream(nbuf, nbuf)
-			}
-			if err = os.WriteFile(smb.mfn, nbuf, defaultFilePerms); err != nil {
+			if err = smb.writeBlock(nbuf, smb.cmp); err != nil {
 				goto SKIP
 			}
 			// Make sure to remove fss state.
@@ -5031,10 +7050,13 @@ func (fs *fileStore) reset() error {
 
 	// Reset blocks.
 	fs.blks, fs.lmb = nil, nil
+	atomic.StoreUint64(&fs.abytes, 0)
 
 	// Reset subject mappings.
 	fs.psim = make(map[string]*psi)
 	fs.bim = make(map[uint32]*msgBlock)
+	// Reset per message TTLs.
+	fs.ttls.reset()
 
 	fs.mu.Unlock()
 
@@ -5162,6 +7184,7 @@ func (mb *msgBlock) removePerSubjectInfoLocked() {
 // Will add a new msgBlock.
 // Lock should be held.
 func (fs *fileStore) addMsgBlock(mb *msgBlock) {
+	mb.updateArchivedBytes()
 	fs.blks = append(fs.blks, mb)
 	fs.lmb = mb
 	fs.bim[mb.index] = mb
@@ -5213,7 +7236,7 @@ func (mb *msgBlock) closeAndKeepIndex() {
 
 	// If we are encrypted we should reset our bek counter.
 	if mb.bek != nil {
-		if bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce); err == nil {
+		if bek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce); err == nil {
 			mb.bek = bek
 		}
 	}
@@ -5260,6 +7283,8 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		mb.ifd = nil
 	}
 	if remove {
+		// We no longer count towards our store's archived bytes.
+		mb.setArchivedBytes(0)
 		if mb.ifn != _EMPTY_ {
 			os.Remove(mb.ifn)
 			mb.ifn = _EMPTY_
@@ -5429,7 +7454,22 @@ func (mb *msgBlock) ensurePerSubjectInfoLoaded() error {
 		return nil
 	}
 	// Load from file.
-	return mb.readPerSubjectInfo(true)
+	if err := mb.readPerSubjectInfo(true); err != nil || !mb.fssChk {
+		return err
+	}
+	// We recovered from our subject index, so this has not been checked against our block yet.
+	// Removals do not change our last checksum, so make sure we agree.
+	mb.fssChk = false
+	var fssMsgs uint64
+	for subj, ss := range mb.fss {
+		if len(subj) > 0 {
+			fssMsgs += ss.Msgs
+		}
+	}
+	if fssMsgs != mb.msgs {
+		return mb.generatePerSubjectInfo(true)
+	}
+	return nil
 }
 
 // Called on recovery to populate the global psim state.
@@ -5563,6 +7603,219 @@ func (mb *msgBlock) writePerSubjectInfo() error {
 	return err
 }
 
+// The state of a block our subject index was built from.
+type subjectIndexBlock struct {
+	first uint64
+	last  uint64
+	msgs  uint64
+	lchk  [8]byte
+}
+
+// A persisted snapshot of our global per subject state, loaded on recovery.
+type subjectIndex struct {
+	psim    map[string]*psi
+	blks    map[uint32]subjectIndexBlock
+	matched int
+	stale   bool
+}
+
+// Any change to the subjects held in a block will change its sequences, msgs or last checksum.
+// Lock should be held.
+func (mb *msgBlock) subjectIndexState() subjectIndexBlock {
+	return subjectIndexBlock{mb.first.seq, mb.last.seq, mb.msgs, mb.lchk}
+}
+
+// Copy our global per subject state along with the state of the blocks it reflects,
+// so it can be encoded without holding our lock. Returns nil if we are not tracking any subjects.
+// Lock should be held.
+func (fs *fileStore) snapshotSubjectIndex() *subjectIndex {
+	if len(fs.psim) == 0 {
+		return nil
+	}
+	si := &subjectIndex{
+		psim: make(map[string]*psi, len(fs.psim)),
+		blks: make(map[uint32]subjectIndexBlock, len(fs.blks)),
+	}
+	for subj, info := range fs.psim {
+		si.psim[subj] = &psi{info.total, info.fblk, info.lblk}
+	}
+	// Only blocks holding subjects are checked on recovery.
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.msgs > 0 && !mb.noTrack {
+			si.blks[mb.index] = mb.subjectIndexState()
+		}
+		mb.mu.RUnlock()
+	}
+	return si
+}
+
+// Encode a snapshot of our subject index, see snapshotSubjectIndex.
+func (si *subjectIndex) encode(hh hash.Hash64) []byte {
+	if si == nil {
+		return nil
+	}
+	var scratch [4 * binary.MaxVarintLen64]byte
+	var b bytes.Buffer
+	b.WriteByte(magic)
+	b.WriteByte(version)
+	n := binary.PutUvarint(scratch[0:], uint64(len(si.blks)))
+	b.Write(scratch[0:n])
+	for index, bs := range si.blks {
+		n := binary.PutUvarint(scratch[0:], uint64(index))
+		n += binary.PutUvarint(scratch[n:], bs.first)
+		n += binary.PutUvarint(scratch[n:], bs.last)
+		n += binary.PutUvarint(scratch[n:], bs.msgs)
+		b.Write(scratch[0:n])
+		b.Write(bs.lchk[:])
+	}
+	n = binary.PutUvarint(scratch[0:], uint64(len(si.psim)))
+	b.Write(scratch[0:n])
+	for subj, info := range si.psim {
+		n := binary.PutUvarint(scratch[0:], uint64(len(subj)))
+		b.Write(scratch[0:n])
+		b.WriteString(subj)
+		n = binary.PutUvarint(scratch[0:], info.total)
+		n += binary.PutUvarint(scratch[n:], uint64(info.fblk))
+		n += binary.PutUvarint(scratch[n:], uint64(info.lblk))
+		b.Write(scratch[0:n])
+	}
+	hh.Write(b.Bytes())
+	b.Write(hh.Sum(nil))
+	return b.Bytes()
+}
+
+// We do not use our shared hash since we may only hold the read lock.
+func (fs *fileStore) subjectIndexHash() hash.Hash64 {
+	key := sha256.Sum256([]byte(fs.cfg.Name))
+	hh, _ := highwayhash.New64(key[:])
+	return hh
+}
+
+// Write out our encoded subject index, or remove any stale one if we have nothing to write.
+func (fs *fileStore) writeSubjectIndex(buf []byte) error {
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, subjectIndexFile)
+	if len(buf) == 0 {
+		os.Remove(fn)
+		return nil
+	}
+	<-dios
+	err := writeFilesAtomic([]string{fn}, [][]byte{buf})
+	dios <- struct{}{}
+	return err
+}
+
+// Persist our subject index in the background.
+// Once closed the final write is done when stopping.
+func (fs *fileStore) persistSubjectIndex() {
+	fs.sidxMu.Lock()
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		fs.sidxMu.Unlock()
+		return
+	}
+	si, hh := fs.snapshotSubjectIndex(), fs.subjectIndexHash()
+	fs.mu.RUnlock()
+	fs.writeSubjectIndex(si.encode(hh))
+	fs.sidxMu.Unlock()
+
+	fs.mu.Lock()
+	if !fs.closed && fs.fcfg.SubjectIndexInterval > 0 {
+		fs.sidxTmr = time.AfterFunc(fs.fcfg.SubjectIndexInterval, fs.persistSubjectIndex)
+	}
+	fs.mu.Unlock()
+}
+
+// Load our persisted subject index on recovery. This is only trusted once, so the
+// file is removed and will be written again on shutdown or by our timer.
+// Lock should be held.
+func (fs *fileStore) loadSubjectIndex() *subjectIndex {
+	fn := filepath.Join(fs.fcfg.StoreDir, msgDir, subjectIndexFile)
+	os.Remove(rotFile(fn))
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	os.Remove(fn)
+
+	if len(buf) < hdrLen+checksumSize || checkHeader(buf) != nil {
+		return nil
+	}
+	hh := fs.subjectIndexHash()
+	hh.Write(buf[:len(buf)-checksumSize])
+	if !bytes.Equal(hh.Sum(nil), buf[len(buf)-checksumSize:]) {
+		return nil
+	}
+	buf = buf[:len(buf)-checksumSize]
+
+	bi := hdrLen
+	readU64 := func() uint64 {
+		if bi < 0 || bi >= len(buf) {
+			bi = -1
+			return 0
+		}
+		num, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return num
+	}
+
+	numBlks := readU64()
+	si := &subjectIndex{blks: make(map[uint32]subjectIndexBlock, numBlks)}
+	for i := uint64(0); i < numBlks && bi >= 0; i++ {
+		index := uint32(readU64())
+		bs := subjectIndexBlock{first: readU64(), last: readU64(), msgs: readU64()}
+		if bi < 0 || bi+len(bs.lchk) > len(buf) {
+			return nil
+		}
+		bi += copy(bs.lchk[:], buf[bi:])
+		si.blks[index] = bs
+	}
+	numSubjects := readU64()
+	si.psim = make(map[string]*psi, numSubjects)
+	for i := uint64(0); i < numSubjects && bi >= 0; i++ {
+		lsubj := int(readU64())
+		if bi < 0 || bi+lsubj > len(buf) {
+			return nil
+		}
+		subj := string(buf[bi : bi+lsubj])
+		bi += lsubj
+		total, fblk, lblk := readU64(), readU64(), readU64()
+		si.psim[subj] = &psi{total: total, fblk: uint32(fblk), lblk: uint32(lblk)}
+	}
+	if bi != len(buf) {
+		return nil
+	}
+	return si
+}
+
+// Checks our subject index on recovery, returning true if it covers this block.
+// Once stale we will rebuild all per subject state from our blocks after recovering them.
+// Lock should be held.
+func (fs *fileStore) checkSubjectIndex(mb *msgBlock) bool {
+	si := fs.sidx
+	if si == nil {
+		return false
+	}
+	if bs, ok := si.blks[mb.index]; ok && bs == mb.subjectIndexState() {
+		si.matched++
+	} else {
+		si.stale = true
+	}
+	return true
+}
+
+// Returns how long it took to recover our state and whether our persisted subject index was used.
+func (fs *fileStore) recoveryState() (time.Duration, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.rtime, fs.rsidx
+}
+
 // Close the message block.
 func (mb *msgBlock) close(sync bool) {
 	if mb == nil {
@@ -5618,6 +7871,9 @@ func (fs *fileStore) closeAllMsgBlocks(sync bool) {
 func (fs *fileStore) Delete() error {
 	if fs.isClosed() {
 		// Always attempt to remove since we could have been closed beforehand.
+		if fs.fcfg.ArchiveDir != _EMPTY_ {
+			os.RemoveAll(fs.fcfg.ArchiveDir)
+		}
 		os.RemoveAll(fs.fcfg.StoreDir)
 		return ErrStoreClosed
 	}
@@ -5634,6 +7890,9 @@ func (fs *fileStore) Delete() error {
 		return err
 	}
 
+	if fs.fcfg.ArchiveDir != _EMPTY_ {
+		os.RemoveAll(fs.fcfg.ArchiveDir)
+	}
 	err := os.RemoveAll(fs.fcfg.StoreDir)
 	if err == nil {
 		return nil
@@ -5656,6 +7915,38 @@ func (fs *fileStore) cancelSyncTimer() {
 	}
 }
 
+// Lock should be held.
+func (fs *fileStore) cancelScrubTimer() {
+	if fs.scrubTmr != nil {
+		fs.scrubTmr.Stop()
+		fs.scrubTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelCompactTimer() {
+	if fs.cmpctTmr != nil {
+		fs.cmpctTmr.Stop()
+		fs.cmpctTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelArchiveTimer() {
+	if fs.archTmr != nil {
+		fs.archTmr.Stop()
+		fs.archTmr = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelSubjectIndexTimer() {
+	if fs.sidxTmr != nil {
+		fs.sidxTmr.Stop()
+		fs.sidxTmr = nil
+	}
+}
+
 func (fs *fileStore) Stop() error {
 	fs.mu.Lock()
 	if fs.closed {
@@ -5669,13 +7960,31 @@ func (fs *fileStore) Stop() error {
 	fs.closeAllMsgBlocks(false)
 
 	fs.cancelSyncTimer()
+	fs.cancelScrubTimer()
+	fs.cancelCompactTimer()
+	fs.cancelArchiveTimer()
+	fs.cancelSubjectIndexTimer()
 	fs.cancelAgeChk()
+	fs.cancelTTLChk()
+
+	// Our blocks are in sync so persist our TTL index to speed up recovery.
+	tbuf := fs.encodeTTLIndex()
 
 	var _cfs [256]ConsumerStore
 	cfs := append(_cfs[:0], fs.cfs...)
 	fs.cfs = nil
 	fs.mu.Unlock()
 
+	fs.writeTTLIndex(tbuf)
+
+	// Our blocks are in sync so persist our subject index to speed up recovery.
+	fs.sidxMu.Lock()
+	fs.mu.RLock()
+	si, hh := fs.snapshotSubjectIndex(), fs.subjectIndexHash()
+	fs.mu.RUnlock()
+	fs.writeSubjectIndex(si.encode(hh))
+	fs.sidxMu.Unlock()
+
 	for _, o := range cfs {
 		o.Stop()
 	}
@@ -5792,7 +8101,7 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 		}
 		// Check for encryption.
 		if mb.bek != nil && len(bbuf) > 0 {
-			rbek, err := genBlockEncryptionKey(fs.fcfg.Cipher, mb.seed, mb.nonce)
+			rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 			if err != nil {
 				mb.mu.Unlock()
 				writeErr(fmt.Sprintf("Could not create encryption key for message block [%d]: %v", mb.index, err))
@@ -5975,34 +8284,30 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 
 	// Check for encryption.
 	if o.prf != nil {
-		if ekey, err := os.ReadFile(filepath.Join(odir, JetStreamMetaFileKey)); err == nil {
+		keyFile := filepath.Join(odir, JetStreamMetaFileKey)
+		// Finish or discard any key rotation that was interrupted.
+		recoverFilesAtomic(filepath.Join(odir, JetStreamMetaFile), filepath.Join(odir, JetStreamMetaFileSum), o.ifn, keyFile)
+		if ekey, err := os.ReadFile(keyFile); err == nil {
 			if len(ekey) < minBlkKeySize {
 				return nil, errBadKeySize
 			}
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fs.cfg.Name + tsep + o.name))
-			if err != nil {
-				return nil, err
-			}
-
-			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
+			prf, oldprf, sc := fs.keyGens()
+			seed, _, osc, old, err := openKeyFile(prf, oldprf, sc, fs.cfg.Name+tsep+o.name, ekey)
 			if err != nil {
 				return nil, err
 			}
-			ns := kek.NonceSize()
-			nonce := ekey[:ns]
-			seed, err := kek.Open(nil, nonce, ekey[ns:], nil)
-			if err != nil {
-				// We may be here on a cipher conversion, so attempt to convert.
+			if osc != sc && !old {
+				// We are here on a cipher conversion, so convert.
 				if err = o.convertCipher(); err != nil {
 					return nil, err
 				}
-			} else {
-				o.aek, err = genEncryptionKey(sc, seed)
-			}
-			if err != nil {
+			} else if o.aek, err = genEncryptionKey(osc, seed); err != nil {
 				return nil, err
+			} else if old {
+				// Still using our previous key, so rewrite with our current one.
+				if err = o.rotateFromOldKey(prf, sc); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -6113,6 +8418,95 @@ func (o *consumerFileStore) convertCipher() error {
 	return o.writeState(buf)
 }
 
+// Rewrite our meta data and state that are still encrypted with our previous key.
+func (o *consumerFileStore) rotateFromOldKey(prf keyGen, sc StoreCipher) error {
+	open := func(fn string) ([]byte, error) {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return nil, err
+		}
+		ns := o.aek.NonceSize()
+		if len(buf) < ns {
+			return nil, errCorruptState
+		}
+		return o.aek.Open(nil, buf[:ns], buf[ns:], nil)
+	}
+	meta, err := open(filepath.Join(o.odir, JetStreamMetaFile))
+	if err != nil {
+		return err
+	}
+	state, err := open(o.ifn)
+	if err != nil {
+		return err
+	}
+	return o.writeRotatedKeys(prf, sc, meta, state)
+}
+
+// Rotate to a new key and cipher, rewriting our meta data and state.
+func (o *consumerFileStore) rotateEncryption(prf keyGen, sc StoreCipher) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Any state write in flight would be using our current key.
+	for o.writing && !o.closed {
+		o.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		o.mu.Lock()
+	}
+	if o.closed || o.prf == nil {
+		return nil
+	}
+	meta, err := json.Marshal(o.cfg)
+	if err != nil {
+		return err
+	}
+	// Our state on disk may be all we have, any newer state will be written with our new key.
+	state, err := os.ReadFile(o.ifn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(state) > 0 && o.aek != nil {
+		ns := o.aek.NonceSize()
+		if state, err = o.aek.Open(nil, state[:ns], state[ns:], nil); err != nil {
+			return err
+		}
+	}
+	return o.writeRotatedKeys(prf, sc, meta, state)
+}
+
+// Write out our meta data and state with new keys, replacing all files at once.
+// Lock should be held.
+func (o *consumerFileStore) writeRotatedKeys(prf keyGen, sc StoreCipher, meta, state []byte) error {
+	aek, _, _, encrypted, err := genEncryptionKeys(prf, sc, o.fs.cfg.Name+tsep+o.name)
+	if err != nil {
+		return err
+	}
+	seal := func(buf []byte) []byte {
+		nonce := make([]byte, aek.NonceSize(), aek.NonceSize()+len(buf)+aek.Overhead())
+		mrand.Read(nonce)
+		return aek.Seal(nonce, nonce, buf, nil)
+	}
+	b := seal(meta)
+	o.hh.Reset()
+	o.hh.Write(b)
+	checksum := hex.EncodeToString(o.hh.Sum(nil))
+
+	fns := []string{filepath.Join(o.odir, JetStreamMetaFile), filepath.Join(o.odir, JetStreamMetaFileSum)}
+	bufs := [][]byte{b, []byte(checksum)}
+	if len(state) > 0 {
+		fns, bufs = append(fns, o.ifn), append(bufs, seal(state))
+	}
+	fns, bufs = append(fns, filepath.Join(o.odir, JetStreamMetaFileKey)), append(bufs, encrypted)
+	if err := writeFilesAtomic(fns, bufs); err != nil {
+		return err
+	}
+	o.prf, o.aek = prf, aek
+	return nil
+}
+
 // Kick flusher for this consumer.
 // Lock should be held.
 func (o *consumerFileStore) kickFlusher() {
@@ -0,0 +1,565 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/highwayhash"
+)
+
+// Information about a single message block gathered while inspecting a stream directory.
+type blockInspect struct {
+	mb *msgBlock
+	// Size of the block file on disk.
+	size int64
+	// Error loading the index file, if any.
+	ierr error
+	// State as found in the message records.
+	first, last msgId
+	msgs, bytes uint64
+	deleted     []uint64
+	bad         []uint64
+	subjects    map[string]uint64
+	// Offset in the plaintext block of a torn write at the end, -1 if none.
+	torn int
+	// Offset in the plaintext block of unreadable records in a sealed block, -1 if none.
+	damaged int
+	// Plaintext length of the block.
+	plen int
+}
+
+// InspectStreamStore opens the stream directory in opts.InspectStore while the server is not running and
+// writes a report of its message blocks, sequences, subjects, deleted messages and consumers to w.
+// Nothing is modified unless opts.InspectTruncate or opts.InspectRebuildIndex are set, in which case
+// a torn write at the end of the last block is truncated and the block index files are rewritten.
+// Damaged records in earlier blocks are only reported.
+func InspectStreamStore(opts *Options, w io.Writer) error {
+	dir := opts.InspectStore
+	if fi, err := os.Stat(filepath.Join(dir, msgDir)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%q is not a stream directory", dir)
+	}
+	// Layout is <store_dir>/jetstream/<account>/streams/<stream>.
+	name, acc := filepath.Base(dir), filepath.Base(filepath.Dir(filepath.Dir(dir)))
+	prf, oldprf := jsKeyGen(opts.JetStreamKey, acc), jsKeyGen(opts.JetStreamOldKey, acc)
+
+	buf, aek, err := readInspectMeta(dir, name, prf, oldprf, opts.JetStreamCipher)
+	if err != nil {
+		return fmt.Errorf("could not read stream meta: %v", err)
+	}
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return fmt.Errorf("could not decode stream meta: %v", err)
+	}
+
+	fs := &fileStore{
+		fcfg:   FileStoreConfig{StoreDir: dir, Cipher: opts.JetStreamCipher},
+		cfg:    cfg,
+		prf:    prf,
+		oldprf: oldprf,
+	}
+	if aek == nil {
+		fs.prf, fs.oldprf = nil, nil
+	}
+
+	fmt.Fprintf(w, "Stream:       %s (account %q)\n", cfg.Name, acc)
+	fmt.Fprintf(w, "Created:      %s\n", cfg.Created.Format(time.RFC3339))
+	fmt.Fprintf(w, "Subjects:     %s\n", strings.Join(cfg.Subjects, ", "))
+	fmt.Fprintf(w, "Encrypted:    %v\n", aek != nil)
+
+	// Find our block files, including any that have been archived.
+	mfns := make(map[uint32]string)
+	scanBlocks := func(mdir string) error {
+		fis, err := os.ReadDir(mdir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			var index uint32
+			if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+				mfns[index] = filepath.Join(mdir, fi.Name())
+			}
+		}
+		return nil
+	}
+	if opts.JetStreamArchiveDir != _EMPTY_ {
+		fs.fcfg.ArchiveDir = filepath.Join(opts.JetStreamArchiveDir, JetStreamStoreDir, acc, streamsDir, name)
+		if err := scanBlocks(filepath.Join(fs.fcfg.ArchiveDir, msgDir)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Our local copy wins if we were interrupted while archiving.
+	if err := scanBlocks(filepath.Join(dir, msgDir)); err != nil {
+		return err
+	}
+	indexes := make([]uint32, 0, len(mfns))
+	for index := range mfns {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var blks []*blockInspect
+	for _, index := range indexes {
+		bi, err := fs.inspectBlock(index, mfns[index])
+		if err != nil {
+			return fmt.Errorf("could not inspect block %d: %v", index, err)
+		}
+		blks = append(blks, bi)
+	}
+	// Only the last block can have a torn write, anything unreadable before that is corruption
+	// and the records that follow it are still there.
+	for i := 0; i < len(blks)-1; i++ {
+		if bi := blks[i]; bi.torn >= 0 {
+			bi.damaged, bi.torn = bi.torn, -1
+		}
+	}
+
+	fmt.Fprintf(w, "\nBlocks:\n")
+	var state StreamState
+	subjects := make(map[string]uint64)
+	for _, bi := range blks {
+		mb := bi.mb
+		fmt.Fprintf(w, "  %s  size %s  compression %s  archived %v\n", filepath.Base(mb.mfn), friendlyBytes(bi.size), mb.cmp, mb.archived)
+		if bi.ierr != nil {
+			fmt.Fprintf(w, "    index:      %v\n", bi.ierr)
+		} else {
+			fmt.Fprintf(w, "    index:      seqs [%d, %d]  msgs %d  bytes %d  deleted %d\n",
+				mb.first.seq, mb.last.seq, mb.msgs, mb.bytes, len(mb.dmap))
+		}
+		fmt.Fprintf(w, "    records:    seqs [%d, %d]  msgs %d  bytes %d\n", bi.first.seq, bi.last.seq, bi.msgs, bi.bytes)
+		if len(bi.deleted) > 0 {
+			fmt.Fprintf(w, "    deleted:    %d %s\n", len(bi.deleted), seqRangesString(bi.deleted))
+		}
+		if len(bi.bad) > 0 {
+			fmt.Fprintf(w, "    corrupt:    %d %s\n", len(bi.bad), seqRangesString(bi.bad))
+		}
+		if bi.torn >= 0 {
+			fmt.Fprintf(w, "    torn tail:  %d bytes at offset %d\n", bi.plen-bi.torn, bi.torn)
+		}
+		if bi.damaged >= 0 {
+			fmt.Fprintf(w, "    unreadable: %d bytes at offset %d\n", bi.plen-bi.damaged, bi.damaged)
+		}
+		if bi.ierr == nil && (mb.msgs != bi.msgs || mb.last.seq != bi.last.seq) {
+			fmt.Fprintf(w, "    index does not match records\n")
+		}
+
+		if bi.msgs > 0 {
+			if state.FirstSeq == 0 {
+				state.FirstSeq, state.FirstTime = bi.first.seq, time.Unix(0, bi.first.ts).UTC()
+			}
+			state.Msgs += bi.msgs
+			state.Bytes += bi.bytes
+		}
+		if bi.last.seq > state.LastSeq {
+			state.LastSeq, state.LastTime = bi.last.seq, time.Unix(0, bi.last.ts).UTC()
+		}
+		state.NumDeleted += len(bi.deleted)
+		for subj, n := range bi.subjects {
+			subjects[subj] += n
+		}
+	}
+
+	fmt.Fprintf(w, "\nState:\n")
+	fmt.Fprintf(w, "  msgs %d  bytes %d  seqs [%d, %d]  deleted %d  subjects %d\n",
+		state.Msgs, state.Bytes, state.FirstSeq, state.LastSeq, state.NumDeleted, len(subjects))
+	if state.Msgs > 0 {
+		fmt.Fprintf(w, "  first %s  last %s\n", state.FirstTime.Format(time.RFC3339), state.LastTime.Format(time.RFC3339))
+	}
+
+	if len(subjects) > 0 {
+		fmt.Fprintf(w, "\nSubjects:\n")
+		subjs := make([]string, 0, len(subjects))
+		for subj := range subjects {
+			subjs = append(subjs, subj)
+		}
+		sort.Strings(subjs)
+		for _, subj := range subjs {
+			fmt.Fprintf(w, "  %s  %d\n", subj, subjects[subj])
+		}
+	}
+
+	if err := inspectConsumers(w, dir, name, prf, oldprf, opts.JetStreamCipher); err != nil {
+		return err
+	}
+
+	if !opts.InspectTruncate && !opts.InspectRebuildIndex {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\nRepairs:\n")
+	for _, bi := range blks {
+		mb := bi.mb
+		// We can not tell what follows damage in a sealed block, so leave it for the server to recover.
+		if bi.damaged >= 0 {
+			fmt.Fprintf(w, "  %s  unreadable records at offset %d, left unchanged\n", filepath.Base(mb.mfn), bi.damaged)
+			continue
+		}
+		truncate := opts.InspectTruncate && bi.torn >= 0
+		if truncate {
+			if err := bi.truncateTail(); err != nil {
+				return fmt.Errorf("could not truncate block %d: %v", mb.index, err)
+			}
+			fmt.Fprintf(w, "  %s  truncated to %d bytes\n", filepath.Base(mb.mfn), bi.plen)
+		}
+		// A truncated block always needs its index to match.
+		if truncate || opts.InspectRebuildIndex {
+			if err := bi.rebuildIndex(); err != nil {
+				return fmt.Errorf("could not rebuild index for block %d: %v", mb.index, err)
+			}
+			fmt.Fprintf(w, "  %s  index rebuilt\n", filepath.Base(mb.mfn))
+			if !truncate && bi.torn >= 0 {
+				fmt.Fprintf(w, "  %s  torn tail remains, the server will rebuild this block on startup\n", filepath.Base(mb.mfn))
+			}
+		}
+	}
+	return nil
+}
+
+// Read a meta file from dir, decrypting it if we find a key file.
+// Returns the plaintext and the key used, if any.
+func readInspectMeta(dir, context string, prf, oldprf keyGen, sc StoreCipher) ([]byte, cipher.AEAD, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	ekey, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFileKey))
+	if os.IsNotExist(err) {
+		return buf, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if prf == nil && oldprf == nil {
+		return nil, nil, errors.New("encrypted, a configuration with the encryption key is required")
+	}
+	aek, err := inspectMetaKey(prf, oldprf, sc, context, ekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns := aek.NonceSize()
+	if len(buf) < ns {
+		return nil, nil, errBadKeySize
+	}
+	if buf, err = aek.Open(nil, buf[:ns], buf[ns:], nil); err != nil {
+		return nil, nil, err
+	}
+	return buf, aek, nil
+}
+
+// Recover the key used to seal a meta file and any state along with it.
+func inspectMetaKey(prf, oldprf keyGen, sc StoreCipher, context string, ekey []byte) (cipher.AEAD, error) {
+	seed, _, osc, _, err := openKeyFile(prf, oldprf, sc, context, ekey)
+	if err != nil {
+		return nil, err
+	}
+	return genEncryptionKey(osc, seed)
+}
+
+// Walk all the records of a message block without loading it into a store.
+func (fs *fileStore) inspectBlock(index uint32, mfn string) (*blockInspect, error) {
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	mb := &msgBlock{
+		fs:       fs,
+		index:    index,
+		mfn:      mfn,
+		ifn:      filepath.Join(mdir, fmt.Sprintf(indexScan, index)),
+		sfn:      filepath.Join(mdir, fmt.Sprintf(fssScan, index)),
+		archived: filepath.Dir(mfn) != mdir,
+	}
+	key := sha256.Sum256(fs.hashKeyForBlock(index))
+	mb.hh, _ = highwayhash.New64(key[:])
+
+	if fs.prf != nil {
+		ekey, err := os.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, index)))
+		if err != nil {
+			return nil, err
+		}
+		seed, nonce, sc, _, err := fs.openKeyFile(fmt.Sprintf("%s:%d", fs.cfg.Name, index), ekey)
+		if err != nil {
+			return nil, err
+		}
+		mb.seed, mb.nonce, mb.sc = seed, nonce, sc
+		if mb.aek, err = genEncryptionKey(sc, seed); err != nil {
+			return nil, err
+		}
+		if mb.bek, err = genBlockEncryptionKey(sc, seed, nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	bi := &blockInspect{mb: mb, torn: -1, damaged: -1, subjects: make(map[string]uint64)}
+
+	// Index information, which we only read here.
+	if buf, err := os.ReadFile(mb.ifn); err != nil {
+		bi.ierr = err
+	} else {
+		mb.liwsz = int64(len(buf))
+		if mb.aek != nil {
+			buf, err = mb.aek.Open(buf[:0], mb.nonce, buf, nil)
+		}
+		if err == nil {
+			err = mb.parseIndexInfo(buf)
+		}
+		if bi.ierr = err; err != nil {
+			mb.msgs, mb.bytes, mb.first, mb.last, mb.dmap = 0, 0, msgId{}, msgId{}, nil
+		}
+	}
+
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return nil, err
+	}
+	bi.size = int64(len(buf))
+	if mb.bek != nil && len(buf) > 0 {
+		mb.bek.XORKeyStream(buf, buf)
+	}
+	if buf, mb.cmp, err = decompressBlock(buf); err != nil {
+		return nil, err
+	}
+	bi.plen = len(buf)
+
+	var le = binary.LittleEndian
+	// End of the last record we know is good, anything damaged after this is a torn write.
+	var goodEnd, tornBad int
+	for index := 0; index < len(buf); {
+		rl, seq, erased, ok := parseMsgRecord(buf, index)
+		if !ok {
+			break
+		}
+		rec := buf[index : index+rl]
+		index += rl
+
+		if seq == 0 {
+			continue
+		}
+		if !erased && !mb.checkMsgRecord(rec) {
+			bi.bad = append(bi.bad, seq)
+			tornBad++
+			continue
+		}
+		goodEnd, tornBad = index, 0
+		ts := int64(le.Uint64(rec[12:]))
+		if seq > bi.last.seq {
+			bi.last = msgId{seq, ts}
+		}
+
+		// Messages removed at the head or through the delete map are only tracked in the index.
+		_, deleted := mb.dmap[seq]
+		if erased || deleted || seq < mb.first.seq {
+			bi.deleted = append(bi.deleted, seq)
+			continue
+		}
+		if bi.first.seq == 0 {
+			bi.first = msgId{seq, ts}
+		}
+		bi.msgs++
+		bi.bytes += uint64(rl)
+		if slen := int(le.Uint16(rec[20:])); slen > 0 {
+			bi.subjects[string(rec[msgHdrSize:msgHdrSize+slen])]++
+		}
+	}
+	if goodEnd < len(buf) {
+		// Damaged records in the torn write are not counted as corrupt.
+		bi.torn, bi.bad = goodEnd, bi.bad[:len(bi.bad)-tornBad]
+	}
+	return bi, nil
+}
+
+// Truncate a torn write at the end of our block.
+func (bi *blockInspect) truncateTail() error {
+	mb := bi.mb
+	// Our key stream is positional, so uncompressed blocks can be truncated in place.
+	if mb.cmp == NoCompression {
+		if err := os.Truncate(mb.mfn, int64(bi.torn)); err != nil {
+			return err
+		}
+	} else {
+		buf, err := mb.loadPlaintextBlock()
+		if err != nil {
+			return err
+		}
+		err = mb.writeBlock(buf[:bi.torn], mb.cmp)
+		recycleMsgBlockBuf(buf)
+		if err != nil {
+			return err
+		}
+	}
+	bi.plen = bi.torn
+	bi.torn = -1
+	return nil
+}
+
+// Rewrite the index file for our block from what we found in the records.
+func (bi *blockInspect) rebuildIndex() error {
+	mb := bi.mb
+	buf, err := mb.loadPlaintextBlock()
+	if err != nil {
+		return err
+	}
+	defer recycleMsgBlockBuf(buf)
+	if bi.torn >= 0 {
+		buf = buf[:bi.torn]
+	}
+	// Recompute from the records that remain.
+	var le = binary.LittleEndian
+	var first, last msgId
+	var msgs, bytes uint64
+	dmap := make(map[uint64]struct{})
+	for index := 0; index < len(buf); {
+		rl, seq, erased, ok := parseMsgRecord(buf, index)
+		if !ok {
+			break
+		}
+		rec := buf[index : index+rl]
+		index += rl
+		if seq == 0 {
+			continue
+		}
+		last = msgId{seq, int64(le.Uint64(rec[12:]))}
+		if seq < mb.first.seq {
+			continue
+		}
+		if _, deleted := mb.dmap[seq]; erased || deleted {
+			dmap[seq] = struct{}{}
+			continue
+		}
+		if first.seq == 0 {
+			first = last
+		}
+		msgs++
+		bytes += uint64(rl)
+	}
+	if first.seq == 0 {
+		first = msgId{last.seq + 1, 0}
+	}
+	// Only sequences within our range belong in the delete map.
+	for seq := range dmap {
+		if seq < first.seq {
+			delete(dmap, seq)
+		}
+	}
+	mb.first, mb.last, mb.msgs, mb.bytes, mb.dmap = first, last, msgs, bytes, dmap
+	if len(buf) >= checksumSize {
+		copy(mb.lchk[0:], buf[len(buf)-checksumSize:])
+	} else {
+		mb.lchk = [8]byte{}
+	}
+	if err := mb.writeIndexInfoLocked(); err != nil {
+		return err
+	}
+	mb.closeFDsLockedNoCheck()
+	// Our per subject information will be regenerated when loaded.
+	os.Remove(mb.sfn)
+	return nil
+}
+
+// Write out the configuration and state of all consumers of the stream in dir.
+func inspectConsumers(w io.Writer, dir, stream string, prf, oldprf keyGen, sc StoreCipher) error {
+	odir := filepath.Join(dir, consumerDir)
+	fis, err := os.ReadDir(odir)
+	if os.IsNotExist(err) || len(fis) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nConsumers:\n")
+	for _, fi := range fis {
+		name := fi.Name()
+		cdir := filepath.Join(odir, name)
+		buf, aek, err := readInspectMeta(cdir, stream+tsep+name, prf, oldprf, sc)
+		if err != nil {
+			fmt.Fprintf(w, "  %s  could not read meta: %v\n", name, err)
+			continue
+		}
+		var cfg FileConsumerInfo
+		if err := json.Unmarshal(buf, &cfg); err != nil {
+			fmt.Fprintf(w, "  %s  could not decode meta: %v\n", name, err)
+			continue
+		}
+		kind := "ephemeral"
+		if cfg.Durable != _EMPTY_ {
+			kind = "durable"
+		}
+		if len(cfg.FilterSubjects) > 0 {
+			fmt.Fprintf(w, "  %s  %s  ack %s  filters %q\n", name, kind, cfg.AckPolicy, cfg.FilterSubjects)
+		} else {
+			fmt.Fprintf(w, "  %s  %s  ack %s  filter %q\n", name, kind, cfg.AckPolicy, cfg.FilterSubject)
+		}
+
+		state, err := readInspectConsumerState(filepath.Join(cdir, consumerState), aek)
+		if err != nil {
+			fmt.Fprintf(w, "    state:      %v\n", err)
+			continue
+		} else if state == nil {
+			continue
+		}
+		fmt.Fprintf(w, "    delivered:  consumer %d  stream %d\n", state.Delivered.Consumer, state.Delivered.Stream)
+		fmt.Fprintf(w, "    ack floor:  consumer %d  stream %d\n", state.AckFloor.Consumer, state.AckFloor.Stream)
+		fmt.Fprintf(w, "    pending %d  redelivered %d\n", len(state.Pending), len(state.Redelivered))
+	}
+	return nil
+}
+
+// Read a consumer state file, returns nil if there is none.
+func readInspectConsumerState(fn string, aek cipher.AEAD) (*ConsumerState, error) {
+	buf, err := os.ReadFile(fn)
+	if os.IsNotExist(err) || err == nil && len(buf) == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if aek != nil {
+		ns := aek.NonceSize()
+		if len(buf) < ns {
+			return nil, errCorruptState
+		}
+		if buf, err = aek.Open(nil, buf[:ns], buf[ns:], nil); err != nil {
+			return nil, err
+		}
+	}
+	return decodeConsumerState(buf)
+}
+
+// Format a sorted list of sequences as compact ranges.
+func seqRangesString(seqs []uint64) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		if i == j {
+			fmt.Fprintf(&sb, "%d", seqs[i])
+		} else {
+			fmt.Fprintf(&sb, "%d-%d", seqs[i], seqs[j])
+		}
+		i = j + 1
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
@@ -49,105 +49,6 @@ func testFileStoreAllPermutations(t *testing.T, fn func(t *testing.T, fcfg FileS
 	}
 }
 
-func TestFileStoreBasics(t *testing.T) {
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		subj, msg := "foo", []byte("Hello World")
-		now := time.Now().UnixNano()
-		for i := 1; i <= 5; i++ {
-			if seq, ts, err := fs.StoreMsg(subj, nil, msg); err != nil {
-				t.Fatalf("Error storing msg: %v", err)
-			} else if seq != uint64(i) {
-				t.Fatalf("Expected sequence to be %d, got %d", i, seq)
-			} else if ts < now || ts > now+int64(time.Millisecond) {
-				t.Fatalf("Expected timestamp to be current, got %v", ts-now)
-			}
-		}
-
-		state := fs.State()
-		if state.Msgs != 5 {
-			t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
-		}
-		expectedSize := 5 * fileStoreMsgSize(subj, nil, msg)
-		if state.Bytes != expectedSize {
-			t.Fatalf("Expected %d bytes, got %d", expectedSize, state.Bytes)
-		}
-
-		var smv StoreMsg
-		sm, err := fs.LoadMsg(2, &smv)
-		if err != nil {
-			t.Fatalf("Unexpected error looking up msg: %v", err)
-		}
-		if sm.subj != subj {
-			t.Fatalf("Subjects don't match, original %q vs %q", subj, sm.subj)
-		}
-		if !bytes.Equal(sm.msg, msg) {
-			t.Fatalf("Msgs don't match, original %q vs %q", msg, sm.msg)
-		}
-		_, err = fs.LoadMsg(3, nil)
-		if err != nil {
-			t.Fatalf("Unexpected error looking up msg: %v", err)
-		}
-
-		remove := func(seq, expectedMsgs uint64) {
-			t.Helper()
-			removed, err := fs.RemoveMsg(seq)
-			if err != nil {
-				t.Fatalf("Got an error on remove of %d: %v", seq, err)
-			}
-			if !removed {
-				t.Fatalf("Expected remove to return true for %d", seq)
-			}
-			if state := fs.State(); state.Msgs != expectedMsgs {
-				t.Fatalf("Expected %d msgs, got %d", expectedMsgs, state.Msgs)
-			}
-		}
-
-		// Remove first
-		remove(1, 4)
-		// Remove last
-		remove(5, 3)
-		// Remove a middle
-		remove(3, 2)
-	})
-}
-
-func TestFileStoreMsgHeaders(t *testing.T) {
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		subj, hdr, msg := "foo", []byte("name:derek"), []byte("Hello World")
-		elen := 22 + len(subj) + 4 + len(hdr) + len(msg) + 8
-		if sz := int(fileStoreMsgSize(subj, hdr, msg)); sz != elen {
-			t.Fatalf("Wrong size for stored msg with header")
-		}
-		fs.StoreMsg(subj, hdr, msg)
-		var smv StoreMsg
-		sm, err := fs.LoadMsg(1, &smv)
-		if err != nil {
-			t.Fatalf("Unexpected error looking up msg: %v", err)
-		}
-		if !bytes.Equal(msg, sm.msg) {
-			t.Fatalf("Expected same msg, got %q vs %q", sm.msg, msg)
-		}
-		if !bytes.Equal(hdr, sm.hdr) {
-			t.Fatalf("Expected same hdr, got %q vs %q", sm.hdr, hdr)
-		}
-		if removed, _ := fs.EraseMsg(1); !removed {
-			t.Fatalf("Expected erase msg to return success")
-		}
-	})
-}
-
 func TestFileStoreBasicWriteMsgsAndRestore(t *testing.T) {
 	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
 		if _, err := newFileStore(fcfg, StreamConfig{Storage: MemoryStorage}); err == nil {
@@ -474,42 +375,6 @@ func TestFileStoreWriteExpireWrite(t *testing.T) {
 	})
 }
 
-func TestFileStoreMsgLimit(t *testing.T) {
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage, MaxMsgs: 10})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		subj, msg := "foo", []byte("Hello World")
-		for i := 0; i < 10; i++ {
-			fs.StoreMsg(subj, nil, msg)
-		}
-		state := fs.State()
-		if state.Msgs != 10 {
-			t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
-		}
-		if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
-			t.Fatalf("Error storing msg: %v", err)
-		}
-		state = fs.State()
-		if state.Msgs != 10 {
-			t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
-		}
-		if state.LastSeq != 11 {
-			t.Fatalf("Expected the last sequence to be 11 now, but got %d", state.LastSeq)
-		}
-		if state.FirstSeq != 2 {
-			t.Fatalf("Expected the first sequence to be 2 now, but got %d", state.FirstSeq)
-		}
-		// Make sure we can not lookup seq 1.
-		if _, err := fs.LoadMsg(1, nil); err == nil {
-			t.Fatalf("Expected error looking up seq 1 but got none")
-		}
-	})
-}
-
 func TestFileStoreMsgLimitBug(t *testing.T) {
 	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
 		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage, MaxMsgs: 1})
@@ -532,53 +397,6 @@ func TestFileStoreMsgLimitBug(t *testing.T) {
 	})
 }
 
-func TestFileStoreBytesLimit(t *testing.T) {
-	subj, msg := "foo", make([]byte, 512)
-	storedMsgSize := fileStoreMsgSize(subj, nil, msg)
-
-	toStore := uint64(1024)
-	maxBytes := storedMsgSize * toStore
-
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage, MaxBytes: int64(maxBytes)})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		for i := uint64(0); i < toStore; i++ {
-			fs.StoreMsg(subj, nil, msg)
-		}
-		state := fs.State()
-		if state.Msgs != toStore {
-			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
-		}
-		if state.Bytes != storedMsgSize*toStore {
-			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, state.Bytes)
-		}
-
-		// Now send 10 more and check that bytes limit enforced.
-		for i := 0; i < 10; i++ {
-			if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
-				t.Fatalf("Error storing msg: %v", err)
-			}
-		}
-		state = fs.State()
-		if state.Msgs != toStore {
-			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
-		}
-		if state.Bytes != storedMsgSize*toStore {
-			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, state.Bytes)
-		}
-		if state.FirstSeq != 11 {
-			t.Fatalf("Expected first sequence to be 11, got %d", state.FirstSeq)
-		}
-		if state.LastSeq != toStore+10 {
-			t.Fatalf("Expected last sequence to be %d, got %d", toStore+10, state.LastSeq)
-		}
-	})
-}
-
 func TestFileStoreAgeLimit(t *testing.T) {
 	maxAge := 250 * time.Millisecond
 
@@ -642,35 +460,6 @@ func TestFileStoreAgeLimit(t *testing.T) {
 	})
 }
 
-func TestFileStoreTimeStamps(t *testing.T) {
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		last := time.Now().UnixNano()
-		subj, msg := "foo", []byte("Hello World")
-		for i := 0; i < 10; i++ {
-			time.Sleep(5 * time.Millisecond)
-			fs.StoreMsg(subj, nil, msg)
-		}
-		var smv StoreMsg
-		for seq := uint64(1); seq <= 10; seq++ {
-			sm, err := fs.LoadMsg(seq, &smv)
-			if err != nil {
-				t.Fatalf("Unexpected error looking up msg [%d]: %v", seq, err)
-			}
-			// These should be different
-			if sm.ts <= last {
-				t.Fatalf("Expected different timestamps, got last %v vs %v", last, sm.ts)
-			}
-			last = sm.ts
-		}
-	})
-}
-
 func TestFileStorePurge(t *testing.T) {
 	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
 		blkSize := uint64(64 * 1024)
@@ -2807,53 +2596,6 @@ func TestFileStoreConsumerDeliveredAndAckUpdates(t *testing.T) {
 	})
 }
 
-func TestFileStoreStreamStateDeleted(t *testing.T) {
-	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
-		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		defer fs.Stop()
-
-		subj, toStore := "foo", uint64(10)
-		for i := uint64(1); i <= toStore; i++ {
-			msg := []byte(fmt.Sprintf("[%08d] Hello World!", i))
-			if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
-				t.Fatalf("Error storing msg: %v", err)
-			}
-		}
-		state := fs.State()
-		if len(state.Deleted) != 0 {
-			t.Fatalf("Expected deleted to be empty")
-		}
-		// Now remove some interior messages.
-		var expected []uint64
-		for seq := uint64(2); seq < toStore; seq += 2 {
-			fs.RemoveMsg(seq)
-			expected = append(expected, seq)
-		}
-		state = fs.State()
-		if !reflect.DeepEqual(state.Deleted, expected) {
-			t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
-		}
-		// Now fill the gap by deleting 1 and 3
-		fs.RemoveMsg(1)
-		fs.RemoveMsg(3)
-		expected = expected[2:]
-		state = fs.State()
-		if !reflect.DeepEqual(state.Deleted, expected) {
-			t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
-		}
-		if state.FirstSeq != 5 {
-			t.Fatalf("Expected first seq to be 5, got %d", state.FirstSeq)
-		}
-		fs.Purge()
-		if state = fs.State(); len(state.Deleted) != 0 {
-			t.Fatalf("Expected no deleted after purge, got %+v\n", state.Deleted)
-		}
-	})
-}
-
 // We have reports that sometimes under load a stream could complain about a storage directory
 // not being empty.
 func TestFileStoreStreamDeleteDirNotEmpty(t *testing.T) {
@@ -5227,3 +4969,1358 @@ func TestFileStoreStreamCompactMultiBlockSubjectInfo(t *testing.T) {
 		require_True(t, state.NumSubjects == 500)
 	})
 }
+
+func TestFileStoreMessageTTL(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 256
+
+		fs, err := newFileStore(
+			fcfg,
+			StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, AllowMsgTTL: true},
+		)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		ttlHdr := genHeader(nil, JSMessageTTL, "1s")
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo.ttl", ttlHdr, []byte("Hello World"))
+			require_NoError(t, err)
+			_, _, err = fs.StoreMsg("foo.keep", nil, []byte("Hello World"))
+			require_NoError(t, err)
+		}
+		state := fs.State()
+		require_True(t, state.Msgs == 20)
+
+		checkFor(t, 3*time.Second, 100*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs, got %d", state.Msgs)
+			}
+			return nil
+		})
+		if ss := fs.FilteredState(1, "foo.ttl"); ss.Msgs != 0 {
+			t.Fatalf("Expected all TTL msgs to be expired, got %d", ss.Msgs)
+		}
+	})
+}
+
+func TestFileStoreMessageTTLIndexRecovery(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 256
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, AllowMsgTTL: true}
+
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		ttlHdr := genHeader(nil, JSMessageTTL, "1h")
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo.ttl", ttlHdr, []byte("Hello World"))
+			require_NoError(t, err)
+			_, _, err = fs.StoreMsg("foo.keep", nil, []byte("Hello World"))
+			require_NoError(t, err)
+		}
+		fs.Stop()
+
+		fn := filepath.Join(fcfg.StoreDir, msgDir, ttlIndexFile)
+		_, err = os.Stat(fn)
+		require_NoError(t, err)
+
+		numTTLs := func() int {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			return len(fs.ttls)
+		}
+
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+		require_True(t, numTTLs() == 10)
+
+		// The index is only trusted once.
+		_, err = os.Stat(fn)
+		require_True(t, os.IsNotExist(err))
+
+		// Rewrite our index without any TTLs. If recovery trusts the index
+		// instead of rescanning the blocks we should not track anything.
+		fs.Stop()
+		fs.ttls.reset()
+		require_NoError(t, fs.writeTTLIndex(fs.encodeTTLIndex()))
+
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+		require_True(t, numTTLs() == 0)
+
+		// Add to the last block so it no longer matches a stale index and make sure it is rescanned.
+		_, _, err = fs.StoreMsg("foo.ttl", genHeader(nil, JSMessageTTL, "1s"), []byte("Hello World"))
+		require_NoError(t, err)
+		fs.mu.RLock()
+		buf := fs.encodeTTLIndex()
+		fs.mu.RUnlock()
+		_, _, err = fs.StoreMsg("foo.ttl", genHeader(nil, JSMessageTTL, "1s"), []byte("Hello World"))
+		require_NoError(t, err)
+		fs.Stop()
+		require_NoError(t, fs.writeTTLIndex(buf))
+
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != 20 {
+				return fmt.Errorf("Expected 20 msgs, got %d", state.Msgs)
+			}
+			return nil
+		})
+	})
+}
+
+func TestFileStoreMessageTTLRecovered(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 256
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, AllowMsgTTL: true}
+
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		ttlHdr := genHeader(nil, JSMessageTTL, "2s")
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo.ttl", ttlHdr, []byte("Hello World"))
+			require_NoError(t, err)
+			_, _, err = fs.StoreMsg("foo.keep", nil, []byte("Hello World"))
+			require_NoError(t, err)
+		}
+		fs.Stop()
+
+		// Restart and make sure we still expire the TTL msgs.
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		state := fs.State()
+		require_True(t, state.Msgs == 20)
+
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs, got %d", state.Msgs)
+			}
+			return nil
+		})
+
+		// Now let them expire while we are down.
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo.ttl", genHeader(nil, JSMessageTTL, "1s"), []byte("Hello World"))
+			require_NoError(t, err)
+		}
+		fs.Stop()
+		time.Sleep(1200 * time.Millisecond)
+
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs, got %d", state.Msgs)
+			}
+			return nil
+		})
+	})
+}
+
+func TestFileStoreLoadNextMsgMulti(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 256
+
+		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"*.*"}, Storage: FileStorage})
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%10), nil, []byte("Hello World"))
+			require_NoError(t, err)
+			_, _, err = fs.StoreMsg("bar.baz", nil, []byte("Hello World"))
+			require_NoError(t, err)
+		}
+
+		for _, filters := range [][]string{
+			{"foo.1", "foo.2"},
+			{"foo.1", "bar.*"},
+			{"foo.9", "baz.*"},
+		} {
+			var expected []uint64
+			var smv StoreMsg
+			for seq := uint64(1); seq <= 200; seq++ {
+				if sm, err := fs.LoadMsg(seq, &smv); err == nil && subjectIsSubsetMatchAny(sm.subj, filters) {
+					expected = append(expected, seq)
+				}
+			}
+			var seqs []uint64
+			for seq := uint64(1); ; {
+				sm, _, err := fs.LoadNextMsgMulti(filters, seq, &smv)
+				if err == ErrStoreEOF {
+					break
+				}
+				require_NoError(t, err)
+				seqs = append(seqs, sm.seq)
+				seq = sm.seq + 1
+			}
+			if !reflect.DeepEqual(seqs, expected) {
+				t.Fatalf("Expected %v for %v, got %v", expected, filters, seqs)
+			}
+		}
+	})
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		for _, encrypted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+				fcfg.StoreDir = t.TempDir()
+				fcfg.BlockSize = 4096
+
+				var prf keyGen
+				if encrypted {
+					prf = func(context []byte) ([]byte, error) {
+						h := hmac.New(sha256.New, []byte("dlc22"))
+						if _, err := h.Write(context); err != nil {
+							return nil, err
+						}
+						return h.Sum(nil), nil
+					}
+				}
+
+				cfg := StreamConfig{Name: "zzz", Subjects: []string{"telemetry.>"}, Storage: FileStorage}
+				fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+				require_NoError(t, err)
+				defer fs.Stop()
+
+				msg := func(i int) []byte {
+					return []byte(fmt.Sprintf(`{"id":%d,"host":"server-22","cpu":0.22,"mem":2222,"status":"ok","tags":["a","b","c"]}`, i))
+				}
+				store := func(from, to int) {
+					t.Helper()
+					for i := from; i <= to; i++ {
+						_, _, err := fs.StoreMsg("telemetry.host", nil, msg(i))
+						require_NoError(t, err)
+					}
+				}
+				checkMsgs := func(first, last int, deleted ...int) {
+					t.Helper()
+					dmap := make(map[int]bool)
+					for _, i := range deleted {
+						dmap[i] = true
+					}
+					var smv StoreMsg
+					for i := first; i <= last; i++ {
+						sm, err := fs.LoadMsg(uint64(i), &smv)
+						if dmap[i] {
+							require_Error(t, err)
+							continue
+						}
+						require_NoError(t, err)
+						require_True(t, bytes.Equal(sm.msg, msg(i)))
+					}
+				}
+				// Returns the number of compressed and uncompressed sealed blocks.
+				blocks := func() (cmp, plain int) {
+					t.Helper()
+					fs.mu.RLock()
+					defer fs.mu.RUnlock()
+					for _, mb := range fs.blks {
+						if mb == fs.lmb {
+							require_True(t, mb.cmp == NoCompression)
+							continue
+						}
+						mb.mu.RLock()
+						fi, err := os.Stat(mb.mfn)
+						require_NoError(t, err)
+						if mb.cmp == S2Compression {
+							require_True(t, uint64(fi.Size()) < mb.rbytes)
+							cmp++
+						} else {
+							plain++
+						}
+						mb.mu.RUnlock()
+					}
+					return cmp, plain
+				}
+
+				// Blocks sealed before enabling compression stay as is.
+				store(1, 100)
+				cmp, plain := blocks()
+				require_True(t, cmp == 0)
+				require_True(t, plain > 0)
+
+				cfg.Compression = S2Compression
+				require_NoError(t, fs.UpdateConfig(&cfg))
+				store(101, 300)
+				// Sealed blocks are compressed in the background.
+				var ncmp, nplain int
+				checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+					if ncmp, nplain = blocks(); ncmp == 0 || nplain != plain {
+						return fmt.Errorf("Expected compressed blocks, got %d compressed and %d plain", ncmp, nplain)
+					}
+					return nil
+				})
+				checkMsgs(1, 300)
+
+				// Remove from compressed and uncompressed blocks.
+				for _, seq := range []uint64{2, 150, 151, 200} {
+					_, err = fs.EraseMsg(seq)
+					require_NoError(t, err)
+				}
+				checkMsgs(1, 300, 2, 150, 151, 200)
+
+				// Recover with our index files and without them.
+				for _, removeIndex := range []bool{false, true} {
+					// Encrypted stores do not erase in place, so only the index knows about the deletes.
+					if removeIndex && encrypted {
+						break
+					}
+					fs.Stop()
+					if removeIndex {
+						idxs, err := filepath.Glob(filepath.Join(fcfg.StoreDir, msgDir, "*.idx"))
+						require_NoError(t, err)
+						for _, fn := range idxs {
+							require_NoError(t, os.Remove(fn))
+						}
+					}
+					fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+					require_NoError(t, err)
+					defer fs.Stop()
+
+					state := fs.State()
+					require_True(t, state.Msgs == uint64(296))
+					require_True(t, state.LastSeq == uint64(300))
+					checkMsgs(1, 300, 2, 150, 151, 200)
+					rcmp, _ := blocks()
+					require_True(t, rcmp >= ncmp)
+				}
+
+				// Truncating into a compressed block will make it writable again.
+				require_NoError(t, fs.Truncate(250))
+				store(251, 260)
+				state := fs.State()
+				require_True(t, state.LastSeq == uint64(260))
+				checkMsgs(1, 260, 2, 150, 151, 200)
+
+				fs.Stop()
+				fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+				require_NoError(t, err)
+				defer fs.Stop()
+				checkMsgs(1, 260, 2, 150, 151, 200)
+			})
+		}
+	})
+}
+
+func TestFileStoreCompressionReportsErrors(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 4096
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage}
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		errs := make(chan error, 10)
+		fs.registerErrorHandler(func(err error) { errs <- err })
+
+		msg := bytes.Repeat([]byte("Z"), 256)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg("foo", nil, msg)
+			require_NoError(t, err)
+		}
+		cfg.Compression = S2Compression
+		require_NoError(t, fs.UpdateConfig(&cfg))
+
+		// Lose a sealed block from under us and queue it along with a good one.
+		fs.mu.Lock()
+		bad, good := fs.blks[0], fs.blks[1]
+		require_NoError(t, os.Remove(bad.mfn))
+		fs.queueCompress(bad)
+		fs.queueCompress(good)
+		fs.mu.Unlock()
+
+		select {
+		case err := <-errs:
+			require_True(t, os.IsNotExist(errors.Unwrap(err)))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an error to be reported")
+		}
+		checkFor(t, 5*time.Second, 20*time.Millisecond, func() error {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			if fs.cmpw || len(fs.cmpq) > 0 {
+				return fmt.Errorf("Compression still running")
+			}
+			return nil
+		})
+		good.mu.RLock()
+		defer good.mu.RUnlock()
+		require_True(t, good.cmp == S2Compression)
+	})
+}
+
+func TestFileStoreEncryptionKeyRotation(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.StoreDir = t.TempDir()
+		fcfg.BlockSize = 1024
+
+		keyGen := func(key string) keyGen {
+			return func(context []byte) ([]byte, error) {
+				h := hmac.New(sha256.New, []byte(key))
+				if _, err := h.Write(context); err != nil {
+					return nil, err
+				}
+				return h.Sum(nil), nil
+			}
+		}
+		prf, nprf := keyGen("dlc22"), keyGen("derek")
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		o, err := fs.ConsumerStore("o22", &ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit})
+		require_NoError(t, err)
+		state := &ConsumerState{}
+		state.Delivered.Consumer, state.Delivered.Stream = 22, 22
+		state.AckFloor.Consumer, state.AckFloor.Stream = 11, 11
+		require_NoError(t, o.Update(state))
+		o.Stop()
+
+		checkStore := func(fs *fileStore, msgs uint64) {
+			t.Helper()
+			state := fs.State()
+			require_True(t, state.Msgs == msgs)
+			var smv StoreMsg
+			for seq := state.FirstSeq; seq <= state.LastSeq; seq++ {
+				sm, err := fs.LoadMsg(seq, &smv)
+				require_NoError(t, err)
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+			o, err := fs.ConsumerStore("o22", &ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit})
+			require_NoError(t, err)
+			defer o.Stop()
+			ostate, err := o.State()
+			require_NoError(t, err)
+			require_True(t, ostate.Delivered.Stream == 22)
+			require_True(t, ostate.AckFloor.Stream == 11)
+		}
+		waitForRotation := func(fs *fileStore) {
+			t.Helper()
+			checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+				if rot := fs.keyRotationState(); rot.active || rot.done != rot.total {
+					return fmt.Errorf("Rotation not done: %d of %d", rot.done, rot.total)
+				}
+				return nil
+			})
+			rot := fs.keyRotationState()
+			require_NoError(t, rot.err)
+		}
+
+		// Rotate to a new key and cipher while still writing.
+		nsc := otherCipher(fcfg.Cipher)
+		o, err = fs.ConsumerStore("o22", &ConsumerConfig{Durable: "o22", AckPolicy: AckExplicit})
+		require_NoError(t, err)
+		require_NoError(t, fs.rotateEncryption(nprf, prf, nsc))
+		o.Stop()
+		for i := 0; i < 10; i++ {
+			_, _, err := fs.StoreMsg("foo.1", nil, msg)
+			require_NoError(t, err)
+		}
+		waitForRotation(fs)
+		require_True(t, fs.keyRotationState().total > 1)
+		checkStore(fs, 110)
+		fs.Stop()
+
+		// Everything should now only need our new key and cipher.
+		fcfg.Cipher = nsc
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs, 110)
+		fs.Stop()
+
+		// Simulate a crash after a block was re-encrypted but before anything was renamed.
+		mdir := filepath.Join(fcfg.StoreDir, msgDir)
+		mfn := filepath.Join(mdir, fmt.Sprintf(blkScan, 1))
+		kfn := filepath.Join(mdir, fmt.Sprintf(keyScan, 1))
+		for _, fn := range []string{mfn, kfn} {
+			buf, err := os.ReadFile(fn)
+			require_NoError(t, err)
+			require_NoError(t, os.WriteFile(rotFile(fn), buf, defaultFilePerms))
+			// Corrupt the original which should be replaced on recovery.
+			require_NoError(t, os.WriteFile(fn, bytes.Repeat([]byte{0xff}, len(buf)), defaultFilePerms))
+		}
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs, 110)
+		fs.Stop()
+
+		// Incomplete sets without the key file should be discarded.
+		require_NoError(t, os.WriteFile(rotFile(mfn), []byte("partial"), defaultFilePerms))
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkStore(fs, 110)
+		_, err = os.Stat(rotFile(mfn))
+		require_True(t, os.IsNotExist(err))
+		fs.Stop()
+
+		// Rotating back with a restart part way through should pick up where it left off.
+		fs, err = newFileStoreWithKeys(fcfg, cfg, time.Now(), nprf, nil)
+		require_NoError(t, err)
+		fs.mu.Lock()
+		fs.prf, fs.oldprf, fs.fcfg.Cipher = prf, nprf, fcfg.Cipher
+		require_NoError(t, fs.rotateStreamMeta())
+		fs.mu.Unlock()
+		fs.Stop()
+
+		fs, err = newFileStoreWithKeys(fcfg, cfg, time.Now(), prf, nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		waitForRotation(fs)
+		require_True(t, fs.keyRotationState().total > 1)
+		checkStore(fs, 110)
+	})
+}
+
+func TestFileStoreEncryptionKeyRotationWhileCompressing(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+
+		keyGen := func(key string) keyGen {
+			return func(context []byte) ([]byte, error) {
+				h := hmac.New(sha256.New, []byte(key))
+				if _, err := h.Write(context); err != nil {
+					return nil, err
+				}
+				return h.Sum(nil), nil
+			}
+		}
+		prf, nprf := keyGen("dlc22"), keyGen("derek")
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 200; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		cfg.Compression = S2Compression
+		require_NoError(t, fs.UpdateConfig(&cfg))
+
+		// Blocks waiting to be re-encrypted are not compressed.
+		fs.mu.RLock()
+		mb := fs.blks[0]
+		fs.mu.RUnlock()
+		mb.mu.Lock()
+		mb.rotate = true
+		mb.mu.Unlock()
+		written, err := mb.compressIfNeeded(S2Compression)
+		require_NoError(t, err)
+		require_True(t, written == 0)
+		mb.mu.Lock()
+		require_True(t, mb.cmp == NoCompression)
+		mb.rotate = false
+		mb.mu.Unlock()
+
+		// Queue all our sealed blocks and rotate our keys while they are compressed.
+		fs.mu.Lock()
+		for _, mb := range fs.blks {
+			if mb != fs.lmb {
+				fs.queueCompress(mb)
+			}
+		}
+		fs.mu.Unlock()
+		nsc := otherCipher(fcfg.Cipher)
+		require_NoError(t, fs.rotateEncryption(nprf, prf, nsc))
+
+		checkFor(t, 10*time.Second, 20*time.Millisecond, func() error {
+			if rot := fs.keyRotationState(); rot.active || rot.done != rot.total {
+				return fmt.Errorf("Rotation not done: %d of %d", rot.done, rot.total)
+			}
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			if fs.cmpw || len(fs.cmpq) > 0 {
+				return fmt.Errorf("Compression still running")
+			}
+			for _, mb := range fs.blks {
+				mb.mu.RLock()
+				cmp := mb.cmp
+				mb.mu.RUnlock()
+				if mb != fs.lmb && cmp != S2Compression {
+					return fmt.Errorf("Block %d not compressed", mb.index)
+				}
+			}
+			return nil
+		})
+		require_NoError(t, fs.keyRotationState().err)
+		fs.Stop()
+
+		// Everything should be readable with only our new key and cipher.
+		fcfg.Cipher = nsc
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		state := fs.State()
+		require_True(t, state.Msgs == 200)
+		var smv StoreMsg
+		for seq := state.FirstSeq; seq <= state.LastSeq; seq++ {
+			sm, err := fs.LoadMsg(seq, &smv)
+			require_NoError(t, err)
+			require_True(t, bytes.Equal(sm.msg, msg))
+		}
+	})
+}
+
+func TestFileStoreScrubAndRepair(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.StoreDir = t.TempDir()
+		fcfg.BlockSize = 1024
+		fcfg.ScrubInterval = -1
+
+		fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage})
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		var msgs []*StoreMsg
+		for i := 0; i < 50; i++ {
+			subj, msg := fmt.Sprintf("foo.%d", i%3), []byte(fmt.Sprintf("MSG-%03d-%s", i, strings.Repeat("Z", 80)))
+			seq, ts, err := fs.StoreMsg(subj, nil, msg)
+			require_NoError(t, err)
+			msgs = append(msgs, &StoreMsg{subj: subj, msg: msg, seq: seq, ts: ts})
+		}
+		// Remove one so we also have a deleted message in our damaged range.
+		_, err = fs.RemoveMsg(11)
+		require_NoError(t, err)
+		state := fs.State()
+
+		var bad []seqRange
+		fs.registerCorruptHandler(func(first, last uint64) {
+			bad = append(bad, seqRange{first, last})
+		})
+
+		// Nothing wrong yet.
+		fs.scrubBlocks()
+		require_True(t, len(bad) == 0)
+		stats := fs.scrubState()
+		require_True(t, stats.runs == 1)
+		require_True(t, stats.blocks > 1)
+
+		// Flip some bits in the second block.
+		fs.mu.RLock()
+		mb := fs.blks[1]
+		fs.mu.RUnlock()
+		mb.mu.RLock()
+		mfn, first, last := mb.mfn, mb.first.seq, mb.last.seq
+		mb.mu.RUnlock()
+		require_True(t, first < 11 && last > first+5)
+
+		buf, err := os.ReadFile(mfn)
+		require_NoError(t, err)
+		rl := len(buf) / int(last-first+1)
+		for _, i := range []int{rl / 2, 4*rl + rl/2, 5*rl + rl/2} {
+			buf[i] ^= 0xff
+		}
+		require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+		mb.mu.Lock()
+		mb.clearCacheAndOffset()
+		mb.mu.Unlock()
+
+		fs.scrubBlocks()
+		require_True(t, len(bad) == 2)
+		require_True(t, bad[0].first == first && bad[0].last == first)
+		require_True(t, bad[1].first == first+4 && bad[1].last == first+5)
+		stats = fs.scrubState()
+		require_True(t, stats.ranges == 2)
+		require_True(t, stats.msgs == 3)
+
+		// Damaged messages should not be served.
+		var smv StoreMsg
+		_, err = fs.LoadMsg(first, &smv)
+		require_Error(t, err)
+
+		// Now repair from our copies, the removed message should stay deleted.
+		for _, r := range bad {
+			var rmsgs []*StoreMsg
+			for _, sm := range msgs {
+				if sm.seq >= r.first && sm.seq <= r.last {
+					rmsgs = append(rmsgs, sm)
+				}
+			}
+			require_NoError(t, fs.repairMsgs(r.first, r.last, rmsgs))
+		}
+		bad = nil
+		fs.scrubBlocks()
+		require_True(t, len(bad) == 0)
+		require_True(t, fs.scrubState().repaired == 3)
+
+		checkMsgs := func(fs *fileStore) {
+			t.Helper()
+			nstate := fs.State()
+			require_True(t, nstate.Msgs == state.Msgs)
+			require_True(t, nstate.Bytes == state.Bytes)
+			require_True(t, nstate.FirstSeq == state.FirstSeq && nstate.LastSeq == state.LastSeq)
+			for _, sm := range msgs {
+				lsm, err := fs.LoadMsg(sm.seq, &smv)
+				if sm.seq == 11 {
+					require_Error(t, err)
+					continue
+				}
+				require_NoError(t, err)
+				require_True(t, lsm.subj == sm.subj)
+				require_True(t, bytes.Equal(lsm.msg, sm.msg))
+			}
+			ss := fs.FilteredState(1, "foo.2")
+			require_True(t, ss.Msgs == 16)
+		}
+		checkMsgs(fs)
+
+		// Our global per subject info should have been adjusted to match a full rebuild.
+		checkPerSubjectInfo := func() {
+			t.Helper()
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			psim := fs.psim
+			fs.psim = make(map[string]*psi)
+			for _, mb := range fs.blks {
+				fs.populateGlobalPerSubjectInfo(mb)
+			}
+			require_True(t, len(psim) == len(fs.psim))
+			for subj, info := range fs.psim {
+				require_True(t, psim[subj] != nil)
+				require_True(t, psim[subj].total == info.total)
+			}
+		}
+		checkPerSubjectInfo()
+
+		// Make sure this survives a restart.
+		fs.Stop()
+		fs, err = newFileStore(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage})
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkMsgs(fs)
+
+		// Repairing without a copy of a message will remove it.
+		nsubj := fs.FilteredState(1, msgs[first].subj).Msgs
+		require_NoError(t, fs.repairMsgs(first+1, first+1, nil))
+		require_True(t, fs.FilteredState(1, msgs[first].subj).Msgs == nsubj-1)
+		_, err = fs.LoadMsg(first+1, &smv)
+		require_Error(t, err)
+		checkPerSubjectInfo()
+	})
+}
+
+func TestFileStoreInspect(t *testing.T) {
+	for _, key := range []string{_EMPTY_, "s3cr3t"} {
+		t.Run(fmt.Sprintf("key=%q", key), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "jetstream", "ACC", "streams", "zzz")
+			fcfg := FileStoreConfig{StoreDir: dir, BlockSize: 1024, ScrubInterval: -1, Cipher: ChaCha}
+			cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+			prf := jsKeyGen(key, "ACC")
+
+			fs, err := newFileStoreWithKeys(fcfg, cfg, time.Now(), prf, nil)
+			require_NoError(t, err)
+			defer fs.Stop()
+
+			for i := 0; i < 30; i++ {
+				_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%3), nil, []byte(strings.Repeat("Z", 64)))
+				require_NoError(t, err)
+			}
+			_, err = fs.RemoveMsg(5)
+			require_NoError(t, err)
+
+			o, err := fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+			require_NoError(t, err)
+			state := &ConsumerState{}
+			state.Delivered.Consumer, state.Delivered.Stream = 10, 10
+			state.AckFloor.Consumer, state.AckFloor.Stream = 8, 8
+			require_NoError(t, o.Update(state))
+			_, err = fs.ConsumerStore("multi", &ConsumerConfig{Durable: "multi", AckPolicy: AckExplicit, FilterSubjects: []string{"foo.0", "foo.1"}})
+			require_NoError(t, err)
+
+			fs.mu.RLock()
+			mfn := fs.lmb.mfn
+			fs.mu.RUnlock()
+			fs.Stop()
+
+			// Tear our last record.
+			fi, err := os.Stat(mfn)
+			require_NoError(t, err)
+			require_NoError(t, os.Truncate(mfn, fi.Size()-5))
+
+			inspect := func(opts *Options) string {
+				t.Helper()
+				var sb strings.Builder
+				require_NoError(t, InspectStreamStore(opts, &sb))
+				return sb.String()
+			}
+			opts := &Options{InspectStore: dir, JetStreamKey: key}
+			out := inspect(opts)
+			for _, expected := range []string{
+				"Stream:       zzz",
+				fmt.Sprintf("Encrypted:    %v", key != _EMPTY_),
+				"deleted:    1 [5]",
+				"torn tail:",
+				"msgs 28 ",
+				"foo.0  10\n",
+				"foo.1  9\n",
+				"foo.2  9\n",
+				"dlc  durable  ack explicit",
+				`multi  durable  ack explicit  filters ["foo.0" "foo.1"]`,
+				"delivered:  consumer 10  stream 10",
+				"ack floor:  consumer 8  stream 8",
+			} {
+				if !strings.Contains(out, expected) {
+					t.Fatalf("Expected %q in output:\n%s", expected, out)
+				}
+			}
+			// Inspecting should leave everything alone.
+			nfi, err := os.Stat(mfn)
+			require_NoError(t, err)
+			require_True(t, nfi.Size() == fi.Size()-5)
+
+			// Encrypted stores need the key.
+			if key != _EMPTY_ {
+				require_Error(t, InspectStreamStore(&Options{InspectStore: dir}, io.Discard))
+			}
+
+			opts.InspectTruncate = true
+			out = inspect(opts)
+			if !strings.Contains(out, "truncated to") || !strings.Contains(out, "index rebuilt") {
+				t.Fatalf("Expected repairs in output:\n%s", out)
+			}
+			out = inspect(&Options{InspectStore: dir, JetStreamKey: key})
+			if strings.Contains(out, "torn tail:") || strings.Contains(out, "index does not match") {
+				t.Fatalf("Expected a clean store after repairs:\n%s", out)
+			}
+
+			fs, err = newFileStoreWithKeys(fcfg, cfg, time.Now(), prf, nil)
+			require_NoError(t, err)
+			defer fs.Stop()
+			ss := fs.State()
+			require_True(t, ss.Msgs == 28)
+			require_True(t, ss.FirstSeq == 1 && ss.LastSeq == 29)
+			_, err = fs.LoadMsg(29, nil)
+			require_NoError(t, err)
+		})
+	}
+}
+
+func TestFileStoreInspectDamagedBlock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "jetstream", "ACC", "streams", "zzz")
+	fcfg := FileStoreConfig{StoreDir: dir, BlockSize: 1024, ScrubInterval: -1}
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	for i := 0; i < 30; i++ {
+		_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%3), nil, []byte(strings.Repeat("Z", 64)))
+		require_NoError(t, err)
+	}
+	fs.mu.RLock()
+	require_True(t, len(fs.blks) > 2)
+	mfn := fs.blks[0].mfn
+	fs.mu.RUnlock()
+	sm, err := fs.LoadMsg(1, nil)
+	require_NoError(t, err)
+	rl := int(fileStoreMsgSize(sm.subj, sm.hdr, sm.msg))
+	fs.Stop()
+
+	// Damage the header of the second record in our first block.
+	buf, err := os.ReadFile(mfn)
+	require_NoError(t, err)
+	buf[rl+3] ^= 0x3f
+	require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+
+	var sb strings.Builder
+	opts := &Options{InspectStore: dir, InspectTruncate: true, InspectRebuildIndex: true}
+	require_NoError(t, InspectStreamStore(opts, &sb))
+	out := sb.String()
+	if !strings.Contains(out, fmt.Sprintf("unreadable: %d bytes at offset %d", len(buf)-rl, rl)) ||
+		!strings.Contains(out, "left unchanged") || strings.Contains(out, "truncated to") {
+		t.Fatalf("Unexpected output:\n%s", out)
+	}
+
+	// The records that follow the damage must still be there.
+	nbuf, err := os.ReadFile(mfn)
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(buf, nbuf))
+}
+
+func TestFileStoreArchiveBlocks(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+		fcfg.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, ArchiveAfter: time.Millisecond}
+
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := []byte(strings.Repeat("Z", 100))
+		for i := 0; i < 50; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		before := fs.State()
+		require_True(t, before.ArchivedBytes == 0)
+
+		time.Sleep(10 * time.Millisecond)
+		adir, mdir := filepath.Join(fcfg.ArchiveDir, msgDir), filepath.Join(fcfg.StoreDir, msgDir)
+
+		// We archive on our own timer, not when syncing.
+		fs.syncBlocks()
+		_, err = os.Stat(adir)
+		require_True(t, os.IsNotExist(err))
+		fs.mu.RLock()
+		require_True(t, fs.archTmr != nil)
+		fs.mu.RUnlock()
+		fs.archiveBlocks()
+
+		fs.mu.RLock()
+		nblks, lmb := len(fs.blks), fs.lmb
+		fs.mu.RUnlock()
+		require_True(t, nblks > 2)
+
+		checkBlockFiles := func() {
+			t.Helper()
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			for _, mb := range fs.blks {
+				blk := fmt.Sprintf(blkScan, mb.index)
+				_, lerr := os.Stat(filepath.Join(mdir, blk))
+				_, aerr := os.Stat(filepath.Join(adir, blk))
+				if mb == fs.lmb {
+					require_True(t, lerr == nil && os.IsNotExist(aerr))
+				} else {
+					require_True(t, os.IsNotExist(lerr) && aerr == nil)
+				}
+			}
+		}
+		checkBlockFiles()
+
+		var archived uint64
+		fs.mu.RLock()
+		for _, mb := range fs.blks {
+			if mb != lmb {
+				archived += mb.bytes
+			}
+		}
+		fs.mu.RUnlock()
+
+		state := fs.State()
+		require_True(t, state.Msgs == before.Msgs && state.Bytes == before.Bytes)
+		require_True(t, state.ArchivedBytes == archived)
+		var fstate StreamState
+		fs.FastState(&fstate)
+		require_True(t, fstate.ArchivedBytes == archived)
+
+		// Removing from an archived block works as usual and is reflected in our accounting.
+		_, err = fs.RemoveMsg(2)
+		require_NoError(t, err)
+		state = fs.State()
+		require_True(t, state.ArchivedBytes < archived)
+		require_True(t, state.Bytes-state.ArchivedBytes == before.Bytes-archived)
+
+		// Restart and make sure we find our archived blocks again.
+		fs.Stop()
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		rstate := fs.State()
+		require_True(t, rstate.Msgs == state.Msgs && rstate.Bytes == state.Bytes)
+		require_True(t, rstate.ArchivedBytes == state.ArchivedBytes)
+		checkBlockFiles()
+
+		for seq := uint64(1); seq <= 50; seq++ {
+			sm, err := fs.LoadMsg(seq, nil)
+			if seq == 2 {
+				require_Error(t, err)
+				continue
+			}
+			require_NoError(t, err)
+			require_True(t, sm.subj == fmt.Sprintf("foo.%d", (seq-1)%5))
+			require_True(t, bytes.Equal(sm.msg, msg))
+		}
+
+		// Our running count of archived bytes matches our archived blocks.
+		checkArchivedBytes := func() {
+			t.Helper()
+			var archived uint64
+			fs.mu.RLock()
+			for _, mb := range fs.blks {
+				mb.mu.RLock()
+				if mb.archived {
+					archived += mb.bytes
+				}
+				mb.mu.RUnlock()
+			}
+			fs.mu.RUnlock()
+			require_True(t, fs.State().ArchivedBytes == archived)
+		}
+		checkArchivedBytes()
+		_, err = fs.Compact(15)
+		require_NoError(t, err)
+		checkArchivedBytes()
+		_, err = fs.PurgeEx("foo.3", 0, 0)
+		require_NoError(t, err)
+		checkArchivedBytes()
+		require_True(t, fs.State().ArchivedBytes > 0)
+
+		// Purging removes our archived blocks.
+		_, err = fs.Purge()
+		require_NoError(t, err)
+		require_True(t, fs.State().ArchivedBytes == 0)
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if fis, _ := os.ReadDir(adir); len(fis) > 0 {
+				return fmt.Errorf("still have %d archived files", len(fis))
+			}
+			return nil
+		})
+
+		require_NoError(t, fs.Delete())
+		_, err = os.Stat(fcfg.ArchiveDir)
+		require_True(t, os.IsNotExist(err))
+	})
+}
+
+func TestFileStoreEncryptionKeyRotationWhileArchiving(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+		fcfg.ArchiveDir = filepath.Join(t.TempDir(), "archive")
+
+		keyGen := func(key string) keyGen {
+			return func(context []byte) ([]byte, error) {
+				h := hmac.New(sha256.New, []byte(key))
+				if _, err := h.Write(context); err != nil {
+					return nil, err
+				}
+				return h.Sum(nil), nil
+			}
+		}
+		prf, nprf := keyGen("dlc22"), keyGen("derek")
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage, ArchiveAfter: time.Millisecond}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 200; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		adir := filepath.Join(fcfg.ArchiveDir, msgDir)
+
+		// Blocks waiting to be re-encrypted are not archived.
+		fs.mu.RLock()
+		mb := fs.blks[0]
+		fs.mu.RUnlock()
+		mb.mu.Lock()
+		mb.rotate = true
+		mb.mu.Unlock()
+		require_Error(t, mb.archive(adir), errArchBlkChanged)
+		mb.mu.Lock()
+		require_False(t, mb.archived)
+		mb.rotate = false
+		mb.mu.Unlock()
+
+		// Archive our blocks while rotating our keys.
+		done := make(chan struct{})
+		go func() {
+			fs.archiveBlocks()
+			close(done)
+		}()
+		nsc := otherCipher(fcfg.Cipher)
+		require_NoError(t, fs.rotateEncryption(nprf, prf, nsc))
+		<-done
+
+		checkFor(t, 10*time.Second, 20*time.Millisecond, func() error {
+			if rot := fs.keyRotationState(); rot.active || rot.done != rot.total {
+				return fmt.Errorf("Rotation not done: %d of %d", rot.done, rot.total)
+			}
+			return nil
+		})
+		require_NoError(t, fs.keyRotationState().err)
+		// Pick up anything skipped while it was re-encrypted.
+		fs.archiveBlocks()
+		fs.mu.RLock()
+		for _, mb := range fs.blks {
+			mb.mu.RLock()
+			archived := mb.archived
+			mb.mu.RUnlock()
+			require_True(t, archived == (mb != fs.lmb))
+		}
+		fs.mu.RUnlock()
+		fs.Stop()
+
+		// Everything should be readable with only our new key and cipher.
+		fcfg.Cipher = nsc
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), nprf)
+		require_NoError(t, err)
+		defer fs.Stop()
+		state := fs.State()
+		require_True(t, state.Msgs == 200)
+		var smv StoreMsg
+		for seq := state.FirstSeq; seq <= state.LastSeq; seq++ {
+			sm, err := fs.LoadMsg(seq, &smv)
+			require_NoError(t, err)
+			require_True(t, bytes.Equal(sm.msg, msg))
+		}
+	})
+}
+
+func TestFileStoreCompactSparseBlocks(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.StoreDir = t.TempDir()
+		fcfg.BlockSize = 4096
+		fcfg.CompactInterval = -1
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		msg := bytes.Repeat([]byte("Z"), 100)
+		for i := 0; i < 200; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%5), nil, msg)
+			require_NoError(t, err)
+		}
+		// Keep every fourth message, leaving the blocks mostly deleted.
+		for seq := uint64(1); seq <= 200; seq++ {
+			if seq%4 != 0 {
+				_, err := fs.RemoveMsg(seq)
+				require_NoError(t, err)
+			}
+		}
+		state := fs.State()
+		require_True(t, state.Msgs == 50)
+
+		blkSizes := func() (total uint64) {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			for _, mb := range fs.blks {
+				fi, err := os.Stat(mb.mfn)
+				require_NoError(t, err)
+				total += uint64(fi.Size())
+			}
+			return total
+		}
+		before := blkSizes()
+
+		fs.compactBlocks()
+		stats := fs.compactState()
+		require_True(t, stats.runs == 1)
+		require_True(t, stats.blocks > 0)
+		require_True(t, stats.reclaimed > 0)
+		require_True(t, blkSizes() == before-stats.reclaimed)
+
+		checkState := func(fs *fileStore) {
+			t.Helper()
+			nstate := fs.State()
+			require_True(t, nstate.Msgs == state.Msgs)
+			require_True(t, nstate.Bytes == state.Bytes)
+			require_True(t, nstate.FirstSeq == state.FirstSeq && nstate.LastSeq == state.LastSeq)
+			if !reflect.DeepEqual(nstate.Deleted, state.Deleted) {
+				t.Fatalf("Deleted does not match: %v vs %v", nstate.Deleted, state.Deleted)
+			}
+			var smv StoreMsg
+			for seq := uint64(1); seq <= 200; seq++ {
+				sm, err := fs.LoadMsg(seq, &smv)
+				if seq%4 != 0 {
+					require_True(t, err != nil)
+					continue
+				}
+				require_NoError(t, err)
+				require_True(t, sm.seq == seq)
+				require_Equal(t, sm.subj, fmt.Sprintf("foo.%d", (seq-1)%5))
+				require_True(t, bytes.Equal(sm.msg, msg))
+			}
+			require_True(t, fs.FilteredState(1, "foo.3").Msgs == 10)
+		}
+		checkState(fs)
+
+		// Nothing left to reclaim.
+		fs.compactBlocks()
+		stats2 := fs.compactState()
+		require_True(t, stats2.runs == 2)
+		require_True(t, stats2.reclaimed == stats.reclaimed)
+
+		// Everything should survive a restart.
+		require_NoError(t, fs.Stop())
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer fs.Stop()
+		checkState(fs)
+
+		// New messages continue the sequence.
+		seq, _, err := fs.StoreMsg("foo.0", nil, msg)
+		require_NoError(t, err)
+		require_True(t, seq == 201)
+	})
+}
+
+func TestFileStoreSubjectIndexRecovery(t *testing.T) {
+	testFileStoreAllPermutations(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.StoreDir = t.TempDir()
+		fcfg.BlockSize = 4096
+		fcfg.SubjectIndexInterval = -1
+
+		cfg := StreamConfig{Name: "zzz", Subjects: []string{"kv.>"}, Storage: FileStorage}
+		fs, err := newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		defer func() { fs.Stop() }()
+
+		for i := 0; i < 1000; i++ {
+			_, _, err := fs.StoreMsg(fmt.Sprintf("kv.%d", i%100), nil, []byte("ok"))
+			require_NoError(t, err)
+		}
+		for seq := uint64(1); seq <= 1000; seq += 7 {
+			_, err := fs.RemoveMsg(seq)
+			require_NoError(t, err)
+		}
+
+		totals := func(fs *fileStore) map[string]uint64 {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			m := make(map[string]uint64, len(fs.psim))
+			for subj, info := range fs.psim {
+				m[subj] = info.total
+			}
+			return m
+		}
+		expected, ss := totals(fs), fs.SubjectsState("kv.>")
+		require_True(t, len(expected) == 100)
+
+		ifn := filepath.Join(fcfg.StoreDir, msgDir, subjectIndexFile)
+		restart := func(usedIndex bool) {
+			t.Helper()
+			fs.Stop()
+			fs, err = newFileStore(fcfg, cfg)
+			require_NoError(t, err)
+			_, sidx := fs.recoveryState()
+			require_True(t, sidx == usedIndex)
+			if !reflect.DeepEqual(totals(fs), expected) {
+				t.Fatalf("Subject totals do not match after restart")
+			}
+			if nss := fs.SubjectsState("kv.>"); !reflect.DeepEqual(nss, ss) {
+				t.Fatalf("Subjects state does not match: %+v vs %+v", nss, ss)
+			}
+		}
+
+		// A clean shutdown persists our index and we use it on recovery.
+		restart(true)
+		// It is only trusted once.
+		_, err = os.Stat(ifn)
+		require_True(t, os.IsNotExist(err))
+
+		// A block's per subject info is not checked on recovery when using our index,
+		// so make sure a stale one is caught when it is loaded.
+		fs.mu.RLock()
+		mb := fs.blks[0]
+		fs.mu.RUnlock()
+		mb.mu.RLock()
+		sfn, mfirst := mb.sfn, mb.first.seq
+		mb.mu.RUnlock()
+		fs.Stop()
+		sbuf, err := os.ReadFile(sfn)
+		require_NoError(t, err)
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, err = fs.RemoveMsg(mfirst + 1)
+		require_NoError(t, err)
+		expected, ss = totals(fs), fs.SubjectsState("kv.>")
+		fs.Stop()
+		require_NoError(t, os.WriteFile(sfn, sbuf, defaultFilePerms))
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, sidx := fs.recoveryState()
+		require_True(t, sidx)
+		if nss := fs.SubjectsState("kv.>"); !reflect.DeepEqual(nss, ss) {
+			t.Fatalf("Subjects state does not match: %+v vs %+v", nss, ss)
+		}
+
+		// Keep a copy and make it stale by removing more messages.
+		restart(true)
+		fs.Stop()
+		stale, err := os.ReadFile(ifn)
+		require_NoError(t, err)
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		for seq := uint64(2); seq <= 1000; seq += 13 {
+			_, err := fs.RemoveMsg(seq)
+			require_NoError(t, err)
+		}
+		expected, ss = totals(fs), fs.SubjectsState("kv.>")
+		fs.Stop()
+		require_NoError(t, os.WriteFile(ifn, stale, defaultFilePerms))
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, sidx = fs.recoveryState()
+		require_False(t, sidx)
+		if !reflect.DeepEqual(totals(fs), expected) {
+			t.Fatalf("Subject totals do not match after stale index")
+		}
+
+		// New messages in our last block also make it stale.
+		restart(true)
+		fs.Stop()
+		stale, err = os.ReadFile(ifn)
+		require_NoError(t, err)
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, _, err = fs.StoreMsg("kv.new", nil, []byte("ok"))
+		require_NoError(t, err)
+		expected, ss = totals(fs), fs.SubjectsState("kv.>")
+		fs.Stop()
+		require_NoError(t, os.WriteFile(ifn, stale, defaultFilePerms))
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, sidx = fs.recoveryState()
+		require_False(t, sidx)
+		require_True(t, totals(fs)["kv.new"] == 1)
+
+		// Corruption is detected.
+		fs.Stop()
+		buf, err := os.ReadFile(ifn)
+		require_NoError(t, err)
+		buf[len(buf)/2] ^= 0xff
+		require_NoError(t, os.WriteFile(ifn, buf, defaultFilePerms))
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		_, sidx = fs.recoveryState()
+		require_False(t, sidx)
+		if !reflect.DeepEqual(totals(fs), expected) {
+			t.Fatalf("Subject totals do not match after corrupt index")
+		}
+
+		// We also persist on an interval.
+		fs.Stop()
+		fcfg.SubjectIndexInterval = 50 * time.Millisecond
+		fs, err = newFileStore(fcfg, cfg)
+		require_NoError(t, err)
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			_, err := os.Stat(ifn)
+			return err
+		})
+	})
+}
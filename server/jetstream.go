@@ -53,6 +53,7 @@ type JetStreamStats struct {
 	ReservedStore  uint64            `json:"reserved_storage"`
 	Accounts       int               `json:"accounts"`
 	HAAssets       int               `json:"ha_assets"`
+	HALeaders      int               `json:"ha_leaders"`
 	API            JetStreamAPIStats `json:"api"`
 }
 
@@ -212,7 +213,200 @@ type keyGen func(context []byte) ([]byte, error)
 // Return a key generation function or nil if encryption not enabled.
 // keyGen defined in filestore.go - keyGen func(iv, context []byte) []byte
 func (s *Server) jsKeyGen(info string) keyGen {
-	if ek := s.getOpts().JetStreamKey; ek != _EMPTY_ {
+	return jsKeyGen(s.getOpts().JetStreamKey, info)
+}
+
+// Return a key generation function for our previous key, used when rotating keys,
+// or nil if not set.
+func (s *Server) jsOldKeyGen(info string) keyGen {
+	return jsKeyGen(s.getOpts().JetStreamOldKey, info)
+}
+
+// Rotate the encryption of all our file based stores, including our raft logs and persisted
+// memory streams, to our current key and cipher. Existing blocks are re-encrypted in the background.
+func (s *Server) rotateJetStreamKeys() {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	sc := s.getOpts().JetStreamCipher
+
+	var streams []*stream
+	js.mu.RLock()
+	for _, jsa := range js.accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			streams = append(streams, mset)
+		}
+		jsa.mu.RUnlock()
+	}
+	js.mu.RUnlock()
+
+	for _, mset := range streams {
+		mset.mu.RLock()
+		store, accName, name := mset.store, mset.acc.Name, mset.cfg.Name
+		mset.mu.RUnlock()
+		var err error
+		switch st := store.(type) {
+		case *fileStore:
+			err = st.rotateEncryption(s.jsKeyGen(accName), s.jsOldKeyGen(accName), sc)
+		case *memStore:
+			err = st.rotateEncryption(s.jsKeyGen(accName), s.jsOldKeyGen(accName), sc)
+		default:
+			continue
+		}
+		if err != nil {
+			s.Warnf("Error rotating encryption key for stream '%s > %s': %v", accName, name, err)
+		}
+	}
+
+	var nodes []*raft
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n.(*raft))
+	}
+	s.rnMu.RUnlock()
+
+	for _, n := range nodes {
+		n.RLock()
+		fs, _ := n.wal.(*fileStore)
+		group := n.group
+		n.RUnlock()
+		if fs == nil {
+			continue
+		}
+		// Our logs keep their cipher, only the key changes.
+		_, _, wsc := fs.keyGens()
+		if err := fs.rotateEncryption(s.jsKeyGen(group), s.jsOldKeyGen(group), wsc); err != nil {
+			s.Warnf("Error rotating encryption key for raft group %q: %v", group, err)
+		}
+	}
+}
+
+// Returns the file stores of all of our streams.
+func (s *Server) jsFileStores() []*fileStore {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	var stores []*fileStore
+	js.mu.RLock()
+	for _, jsa := range js.accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			mset.mu.RLock()
+			if fs, ok := mset.store.(*fileStore); ok {
+				stores = append(stores, fs)
+			}
+			mset.mu.RUnlock()
+		}
+		jsa.mu.RUnlock()
+	}
+	js.mu.RUnlock()
+	return stores
+}
+
+// Returns the persisted memory stores of all of our streams.
+func (s *Server) jsPersistedMemStores() []*memStore {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	var stores []*memStore
+	js.mu.RLock()
+	for _, jsa := range js.accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			mset.mu.RLock()
+			if ms, ok := mset.store.(*memStore); ok && mset.cfg.Persist {
+				stores = append(stores, ms)
+			}
+			mset.mu.RUnlock()
+		}
+		jsa.mu.RUnlock()
+	}
+	js.mu.RUnlock()
+	return stores
+}
+
+// Returns the file stores holding the logs of all of our raft groups.
+func (s *Server) raftFileStores() []*fileStore {
+	var nodes []*raft
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n.(*raft))
+	}
+	s.rnMu.RUnlock()
+
+	var stores []*fileStore
+	for _, n := range nodes {
+		n.RLock()
+		if fs, ok := n.wal.(*fileStore); ok {
+			stores = append(stores, fs)
+		}
+		n.RUnlock()
+	}
+	return stores
+}
+
+// Returns the combined progress of re-encrypting all of our streams, persisted memory
+// streams and raft logs after a key rotation.
+func (s *Server) jsKeyRotationState() keyRotation {
+	var rot keyRotation
+	add := func(r keyRotation) {
+		rot.active = rot.active || r.active
+		rot.total += r.total
+		rot.done += r.done
+		if rot.err == nil {
+			rot.err = r.err
+		}
+	}
+	for _, fs := range s.jsFileStores() {
+		add(fs.keyRotationState())
+	}
+	for _, ms := range s.jsPersistedMemStores() {
+		add(ms.keyRotationState())
+	}
+	for _, fs := range s.raftFileStores() {
+		add(fs.keyRotationState())
+	}
+	return rot
+}
+
+// Returns the combined results of verifying the blocks of all of our streams.
+func (s *Server) jsScrubState() scrubStats {
+	var stats scrubStats
+	for _, fs := range s.jsFileStores() {
+		fst := fs.scrubState()
+		stats.runs += fst.runs
+		stats.blocks += fst.blocks
+		stats.ranges += fst.ranges
+		stats.msgs += fst.msgs
+		stats.repaired += fst.repaired
+		if fst.last.After(stats.last) {
+			stats.last = fst.last
+		}
+	}
+	return stats
+}
+
+// Returns the combined results of compacting the sparse blocks of all of our streams.
+func (s *Server) jsCompactState() compactStats {
+	var stats compactStats
+	for _, fs := range s.jsFileStores() {
+		fst := fs.compactState()
+		stats.runs += fst.runs
+		stats.blocks += fst.blocks
+		stats.reclaimed += fst.reclaimed
+		if fst.last.After(stats.last) {
+			stats.last = fst.last
+		}
+	}
+	return stats
+}
+
+func jsKeyGen(ek, info string) keyGen {
+	if ek != _EMPTY_ {
 		return func(context []byte) ([]byte, error) {
 			h := hmac.New(sha256.New, []byte(ek))
 			if _, err := h.Write([]byte(info)); err != nil {
@@ -229,10 +423,34 @@ func (s *Server) jsKeyGen(info string) keyGen {
 
 // Decode the encrypted metafile.
 func (s *Server) decryptMeta(sc StoreCipher, ekey, buf []byte, acc, context string) ([]byte, error) {
+	return decryptMeta(s.jsKeyGen(acc), sc, ekey, buf, context)
+}
+
+// Decode the encrypted metafile with either cipher, and then with our previous key if set.
+// Returns the cipher that was used and whether it was with our previous key.
+func (s *Server) decryptMetaAny(sc StoreCipher, ekey, buf []byte, acc, context string) ([]byte, StoreCipher, bool, error) {
+	var err error
+	for i, prf := range []keyGen{s.jsKeyGen(acc), s.jsOldKeyGen(acc)} {
+		if prf == nil {
+			continue
+		}
+		for _, osc := range []StoreCipher{sc, otherCipher(sc)} {
+			var plain []byte
+			if plain, err = decryptMeta(prf, osc, ekey, buf, context); err == nil {
+				return plain, osc, i > 0, nil
+			}
+		}
+	}
+	if err == nil {
+		err = errNoEncryption
+	}
+	return nil, sc, false, err
+}
+
+func decryptMeta(prf keyGen, sc StoreCipher, ekey, buf []byte, context string) ([]byte, error) {
 	if len(ekey) < minMetaKeySize {
 		return nil, errBadKeySize
 	}
-	prf := s.jsKeyGen(acc)
 	if prf == nil {
 		return nil, errNoEncryption
 	}
@@ -908,6 +1126,7 @@ func (s *Server) shutdownJetStream() {
 			cc.qch = nil
 		}
 		js.stopUpdatesSub()
+		js.stopLeaderRebalanceSubs()
 		if cc.c != nil {
 			cc.c.closeConnection(ClientClosed)
 			cc.c = nil
@@ -1151,6 +1370,9 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 	plaintext := true
 	sc := s.getOpts().JetStreamCipher
 
+	// Finish swapping in any persisted memory streams that were interrupted.
+	recoverMemStorePersist(jsa.storeDir)
+
 	// Now recover the streams.
 	fis, _ := os.ReadDir(sdir)
 	for _, fi := range fis {
@@ -1162,6 +1384,9 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 		}
 		metafile := filepath.Join(mdir, JetStreamMetaFile)
 		metasum := filepath.Join(mdir, JetStreamMetaFileSum)
+		keyFile := filepath.Join(mdir, JetStreamMetaFileKey)
+		// Finish or discard any key rotation that was interrupted.
+		recoverFilesAtomic(metafile, metasum, keyFile)
 		if _, err := os.Stat(metafile); os.IsNotExist(err) {
 			s.Warnf("  Missing stream metafile for %q", metafile)
 			continue
@@ -1187,12 +1412,11 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			continue
 		}
 
-		// Track if we are converting ciphers.
+		// Track if we are converting ciphers or rotating keys.
 		var osc StoreCipher
-		var convertingCiphers bool
+		var convertingCiphers, rotatingKeys bool
 
 		// Check if we are encrypted.
-		keyFile := filepath.Join(mdir, JetStreamMetaFileKey)
 		if key, err := os.ReadFile(keyFile); err == nil {
 			s.Debugf("  Stream metafile is encrypted, reading encrypted keyfile")
 			if len(key) < minMetaKeySize {
@@ -1200,27 +1424,20 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 				continue
 			}
 			// Decode the buffer before proceeding.
-			nbuf, err := s.decryptMeta(sc, key, buf, a.Name, fi.Name())
-			if err != nil {
-				// See if we are changing ciphers.
-				switch sc {
-				case ChaCha:
-					nbuf, err = s.decryptMeta(AES, key, buf, a.Name, fi.Name())
-					osc, convertingCiphers = AES, true
-				case AES:
-					nbuf, err = s.decryptMeta(ChaCha, key, buf, a.Name, fi.Name())
-					osc, convertingCiphers = ChaCha, true
-				}
-				if err != nil {
-					s.Warnf("  Error decrypting our stream metafile: %v", err)
-					continue
-				}
+			var nbuf []byte
+			if nbuf, osc, rotatingKeys, err = s.decryptMetaAny(sc, key, buf, a.Name, fi.Name()); err != nil {
+				s.Warnf("  Error decrypting our stream metafile: %v", err)
+				continue
 			}
+			convertingCiphers = osc != sc && !rotatingKeys
 			buf = nbuf
 			plaintext = false
 
 			// Remove the key file to have system regenerate with the new cipher.
-			os.Remove(keyFile)
+			// When rotating keys the store will replace all files at once instead.
+			if !rotatingKeys {
+				os.Remove(keyFile)
+			}
 		}
 
 		var cfg FileStreamInfo
@@ -1272,6 +1489,8 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 				s.Noticef("  Encrypting stream '%s > %s'", a.Name, cfg.StreamConfig.Name)
 			} else if convertingCiphers {
 				s.Noticef("  Converting from %s to %s for stream '%s > %s'", osc, sc, a.Name, cfg.StreamConfig.Name)
+			} else if rotatingKeys {
+				s.Noticef("  Rotating encryption key for stream '%s > %s'", a.Name, cfg.StreamConfig.Name)
 			}
 		}
 
@@ -1307,6 +1526,9 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 		for _, ofi := range ofis {
 			metafile := filepath.Join(e.odir, ofi.Name(), JetStreamMetaFile)
 			metasum := filepath.Join(e.odir, ofi.Name(), JetStreamMetaFileSum)
+			keyFile := filepath.Join(e.odir, ofi.Name(), JetStreamMetaFileKey)
+			// Finish or discard any key rotation that was interrupted.
+			recoverFilesAtomic(metafile, metasum, filepath.Join(e.odir, ofi.Name(), consumerState), keyFile)
 			if _, err := os.Stat(metafile); os.IsNotExist(err) {
 				s.Warnf("    Missing consumer metafile %q", metafile)
 				continue
@@ -1322,23 +1544,14 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			}
 
 			// Check if we are encrypted.
-			if key, err := os.ReadFile(filepath.Join(e.odir, ofi.Name(), JetStreamMetaFileKey)); err == nil {
+			if key, err := os.ReadFile(keyFile); err == nil {
 				s.Debugf("  Consumer metafile is encrypted, reading encrypted keyfile")
-				// Decode the buffer before proceeding.
+				// Decode the buffer before proceeding, this will also handle changing ciphers or keys.
 				ctxName := e.mset.name() + tsep + ofi.Name()
-				nbuf, err := s.decryptMeta(sc, key, buf, a.Name, ctxName)
+				nbuf, _, _, err := s.decryptMetaAny(sc, key, buf, a.Name, ctxName)
 				if err != nil {
-					// See if we are changing ciphers.
-					switch sc {
-					case ChaCha:
-						nbuf, err = s.decryptMeta(AES, key, buf, a.Name, ctxName)
-					case AES:
-						nbuf, err = s.decryptMeta(ChaCha, key, buf, a.Name, ctxName)
-					}
-					if err != nil {
-						s.Warnf("  Error decrypting our consumer metafile: %v", err)
-						continue
-					}
+					s.Warnf("  Error decrypting our consumer metafile: %v", err)
+					continue
 				}
 				buf = nbuf
 			}
@@ -1447,7 +1660,7 @@ func (a *Account) filteredStreams(filter string) []*stream {
 	var msets []*stream
 	for _, mset := range jsa.streams {
 		if filter != _EMPTY_ {
-			for _, subj := range mset.cfg.Subjects {
+			for _, subj := range mset.cfg.storedSubjects() {
 				if SubjectsCollide(filter, subj) {
 					msets = append(msets, mset)
 					break
@@ -1937,6 +2150,11 @@ func (jsa *jsAccount) storageTotals() (uint64, uint64) {
 }
 
 func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bool, *ApiError) {
+	return jsa.wouldExceedLimits(storeType, tierName, 0)
+}
+
+// Check if adding sz bytes would exceed our limits for the given tier.
+func (jsa *jsAccount) wouldExceedLimits(storeType StorageType, tierName string, sz int64) (bool, *ApiError) {
 	jsa.usageMu.RLock()
 	defer jsa.usageMu.RUnlock()
 
@@ -1944,13 +2162,12 @@ func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bo
 	if !ok {
 		return true, NewJSNoLimitsError()
 	}
-	inUse := jsa.usage[tierName]
-	if inUse == nil {
-		// Imply totals of 0
-		return false, nil
+	// Imply totals of 0 if nothing is in use yet.
+	totalMem, totalStore := sz, sz
+	if inUse := jsa.usage[tierName]; inUse != nil {
+		totalMem, totalStore = inUse.total.mem+sz, inUse.total.store+sz
 	}
 	if storeType == MemoryStorage {
-		totalMem := inUse.total.mem
 		if selectedLimits.MemoryMaxStreamBytes > 0 && totalMem > selectedLimits.MemoryMaxStreamBytes {
 			return true, nil
 		}
@@ -1958,7 +2175,6 @@ func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bo
 			return true, nil
 		}
 	} else {
-		totalStore := inUse.total.store
 		if selectedLimits.StoreMaxStreamBytes > 0 && totalStore > selectedLimits.StoreMaxStreamBytes {
 			return true, nil
 		}
@@ -2102,6 +2318,7 @@ func (js *jetStream) usageStats() *JetStreamStats {
 	stats.Memory = (uint64)(atomic.LoadInt64(&js.memUsed))
 	stats.Store = (uint64)(atomic.LoadInt64(&js.storeUsed))
 	stats.HAAssets = s.numRaftNodes()
+	stats.HALeaders = s.numRaftLeaders()
 	return &stats
 }
 
@@ -2695,6 +2912,12 @@ func validateJetStreamOptions(o *Options) error {
 	if o.JetStreamMaxCatchup < 0 {
 		return fmt.Errorf("jetstream max catchup cannot be negative")
 	}
+	if o.JetStreamLeaderRebalance < 0 {
+		return fmt.Errorf("jetstream leader rebalance interval cannot be negative")
+	}
+	if o.JetStreamLeaderRebalanceMoves < 0 {
+		return fmt.Errorf("jetstream leader rebalance max moves cannot be negative")
+	}
 	return nil
 }
 
@@ -164,6 +164,21 @@ const (
 	JSApiConsumerDelete  = "$JS.API.CONSUMER.DELETE.*.*"
 	JSApiConsumerDeleteT = "$JS.API.CONSUMER.DELETE.%s.%s"
 
+	// JSApiConsumerPause is the endpoint to pause or resume consumers.
+	// Will return JSON response.
+	JSApiConsumerPause  = "$JS.API.CONSUMER.PAUSE.*.*"
+	JSApiConsumerPauseT = "$JS.API.CONSUMER.PAUSE.%s.%s"
+
+	// JSApiConsumerReset is the endpoint to move a consumer back or forward to a given starting point.
+	// Will return JSON response.
+	JSApiConsumerReset  = "$JS.API.CONSUMER.RESET.*.*"
+	JSApiConsumerResetT = "$JS.API.CONSUMER.RESET.%s.%s"
+
+	// JSApiConsumerUnpin is the endpoint to unpin the pinned client of a consumer's priority group.
+	// Will return JSON response.
+	JSApiConsumerUnpin  = "$JS.API.CONSUMER.UNPIN.*.*"
+	JSApiConsumerUnpinT = "$JS.API.CONSUMER.UNPIN.%s.%s"
+
 	// JSApiRequestNextT is the prefix for the request next message(s) for a consumer in worker/pull mode.
 	JSApiRequestNextT = "$JS.API.CONSUMER.MSG.NEXT.%s.%s"
 
@@ -261,6 +276,9 @@ const (
 	// JSAdvisoryConsumerDeletedPre notification that a template deleted.
 	JSAdvisoryConsumerDeletedPre = "$JS.EVENT.ADVISORY.CONSUMER.DELETED"
 
+	// JSAdvisoryConsumerPausePre notification that a consumer was paused or resumed.
+	JSAdvisoryConsumerPausePre = "$JS.EVENT.ADVISORY.CONSUMER.PAUSED"
+
 	// JSAdvisoryStreamSnapshotCreatePre notification that a snapshot was created.
 	JSAdvisoryStreamSnapshotCreatePre = "$JS.EVENT.ADVISORY.STREAM.SNAPSHOT_CREATE"
 
@@ -273,6 +291,9 @@ const (
 	// JSAdvisoryStreamRestoreCompletePre notification that a restore was completed.
 	JSAdvisoryStreamRestoreCompletePre = "$JS.EVENT.ADVISORY.STREAM.RESTORE_COMPLETE"
 
+	// JSAdvisoryStreamCorruptPre notification that a stream has a damaged range of messages.
+	JSAdvisoryStreamCorruptPre = "$JS.EVENT.ADVISORY.STREAM.CORRUPT"
+
 	// JSAdvisoryStreamLeaderElectedPre notification that a replicated stream has elected a leader.
 	JSAdvisoryStreamLeaderElectedPre = "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED"
 
@@ -404,6 +425,8 @@ type JSApiStreamInfoRequest struct {
 	ApiPagedRequest
 	DeletedDetails bool   `json:"deleted_details,omitempty"`
 	SubjectsFilter string `json:"subjects_filter,omitempty"`
+	// Linearizable confirms leadership with the stream's peers before responding.
+	Linearizable bool `json:"linearizable,omitempty"`
 }
 
 type JSApiStreamInfoResponse struct {
@@ -524,6 +547,8 @@ type JSApiStreamRestoreRequest struct {
 	Config StreamConfig `json:"config"`
 	// Current State for the given stream.
 	State StreamState `json:"state"`
+	// Optional point in time and identity for the restored stream.
+	StreamRestoreOptions
 }
 
 // JSApiStreamRestoreResponse is the direct response to the restore request.
@@ -621,6 +646,9 @@ type JSApiMsgGetRequest struct {
 	Seq     uint64 `json:"seq,omitempty"`
 	LastFor string `json:"last_by_subj,omitempty"`
 	NextFor string `json:"next_by_subj,omitempty"`
+	// Linearizable confirms leadership with the stream's peers before responding.
+	// Not supported for direct gets.
+	Linearizable bool `json:"linearizable,omitempty"`
 }
 
 type JSApiMsgGetResponse struct {
@@ -647,6 +675,53 @@ type JSApiConsumerDeleteResponse struct {
 
 const JSApiConsumerDeleteResponseType = "io.nats.jetstream.api.v1.consumer_delete_response"
 
+// JSApiConsumerPauseRequest is the request to pause a consumer until the given time.
+// A zero or past time resumes the consumer.
+type JSApiConsumerPauseRequest struct {
+	PauseUntil time.Time `json:"pause_until,omitempty"`
+}
+
+type JSApiConsumerPauseResponse struct {
+	ApiResponse
+	Paused         bool          `json:"paused"`
+	PauseUntil     time.Time     `json:"pause_until"`
+	PauseRemaining time.Duration `json:"pause_remaining,omitempty"`
+}
+
+const JSApiConsumerPauseResponseType = "io.nats.jetstream.api.v1.consumer_pause_response"
+
+// JSApiConsumerResetRequest is the request to reset a consumer to deliver from the
+// given stream sequence, or from the first message at or after the given time.
+type JSApiConsumerResetRequest struct {
+	StartSeq  uint64     `json:"start_seq,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+}
+
+type JSApiConsumerResetResponse struct {
+	ApiResponse
+	*ConsumerInfo
+	ResetSeq uint64 `json:"reset_seq,omitempty"`
+}
+
+const JSApiConsumerResetResponseType = "io.nats.jetstream.api.v1.consumer_reset_response"
+
+// JSApiConsumerUnpinRequest is the request to unpin the pinned client of a priority group.
+type JSApiConsumerUnpinRequest struct {
+	Group string `json:"group"`
+}
+
+type JSApiConsumerUnpinResponse struct {
+	ApiResponse
+}
+
+const JSApiConsumerUnpinResponseType = "io.nats.jetstream.api.v1.consumer_unpin_response"
+
+// JSApiConsumerInfoRequest is optional for consumer info.
+type JSApiConsumerInfoRequest struct {
+	// Linearizable confirms leadership with the consumer's peers before responding.
+	Linearizable bool `json:"linearizable,omitempty"`
+}
+
 type JSApiConsumerInfoResponse struct {
 	ApiResponse
 	*ConsumerInfo
@@ -682,6 +757,15 @@ type JSApiConsumerGetNextRequest struct {
 	MaxBytes  int           `json:"max_bytes,omitempty"`
 	NoWait    bool          `json:"no_wait,omitempty"`
 	Heartbeat time.Duration `json:"idle_heartbeat,omitempty"`
+	PriorityGroup
+}
+
+// PriorityGroup is the part of a next message request that selects a priority group.
+type PriorityGroup struct {
+	Group         string `json:"group,omitempty"`
+	Id            string `json:"id,omitempty"`
+	MinPending    int64  `json:"min_pending,omitempty"`
+	MinAckPending int64  `json:"min_ack_pending,omitempty"`
 }
 
 // JSApiStreamTemplateCreateResponse for creating templates.
@@ -857,6 +941,9 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiConsumerList, s.jsConsumerListRequest},
 		{JSApiConsumerInfo, s.jsConsumerInfoRequest},
 		{JSApiConsumerDelete, s.jsConsumerDeleteRequest},
+		{JSApiConsumerPause, s.jsConsumerPauseRequest},
+		{JSApiConsumerReset, s.jsConsumerResetRequest},
+		{JSApiConsumerUnpin, s.jsConsumerUnpinRequest},
 	}
 
 	js.mu.Lock()
@@ -1536,7 +1623,7 @@ func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, _ *Account,
 						resp.Streams = append(resp.Streams, stream)
 					}
 				} else {
-					for _, subj := range sa.Config.Subjects {
+					for _, subj := range sa.Config.storedSubjects() {
 						if SubjectsCollide(filter, subj) {
 							resp.Streams = append(resp.Streams, stream)
 							break
@@ -1803,7 +1890,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 		return
 	}
 
-	var details bool
+	var details, linearizable bool
 	var subjects string
 	var offset int
 	if !isEmptyRequest(msg) {
@@ -1814,7 +1901,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 			return
 		}
 		details, subjects = req.DeletedDetails, req.SubjectsFilter
-		offset = req.Offset
+		offset, linearizable = req.Offset, req.Linearizable
 	}
 
 	mset, err := acc.lookupStream(streamName)
@@ -1823,6 +1910,28 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+
+	if linearizable {
+		msg = copyBytes(msg)
+		err := queueLinearizableRead(mset.raftNode(), func(err error) {
+			if err != nil {
+				resp.Error = NewJSClusterNotLeaderError()
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			s.sendStreamInfo(ci, acc, subject, reply, msg, mset, &resp, details, subjects, offset, clusterWideConsCount)
+		})
+		if err != nil {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	s.sendStreamInfo(ci, acc, subject, reply, msg, mset, &resp, details, subjects, offset, clusterWideConsCount)
+}
+
+// Fill in and send the stream info response.
+func (s *Server) sendStreamInfo(ci *ClientInfo, acc *Account, subject, reply string, msg []byte, mset *stream, resp *JSApiStreamInfoResponse, details bool, subjects string, offset, clusterWideConsCount int) {
 	config := mset.config()
 
 	js, _ := s.getJetStreamCluster()
@@ -3017,8 +3126,30 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 		return
 	}
 
+	if req.Linearizable {
+		msg = copyBytes(msg)
+		err := queueLinearizableRead(mset.raftNode(), func(err error) {
+			if err != nil {
+				resp.Error = NewJSClusterNotLeaderError()
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			s.sendMsgGet(ci, acc, subject, reply, msg, mset, &req, &resp)
+		})
+		if err != nil {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	s.sendMsgGet(ci, acc, subject, reply, msg, mset, &req, &resp)
+}
+
+// Load the requested message and send the msg get response.
+func (s *Server) sendMsgGet(ci *ClientInfo, acc *Account, subject, reply string, msg []byte, mset *stream, req *JSApiMsgGetRequest, resp *JSApiMsgGetResponse) {
 	var svp StoreMsg
 	var sm *StoreMsg
+	var err error
 
 	if req.Seq > 0 && req.NextFor == _EMPTY_ {
 		sm, err = mset.store.LoadMsg(req.Seq, &svp)
@@ -3029,7 +3160,7 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 	}
 	if err != nil {
 		resp.Error = NewJSNoMessageFoundError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 		return
 	}
 	resp.Message = &StoredMsg{
@@ -3226,6 +3357,17 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, _ *Account
 		return
 	}
 
+	if req.Sequence > 0 && req.Time != nil {
+		resp.Error = NewJSStreamRestoreError(errors.New("sequence and time are mutually exclusive"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Rename && cfg.Backend != _EMPTY_ {
+		resp.Error = NewJSStreamRestoreError(errors.New("rename not supported with a store backend"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	if s.JetStreamIsClustered() {
 		s.jsClusteredStreamRestoreRequest(ci, acc, &req, stream, subject, reply, rmsg)
 		return
@@ -3251,10 +3393,14 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, _ *Account
 		return
 	}
 
-	s.processStreamRestore(ci, acc, &req.Config, subject, reply, string(msg))
+	var ropts *StreamRestoreOptions
+	if req.StreamRestoreOptions.isSet() {
+		ropts = &req.StreamRestoreOptions
+	}
+	s.processStreamRestore(ci, acc, &req.Config, ropts, subject, reply, string(msg))
 }
 
-func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamConfig, subject, reply, msg string) <-chan error {
+func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamConfig, ropts *StreamRestoreOptions, subject, reply, msg string) <-chan error {
 	js := s.getJetStream()
 
 	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
@@ -3398,7 +3544,7 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 				if err == nil {
 					s.Debugf("Finalizing restore for stream '%s > %s'", acc.Name, streamName)
 					tfile.Seek(0, 0)
-					mset, err = acc.RestoreStream(cfg, tfile)
+					mset, err = acc.restoreStream(cfg, tfile, ropts)
 				} else {
 					errStr := err.Error()
 					tmp := []rune(errStr)
@@ -4094,10 +4240,13 @@ func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, _ *Account,
 
 	var resp = JSApiConsumerInfoResponse{ApiResponse: ApiResponse{Type: JSApiConsumerInfoResponseType}}
 
+	var req JSApiConsumerInfoRequest
 	if !isEmptyRequest(msg) {
-		resp.Error = NewJSNotEmptyRequestError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
 	}
 
 	// If we are in clustered mode we need to be the stream leader to proceed.
@@ -4222,6 +4371,23 @@ func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, _ *Account,
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if req.Linearizable {
+		msg = copyBytes(msg)
+		err := queueLinearizableRead(obs.raftNode(), func(err error) {
+			if err != nil {
+				resp.Error = NewJSClusterNotLeaderError()
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			resp.ConsumerInfo = obs.info()
+			s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+		})
+		if err != nil {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
 	resp.ConsumerInfo = obs.info()
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
@@ -4298,6 +4464,292 @@ func (s *Server) jsConsumerDeleteRequest(sub *subscription, c *client, _ *Accoun
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
+// Request to pause or resume a consumer.
+func (s *Server) jsConsumerPauseRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerPauseResponse{ApiResponse: ApiResponse{Type: JSApiConsumerPauseResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	// An empty request resumes the consumer.
+	var req JSApiConsumerPauseRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+	var pauseUntil *time.Time
+	if !req.PauseUntil.IsZero() {
+		pauseUTC := req.PauseUntil.UTC()
+		pauseUntil = &pauseUTC
+	}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerPauseRequest(ci, acc, stream, consumer, subject, reply, rmsg, pauseUntil)
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	obs := mset.lookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	ncfg := obs.config()
+	ncfg.PauseUntil = pauseUntil
+	if err := obs.updateConfig(&ncfg); err != nil {
+		resp.Error = NewJSConsumerCreateError(err, Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.setPauseState(&ncfg)
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Fills in the pause state of the response from the consumer config.
+func (resp *JSApiConsumerPauseResponse) setPauseState(cfg *ConsumerConfig) {
+	if cfg.PauseUntil != nil {
+		resp.PauseUntil = cfg.PauseUntil.UTC()
+	}
+	resp.Paused, resp.PauseRemaining = cfg.pauseState()
+}
+
+// Request to reset a consumer's starting point.
+func (s *Server) jsConsumerResetRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerResetResponse{ApiResponse: ApiResponse{Type: JSApiConsumerResetResponseType}}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	// If we are in clustered mode the consumer leader will process this through its group.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa, ca := cc.isLeader(), js.streamAssignment(acc.Name, stream), js.consumerAssignment(acc.Name, stream, consumer)
+		js.mu.RUnlock()
+
+		if sa == nil || ca == nil {
+			// Only the meta leader will respond when not found.
+			if isLeader {
+				if sa == nil {
+					resp.Error = NewJSStreamNotFoundError()
+				} else {
+					resp.Error = NewJSConsumerNotFoundError()
+				}
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			}
+			return
+		}
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(ca.Group) {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if !acc.JetStreamIsConsumerLeader(stream, consumer) {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiConsumerResetRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if (req.StartSeq == 0) == (req.StartTime == nil) {
+		resp.Error = NewJSConsumerResetInvalidRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if mset.config().Retention != LimitsPolicy {
+		resp.Error = NewJSConsumerResetRequiresLimitsError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	obs := mset.lookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if resp.ResetSeq, err = obs.resetStartingSeq(req.StartSeq, req.StartTime); err != nil {
+		resp.Error = NewJSConsumerNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ConsumerInfo = obs.info()
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to unpin the pinned client of a consumer's priority group.
+func (s *Server) jsConsumerUnpinRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerUnpinResponse{ApiResponse: ApiResponse{Type: JSApiConsumerUnpinResponseType}}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	// If we are in clustered mode only the consumer leader holds the pin.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa, ca := cc.isLeader(), js.streamAssignment(acc.Name, stream), js.consumerAssignment(acc.Name, stream, consumer)
+		js.mu.RUnlock()
+
+		if sa == nil || ca == nil {
+			// Only the meta leader will respond when not found.
+			if isLeader {
+				if sa == nil {
+					resp.Error = NewJSStreamNotFoundError()
+				} else {
+					resp.Error = NewJSConsumerNotFoundError()
+				}
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			}
+			return
+		}
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(ca.Group) {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if !acc.JetStreamIsConsumerLeader(stream, consumer) {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiConsumerUnpinRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	obs := mset.lookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !obs.unpin(req.Group) {
+		resp.Error = NewJSConsumerInvalidPriorityGroupError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
 // sendJetStreamAPIAuditAdvisor will send the audit event for a given event.
 func (s *Server) sendJetStreamAPIAuditAdvisory(ci *ClientInfo, acc *Account, subject, request, response string) {
 	s.publishAdvisory(acc, JSAuditAdvisory, JSAPIAudit{
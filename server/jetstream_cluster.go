@@ -26,6 +26,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -66,6 +67,11 @@ type jetStreamCluster struct {
 	peerStreamCancelMove *subscription
 	// To pop out the monitorCluster before the raft layer.
 	qch chan struct{}
+	// For reporting the groups we lead and moving their leadership when the meta leader rebalances.
+	leadersReq     *subscription
+	leaderStepDown *subscription
+	// Meta leader only, if we are in the middle of rebalancing leaders.
+	rebalancing bool
 }
 
 // Used to guide placement of streams and meta controllers in clustered JetStream.
@@ -102,6 +108,12 @@ const (
 	removePendingRequest
 	// For sending compressed streams, either through RAFT or catchup.
 	compressedStreamMsgOp
+	// For resetting a consumer's starting point.
+	resetSeqOp
+	// For storing an atomic batch of stream messages.
+	batchMsgOp
+	// For replicating the pinned client of a consumer's priority group.
+	updatePinOp
 )
 
 // raftGroups are controlled by the metagroup controller.
@@ -126,6 +138,8 @@ type streamAssignment struct {
 	Subject string        `json:"subject"`
 	Reply   string        `json:"reply"`
 	Restore *StreamState  `json:"restore_state,omitempty"`
+	// Point in time and identity for a restore, if any.
+	RestoreOpts *StreamRestoreOptions `json:"restore_opts,omitempty"`
 	// Internal
 	consumers map[string]*consumerAssignment
 	responded bool
@@ -143,6 +157,8 @@ type consumerAssignment struct {
 	Subject string          `json:"subject"`
 	Reply   string          `json:"reply"`
 	State   *ConsumerState  `json:"state,omitempty"`
+	// Set when this update was proposed by a pause request, so we respond with the pause state.
+	Pause bool `json:"pause,omitempty"`
 	// Internal
 	responded bool
 	deleted   bool
@@ -618,11 +634,12 @@ func (js *jetStream) setupMetaGroup() error {
 	sysAcc := s.SystemAccount()
 	storeDir := filepath.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, defaultMetaGroupName)
 
-	fs, err := newFileStoreWithCreated(
-		FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMetaFSBlkSize, AsyncFlush: false},
+	fs, err := newFileStoreWithKeys(
+		FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMetaFSBlkSize, AsyncFlush: false, ScrubInterval: -1},
 		StreamConfig{Name: defaultMetaGroupName, Storage: FileStorage},
 		time.Now().UTC(),
 		s.jsKeyGen(defaultMetaGroupName),
+		s.jsOldKeyGen(defaultMetaGroupName),
 	)
 	if err != nil {
 		s.Errorf("Error creating filestore: %v", err)
@@ -699,6 +716,7 @@ func (js *jetStream) setupMetaGroup() error {
 	}
 	atomic.StoreInt32(&js.clustered, 1)
 	c.registerWithAccount(sacc)
+	js.startLeaderRebalanceSubs()
 
 	js.srv.startGoRoutine(js.monitorCluster)
 	return nil
@@ -984,6 +1002,14 @@ func (js *jetStream) monitorCluster() {
 	lt := time.NewTicker(leaderCheckInterval)
 	defer lt.Stop()
 
+	// Used to periodically rebalance stream and consumer leaders if configured.
+	var rbc <-chan time.Time
+	if rbi := s.getOpts().JetStreamLeaderRebalance; rbi > 0 {
+		rbt := time.NewTicker(rbi)
+		defer rbt.Stop()
+		rbc = rbt.C
+	}
+
 	var (
 		isLeader     bool
 		lastSnap     []byte
@@ -1092,6 +1118,10 @@ func (js *jetStream) monitorCluster() {
 			if n.Leader() {
 				js.checkClusterSize()
 			}
+		case <-rbc:
+			if n.Leader() && !js.isMetaRecovering() {
+				js.rebalanceLeaders()
+			}
 		case <-lt.C:
 			s.Debugf("Checking JetStream cluster state")
 			// If we have a current leader or had one in the past we can cancel this here since the metaleader
@@ -1337,7 +1367,7 @@ func (js *jetStream) setStreamAssignmentRecovering(sa *streamAssignment) {
 	js.mu.Lock()
 	defer js.mu.Unlock()
 	sa.responded = true
-	sa.Restore = nil
+	sa.Restore, sa.RestoreOpts = nil, nil
 	if sa.Group != nil {
 		sa.Group.Preferred = _EMPTY_
 	}
@@ -1368,6 +1398,8 @@ func (ca *consumerAssignment) copyGroup() *consumerAssignment {
 	cca, cg := *ca, *ca.Group
 	cca.Group = &cg
 	cca.Group.Peers = copyStrings(ca.Group.Peers)
+	// Pause only applies to the proposal made by a pause request.
+	cca.Pause = false
 	return &cca
 }
 
@@ -1719,11 +1751,12 @@ func (js *jetStream) createRaftGroup(accName string, rg *raftGroup, storage Stor
 	storeDir := filepath.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, rg.Name)
 	var store StreamStore
 	if storage == FileStorage {
-		fs, err := newFileStoreWithCreated(
-			FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMediumBlockSize, AsyncFlush: false, SyncInterval: 5 * time.Minute},
+		fs, err := newFileStoreWithKeys(
+			FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMediumBlockSize, AsyncFlush: false, SyncInterval: 5 * time.Minute, ScrubInterval: -1},
 			StreamConfig{Name: rg.Name, Storage: FileStorage},
 			time.Now().UTC(),
 			s.jsKeyGen(rg.Name),
+			s.jsOldKeyGen(rg.Name),
 		)
 		if err != nil {
 			s.Errorf("Error creating filestore WAL: %v", err)
@@ -1782,6 +1815,18 @@ func (mset *stream) raftNode() RaftNode {
 	return mset.node
 }
 
+// Serve a linearizable read by calling f once we have confirmed we are still the leader
+// of this group, and have applied all we know about. If we are not clustered f is called
+// right away. Otherwise this waits on a heartbeat round trip with our peers, so f is called
+// from the group's read Go routine. Returns an error without calling f if we can not queue it.
+func queueLinearizableRead(node RaftNode, f func(err error)) error {
+	if node == nil {
+		f(nil)
+		return nil
+	}
+	return node.QueueRead(f)
+}
+
 func (mset *stream) removeNode() {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
@@ -2002,7 +2047,7 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment, sendSnaps
 				}
 				if isRestore {
 					acc, _ := s.LookupAccount(sa.Client.serviceAccount())
-					restoreDoneCh = s.processStreamRestore(sa.Client, acc, sa.Config, _EMPTY_, sa.Reply, _EMPTY_)
+					restoreDoneCh = s.processStreamRestore(sa.Client, acc, sa.Config, sa.RestoreOpts, _EMPTY_, sa.Reply, _EMPTY_)
 					continue
 				} else if n.NeedSnapshot() {
 					doSnapshot()
@@ -2184,7 +2229,7 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment, sendSnaps
 				s.Debugf("Stream restore failed: %v", err)
 			}
 			isRestore = false
-			sa.Restore = nil
+			sa.Restore, sa.RestoreOpts = nil, nil
 			// If we were successful lookup up our stream now.
 			if err == nil {
 				if mset, err = acc.lookupStream(sa.Config.Name); mset != nil {
@@ -2444,6 +2489,37 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 					s.Debugf("Apply stream entries for '%s > %s' got error processing message: %v",
 						mset.account(), mset.name(), err)
 				}
+			case batchMsgOp:
+				if mset == nil {
+					continue
+				}
+				s := js.srv
+
+				id, reply, msgs, err := decodeStreamBatch(buf[1:])
+				if err != nil {
+					if node := mset.raftNode(); node != nil {
+						s.Errorf("JetStream cluster could not decode stream batch for '%s > %s' [%s]",
+							mset.account(), mset.name(), node.Group())
+					}
+					panic(err.Error())
+				}
+
+				// We can skip if we know we already have these.
+				last, clfs := mset.lastSeqAndCLFS()
+				if lseq := msgs[0].lseq; lseq-clfs < last || (lseq == 0 && last != 0) {
+					s.Debugf("Apply stream entries for '%s > %s' skipping batch with sequence %d with last of %d",
+						mset.account(), mset.name(), lseq+1-clfs, last)
+					continue
+				}
+
+				if err := mset.processJetStreamBatch(id, reply, msgs); err != nil {
+					// Only return in place if we are going to reset stream or we are out of space.
+					if isClusterResetErr(err) || isOutOfSpaceErr(err) {
+						return err
+					}
+					s.Debugf("Apply stream entries for '%s > %s' got error processing batch: %v",
+						mset.account(), mset.name(), err)
+				}
 			case deleteMsgOp:
 				md, err := decodeMsgDelete(buf[1:])
 				if err != nil {
@@ -3090,7 +3166,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 		if len(rg.Peers) == 1 || rg.node != nil && rg.node.ID() == rg.Preferred {
 			shouldCreate = false
 		} else {
-			sa.Restore = nil
+			sa.Restore, sa.RestoreOpts = nil, nil
 		}
 	}
 
@@ -3207,7 +3283,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 		// If we are restoring, process that first.
 		if sa.Restore != nil {
 			// We are restoring a stream here.
-			restoreDoneCh := s.processStreamRestore(sa.Client, acc, sa.Config, _EMPTY_, sa.Reply, _EMPTY_)
+			restoreDoneCh := s.processStreamRestore(sa.Client, acc, sa.Config, sa.RestoreOpts, _EMPTY_, sa.Reply, _EMPTY_)
 			s.startGoRoutine(func() {
 				defer s.grWG.Done()
 				select {
@@ -3746,11 +3822,9 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment, state
 				// Need to clear from rg too.
 				js.mu.Lock()
 				rg.node = nil
-				client, subject, reply := ca.Client, ca.Subject, ca.Reply
+				client, subject, reply, pause := ca.Client, ca.Subject, ca.Reply, ca.Pause
 				js.mu.Unlock()
-				var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
-				resp.ConsumerInfo = o.info()
-				s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
+				s.sendConsumerUpdateResponse(o, acc, client, subject, reply, pause)
 				return
 			}
 		}
@@ -3777,17 +3851,30 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment, state
 				if wasExisting && (isLeader || (!didCreate && rg.node.GroupLeader() == _EMPTY_)) {
 					// Process if existing as an update.
 					js.mu.RLock()
-					client, subject, reply := ca.Client, ca.Subject, ca.Reply
+					client, subject, reply, pause := ca.Client, ca.Subject, ca.Reply, ca.Pause
 					js.mu.RUnlock()
-					var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
-					resp.ConsumerInfo = o.info()
-					s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
+					s.sendConsumerUpdateResponse(o, acc, client, subject, reply, pause)
 				}
 			}
 		}
 	}
 }
 
+// Sends the response for an applied consumer update. Updates proposed by a pause
+// request get the pause state instead of the consumer info.
+func (s *Server) sendConsumerUpdateResponse(o *consumer, acc *Account, ci *ClientInfo, subject, reply string, pause bool) {
+	if pause {
+		var resp = JSApiConsumerPauseResponse{ApiResponse: ApiResponse{Type: JSApiConsumerPauseResponseType}}
+		cfg := o.config()
+		resp.setPauseState(&cfg)
+		s.sendAPIResponse(ci, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
+		return
+	}
+	var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	resp.ConsumerInfo = o.info()
+	s.sendAPIResponse(ci, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
+}
+
 func (js *jetStream) processClusterDeleteConsumer(ca *consumerAssignment, isMember, wasLeader bool) {
 	if ca == nil {
 		return
@@ -4255,6 +4342,13 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 					}
 				}
 				o.mu.Unlock()
+			case resetSeqOp:
+				o.mu.Lock()
+				if !o.isLeader() {
+					var le = binary.LittleEndian
+					o.applyReset(le.Uint64(buf[1:]), le.Uint64(buf[9:]))
+				}
+				o.mu.Unlock()
 			case addPendingRequest:
 				o.mu.Lock()
 				if !o.isLeader() {
@@ -4272,6 +4366,16 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 					}
 				}
 				o.mu.Unlock()
+			case updatePinOp:
+				o.mu.Lock()
+				if !o.isLeader() && len(buf) >= 9 {
+					var le = binary.LittleEndian
+					o.pinId, o.pinTS = string(buf[9:]), time.Time{}
+					if ts := int64(le.Uint64(buf[1:])); ts > 0 {
+						o.pinTS = time.Unix(0, ts)
+					}
+				}
+				o.mu.Unlock()
 			default:
 				panic(fmt.Sprintf("JetStream Cluster Unknown group entry op type! %v", entryOp(buf[0])))
 			}
@@ -4368,7 +4472,7 @@ func (js *jetStream) processConsumerLeaderChange(o *consumer, isLeader bool) err
 	}
 	js.mu.Lock()
 	s, account, err := js.srv, ca.Client.serviceAccount(), ca.err
-	client, subject, reply := ca.Client, ca.Subject, ca.Reply
+	client, subject, reply, pause := ca.Client, ca.Subject, ca.Reply, ca.Pause
 	hasResponded := ca.responded
 	ca.responded = true
 	js.mu.Unlock()
@@ -4403,6 +4507,11 @@ func (js *jetStream) processConsumerLeaderChange(o *consumer, isLeader bool) err
 		return nil
 	}
 
+	if pause && err == nil {
+		s.sendConsumerUpdateResponse(o, acc, client, subject, reply, pause)
+		return nil
+	}
+
 	var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
 	if err != nil {
 		resp.Error = NewJSConsumerCreateError(err, Unless(err))
@@ -4681,6 +4790,295 @@ func (js *jetStream) stopUpdatesSub() {
 	}
 }
 
+const (
+	// Meta leader asks all servers for the stream and consumer groups they lead.
+	jscLeadersSubj = "$JSC.LDR"
+	// Meta leader asks a server to transfer leadership of a group to another peer.
+	jscLeaderStepDownT = "$JSC.LDR.SD.%s"
+	// How long the meta leader waits for servers to report the groups they lead.
+	leaderReportWait = 250 * time.Millisecond
+	// Default number of leaders moved each rebalance interval.
+	defaultLeaderRebalanceMoves = 1
+)
+
+// leaderReport is what a server sends the meta leader about the groups it leads.
+type leaderReport struct {
+	Peer   string   `json:"peer"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// leaderStepDown asks the leader of a group to transfer leadership to the preferred peer.
+type leaderStepDown struct {
+	Group     string `json:"group"`
+	Preferred string `json:"preferred"`
+	// The peer we believe is the current leader.
+	leader string
+}
+
+// Lock should be held.
+func (js *jetStream) startLeaderRebalanceSubs() {
+	cc, s, c := js.cluster, js.srv, js.cluster.c
+	if cc.leadersReq == nil {
+		cc.leadersReq, _ = s.systemSubscribe(jscLeadersSubj, _EMPTY_, false, c, js.processLeadersRequest)
+	}
+	if cc.leaderStepDown == nil {
+		subj := fmt.Sprintf(jscLeaderStepDownT, cc.meta.ID())
+		cc.leaderStepDown, _ = s.systemSubscribe(subj, _EMPTY_, false, c, js.processLeaderStepDownRequest)
+	}
+}
+
+// Every server answers the meta leader, so these stay in place across
+// meta leader changes and are only removed when JetStream shuts down.
+// Lock should be held.
+func (js *jetStream) stopLeaderRebalanceSubs() {
+	cc := js.cluster
+	if cc.leadersReq != nil {
+		cc.s.sysUnsubscribe(cc.leadersReq)
+		cc.leadersReq = nil
+	}
+	if cc.leaderStepDown != nil {
+		cc.s.sysUnsubscribe(cc.leaderStepDown)
+		cc.leaderStepDown = nil
+	}
+}
+
+// Report the stream and consumer groups we lead to the meta leader.
+func (js *jetStream) processLeadersRequest(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+	if reply == _EMPTY_ {
+		return
+	}
+	if lr := js.ourLeaderReport(); lr != nil {
+		js.srv.sendInternalMsgLocked(reply, _EMPTY_, nil, lr)
+	}
+}
+
+// Returns the stream and consumer groups we lead.
+func (js *jetStream) ourLeaderReport() *leaderReport {
+	mg := js.getMetaGroup()
+	if mg == nil {
+		return nil
+	}
+	s := js.srv
+	lr := &leaderReport{Peer: mg.ID()}
+
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		if n != mg {
+			nodes = append(nodes, n)
+		}
+	}
+	s.rnMu.RUnlock()
+
+	for _, n := range nodes {
+		if n.Leader() {
+			lr.Groups = append(lr.Groups, n.Group())
+		}
+	}
+	return lr
+}
+
+// The meta leader wants us to move leadership of a group we lead to another peer.
+func (js *jetStream) processLeaderStepDownRequest(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+	var req leaderStepDown
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return
+	}
+	js.rebalanceStepDown(&req)
+}
+
+// Move leadership of a group we lead to the preferred peer.
+func (js *jetStream) rebalanceStepDown(req *leaderStepDown) {
+	s := js.srv
+	n := s.lookupRaftNode(req.Group)
+	if n == nil || !n.Leader() {
+		return
+	}
+	// Only step down if the preferred peer can take over, otherwise we would just cause an election.
+	var current bool
+	for _, p := range n.Peers() {
+		if p.ID == req.Preferred {
+			current = p.Current && time.Since(p.Last) < lostQuorumInterval
+			break
+		}
+	}
+	if !current {
+		s.Debugf("Not rebalancing leader of group %q, preferred peer %q is not current", req.Group, req.Preferred)
+		return
+	}
+	s.Debugf("Rebalancing leader of group %q to %q", req.Group, s.serverNameForNode(req.Preferred))
+	n.StepDown(req.Preferred)
+}
+
+// rebalanceLeaders is run periodically by the meta leader to even out stream and consumer
+// leadership. All servers report the groups they lead and we move leadership of up to
+// JetStreamLeaderRebalanceMoves groups from the servers leading the most to the peers in
+// those groups leading the least.
+func (js *jetStream) rebalanceLeaders() {
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil || cc.rebalancing || !cc.isLeader() {
+		js.mu.Unlock()
+		return
+	}
+	cc.rebalancing = true
+	s, ourID := js.srv, cc.meta.ID()
+	js.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer func() {
+			js.mu.Lock()
+			cc.rebalancing = false
+			js.mu.Unlock()
+		}()
+		for _, sd := range js.computeLeaderMoves(js.collectLeaderReports()) {
+			s.Noticef("Rebalancing JetStream leaders, moving group %q from %q to %q",
+				sd.Group, s.serverNameForNode(sd.leader), s.serverNameForNode(sd.Preferred))
+			// We will not receive our own request.
+			if sd.leader == ourID {
+				js.rebalanceStepDown(sd)
+			} else {
+				s.sendInternalMsgLocked(fmt.Sprintf(jscLeaderStepDownT, sd.leader), _EMPTY_, nil, sd)
+			}
+		}
+	})
+}
+
+// Ask all servers for the groups they lead.
+func (js *jetStream) collectLeaderReports() map[string]*leaderReport {
+	s := js.srv
+	reports := make(map[string]*leaderReport)
+	var mu sync.Mutex
+
+	reply := s.newRespInbox()
+	sub, err := s.sysSubscribe(reply, func(_ *subscription, _ *client, _ *Account, _, _ string, msg []byte) {
+		var lr leaderReport
+		if err := json.Unmarshal(msg, &lr); err == nil && lr.Peer != _EMPTY_ {
+			mu.Lock()
+			reports[lr.Peer] = &lr
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		return nil
+	}
+	s.sendInternalMsgLocked(jscLeadersSubj, reply, nil, nil)
+
+	select {
+	case <-s.quitCh:
+	case <-time.After(leaderReportWait):
+	}
+	s.sysUnsubscribe(sub)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// We will not hear our own report.
+	if lr := js.ourLeaderReport(); lr != nil {
+		reports[lr.Peer] = lr
+	}
+	return reports
+}
+
+// Determine which groups to move. We only move a group when the preferred peer would lead at least two fewer groups than the
+// current leader, so we never just swap an imbalance.
+func (js *jetStream) computeLeaderMoves(reports map[string]*leaderReport) []*leaderStepDown {
+	if len(reports) < 2 {
+		return nil
+	}
+	maxMoves := js.srv.getOpts().JetStreamLeaderRebalanceMoves
+	if maxMoves == 0 {
+		maxMoves = defaultLeaderRebalanceMoves
+	}
+
+	js.mu.RLock()
+	cc := js.cluster
+	if cc == nil {
+		js.mu.RUnlock()
+		return nil
+	}
+	// Groups we could move, and their peers.
+	movable := make(map[string][]string)
+	known := make(map[string]struct{})
+	for _, asa := range cc.streams {
+		for _, sa := range asa {
+			if sa.Group == nil || sa.Config == nil {
+				continue
+			}
+			// Skip if disabled, or if we are in the middle of moving the stream.
+			enabled := !sa.Config.NoLeaderRebalance && len(sa.Group.Peers) == sa.Config.Replicas
+			known[sa.Group.Name] = struct{}{}
+			if enabled && len(sa.Group.Peers) > 1 {
+				movable[sa.Group.Name] = copyStrings(sa.Group.Peers)
+			}
+			for _, ca := range sa.consumers {
+				if ca.Group == nil {
+					continue
+				}
+				known[ca.Group.Name] = struct{}{}
+				if enabled && len(ca.Group.Peers) > 1 {
+					movable[ca.Group.Name] = copyStrings(ca.Group.Peers)
+				}
+			}
+		}
+	}
+	js.mu.RUnlock()
+
+	counts := make(map[string]int, len(reports))
+	led := make(map[string][]string, len(reports))
+	for peer, lr := range reports {
+		counts[peer] = 0
+		for _, group := range lr.Groups {
+			if _, ok := known[group]; !ok {
+				continue
+			}
+			counts[peer]++
+			if _, ok := movable[group]; ok {
+				led[peer] = append(led[peer], group)
+			}
+		}
+		sort.Strings(led[peer])
+	}
+
+	var moves []*leaderStepDown
+	for len(moves) < maxMoves {
+		// Look at the peers leading the most first.
+		peers := make([]string, 0, len(counts))
+		for peer := range counts {
+			peers = append(peers, peer)
+		}
+		sort.Slice(peers, func(i, j int) bool {
+			if counts[peers[i]] != counts[peers[j]] {
+				return counts[peers[i]] > counts[peers[j]]
+			}
+			return peers[i] < peers[j]
+		})
+		var sd *leaderStepDown
+		var gi int
+		for _, peer := range peers {
+			best := -1
+			for i, group := range led[peer] {
+				for _, p := range movable[group] {
+					if c, ok := counts[p]; ok && p != peer && counts[peer]-c >= 2 && (best < 0 || c < best) {
+						best, gi, sd = c, i, &leaderStepDown{Group: group, Preferred: p, leader: peer}
+					}
+				}
+			}
+			if sd != nil {
+				break
+			}
+		}
+		if sd == nil {
+			break
+		}
+		moves = append(moves, sd)
+		led[sd.leader] = append(led[sd.leader][:gi], led[sd.leader][gi+1:]...)
+		counts[sd.leader]--
+		counts[sd.Preferred]++
+	}
+	return moves
+}
+
 func (js *jetStream) processLeaderChange(isLeader bool) {
 	if isLeader {
 		js.srv.Noticef("Self is new JetStream cluster metadata leader")
@@ -5747,6 +6145,9 @@ func (s *Server) jsClusteredStreamRestoreRequest(
 	sa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: cfg, Subject: subject, Reply: reply, Client: ci, Created: time.Now().UTC()}
 	// Now add in our restore state and pre-select a peer to handle the actual receipt of the snapshot.
 	sa.Restore = &req.State
+	if req.StreamRestoreOptions.isSet() {
+		sa.RestoreOpts = &req.StreamRestoreOptions
+	}
 	cc.meta.Propose(encodeAddStreamAssignment(sa))
 }
 
@@ -5766,6 +6167,16 @@ func (s *Server) allPeersOffline(rg *raftGroup) bool {
 	return true
 }
 
+// Returns true if we know the given peer is running at least the given version.
+// Unknown peers are treated as not supporting it.
+func (s *Server) peerVersionAtLeast(peer string, major, minor, update int) bool {
+	si, ok := s.nodeToInfo.Load(peer)
+	if !ok || si == nil {
+		return false
+	}
+	return versionAtLeast(si.(nodeInfo).version, major, minor, update)
+}
+
 // This will do a scatter and gather operation for all streams for this account. This is only called from metadata leader.
 // This will be running in a separate Go routine.
 func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, filter string, offset int, subject, reply string, rmsg []byte) {
@@ -5791,7 +6202,7 @@ func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, filt
 					streams = append(streams, sa)
 				}
 			} else {
-				for _, subj := range sa.Config.Subjects {
+				for _, subj := range sa.Config.storedSubjects() {
 					if SubjectsCollide(filter, subj) {
 						streams = append(streams, sa)
 						break
@@ -6116,6 +6527,38 @@ func (s *Server) jsClusteredConsumerDeleteRequest(ci *ClientInfo, acc *Account,
 	cc.meta.Propose(encodeDeleteConsumerAssignment(ca))
 }
 
+func (s *Server) jsClusteredConsumerPauseRequest(ci *ClientInfo, acc *Account, stream, consumer, subject, reply string, rmsg []byte, pauseUntil *time.Time) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var resp = JSApiConsumerPauseResponse{ApiResponse: ApiResponse{Type: JSApiConsumerPauseResponseType}}
+
+	sa := js.streamAssignment(acc.Name, stream)
+	if sa == nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	oca := sa.consumers[consumer]
+	if oca == nil || oca.Config == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Propose the updated config, which will be persisted and applied by all peers.
+	// The consumer leader will respond with the pause state once applied.
+	ca, cfg := oca.copyGroup(), *oca.Config
+	cfg.PauseUntil = pauseUntil
+	ca.Config, ca.Client, ca.Subject, ca.Reply, ca.Pause = &cfg, ci, subject, reply, true
+	cc.meta.Propose(encodeAddConsumerAssignment(ca))
+}
+
 func encodeMsgDelete(md *streamMsgDelete) []byte {
 	var bb bytes.Buffer
 	bb.WriteByte(byte(deleteMsgOp))
@@ -6311,7 +6754,7 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 
 	// Also short circuit if DeliverLastPerSubject is set with no FilterSubject.
 	if cfg.DeliverPolicy == DeliverLastPerSubject {
-		if cfg.FilterSubject == _EMPTY_ {
+		if len(cfg.filters()) == 0 {
 			resp.Error = NewJSConsumerInvalidPolicyError(fmt.Errorf("consumer delivery policy is deliver last per subject, but FilterSubject is not set"))
 			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
 			return
@@ -6721,6 +7164,15 @@ const streamLagWarnThreshold = 10_000
 
 // processClusteredMsg will propose the inbound message to the underlying raft group.
 func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg []byte) error {
+	// Only the stream itself can reference a scheduled message, so strip this from anything inbound.
+	if len(hdr) > 0 {
+		hdr = removeHeaderIfPresent(hdr, JSScheduledSequence)
+	}
+	return mset.proposeInboundMsg(subject, reply, hdr, msg)
+}
+
+// proposeInboundMsg does the actual processing for processClusteredInboundMsg.
+func (mset *stream) proposeInboundMsg(subject, reply string, hdr, msg []byte) error {
 	// For possible error response.
 	var response []byte
 
@@ -6729,12 +7181,15 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	name, stype, store := mset.cfg.Name, mset.cfg.Storage, mset.store
 	s, js, jsa, st, rf, tierName, outq, node := mset.srv, mset.js, mset.jsa, mset.cfg.Storage, mset.cfg.Replicas, mset.tier, mset.outq, mset.node
 	maxMsgSize, lseq, clfs := int(mset.cfg.MaxMsgSize), mset.lseq, mset.clfs
+	allowTTL, allowSched := mset.cfg.AllowMsgTTL, mset.cfg.AllowMsgSchedules
 	isLeader := mset.isLeader()
 	mset.mu.RUnlock()
 
 	// This should not happen but possible now that we allow scale up, and scale down where this could trigger.
 	if node == nil {
-		return mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0)
+		mset.ingMu.Lock()
+		defer mset.ingMu.Unlock()
+		return mset.storeJetStreamMsg(subject, reply, hdr, msg, 0, 0, false)
 	}
 
 	// Check that we are the leader. This can be false if we have scaled up from an R1 that had inbound queued messages.
@@ -6849,6 +7304,33 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 			}
 			return errors.New("expected stream does not match")
 		}
+		// Per message TTLs can be checked here as well. Sourced messages are exempt.
+		if len(getHeader(JSStreamSource, hdr)) == 0 {
+			if ttl, err := getMessageTTL(hdr); err != nil || (ttl > 0 && !allowTTL) {
+				if canRespond {
+					var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: name}}
+					if err != nil {
+						resp.Error = NewJSMessageTTLInvalidError()
+					} else {
+						resp.Error = NewJSMessageTTLDisabledError()
+					}
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				if err == nil {
+					err = errors.New("message TTL disabled")
+				}
+				return err
+			}
+			if apiErr := checkMsgDeliverAt(hdr, allowSched); apiErr != nil {
+				if canRespond {
+					var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr}
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				return apiErr
+			}
+		}
 	}
 
 	// Since we encode header len as u16 make sure we do not exceed.
@@ -6910,6 +7392,76 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	return err
 }
 
+// processClusteredInboundBatch will propose a committed atomic batch as a single entry.
+func (mset *stream) processClusteredInboundBatch(id, reply string, msgs []*batchMsg) error {
+	mset.mu.RLock()
+	canRespond := !mset.cfg.NoAck && len(reply) > 0
+	name, stype, s, js, outq, node := mset.cfg.Name, mset.cfg.Storage, mset.srv, mset.js, mset.outq, mset.node
+	lseq, clfs := mset.lseq, mset.clfs
+	isLeader := mset.isLeader()
+	mset.mu.RUnlock()
+
+	// This should not happen but possible now that we allow scale up, and scale down where this could trigger.
+	if node == nil {
+		return mset.processJetStreamBatch(id, reply, msgs)
+	}
+
+	respondErr := func(apiErr *ApiError) {
+		if canRespond {
+			b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+			outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, nil, b, nil, 0))
+		}
+	}
+
+	// Check that we are the leader.
+	if !isLeader {
+		respondErr(NewJSClusterNotLeaderError())
+		return NewJSClusterNotLeaderError()
+	}
+
+	// Batches are replicated as their own entry type, which older servers would not be able to apply.
+	for _, p := range node.Peers() {
+		if !s.peerVersionAtLeast(p.ID, batchMinVersion[0], batchMinVersion[1], batchMinVersion[2]) {
+			respondErr(NewJSAtomicPublishUnsupportedPeersError())
+			return NewJSAtomicPublishUnsupportedPeersError()
+		}
+	}
+
+	// Check here pre-emptively if we have exceeded this server limits.
+	if js.limitsExceeded(stype) {
+		s.resourcesExeededError()
+		respondErr(NewJSInsufficientResourcesError())
+		// Stepdown regardless.
+		node.StepDown()
+		return NewJSInsufficientResourcesError()
+	}
+
+	// All other checks are done when applying so all replicas agree on the outcome.
+	mset.clMu.Lock()
+	if mset.clseq == 0 || mset.clseq < lseq {
+		// Re-capture
+		lseq, clfs = mset.lastSeqAndCLFS()
+		mset.clseq = lseq + clfs
+	}
+	ts := time.Now().UnixNano()
+	for i, m := range msgs {
+		m.lseq, m.ts = mset.clseq+uint64(i), ts
+	}
+	err := node.Propose(encodeStreamBatch(id, reply, msgs))
+	if err == nil {
+		mset.clseq += uint64(len(msgs))
+	}
+	mset.clMu.Unlock()
+
+	if err != nil {
+		respondErr(&ApiError{Code: 503, Description: err.Error()})
+		if isOutOfSpaceErr(err) {
+			s.handleOutOfSpace(mset)
+		}
+	}
+	return err
+}
+
 // For requesting messages post raft snapshot to catch up streams post server restart.
 // Any deleted msgs etc will be handled inline on catchup.
 type streamSyncRequest struct {
@@ -7037,6 +7589,9 @@ var (
 	errCatchupStreamStopped   = errors.New("stream has been stopped") // when a catchup is terminated due to the stream going away.
 	errCatchupBadMsg          = errors.New("bad catchup msg")
 	errCatchupWrongSeqForSkip = errors.New("wrong sequence for skipped msg")
+	errRepairNotPossible      = errors.New("stream can not be repaired")
+	errRepairNoLeader         = errors.New("no leader to repair from")
+	errRepairIsLeader         = errors.New("stream leader can not repair from itself")
 )
 
 // Process a stream snapshot.
@@ -7338,6 +7893,7 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 	st := mset.cfg.Storage
 	ddloaded := mset.ddloaded
 	tierName := mset.tier
+	trackSched := mset.cfg.AllowMsgSchedules && mset.cfg.Mirror == nil
 	mset.mu.RUnlock()
 
 	if mset.js.limitsExceeded(st) {
@@ -7348,6 +7904,15 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 		return 0, NewJSInsufficientResourcesError()
 	}
 
+	// Track messages for later delivery before we store them, so consumers never see them as deliverable.
+	var schedAt int64
+	if trackSched && len(hdr) > 0 {
+		if at, _ := getMessageDeliverAt(hdr, ts); at > ts {
+			schedAt = at
+			mset.sched.track(seq, subj, schedAt)
+		}
+	}
+
 	// Put into our store
 	// Messages to be skipped have no subject or timestamp.
 	// TODO(dlc) - formalize with skipMsgOp
@@ -7356,6 +7921,9 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 			return 0, errCatchupWrongSeqForSkip
 		}
 	} else if err := mset.store.StoreRawMsg(subj, hdr, msg, seq, ts); err != nil {
+		if schedAt > 0 {
+			mset.sched.forget(seq)
+		}
 		return 0, err
 	}
 
@@ -7363,7 +7931,15 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 	mset.setLastSeq(seq)
 
 	// Check for MsgId and if we have one here make sure to update our internal map.
+	// Also remove the originals of messages that were scheduled back into the stream.
 	if len(hdr) > 0 {
+		if schedAt > 0 {
+			mset.mu.Lock()
+			mset.setScheduleTimer()
+			mset.mu.Unlock()
+		} else if trackSched {
+			mset.takeScheduledMsg(subj, hdr, ts)
+		}
 		if msgId := getMsgId(hdr); msgId != _EMPTY_ {
 			if !ddloaded {
 				mset.mu.Lock()
@@ -7377,6 +7953,135 @@ func (mset *stream) processCatchupMsg(msg []byte) (uint64, error) {
 	return seq, nil
 }
 
+// Repair a damaged range of messages found by our file store scrubber by requesting
+// the range from our leader through the normal catchup path.
+func (mset *stream) repairRange(first, last uint64) error {
+	mset.mu.RLock()
+	s, n, qch := mset.srv, mset.node, mset.qch
+	fs, _ := mset.store.(*fileStore)
+	var subject string
+	if mset.sa != nil {
+		subject = mset.sa.Sync
+	}
+	qname := fmt.Sprintf("[ACC:%s] stream '%s' repair", mset.acc.Name, mset.cfg.Name)
+	mset.mu.RUnlock()
+
+	if n == nil || fs == nil || subject == _EMPTY_ {
+		return errRepairNotPossible
+	}
+
+	// We can not repair from ourselves.
+	if n.Leader() {
+		return errRepairIsLeader
+	}
+	const leaderWait = 10 * time.Second
+	for start := time.Now(); n.GroupLeader() == _EMPTY_; {
+		if n.Leader() {
+			return errRepairIsLeader
+		}
+		if time.Since(start) > leaderWait {
+			return errRepairNoLeader
+		}
+		select {
+		case <-s.quitCh:
+			return ErrServerNotRunning
+		case <-qch:
+			return errCatchupStreamStopped
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Used to transfer message from the wire to another Go routine internally.
+	type im struct {
+		msg   []byte
+		reply string
+	}
+	msgsQ := s.newIPQueue(qname) // of *im
+	defer msgsQ.unregister()
+
+	reply := syncReplySubject()
+	sub, err := s.sysSubscribe(reply, func(_ *subscription, _ *client, _ *Account, _, reply string, msg []byte) {
+		msgsQ.push(&im{copyBytes(msg), reply})
+	})
+	if err != nil {
+		return err
+	}
+	defer s.sysUnsubscribe(sub)
+
+	b, _ := json.Marshal(&streamSyncRequest{FirstSeq: first, LastSeq: last, Peer: n.ID()})
+	s.sendInternalMsgLocked(subject, reply, nil, b)
+
+	const activityInterval = 10 * time.Second
+	notActive := time.NewTimer(activityInterval)
+	defer notActive.Stop()
+
+	var msgs []*StoreMsg
+	for {
+		select {
+		case <-msgsQ.ch:
+			notActive.Reset(activityInterval)
+			mrecs := msgsQ.pop()
+			for _, mreci := range mrecs {
+				mrec := mreci.(*im)
+				// Check for eof signaling.
+				if len(mrec.msg) == 0 {
+					msgsQ.recycle(&mrecs)
+					return fs.repairMsgs(first, last, msgs)
+				}
+				sm, err := decodeCatchupMsg(mrec.msg)
+				if err != nil {
+					if mrec.reply != _EMPTY_ {
+						s.sendInternalMsgLocked(mrec.reply, _EMPTY_, nil, err.Error())
+					}
+					msgsQ.recycle(&mrecs)
+					return err
+				}
+				if mrec.reply != _EMPTY_ {
+					s.sendInternalMsgLocked(mrec.reply, _EMPTY_, nil, nil)
+				}
+				// Skipped messages have no subject or timestamp and will be treated as deleted.
+				if sm.subj != _EMPTY_ || sm.ts != 0 {
+					msgs = append(msgs, sm)
+				}
+				if sm.seq >= last {
+					msgsQ.recycle(&mrecs)
+					return fs.repairMsgs(first, last, msgs)
+				}
+			}
+			msgsQ.recycle(&mrecs)
+		case <-notActive.C:
+			return errCatchupStalled
+		case <-s.quitCh:
+			return ErrServerNotRunning
+		case <-qch:
+			return errCatchupStreamStopped
+		}
+	}
+}
+
+// Decode a message sent to us from a sync request.
+func decodeCatchupMsg(msg []byte) (*StoreMsg, error) {
+	if len(msg) == 0 {
+		return nil, errCatchupBadMsg
+	}
+	op := entryOp(msg[0])
+	if op != streamMsgOp && op != compressedStreamMsgOp {
+		return nil, errCatchupBadMsg
+	}
+	mbuf := msg[1:]
+	if op == compressedStreamMsgOp {
+		var err error
+		if mbuf, err = s2.Decode(nil, mbuf); err != nil {
+			return nil, errCatchupBadMsg
+		}
+	}
+	subj, _, hdr, msg, seq, ts, err := decodeStreamMsg(mbuf)
+	if err != nil {
+		return nil, errCatchupBadMsg
+	}
+	return &StoreMsg{subj: subj, hdr: hdr, msg: msg, seq: seq, ts: ts}, nil
+}
+
 func (mset *stream) handleClusterSyncRequest(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
 	var sreq streamSyncRequest
 	if err := json.Unmarshal(msg, &sreq); err != nil {
@@ -7472,6 +8177,13 @@ func (js *jetStream) clusterInfo(rg *raftGroup) *ClusterInfo {
 	sort.Slice(ci.Replicas, func(i, j int) bool {
 		return ci.Replicas[i].Name < ci.Replicas[j].Name
 	})
+	// Show if we are pulling, or last pulled, a snapshot from our leader.
+	if sti := n.SnapshotTransfer(); sti != nil {
+		if sir, ok := s.nodeToInfo.Load(sti.Peer); ok && sir != nil {
+			sti.Peer = sir.(nodeInfo).name
+		}
+		ci.SnapshotTransfer = sti
+	}
 	return ci
 }
 
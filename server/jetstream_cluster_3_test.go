@@ -24,6 +24,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -2620,3 +2621,1549 @@ func TestJetStreamClusterActiveActiveSourcedStreams(t *testing.T) {
 	})
 	require_NoError(t, err)
 }
+
+func TestJetStreamClusterMessageTTL(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo.*"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowMsgTTL: true,
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	for i := 0; i < 10; i++ {
+		m := nats.NewMsg("foo.ttl")
+		m.Header.Set(JSMessageTTL, "1s")
+		resp, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error != nil {
+			t.Fatalf("Unexpected response: %q", resp.Data)
+		}
+		sendStreamMsg(t, nc, "foo.keep", "OK")
+	}
+
+	// Invalid TTLs should be rejected by the leader before being proposed.
+	m := nats.NewMsg("foo.ttl")
+	m.Header.Set(JSMessageTTL, "bad")
+	resp, err = nc.RequestMsg(m, time.Second)
+	require_NoError(t, err)
+	if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error == nil || pa.Error.ErrCode != uint16(JSMessageTTLInvalidErr) {
+		t.Fatalf("Expected TTL invalid error, got %q", resp.Data)
+	}
+
+	// All replicas should expire the TTL msgs on their own.
+	checkFor(t, 5*time.Second, 200*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 10 || state.LastSeq != 20 {
+				return fmt.Errorf("Expected 10 msgs and last seq of 20, got %d and %d", state.Msgs, state.LastSeq)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterSubjectTransform(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:             "TEST",
+		Subjects:         []string{"foo.>"},
+		Storage:          FileStorage,
+		Replicas:         3,
+		SubjectTransform: &SubjectTransformConfig{Source: "foo.>", Destination: "bar.>"},
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, fmt.Sprintf("foo.%d", i), "OK")
+	}
+
+	checkFor(t, 5*time.Second, 200*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if ss := mset.store.FilteredState(1, "bar.>"); ss.Msgs != 10 {
+				return fmt.Errorf("Expected 10 transformed msgs on %s, got %d", s, ss.Msgs)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterSourceSubjectTransforms(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "ORIGIN", Subjects: []string{"orders.*", "events.*"}, Replicas: 3})
+	require_NoError(t, err)
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:     "AGG",
+		Storage:  FileStorage,
+		Replicas: 3,
+		Sources: []*StreamSource{{
+			Name: "ORIGIN",
+			SubjectTransforms: []SubjectTransformConfig{
+				{Source: "orders.*", Destination: "agg.orders.$1"},
+				{Source: "events.*", Destination: "agg.events.$1"},
+			},
+		}},
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "AGG"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, fmt.Sprintf("orders.%d", i), "OK")
+		sendStreamMsg(t, nc, fmt.Sprintf("events.%d", i), "OK")
+	}
+
+	checkFor(t, 5*time.Second, 200*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("AGG")
+			if err != nil {
+				return err
+			}
+			if ss := mset.store.FilteredState(1, "agg.orders.*"); ss.Msgs != 10 {
+				return fmt.Errorf("Expected 10 transformed orders on %s, got %d", s, ss.Msgs)
+			}
+			if ss := mset.store.FilteredState(1, "agg.events.*"); ss.Msgs != 10 {
+				return fmt.Errorf("Expected 10 transformed events on %s, got %d", s, ss.Msgs)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterConsumerPause(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	req, err := json.Marshal(&JSApiConsumerPauseRequest{PauseUntil: time.Now().Add(time.Hour)})
+	require_NoError(t, err)
+	msg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "dlc"), req, 5*time.Second)
+	require_NoError(t, err)
+	var resp JSApiConsumerPauseResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	if resp.Error != nil || !resp.Paused || resp.Type != JSApiConsumerPauseResponseType {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// We are only answered once the pause has been applied, so the leader must have it.
+	cl := c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err := cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	if pu := mset.lookupConsumer("dlc").config().PauseUntil; pu == nil || !pu.Equal(resp.PauseUntil) {
+		t.Fatalf("Expected consumer leader to be paused when answered, got %v", pu)
+	}
+
+	// All replicas should have the pause state.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("Consumer not found on %s", s)
+			}
+			if pu := o.config().PauseUntil; pu == nil || !pu.Equal(resp.PauseUntil) {
+				return fmt.Errorf("Consumer not paused on %s", s)
+			}
+		}
+		return nil
+	})
+
+	sendStreamMsg(t, nc, "foo", "OK")
+
+	// Make sure a new leader stays paused.
+	require_NoError(t, mset.lookupConsumer("dlc").raftNode().StepDown())
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.NumPending == 1)
+	require_True(t, ci.NumAckPending == 0)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	_, err = sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+	require_Error(t, err)
+
+	// Resume.
+	msg, err = nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "dlc"), nil, 5*time.Second)
+	require_NoError(t, err)
+	resp = JSApiConsumerPauseResponse{}
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	if resp.Error != nil || resp.Paused {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		msgs, err := sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+		if err != nil {
+			return err
+		}
+		return msgs[0].Ack()
+	})
+
+	// Single replica consumers respond once applied as well.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "R1", AckPolicy: nats.AckExplicitPolicy, Replicas: 1})
+	require_NoError(t, err)
+	msg, err = nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "R1"), req, 5*time.Second)
+	require_NoError(t, err)
+	resp = JSApiConsumerPauseResponse{}
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	if resp.Error != nil || !resp.Paused || resp.Type != JSApiConsumerPauseResponseType {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	ci, err = js.ConsumerInfo("TEST", "R1")
+	require_NoError(t, err)
+	require_True(t, ci.NumAckPending == 0)
+}
+
+func TestJetStreamClusterConsumerUpdateAfterPause(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	for _, replicas := range []int{3, 1} {
+		durable := fmt.Sprintf("R%d", replicas)
+		_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: durable, AckPolicy: nats.AckExplicitPolicy, Replicas: replicas})
+		require_NoError(t, err)
+
+		req, err := json.Marshal(&JSApiConsumerPauseRequest{PauseUntil: time.Now().Add(time.Hour)})
+		require_NoError(t, err)
+		msg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", durable), req, 5*time.Second)
+		require_NoError(t, err)
+		var presp JSApiConsumerPauseResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &presp))
+		if presp.Error != nil || !presp.Paused {
+			t.Fatalf("Unexpected response: %+v", presp)
+		}
+
+		// A later update must be answered with the consumer info, not the pause state.
+		req, err = json.Marshal(&CreateConsumerRequest{
+			Stream: "TEST",
+			Config: ConsumerConfig{Durable: durable, AckPolicy: AckExplicit, AckWait: 10 * time.Second, Replicas: replicas},
+		})
+		require_NoError(t, err)
+		msg, err = nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", durable), req, 5*time.Second)
+		require_NoError(t, err)
+		var cresp JSApiConsumerCreateResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &cresp))
+		if cresp.Error != nil || cresp.Type != JSApiConsumerCreateResponseType || cresp.ConsumerInfo == nil {
+			t.Fatalf("Unexpected response: %s", msg.Data)
+		}
+		require_True(t, cresp.Config.AckWait == 10*time.Second)
+	}
+}
+
+func TestJetStreamClusterMessageSchedules(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:              "TEST",
+		Subjects:          []string{"foo.*"},
+		Storage:           FileStorage,
+		Replicas:          3,
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		m := nats.NewMsg("foo.later")
+		m.Header.Set(JSDeliverAt, "2s")
+		_, err = js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+	sendStreamMsg(t, nc, "foo.now", "OK")
+
+	// All replicas should track the scheduled messages.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if n := len(mset.sched.seqs()); n != 5 {
+				return fmt.Errorf("Expected 5 scheduled msgs on %s, got %d", s, n)
+			}
+		}
+		return nil
+	})
+
+	// Change the stream leader before they are due.
+	sl := c.streamLeader(globalAccountName, "TEST")
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamLeaderStepDownT, "TEST"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	require_True(t, c.streamLeader(globalAccountName, "TEST") != sl)
+
+	sub, err := js.PullSubscribe("foo.*", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 1)
+	require_Equal(t, msgs[0].Subject, "foo.now")
+	require_NoError(t, msgs[0].AckSync())
+
+	var received int
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		msgs, _ := sub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+		for _, m := range msgs {
+			require_Equal(t, m.Subject, "foo.later")
+			require_NoError(t, m.AckSync())
+			received++
+		}
+		if received != 5 {
+			return fmt.Errorf("Expected 5 msgs, got %d", received)
+		}
+		return nil
+	})
+
+	// Originals should be gone on all replicas, and nothing delivered twice.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 6 || state.LastSeq != 11 {
+				return fmt.Errorf("Expected 6 msgs and last seq of 11 on %s, got %d and %d", s, state.Msgs, state.LastSeq)
+			}
+			mset.sched.mu.Lock()
+			ql := len(mset.sched.q)
+			mset.sched.mu.Unlock()
+			if ql != 0 {
+				return fmt.Errorf("Expected no queued schedules on %s, got %d", s, ql)
+			}
+		}
+		return nil
+	})
+	_, err = sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+	require_Error(t, err)
+
+	// Clients can not reference a scheduled message themselves.
+	m := nats.NewMsg("foo.later")
+	m.Header.Set(JSScheduledSequence, "1")
+	pa, err := js.PublishMsg(m)
+	require_NoError(t, err)
+	sm, err := js.GetMsg("TEST", pa.Sequence)
+	require_NoError(t, err)
+	require_Equal(t, sm.Header.Get(JSScheduledSequence), _EMPTY_)
+}
+
+func TestJetStreamClusterConsumerReset(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "foo", "OK")
+	}
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(10)
+	require_NoError(t, err)
+	for _, m := range msgs[:8] {
+		require_NoError(t, m.AckSync())
+	}
+
+	msg, err := nc.Request(fmt.Sprintf(JSApiConsumerResetT, "TEST", "dlc"), []byte(`{"start_seq":4}`), 5*time.Second)
+	require_NoError(t, err)
+	var resp JSApiConsumerResetResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	require_True(t, resp.ResetSeq == 4)
+
+	// All replicas should have the reset state.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("Consumer not found on %s", s)
+			}
+			state, err := o.store.State()
+			if err != nil {
+				return err
+			}
+			if state.Delivered.Stream != 3 || state.AckFloor.Stream != 3 || len(state.Pending) != 0 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Should survive a leader change.
+	cl := c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err := cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_NoError(t, mset.lookupConsumer("dlc").raftNode().StepDown())
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.Delivered.Stream == 3)
+	require_True(t, ci.NumAckPending == 0)
+	require_True(t, ci.NumPending == 7)
+
+	msgs, err = sub.Fetch(1)
+	require_NoError(t, err)
+	meta, err := msgs[0].Metadata()
+	require_NoError(t, err)
+	require_True(t, meta.Sequence.Stream == 4)
+
+	// Resets are rejected as long as a peer runs a version that can not apply them.
+	cl = c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err = cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	rn := mset.lookupConsumer("dlc").raftNode()
+	var peer string
+	for _, p := range rn.Peers() {
+		if p.ID != rn.ID() {
+			peer = p.ID
+			break
+		}
+	}
+	ni, ok := cl.nodeToInfo.Load(peer)
+	require_True(t, ok)
+	old := ni.(nodeInfo)
+	// This is the version servers report that do not know about resets.
+	old.version = "2.9.15-beta"
+	cl.nodeToInfo.Store(peer, old)
+	msg, err = nc.Request(fmt.Sprintf(JSApiConsumerResetT, "TEST", "dlc"), []byte(`{"start_seq":1}`), 5*time.Second)
+	require_NoError(t, err)
+	resp = JSApiConsumerResetResponse{}
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	if resp.Error == nil || resp.Error.ErrCode != uint16(JSConsumerResetUnsupportedPeers) {
+		t.Fatalf("Expected unsupported peers error, got %+v", resp.Error)
+	}
+	cl.nodeToInfo.Store(peer, ni)
+	ci, err = js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.Delivered.Stream == 4)
+}
+
+func TestJetStreamClusterAtomicBatchPublish(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:               "TEST",
+		Subjects:           []string{"foo.*"},
+		Storage:            FileStorage,
+		Replicas:           3,
+		AllowAtomicPublish: true,
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	publishBatch := func(id string, n int, expectedLastSeq string) *JSPubAckResponse {
+		t.Helper()
+		var rmsg *nats.Msg
+		for i := 1; i <= n; i++ {
+			m := nats.NewMsg(fmt.Sprintf("foo.%d", i))
+			m.Header.Set(JSBatchId, id)
+			m.Header.Set(JSBatchSeq, fmt.Sprintf("%d", i))
+			if i == 1 && expectedLastSeq != _EMPTY_ {
+				m.Header.Set(JSExpectedLastSeq, expectedLastSeq)
+			}
+			if i < n {
+				require_NoError(t, nc.PublishMsg(m))
+				continue
+			}
+			m.Header.Set(JSBatchCommit, "1")
+			rmsg, err = nc.RequestMsg(m, 2*time.Second)
+			require_NoError(t, err)
+		}
+		var pa JSPubAckResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &pa))
+		return &pa
+	}
+
+	sendStreamMsg(t, nc, "foo.x", "OK")
+	pa := publishBatch("B1", 10, _EMPTY_)
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 11)
+	require_True(t, pa.BatchSize == 10)
+
+	// A failed expectation drops the whole batch on all replicas.
+	pa = publishBatch("B2", 5, "1")
+	if pa.Error == nil || pa.Error.ErrCode != uint16(JSStreamWrongLastSequenceErrF) {
+		t.Fatalf("Expected wrong last sequence error, got %+v", pa.Error)
+	}
+	// Sequences continue without gaps after a failed batch.
+	sendStreamMsg(t, nc, "foo.y", "OK")
+	pa = publishBatch("B3", 3, "12")
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 15)
+
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			var state StreamState
+			mset.store.FastState(&state)
+			if state.Msgs != 15 || state.FirstSeq != 1 || state.LastSeq != 15 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Make sure a new leader continues where we left off.
+	sl := c.streamLeader(globalAccountName, "TEST")
+	sl.JetStreamStepdownStream(globalAccountName, "TEST")
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	pa = publishBatch("B4", 2, "15")
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 17)
+
+	// Batches are rejected as long as a peer runs a version that can not apply them.
+	sl = c.streamLeader(globalAccountName, "TEST")
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	var peer string
+	for _, p := range mset.raftNode().Peers() {
+		if p.ID != mset.raftNode().ID() {
+			peer = p.ID
+			break
+		}
+	}
+	ni, ok := sl.nodeToInfo.Load(peer)
+	require_True(t, ok)
+	old := ni.(nodeInfo)
+	// This is the version servers report that do not know about batches.
+	old.version = "2.9.15-beta"
+	sl.nodeToInfo.Store(peer, old)
+	pa = publishBatch("B5", 2, _EMPTY_)
+	if pa.Error == nil || pa.Error.ErrCode != uint16(JSAtomicPublishUnsupportedPeers) {
+		t.Fatalf("Expected unsupported peers error, got %+v", pa.Error)
+	}
+	sl.nodeToInfo.Store(peer, ni)
+	pa = publishBatch("B6", 2, "17")
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 19)
+
+	// Long batch ids and reply subjects are fine.
+	id := strings.Repeat("B", maxBatchIdLen)
+	reply := nats.NewInbox() + "." + strings.Repeat("r", 300)
+	rsub := natsSubSync(t, nc, reply)
+	require_NoError(t, nc.Flush())
+	for i := 1; i <= 2; i++ {
+		m := nats.NewMsg(fmt.Sprintf("foo.%d", i))
+		m.Header.Set(JSBatchId, id)
+		m.Header.Set(JSBatchSeq, fmt.Sprintf("%d", i))
+		if i == 2 {
+			m.Header.Set(JSBatchCommit, "1")
+			m.Reply = reply
+		}
+		require_NoError(t, nc.PublishMsg(m))
+	}
+	rmsg := natsNexMsg(t, rsub, 2*time.Second)
+	pa = &JSPubAckResponse{}
+	require_NoError(t, json.Unmarshal(rmsg.Data, pa))
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 21)
+}
+
+func TestJetStreamClusterScrubRepairsFromLeader(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+	checkMsgs := func(msgs uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if err != nil {
+					return err
+				}
+				var state StreamState
+				mset.store.FastState(&state)
+				if state.Msgs != msgs {
+					return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+				}
+			}
+			return nil
+		})
+	}
+	checkMsgs(10)
+
+	// Seal the first block on one of our followers and add some more.
+	sr := c.randomNonStreamLeader(globalAccountName, "TEST")
+	mset, err := sr.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	fs.mu.Lock()
+	mb := fs.lmb
+	_, err = fs.newMsgBlockForWrite()
+	fs.mu.Unlock()
+	require_NoError(t, err)
+	require_NoError(t, mb.flushPendingMsgs())
+
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	// Now damage a message in the sealed block.
+	mb.mu.Lock()
+	buf, err := os.ReadFile(mb.mfn)
+	require_NoError(t, err)
+	rl := len(buf) / 10
+	buf[4*rl+rl/2] ^= 0xff
+	require_NoError(t, os.WriteFile(mb.mfn, buf, defaultFilePerms))
+	mb.clearCacheAndOffset()
+	mb.mu.Unlock()
+
+	var smv StoreMsg
+	_, err = fs.LoadMsg(5, &smv)
+	require_Error(t, err)
+
+	sub, err := nc.SubscribeSync(JSAdvisoryStreamCorruptPre + ".TEST")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	fs.scrubBlocks()
+
+	m, err := sub.NextMsg(2 * time.Second)
+	require_NoError(t, err)
+	var adv JSStreamCorruptAdvisory
+	require_NoError(t, json.Unmarshal(m.Data, &adv))
+	require_True(t, adv.Type == JSStreamCorruptAdvisoryType)
+	require_True(t, adv.Server == sr.Name())
+	require_True(t, adv.FirstSeq == 5 && adv.LastSeq == 5)
+	require_True(t, adv.Repair)
+
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		if fs.scrubState().repaired != 1 {
+			return fmt.Errorf("Not repaired yet")
+		}
+		return nil
+	})
+	for seq := uint64(1); seq <= 15; seq++ {
+		sm, err := fs.LoadMsg(seq, &smv)
+		require_NoError(t, err)
+		require_True(t, bytes.Equal(sm.msg, msg))
+	}
+	checkMsgs(15)
+
+	jsz, err := sr.Jsz(nil)
+	require_NoError(t, err)
+	require_True(t, jsz.Scrub != nil)
+	require_True(t, jsz.Scrub.Corrupt == 1)
+	require_True(t, jsz.Scrub.CorruptMsgs == 1)
+	require_True(t, jsz.Scrub.Repaired == 1)
+}
+
+func TestJetStreamClusterScrubConfig(t *testing.T) {
+	tmpl := strings.Replace(jsClusterTempl, "store_dir: '%s'", "store_dir: '%s', scrub_interval: 1h, compact_max_rate: 1MB", 1)
+	c := createJetStreamClusterWithTemplate(t, tmpl, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	scrubbing := func(fs *fileStore) bool {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return fs.scrubTmr != nil
+	}
+	walStore := func(n RaftNode) *fileStore {
+		fs, ok := n.(*raft).wal.(*fileStore)
+		require_True(t, ok)
+		return fs
+	}
+	for _, s := range c.servers {
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		fs := mset.store.(*fileStore)
+		require_True(t, fs.fcfg.ScrubInterval == time.Hour)
+		require_True(t, fs.fcfg.CompactMaxRate == 1024*1024)
+		require_True(t, scrubbing(fs))
+		// Our WALs are not scrubbed.
+		require_False(t, scrubbing(walStore(mset.raftNode())))
+		require_False(t, scrubbing(walStore(s.getJetStream().getMetaGroup())))
+	}
+
+	// The leader does not give up leadership to repair itself.
+	sl := c.streamLeader(globalAccountName, "TEST")
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	fs.mu.Lock()
+	mb := fs.lmb
+	_, err = fs.newMsgBlockForWrite()
+	fs.mu.Unlock()
+	require_NoError(t, err)
+	require_NoError(t, mb.flushPendingMsgs())
+
+	mb.mu.Lock()
+	buf, err := os.ReadFile(mb.mfn)
+	require_NoError(t, err)
+	rl := len(buf) / 10
+	buf[4*rl+rl/2] ^= 0xff
+	require_NoError(t, os.WriteFile(mb.mfn, buf, defaultFilePerms))
+	mb.clearCacheAndOffset()
+	mb.mu.Unlock()
+
+	sub, err := nc.SubscribeSync(JSAdvisoryStreamCorruptPre + ".TEST")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	fs.scrubBlocks()
+
+	m, err := sub.NextMsg(2 * time.Second)
+	require_NoError(t, err)
+	var adv JSStreamCorruptAdvisory
+	require_NoError(t, json.Unmarshal(m.Data, &adv))
+	require_True(t, adv.Server == sl.Name())
+	require_True(t, adv.FirstSeq == 5 && adv.LastSeq == 5)
+	require_False(t, adv.Repair)
+
+	require_Error(t, mset.repairRange(5, 5), errRepairIsLeader)
+	require_True(t, mset.raftNode().Leader())
+	require_True(t, fs.scrubState().repaired == 0)
+}
+
+func TestJetStreamClusterRaftPreVoteNoDisruption(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("ok"))
+		require_NoError(t, err)
+	}
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	raftNode := func(s *Server) *raft {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		return mset.raftNode().(*raft)
+	}
+	sl := c.streamLeader(globalAccountName, "TEST")
+	ln := raftNode(sl)
+	term := ln.Term()
+
+	// Partition a follower from the leader's append entries so it will campaign.
+	// The others still hear from the leader so will not grant the pre-vote, and the
+	// follower should not bump its term and force the leader to stepdown on rejoin.
+	fn := raftNode(c.randomNonStreamLeader(globalAccountName, "TEST"))
+	fn.Lock()
+	fn.unsubscribe(fn.aesub)
+	fn.Unlock()
+	checkFor(t, 2*maxElectionTimeout, 50*time.Millisecond, func() error {
+		if state := fn.State(); state != Candidate {
+			return fmt.Errorf("Expected candidate, got %s", state)
+		}
+		return nil
+	})
+	time.Sleep(maxElectionTimeout)
+
+	// Now rejoin.
+	fn.Lock()
+	fn.aesub, err = fn.subscribe(fn.asubj, fn.handleAppendEntry)
+	fn.Unlock()
+	require_NoError(t, err)
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := fn.State(); state != Follower {
+			return fmt.Errorf("Expected follower, got %s", state)
+		}
+		return nil
+	})
+	require_True(t, fn.Term() == term)
+	require_True(t, ln.Term() == term)
+	require_True(t, ln.State() == Leader)
+	require_True(t, c.streamLeader(globalAccountName, "TEST") == sl)
+
+	// Once the leader is really gone the others should grant the pre-vote and elect a new one.
+	sl.Shutdown()
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	nsl := c.streamLeader(globalAccountName, "TEST")
+	require_True(t, nsl != sl)
+	require_True(t, raftNode(nsl).Term() > term)
+}
+
+func TestJetStreamClusterLinearizableReads(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3, AllowDirect: true})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte(fmt.Sprintf("msg-%d", i)))
+		require_NoError(t, err)
+	}
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "d", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "d")
+
+	req := []byte(`{"linearizable":true}`)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), req, 2*time.Second)
+	require_NoError(t, err)
+	var sresp JSApiStreamInfoResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &sresp))
+	require_True(t, sresp.Error == nil)
+	require_True(t, sresp.State.LastSeq == 10)
+
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiMsgGetT, "TEST"), []byte(`{"seq":10,"linearizable":true}`), 2*time.Second)
+	require_NoError(t, err)
+	var mresp JSApiMsgGetResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &mresp))
+	require_True(t, mresp.Error == nil)
+	require_Equal(t, string(mresp.Message.Data), "msg-9")
+
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "d"), req, 2*time.Second)
+	require_NoError(t, err)
+	var cresp JSApiConsumerInfoResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &cresp))
+	require_True(t, cresp.Error == nil)
+	require_True(t, cresp.NumPending == 10)
+
+	// Direct gets can be answered by any replica so can not be linearizable.
+	rmsg, err = nc.Request(fmt.Sprintf(JSDirectMsgGetT, "TEST"), []byte(`{"seq":10,"linearizable":true}`), 2*time.Second)
+	require_NoError(t, err)
+	require_Equal(t, rmsg.Header.Get("Status"), "400")
+	require_Equal(t, rmsg.Header.Get("Description"), "Linearizable Not Supported For Direct Get")
+
+	sl := c.streamLeader(globalAccountName, "TEST")
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	ln := mset.raftNode()
+	ri, err := ln.ReadIndex()
+	require_NoError(t, err)
+	_, commit, applied := ln.Progress()
+	require_True(t, ri <= commit && ri <= applied)
+
+	// Only responses to the heartbeat we are waiting on in our current term count.
+	rn := ln.(*raft)
+	rn.Lock()
+	term, pterm, pindex, seq := rn.term, rn.pterm, rn.pindex, rn.riseq+100
+	rir := &readIndexReq{index: rn.applied, acks: map[string]struct{}{rn.id: {}}, done: make(chan error, 1)}
+	rn.rireqs[seq] = rir
+	rn.Unlock()
+	var peer string
+	for _, p := range rn.Peers() {
+		if p.ID != rn.ID() {
+			peer = p.ID
+			break
+		}
+	}
+	ar := &appendEntryResponse{pterm, pindex, peer, true, _EMPTY_}
+	acks := func() int {
+		rn.RLock()
+		defer rn.RUnlock()
+		return len(rir.acks)
+	}
+	rn.handleReadIndexResponse(nil, nil, nil, fmt.Sprintf("%s.%d.%d", rn.rireply, term, seq-1), _EMPTY_, ar.encode(nil))
+	require_True(t, acks() == 1)
+	rn.handleReadIndexResponse(nil, nil, nil, fmt.Sprintf("%s.%d.%d", rn.rireply, term-1, seq), _EMPTY_, ar.encode(nil))
+	require_True(t, acks() == 1)
+	require_True(t, len(rir.done) == 0)
+	// Reaching quorum signals the read right away.
+	rn.handleReadIndexResponse(nil, nil, nil, fmt.Sprintf("%s.%d.%d", rn.rireply, term, seq), _EMPTY_, ar.encode(nil))
+	require_True(t, acks() == 2)
+	select {
+	case err := <-rir.done:
+		require_NoError(t, err)
+	default:
+		t.Fatalf("Expected read to be signalled")
+	}
+	rn.RLock()
+	_, ok := rn.rireqs[seq]
+	rn.RUnlock()
+	require_False(t, ok)
+
+	// Queued reads are served in order by a single Go routine per node.
+	done := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		i := i
+		require_NoError(t, ln.QueueRead(func(err error) {
+			require_NoError(t, err)
+			done <- i
+		}))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case n := <-done:
+			require_True(t, n == i)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected queued read %d to be served", i)
+		}
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		rn.RLock()
+		defer rn.RUnlock()
+		if rn.rdw || len(rn.rdq) > 0 {
+			return fmt.Errorf("Read Go routine still running")
+		}
+		return nil
+	})
+	// And are bounded.
+	rn.Lock()
+	rn.rdq, rn.rdw = make([]func(error), maxQueuedReads), true
+	rn.Unlock()
+	require_Error(t, ln.QueueRead(func(error) {}), errReadQueueFull)
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), req, 2*time.Second)
+	require_NoError(t, err)
+	sresp = JSApiStreamInfoResponse{}
+	require_NoError(t, json.Unmarshal(rmsg.Data, &sresp))
+	require_True(t, sresp.Error != nil)
+	rn.Lock()
+	rn.rdq, rn.rdw = nil, false
+	rn.Unlock()
+
+	// Followers can not serve linearizable reads.
+	fs := c.randomNonStreamLeader(globalAccountName, "TEST")
+	mset, err = fs.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	_, err = mset.raftNode().ReadIndex()
+	require_Error(t, err, errNotLeader)
+
+	// A leader that can no longer reach its peers can not confirm its leadership.
+	for _, s := range c.servers {
+		if s != sl {
+			s.Shutdown()
+		}
+	}
+	_, err = ln.ReadIndex()
+	require_Error(t, err)
+}
+
+func TestJetStreamClusterSnapshotChunkedTransfer(t *testing.T) {
+	// Make sure our stream snapshots are offered and pulled in chunks.
+	old := snapChunkSize
+	snapChunkSize = 8
+	defer func() { snapChunkSize = old }()
+
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	fs := c.randomNonStreamLeader(globalAccountName, "TEST")
+	mset, err := fs.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	sd := mset.raftNode().(*raft).sd
+	fs.Shutdown()
+	fs.WaitForShutdown()
+
+	// Make sure we are not connected to the server we shut down.
+	nc.Close()
+	nc, js = jsClientConnect(t, c.streamLeader(globalAccountName, "TEST"))
+	defer nc.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte("ok"))
+		require_NoError(t, err)
+	}
+	// Create interior deletes so the snapshot spans a few chunks.
+	for seq := uint64(2); seq < 100; seq += 2 {
+		require_NoError(t, js.DeleteMsg("TEST", seq))
+	}
+
+	sl := c.streamLeader(globalAccountName, "TEST")
+	mset, err = sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	ln := mset.raftNode().(*raft)
+	require_NoError(t, ln.InstallSnapshot(mset.stateSnapshot()))
+
+	ln.RLock()
+	sfile := ln.snapfile
+	ln.RUnlock()
+	buf, err := os.ReadFile(sfile)
+	require_NoError(t, err)
+	require_True(t, len(buf) > 4*snapChunkSize)
+	term, index, err := termAndIndexFromSnapFile(sfile)
+	require_NoError(t, err)
+
+	// Pretend we had pulled part of this before, we should resume from there.
+	resumed := len(buf) / 2
+	dir := filepath.Join(sd, snapXferDir)
+	require_NoError(t, os.MkdirAll(dir, defaultDirPerms))
+	name := fmt.Sprintf(snapXferFileT, term, index, len(buf), buf[len(buf)-8:])
+	require_NoError(t, os.WriteFile(filepath.Join(dir, name), buf[:resumed], defaultFilePerms))
+
+	fs = c.restartServer(fs)
+	c.waitOnServerCurrent(fs)
+
+	checkFor(t, 10*time.Second, 200*time.Millisecond, func() error {
+		mset, err := fs.GlobalAccount().lookupStream("TEST")
+		if err != nil {
+			return err
+		}
+		if state := mset.state(); state.Msgs != 51 || state.LastSeq != 100 {
+			return fmt.Errorf("follower not caught up: %+v", state)
+		}
+		sti := mset.raftNode().SnapshotTransfer()
+		if sti == nil || sti.Completed.IsZero() {
+			return fmt.Errorf("snapshot transfer not completed: %+v", sti)
+		}
+		if sti.Index != index || sti.Size != uint64(len(buf)) || sti.ResumedFrom != uint64(resumed) {
+			return fmt.Errorf("unexpected snapshot transfer: %+v", sti)
+		}
+		return nil
+	})
+
+	// The partial file is removed once installed.
+	fis, err := os.ReadDir(dir)
+	require_NoError(t, err)
+	require_True(t, len(fis) == 0)
+
+	// And is shown in the stream info from the follower.
+	mset, err = fs.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	ci := fs.getJetStream().clusterInfo(mset.raftGroup())
+	require_True(t, ci.SnapshotTransfer != nil)
+	require_Equal(t, ci.SnapshotTransfer.Peer, sl.Name())
+
+	// The leader's worker serving the chunks goes away once the follower is done.
+	checkFor(t, 4*snapChunkTimeout, 200*time.Millisecond, func() error {
+		ln.RLock()
+		defer ln.RUnlock()
+		if len(ln.ssend) > 0 {
+			return fmt.Errorf("still serving %d snapshot transfers", len(ln.ssend))
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterRaftz(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	for _, name := range []string{"TEST", "OTHER"} {
+		_, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{strings.ToLower(name)}, Replicas: 3})
+		require_NoError(t, err)
+	}
+	_, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "d", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("test", []byte("ok"))
+		require_NoError(t, err)
+	}
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "d")
+
+	sl := c.streamLeader(globalAccountName, "TEST")
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		rz, err := sl.Raftz(nil)
+		require_NoError(t, err)
+		// Meta group, two streams and a consumer.
+		if len(rz.Groups) != 4 {
+			return fmt.Errorf("expected 4 groups, got %d", len(rz.Groups))
+		}
+		return nil
+	})
+
+	rz, err := sl.Raftz(&RaftzOptions{AccountFilter: globalAccountName, StreamFilter: "TEST"})
+	require_NoError(t, err)
+	require_True(t, len(rz.Groups) == 2)
+
+	var sg *RaftzGroup
+	for _, rg := range rz.Groups {
+		require_Equal(t, rg.Account, globalAccountName)
+		require_Equal(t, rg.Stream, "TEST")
+		if rg.Consumer == _EMPTY_ {
+			sg = rg
+		} else {
+			require_Equal(t, rg.Consumer, "d")
+		}
+	}
+	require_True(t, sg != nil)
+	require_Equal(t, sg.State, Leader.String())
+	require_True(t, sg.Term > 0)
+	require_True(t, sg.Commit >= 11 && sg.Applied >= 11)
+	require_True(t, sg.WALMsgs > 0 && sg.WALBytes > 0)
+	require_True(t, len(sg.Peers) == 2)
+	for _, rp := range sg.Peers {
+		require_True(t, rp.Name != _EMPTY_)
+		require_True(t, rp.LastContact < time.Second)
+	}
+	// We voted for ourselves when we became leader.
+	require_True(t, len(sg.Votes) > 0)
+	lv := sg.Votes[len(sg.Votes)-1]
+	require_Equal(t, lv.Candidate, sg.ID)
+	require_True(t, lv.Granted && lv.Term == sg.Term)
+
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_NoError(t, mset.raftNode().InstallSnapshot(mset.stateSnapshot()))
+
+	// Filter by the group name through the system request.
+	sysc, err := nats.Connect(sl.ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	require_NoError(t, err)
+	defer sysc.Close()
+
+	req, err := json.Marshal(&RaftzOptions{GroupFilter: sg.Name})
+	require_NoError(t, err)
+	msg, err := sysc.Request(fmt.Sprintf(serverDirectReqSubj, sl.ID(), "RAFTZ"), req, time.Second)
+	require_NoError(t, err)
+	var resp struct {
+		Data *Raftz `json:"data"`
+	}
+	require_NoError(t, json.Unmarshal(msg.Data, &resp))
+	require_True(t, resp.Data != nil && len(resp.Data.Groups) == 1)
+	rg := resp.Data.Groups[0]
+	require_Equal(t, rg.Name, sg.Name)
+	require_True(t, rg.SnapshotIndex > 0)
+	require_True(t, rg.SnapshotAge < time.Minute)
+
+	// No match.
+	rz, err = sl.Raftz(&RaftzOptions{StreamFilter: "NONE"})
+	require_NoError(t, err)
+	require_True(t, len(rz.Groups) == 0)
+}
+
+func TestJetStreamClusterLeaderRebalance(t *testing.T) {
+	tmpl := strings.Replace(jsClusterTempl, "store_dir: '%s'",
+		"store_dir: '%s', leader_rebalance_interval: 250ms, leader_rebalance_max_moves: 2", 1)
+	c := createJetStreamClusterWithTemplate(t, tmpl, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	var streams []string
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("S%d", i)
+		_, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{strings.ToLower(name)}, Replicas: 3})
+		require_NoError(t, err)
+		streams = append(streams, name)
+	}
+	// This one should be left alone.
+	req, err := json.Marshal(&StreamConfig{Name: "PINNED", Subjects: []string{"pinned"}, Replicas: 3, Storage: FileStorage, NoLeaderRebalance: true})
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "PINNED"), req, 5*time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &scResp))
+	require_True(t, scResp.Error == nil)
+	require_True(t, scResp.Config.NoLeaderRebalance)
+
+	for _, name := range append(streams, "PINNED") {
+		c.waitOnStreamLeader(globalAccountName, name)
+	}
+
+	// Move all leaders to one server, like after a rolling restart.
+	// Use the meta leader since it moves its own leaders directly.
+	hot := c.leader()
+	moveTo := func(name string) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+			sl := c.streamLeader(globalAccountName, name)
+			if sl == hot {
+				return nil
+			}
+			if sl != nil {
+				mset, err := sl.GlobalAccount().lookupStream(name)
+				if err != nil {
+					return err
+				}
+				mset.raftNode().StepDown(hot.NodeName())
+			}
+			return fmt.Errorf("stream %q leader not moved yet", name)
+		})
+	}
+	moveTo("PINNED")
+	for _, name := range streams {
+		moveTo(name)
+	}
+
+	// Now the leaders should be evened out.
+	checkFor(t, 20*time.Second, 250*time.Millisecond, func() error {
+		counts := make(map[string]int)
+		for _, name := range streams {
+			sl := c.streamLeader(globalAccountName, name)
+			if sl == nil {
+				return fmt.Errorf("no leader for %q", name)
+			}
+			counts[sl.Name()]++
+		}
+		// Pinned stream counts towards our hot server's load.
+		counts[hot.Name()]++
+		for _, s := range c.servers {
+			if n := counts[s.Name()]; n < 2 || n > 3 {
+				return fmt.Errorf("leaders not balanced: %v", counts)
+			}
+		}
+		return nil
+	})
+	require_True(t, c.streamLeader(globalAccountName, "PINNED") == hot)
+
+	// The meta leader shows the distribution in jsz.
+	checkFor(t, 10*time.Second, 250*time.Millisecond, func() error {
+		jsz, err := c.leader().Jsz(nil)
+		if err != nil {
+			return err
+		}
+		if jsz.Meta == nil || len(jsz.Meta.LeaderDistribution) != 3 {
+			return fmt.Errorf("unexpected leader distribution: %+v", jsz.Meta)
+		}
+		var total int
+		for _, n := range jsz.Meta.LeaderDistribution {
+			total += n
+		}
+		if total != 7 {
+			return fmt.Errorf("unexpected leader distribution: %v", jsz.Meta.LeaderDistribution)
+		}
+		return nil
+	})
+
+	// Shutting down JetStream should remove the rebalance subscriptions.
+	s := c.randomServer()
+	sjs := s.getJetStream()
+	sjs.mu.RLock()
+	cc := sjs.cluster
+	leadersReq, leaderStepDown := cc.leadersReq, cc.leaderStepDown
+	sjs.mu.RUnlock()
+	require_True(t, leadersReq != nil && leaderStepDown != nil)
+	s.Shutdown()
+	sjs.mu.RLock()
+	defer sjs.mu.RUnlock()
+	require_True(t, cc.leadersReq == nil && cc.leaderStepDown == nil)
+}
+
+func TestJetStreamClusterConsumerPinnedClientFailover(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	req, err := json.Marshal(&CreateConsumerRequest{Stream: "TEST", Config: ConsumerConfig{
+		Durable:        "dlc",
+		AckPolicy:      AckExplicit,
+		PriorityPolicy: PriorityPinnedClient,
+		PriorityGroups: []string{"A"},
+		Replicas:       3,
+	}})
+	require_NoError(t, err)
+	msg, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", "dlc"), req, 5*time.Second)
+	require_NoError(t, err)
+	var ccResp JSApiConsumerCreateResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &ccResp))
+	if ccResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", ccResp.Error)
+	}
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	sub := natsSubSync(t, nc, nats.NewInbox())
+	pull := func(pg PriorityGroup) *nats.Msg {
+		t.Helper()
+		req, err := json.Marshal(&JSApiConsumerGetNextRequest{Batch: 1, Expires: 2 * time.Second, PriorityGroup: pg})
+		require_NoError(t, err)
+		require_NoError(t, nc.PublishRequest(rsubj, sub.Subject, req))
+		return natsNexMsg(t, sub, 3*time.Second)
+	}
+
+	sendStreamMsg(t, nc, "foo", "1")
+	m := pull(PriorityGroup{Group: "A"})
+	pinId := m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, pinId != _EMPTY_)
+	require_NoError(t, m.AckSync())
+
+	// Change the consumer leader, the pinned client should be able to carry on.
+	cl := c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err := cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_NoError(t, mset.lookupConsumer("dlc").raftNode().StepDown())
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+	require_True(t, c.consumerLeader(globalAccountName, "TEST", "dlc") != cl)
+
+	sendStreamMsg(t, nc, "foo", "2")
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		m = pull(PriorityGroup{Group: "A", Id: pinId})
+		if status := m.Header.Get("Status"); status != _EMPTY_ {
+			return fmt.Errorf("Unexpected status %q", status)
+		}
+		return nil
+	})
+	require_Equal(t, string(m.Data), "2")
+	require_Equal(t, m.Header.Get(JSPullRequestNatsPinId), pinId)
+	require_NoError(t, m.AckSync())
+
+	// Another client is not allowed in while pinned.
+	m = pull(PriorityGroup{Group: "A", Id: "bogus"})
+	require_Equal(t, m.Header.Get("Status"), "423")
+
+	// Unpin through the consumer leader.
+	req, err = json.Marshal(&JSApiConsumerUnpinRequest{Group: "A"})
+	require_NoError(t, err)
+	msg, err = nc.Request(fmt.Sprintf(JSApiConsumerUnpinT, "TEST", "dlc"), req, 5*time.Second)
+	require_NoError(t, err)
+	var uResp JSApiConsumerUnpinResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &uResp))
+	if uResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", uResp.Error)
+	}
+	m = pull(PriorityGroup{Group: "A", Id: pinId})
+	require_Equal(t, m.Header.Get("Status"), "423")
+
+	// Another client gets pinned.
+	sendStreamMsg(t, nc, "foo", "3")
+	m = pull(PriorityGroup{Group: "A"})
+	require_Equal(t, string(m.Data), "3")
+	npinId := m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, npinId != _EMPTY_ && npinId != pinId)
+	require_NoError(t, m.AckSync())
+
+	// Once the new pin is known to all replicas change the leader again.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			o.mu.RLock()
+			id := o.pinId
+			o.mu.RUnlock()
+			if id != npinId {
+				return fmt.Errorf("Expected pin %q on %s, got %q", npinId, s, id)
+			}
+		}
+		return nil
+	})
+	cl = c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err = cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_NoError(t, mset.lookupConsumer("dlc").raftNode().StepDown())
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+	require_True(t, c.consumerLeader(globalAccountName, "TEST", "dlc") != cl)
+
+	// The previously pinned client should not get any more deliveries.
+	sendStreamMsg(t, nc, "foo", "4")
+	m = pull(PriorityGroup{Group: "A", Id: pinId})
+	require_Equal(t, m.Header.Get("Status"), "423")
+	m = pull(PriorityGroup{Group: "A", Id: npinId})
+	require_Equal(t, m.Header.Get("Status"), _EMPTY_)
+	require_Equal(t, string(m.Data), "4")
+	require_Equal(t, m.Header.Get(JSPullRequestNatsPinId), npinId)
+	require_NoError(t, m.AckSync())
+
+	// While a peer runs a version that can not apply pins, they are only kept by the leader.
+	cl = c.consumerLeader(globalAccountName, "TEST", "dlc")
+	mset, err = cl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	rn := mset.lookupConsumer("dlc").raftNode()
+	var peer string
+	for _, p := range rn.Peers() {
+		if p.ID != rn.ID() {
+			peer = p.ID
+			break
+		}
+	}
+	ni, ok := cl.nodeToInfo.Load(peer)
+	require_True(t, ok)
+	old := ni.(nodeInfo)
+	// This is the version servers report that do not know about pins.
+	old.version = "2.9.15-beta"
+	cl.nodeToInfo.Store(peer, old)
+	defer cl.nodeToInfo.Store(peer, ni)
+
+	msg, err = nc.Request(fmt.Sprintf(JSApiConsumerUnpinT, "TEST", "dlc"), req, 5*time.Second)
+	require_NoError(t, err)
+	uResp = JSApiConsumerUnpinResponse{}
+	require_NoError(t, json.Unmarshal(msg.Data, &uResp))
+	if uResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", uResp.Error)
+	}
+	sendStreamMsg(t, nc, "foo", "5")
+	m = pull(PriorityGroup{Group: "A"})
+	require_Equal(t, string(m.Data), "5")
+	lpinId := m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, lpinId != _EMPTY_ && lpinId != npinId)
+	require_NoError(t, m.AckSync())
+
+	for _, s := range c.servers {
+		if s == cl {
+			continue
+		}
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		o := mset.lookupConsumer("dlc")
+		o.mu.RLock()
+		id := o.pinId
+		o.mu.RUnlock()
+		if id != npinId {
+			t.Fatalf("Expected pin %q to not be replaced on %s, got %q", npinId, s, id)
+		}
+	}
+}
+
+func TestJetStreamClusterEncryptionKeyRotationIncludesRaftLogs(t *testing.T) {
+	c := createJetStreamClusterWithTemplate(t, jsClusterEncryptedTempl, "JSC", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		sendStreamMsg(t, nc, "foo", "OK")
+	}
+
+	// Our raft logs are re-encrypted along with our streams, so we are only done once they are.
+	s := c.randomServer()
+	s.rotateJetStreamKeys()
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if rot := s.jsKeyRotationState(); rot.err != nil || rot.active || rot.done != rot.total {
+			return fmt.Errorf("Key rotation not done: %+v", rot)
+		}
+		return nil
+	})
+	var streams, logs int
+	for _, fs := range s.jsFileStores() {
+		streams += fs.keyRotationState().total
+	}
+	for _, fs := range s.raftFileStores() {
+		logs += fs.keyRotationState().total
+	}
+	require_True(t, streams > 0)
+	require_True(t, logs > 0)
+	require_True(t, s.jsKeyRotationState().total == streams+logs)
+}
@@ -8,6 +8,33 @@ const (
 	// JSAccountResourcesExceededErr resource limits exceeded for account
 	JSAccountResourcesExceededErr ErrorIdentifier = 10002
 
+	// JSAtomicPublishDisabled atomic publish is disabled
+	JSAtomicPublishDisabled ErrorIdentifier = 10157
+
+	// JSAtomicPublishIncompleteBatch atomic publish batch is incomplete
+	JSAtomicPublishIncompleteBatch ErrorIdentifier = 10161
+
+	// JSAtomicPublishInvalidBatchCommit atomic publish batch commit is invalid
+	JSAtomicPublishInvalidBatchCommit ErrorIdentifier = 10160
+
+	// JSAtomicPublishInvalidBatchID atomic publish batch ID is invalid
+	JSAtomicPublishInvalidBatchID ErrorIdentifier = 10158
+
+	// JSAtomicPublishMissingSeq atomic publish sequence is missing
+	JSAtomicPublishMissingSeq ErrorIdentifier = 10159
+
+	// JSAtomicPublishTooLargeBatch atomic publish batch is too large: {size}
+	JSAtomicPublishTooLargeBatch ErrorIdentifier = 10162
+
+	// JSAtomicPublishTooManyInflight atomic publish too many inflight batches
+	JSAtomicPublishTooManyInflight ErrorIdentifier = 10163
+
+	// JSAtomicPublishUnsupportedHeaderBatch atomic publish unsupported header used: {header}
+	JSAtomicPublishUnsupportedHeaderBatch ErrorIdentifier = 10164
+
+	// JSAtomicPublishUnsupportedPeers atomic publish not supported by all stream peers
+	JSAtomicPublishUnsupportedPeers ErrorIdentifier = 10165
+
 	// JSBadRequestErr bad request
 	JSBadRequestErr ErrorIdentifier = 10003
 
@@ -59,6 +86,15 @@ const (
 	// JSConsumerCreateFilterSubjectMismatchErr Consumer create request did not match filtered subject from create subject
 	JSConsumerCreateFilterSubjectMismatchErr ErrorIdentifier = 10131
 
+	// JSConsumerDeadLetterCycle consumer dead letter subject overlaps with consumer subjects
+	JSConsumerDeadLetterCycle ErrorIdentifier = 10147
+
+	// JSConsumerDeadLetterInvalidSubject consumer dead letter subject is not a valid publish subject
+	JSConsumerDeadLetterInvalidSubject ErrorIdentifier = 10146
+
+	// JSConsumerDeadLetterRequiresAck consumer dead letter requires an ack policy
+	JSConsumerDeadLetterRequiresAck ErrorIdentifier = 10148
+
 	// JSConsumerDeliverCycleErr consumer deliver subject forms a cycle
 	JSConsumerDeliverCycleErr ErrorIdentifier = 10081
 
@@ -83,6 +119,9 @@ const (
 	// JSConsumerDurableNameNotSetErr consumer expected to be durable but a durable name was not set
 	JSConsumerDurableNameNotSetErr ErrorIdentifier = 10018
 
+	// JSConsumerEmptyFilter consumer filter in FilterSubjects cannot be empty
+	JSConsumerEmptyFilter ErrorIdentifier = 10145
+
 	// JSConsumerEphemeralWithDurableInSubjectErr consumer expected to be ephemeral but detected a durable name set in subject
 	JSConsumerEphemeralWithDurableInSubjectErr ErrorIdentifier = 10019
 
@@ -107,6 +146,9 @@ const (
 	// JSConsumerInvalidPolicyErrF Generic delivery policy error ({err})
 	JSConsumerInvalidPolicyErrF ErrorIdentifier = 10094
 
+	// JSConsumerInvalidPriorityGroup consumer requires a single valid priority group name when a priority policy is set
+	JSConsumerInvalidPriorityGroup ErrorIdentifier = 10155
+
 	// JSConsumerInvalidSamplingErrF failed to parse consumer sampling configuration: {err}
 	JSConsumerInvalidSamplingErrF ErrorIdentifier = 10095
 
@@ -131,6 +173,9 @@ const (
 	// JSConsumerMaxWaitingNegativeErr consumer max waiting needs to be positive
 	JSConsumerMaxWaitingNegativeErr ErrorIdentifier = 10087
 
+	// JSConsumerMultipleFiltersNotAllowed consumer cannot have both FilterSubject and FilterSubjects specified
+	JSConsumerMultipleFiltersNotAllowed ErrorIdentifier = 10143
+
 	// JSConsumerNameContainsPathSeparatorsErr Consumer name can not contain path separators
 	JSConsumerNameContainsPathSeparatorsErr ErrorIdentifier = 10127
 
@@ -149,6 +194,15 @@ const (
 	// JSConsumerOnMappedErr consumer direct on a mapped consumer
 	JSConsumerOnMappedErr ErrorIdentifier = 10092
 
+	// JSConsumerOverlappingSubjectFilters consumer subject filters cannot overlap
+	JSConsumerOverlappingSubjectFilters ErrorIdentifier = 10144
+
+	// JSConsumerPinnedTTLInvalid priority timeout requires the pinned client policy and can not be negative
+	JSConsumerPinnedTTLInvalid ErrorIdentifier = 10156
+
+	// JSConsumerPriorityGroupWithPolicyNone consumer can not have priority groups when policy is none
+	JSConsumerPriorityGroupWithPolicyNone ErrorIdentifier = 10154
+
 	// JSConsumerPullNotDurableErr consumer in pull mode requires a durable name
 	JSConsumerPullNotDurableErr ErrorIdentifier = 10085
 
@@ -161,6 +215,9 @@ const (
 	// JSConsumerPushMaxWaitingErr consumer in push mode can not set max waiting
 	JSConsumerPushMaxWaitingErr ErrorIdentifier = 10080
 
+	// JSConsumerPushWithPriorityGroup priority groups can not be used with push consumers
+	JSConsumerPushWithPriorityGroup ErrorIdentifier = 10153
+
 	// JSConsumerReplacementWithDifferentNameErr consumer replacement durable config not the same
 	JSConsumerReplacementWithDifferentNameErr ErrorIdentifier = 10106
 
@@ -170,6 +227,15 @@ const (
 	// JSConsumerReplicasShouldMatchStream consumer config replicas must match interest retention stream's replicas
 	JSConsumerReplicasShouldMatchStream ErrorIdentifier = 10134
 
+	// JSConsumerResetInvalidRequest consumer reset requires either a start sequence or a start time
+	JSConsumerResetInvalidRequest ErrorIdentifier = 10151
+
+	// JSConsumerResetRequiresLimits consumer reset requires limits based retention
+	JSConsumerResetRequiresLimits ErrorIdentifier = 10152
+
+	// JSConsumerResetUnsupportedPeers consumer reset not supported by all consumer peers
+	JSConsumerResetUnsupportedPeers ErrorIdentifier = 10166
+
 	// JSConsumerSmallHeartbeatErr consumer idle heartbeat needs to be >= 100ms
 	JSConsumerSmallHeartbeatErr ErrorIdentifier = 10083
 
@@ -206,6 +272,18 @@ const (
 	// JSMemoryResourcesExceededErr insufficient memory resources available
 	JSMemoryResourcesExceededErr ErrorIdentifier = 10028
 
+	// JSMessageDeliverAtDisabledErr message schedules are disabled
+	JSMessageDeliverAtDisabledErr ErrorIdentifier = 10150
+
+	// JSMessageDeliverAtInvalidErr invalid message delivery time
+	JSMessageDeliverAtInvalidErr ErrorIdentifier = 10149
+
+	// JSMessageTTLDisabledErr per-message TTL is disabled
+	JSMessageTTLDisabledErr ErrorIdentifier = 10136
+
+	// JSMessageTTLInvalidErr invalid per-message TTL
+	JSMessageTTLInvalidErr ErrorIdentifier = 10135
+
 	// JSMirrorConsumerSetupFailedErrF generic mirror consumer setup failure string ({err})
 	JSMirrorConsumerSetupFailedErrF ErrorIdentifier = 10029
 
@@ -263,9 +341,21 @@ const (
 	// JSSourceConsumerSetupFailedErrF General source consumer setup failure string ({err})
 	JSSourceConsumerSetupFailedErrF ErrorIdentifier = 10045
 
+	// JSSourceInvalidSubjectFilter source subject filter is invalid
+	JSSourceInvalidSubjectFilter ErrorIdentifier = 10140
+
+	// JSSourceInvalidTransformDestination source transform destination is invalid
+	JSSourceInvalidTransformDestination ErrorIdentifier = 10141
+
 	// JSSourceMaxMessageSizeTooBigErr stream source must have max message size >= target
 	JSSourceMaxMessageSizeTooBigErr ErrorIdentifier = 10046
 
+	// JSSourceMultipleFiltersNotAllowed source with multiple subject transforms cannot also have a single subject filter
+	JSSourceMultipleFiltersNotAllowed ErrorIdentifier = 10139
+
+	// JSSourceOverlappingSubjectFilters source filters can not overlap
+	JSSourceOverlappingSubjectFilters ErrorIdentifier = 10142
+
 	// JSStorageResourcesExceededErr insufficient storage resources available
 	JSStorageResourcesExceededErr ErrorIdentifier = 10047
 
@@ -389,6 +479,12 @@ const (
 	// JSStreamTemplateNotFoundErr template not found
 	JSStreamTemplateNotFoundErr ErrorIdentifier = 10068
 
+	// JSStreamTransformInvalidDestinationErrF stream transform: {err}
+	JSStreamTransformInvalidDestinationErrF ErrorIdentifier = 10138
+
+	// JSStreamTransformInvalidSourceErrF stream transform source: {err}
+	JSStreamTransformInvalidSourceErrF ErrorIdentifier = 10137
+
 	// JSStreamUpdateErrF Generic stream update error string ({err})
 	JSStreamUpdateErrF ErrorIdentifier = 10069
 
@@ -408,6 +504,15 @@ const (
 var (
 	ApiErrors = map[ErrorIdentifier]*ApiError{
 		JSAccountResourcesExceededErr:              {Code: 400, ErrCode: 10002, Description: "resource limits exceeded for account"},
+		JSAtomicPublishDisabled:                    {Code: 400, ErrCode: 10157, Description: "atomic publish is disabled"},
+		JSAtomicPublishIncompleteBatch:             {Code: 400, ErrCode: 10161, Description: "atomic publish batch is incomplete"},
+		JSAtomicPublishInvalidBatchCommit:          {Code: 400, ErrCode: 10160, Description: "atomic publish batch commit is invalid"},
+		JSAtomicPublishInvalidBatchID:              {Code: 400, ErrCode: 10158, Description: "atomic publish batch ID is invalid"},
+		JSAtomicPublishMissingSeq:                  {Code: 400, ErrCode: 10159, Description: "atomic publish sequence is missing"},
+		JSAtomicPublishTooLargeBatch:               {Code: 400, ErrCode: 10162, Description: "atomic publish batch is too large: {size}"},
+		JSAtomicPublishTooManyInflight:             {Code: 429, ErrCode: 10163, Description: "atomic publish too many inflight batches"},
+		JSAtomicPublishUnsupportedHeaderBatch:      {Code: 400, ErrCode: 10164, Description: "atomic publish unsupported header used: {header}"},
+		JSAtomicPublishUnsupportedPeers:            {Code: 503, ErrCode: 10165, Description: "atomic publish not supported by all stream peers"},
 		JSBadRequestErr:                            {Code: 400, ErrCode: 10003, Description: "bad request"},
 		JSClusterIncompleteErr:                     {Code: 503, ErrCode: 10004, Description: "incomplete results"},
 		JSClusterNoPeersErrF:                       {Code: 400, ErrCode: 10005, Description: "{err}"},
@@ -425,6 +530,9 @@ var (
 		JSConsumerCreateDurableAndNameMismatch:     {Code: 400, ErrCode: 10132, Description: "Consumer Durable and Name have to be equal if both are provided"},
 		JSConsumerCreateErrF:                       {Code: 500, ErrCode: 10012, Description: "{err}"},
 		JSConsumerCreateFilterSubjectMismatchErr:   {Code: 400, ErrCode: 10131, Description: "Consumer create request did not match filtered subject from create subject"},
+		JSConsumerDeadLetterCycle:                  {Code: 400, ErrCode: 10147, Description: "consumer dead letter subject overlaps with consumer subjects"},
+		JSConsumerDeadLetterInvalidSubject:         {Code: 400, ErrCode: 10146, Description: "consumer dead letter subject is not a valid publish subject"},
+		JSConsumerDeadLetterRequiresAck:            {Code: 400, ErrCode: 10148, Description: "consumer dead letter requires an ack policy"},
 		JSConsumerDeliverCycleErr:                  {Code: 400, ErrCode: 10081, Description: "consumer deliver subject forms a cycle"},
 		JSConsumerDeliverToWildcardsErr:            {Code: 400, ErrCode: 10079, Description: "consumer deliver subject has wildcards"},
 		JSConsumerDescriptionTooLongErrF:           {Code: 400, ErrCode: 10107, Description: "consumer description is too long, maximum allowed is {max}"},
@@ -433,6 +541,7 @@ var (
 		JSConsumerDurableNameNotInSubjectErr:       {Code: 400, ErrCode: 10016, Description: "consumer expected to be durable but no durable name set in subject"},
 		JSConsumerDurableNameNotMatchSubjectErr:    {Code: 400, ErrCode: 10017, Description: "consumer name in subject does not match durable name in request"},
 		JSConsumerDurableNameNotSetErr:             {Code: 400, ErrCode: 10018, Description: "consumer expected to be durable but a durable name was not set"},
+		JSConsumerEmptyFilter:                      {Code: 400, ErrCode: 10145, Description: "consumer filter in FilterSubjects cannot be empty"},
 		JSConsumerEphemeralWithDurableInSubjectErr: {Code: 400, ErrCode: 10019, Description: "consumer expected to be ephemeral but detected a durable name set in subject"},
 		JSConsumerEphemeralWithDurableNameErr:      {Code: 400, ErrCode: 10020, Description: "consumer expected to be ephemeral but a durable name was set in request"},
 		JSConsumerExistingActiveErr:                {Code: 400, ErrCode: 10105, Description: "consumer already exists and is still active"},
@@ -441,6 +550,7 @@ var (
 		JSConsumerHBRequiresPushErr:                {Code: 400, ErrCode: 10088, Description: "consumer idle heartbeat requires a push based consumer"},
 		JSConsumerInvalidDeliverSubject:            {Code: 400, ErrCode: 10112, Description: "invalid push consumer deliver subject"},
 		JSConsumerInvalidPolicyErrF:                {Code: 400, ErrCode: 10094, Description: "{err}"},
+		JSConsumerInvalidPriorityGroup:             {Code: 400, ErrCode: 10155, Description: "consumer requires a single valid priority group name when a priority policy is set"},
 		JSConsumerInvalidSamplingErrF:              {Code: 400, ErrCode: 10095, Description: "failed to parse consumer sampling configuration: {err}"},
 		JSConsumerMaxDeliverBackoffErr:             {Code: 400, ErrCode: 10116, Description: "max deliver is required to be > length of backoff values"},
 		JSConsumerMaxPendingAckExcessErrF:          {Code: 400, ErrCode: 10121, Description: "consumer max ack pending exceeds system limit of {limit}"},
@@ -449,19 +559,27 @@ var (
 		JSConsumerMaxRequestBatchNegativeErr:       {Code: 400, ErrCode: 10114, Description: "consumer max request batch needs to be > 0"},
 		JSConsumerMaxRequestExpiresToSmall:         {Code: 400, ErrCode: 10115, Description: "consumer max request expires needs to be >= 1ms"},
 		JSConsumerMaxWaitingNegativeErr:            {Code: 400, ErrCode: 10087, Description: "consumer max waiting needs to be positive"},
+		JSConsumerMultipleFiltersNotAllowed:        {Code: 400, ErrCode: 10143, Description: "consumer cannot have both FilterSubject and FilterSubjects specified"},
 		JSConsumerNameContainsPathSeparatorsErr:    {Code: 400, ErrCode: 10127, Description: "Consumer name can not contain path separators"},
 		JSConsumerNameExistErr:                     {Code: 400, ErrCode: 10013, Description: "consumer name already in use"},
 		JSConsumerNameTooLongErrF:                  {Code: 400, ErrCode: 10102, Description: "consumer name is too long, maximum allowed is {max}"},
 		JSConsumerNotFoundErr:                      {Code: 404, ErrCode: 10014, Description: "consumer not found"},
 		JSConsumerOfflineErr:                       {Code: 500, ErrCode: 10119, Description: "consumer is offline"},
 		JSConsumerOnMappedErr:                      {Code: 400, ErrCode: 10092, Description: "consumer direct on a mapped consumer"},
+		JSConsumerOverlappingSubjectFilters:        {Code: 400, ErrCode: 10144, Description: "consumer subject filters cannot overlap"},
+		JSConsumerPinnedTTLInvalid:                 {Code: 400, ErrCode: 10156, Description: "priority timeout requires the pinned client policy and can not be negative"},
+		JSConsumerPriorityGroupWithPolicyNone:      {Code: 400, ErrCode: 10154, Description: "consumer can not have priority groups when policy is none"},
 		JSConsumerPullNotDurableErr:                {Code: 400, ErrCode: 10085, Description: "consumer in pull mode requires a durable name"},
 		JSConsumerPullRequiresAckErr:               {Code: 400, ErrCode: 10084, Description: "consumer in pull mode requires ack policy"},
 		JSConsumerPullWithRateLimitErr:             {Code: 400, ErrCode: 10086, Description: "consumer in pull mode can not have rate limit set"},
 		JSConsumerPushMaxWaitingErr:                {Code: 400, ErrCode: 10080, Description: "consumer in push mode can not set max waiting"},
+		JSConsumerPushWithPriorityGroup:            {Code: 400, ErrCode: 10153, Description: "priority groups can not be used with push consumers"},
 		JSConsumerReplacementWithDifferentNameErr:  {Code: 400, ErrCode: 10106, Description: "consumer replacement durable config not the same"},
 		JSConsumerReplicasExceedsStream:            {Code: 400, ErrCode: 10126, Description: "consumer config replica count exceeds parent stream"},
 		JSConsumerReplicasShouldMatchStream:        {Code: 400, ErrCode: 10134, Description: "consumer config replicas must match interest retention stream's replicas"},
+		JSConsumerResetInvalidRequest:              {Code: 400, ErrCode: 10151, Description: "consumer reset requires either a start sequence or a start time"},
+		JSConsumerResetRequiresLimits:              {Code: 400, ErrCode: 10152, Description: "consumer reset requires limits based retention"},
+		JSConsumerResetUnsupportedPeers:            {Code: 503, ErrCode: 10166, Description: "consumer reset not supported by all consumer peers"},
 		JSConsumerSmallHeartbeatErr:                {Code: 400, ErrCode: 10083, Description: "consumer idle heartbeat needs to be >= 100ms"},
 		JSConsumerStoreFailedErrF:                  {Code: 500, ErrCode: 10104, Description: "error creating store for consumer: {err}"},
 		JSConsumerWQConsumerNotDeliverAllErr:       {Code: 400, ErrCode: 10101, Description: "consumer must be deliver all on workqueue stream"},
@@ -474,6 +592,10 @@ var (
 		JSMaximumConsumersLimitErr:                 {Code: 400, ErrCode: 10026, Description: "maximum consumers limit reached"},
 		JSMaximumStreamsLimitErr:                   {Code: 400, ErrCode: 10027, Description: "maximum number of streams reached"},
 		JSMemoryResourcesExceededErr:               {Code: 500, ErrCode: 10028, Description: "insufficient memory resources available"},
+		JSMessageDeliverAtDisabledErr:              {Code: 400, ErrCode: 10150, Description: "message schedules are disabled"},
+		JSMessageDeliverAtInvalidErr:               {Code: 400, ErrCode: 10149, Description: "invalid message delivery time"},
+		JSMessageTTLDisabledErr:                    {Code: 400, ErrCode: 10136, Description: "per-message TTL is disabled"},
+		JSMessageTTLInvalidErr:                     {Code: 400, ErrCode: 10135, Description: "invalid per-message TTL"},
 		JSMirrorConsumerSetupFailedErrF:            {Code: 500, ErrCode: 10029, Description: "{err}"},
 		JSMirrorMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10030, Description: "stream mirror must have max message size >= source"},
 		JSMirrorWithSourcesErr:                     {Code: 400, ErrCode: 10031, Description: "stream mirrors can not also contain other sources"},
@@ -493,7 +615,11 @@ var (
 		JSSequenceNotFoundErrF:                     {Code: 400, ErrCode: 10043, Description: "sequence {seq} not found"},
 		JSSnapshotDeliverSubjectInvalidErr:         {Code: 400, ErrCode: 10015, Description: "deliver subject not valid"},
 		JSSourceConsumerSetupFailedErrF:            {Code: 500, ErrCode: 10045, Description: "{err}"},
+		JSSourceInvalidSubjectFilter:               {Code: 400, ErrCode: 10140, Description: "source subject filter is invalid"},
+		JSSourceInvalidTransformDestination:        {Code: 400, ErrCode: 10141, Description: "source transform destination is invalid"},
 		JSSourceMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10046, Description: "stream source must have max message size >= target"},
+		JSSourceMultipleFiltersNotAllowed:          {Code: 400, ErrCode: 10139, Description: "source with multiple subject transforms cannot also have a single subject filter"},
+		JSSourceOverlappingSubjectFilters:          {Code: 400, ErrCode: 10142, Description: "source filters can not overlap"},
 		JSStorageResourcesExceededErr:              {Code: 500, ErrCode: 10047, Description: "insufficient storage resources available"},
 		JSStreamAssignmentErrF:                     {Code: 500, ErrCode: 10048, Description: "{err}"},
 		JSStreamCreateErrF:                         {Code: 500, ErrCode: 10049, Description: "{err}"},
@@ -535,6 +661,8 @@ var (
 		JSStreamTemplateCreateErrF:                 {Code: 500, ErrCode: 10066, Description: "{err}"},
 		JSStreamTemplateDeleteErrF:                 {Code: 500, ErrCode: 10067, Description: "{err}"},
 		JSStreamTemplateNotFoundErr:                {Code: 404, ErrCode: 10068, Description: "template not found"},
+		JSStreamTransformInvalidDestinationErrF:    {Code: 400, ErrCode: 10138, Description: "stream transform: {err}"},
+		JSStreamTransformInvalidSourceErrF:         {Code: 400, ErrCode: 10137, Description: "stream transform source: {err}"},
 		JSStreamUpdateErrF:                         {Code: 500, ErrCode: 10069, Description: "{err}"},
 		JSStreamWrongLastMsgIDErrF:                 {Code: 400, ErrCode: 10070, Description: "wrong last msg ID: {id}"},
 		JSStreamWrongLastSequenceErrF:              {Code: 400, ErrCode: 10071, Description: "wrong last sequence: {seq}"},
@@ -575,6 +703,108 @@ func NewJSAccountResourcesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSAccountResourcesExceededErr]
 }
 
+// NewJSAtomicPublishDisabledError creates a new JSAtomicPublishDisabled error: "atomic publish is disabled"
+func NewJSAtomicPublishDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishDisabled]
+}
+
+// NewJSAtomicPublishIncompleteBatchError creates a new JSAtomicPublishIncompleteBatch error: "atomic publish batch is incomplete"
+func NewJSAtomicPublishIncompleteBatchError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishIncompleteBatch]
+}
+
+// NewJSAtomicPublishInvalidBatchCommitError creates a new JSAtomicPublishInvalidBatchCommit error: "atomic publish batch commit is invalid"
+func NewJSAtomicPublishInvalidBatchCommitError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishInvalidBatchCommit]
+}
+
+// NewJSAtomicPublishInvalidBatchIDError creates a new JSAtomicPublishInvalidBatchID error: "atomic publish batch ID is invalid"
+func NewJSAtomicPublishInvalidBatchIDError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishInvalidBatchID]
+}
+
+// NewJSAtomicPublishMissingSeqError creates a new JSAtomicPublishMissingSeq error: "atomic publish sequence is missing"
+func NewJSAtomicPublishMissingSeqError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishMissingSeq]
+}
+
+// NewJSAtomicPublishTooLargeBatchError creates a new JSAtomicPublishTooLargeBatch error: "atomic publish batch is too large: {size}"
+func NewJSAtomicPublishTooLargeBatchError(size interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSAtomicPublishTooLargeBatch]
+	args := e.toReplacerArgs([]interface{}{"{size}", size})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSAtomicPublishTooManyInflightError creates a new JSAtomicPublishTooManyInflight error: "atomic publish too many inflight batches"
+func NewJSAtomicPublishTooManyInflightError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishTooManyInflight]
+}
+
+// NewJSAtomicPublishUnsupportedHeaderBatchError creates a new JSAtomicPublishUnsupportedHeaderBatch error: "atomic publish unsupported header used: {header}"
+func NewJSAtomicPublishUnsupportedHeaderBatchError(header interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSAtomicPublishUnsupportedHeaderBatch]
+	args := e.toReplacerArgs([]interface{}{"{header}", header})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSAtomicPublishUnsupportedPeersError creates a new JSAtomicPublishUnsupportedPeers error: "atomic publish not supported by all stream peers"
+func NewJSAtomicPublishUnsupportedPeersError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishUnsupportedPeers]
+}
+
 // NewJSBadRequestError creates a new JSBadRequestErr error: "bad request"
 func NewJSBadRequestError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -757,6 +987,36 @@ func NewJSConsumerCreateFilterSubjectMismatchError(opts ...ErrorOption) *ApiErro
 	return ApiErrors[JSConsumerCreateFilterSubjectMismatchErr]
 }
 
+// NewJSConsumerDeadLetterCycleError creates a new JSConsumerDeadLetterCycle error: "consumer dead letter subject overlaps with consumer subjects"
+func NewJSConsumerDeadLetterCycleError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerDeadLetterCycle]
+}
+
+// NewJSConsumerDeadLetterInvalidSubjectError creates a new JSConsumerDeadLetterInvalidSubject error: "consumer dead letter subject is not a valid publish subject"
+func NewJSConsumerDeadLetterInvalidSubjectError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerDeadLetterInvalidSubject]
+}
+
+// NewJSConsumerDeadLetterRequiresAckError creates a new JSConsumerDeadLetterRequiresAck error: "consumer dead letter requires an ack policy"
+func NewJSConsumerDeadLetterRequiresAckError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerDeadLetterRequiresAck]
+}
+
 // NewJSConsumerDeliverCycleError creates a new JSConsumerDeliverCycleErr error: "consumer deliver subject forms a cycle"
 func NewJSConsumerDeliverCycleError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -843,6 +1103,16 @@ func NewJSConsumerDurableNameNotSetError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerDurableNameNotSetErr]
 }
 
+// NewJSConsumerEmptyFilterError creates a new JSConsumerEmptyFilter error: "consumer filter in FilterSubjects cannot be empty"
+func NewJSConsumerEmptyFilterError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerEmptyFilter]
+}
+
 // NewJSConsumerEphemeralWithDurableInSubjectError creates a new JSConsumerEphemeralWithDurableInSubjectErr error: "consumer expected to be ephemeral but detected a durable name set in subject"
 func NewJSConsumerEphemeralWithDurableInSubjectError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -929,6 +1199,16 @@ func NewJSConsumerInvalidPolicyError(err error, opts ...ErrorOption) *ApiError {
 	}
 }
 
+// NewJSConsumerInvalidPriorityGroupError creates a new JSConsumerInvalidPriorityGroup error: "consumer requires a single valid priority group name when a priority policy is set"
+func NewJSConsumerInvalidPriorityGroupError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerInvalidPriorityGroup]
+}
+
 // NewJSConsumerInvalidSamplingError creates a new JSConsumerInvalidSamplingErrF error: "failed to parse consumer sampling configuration: {err}"
 func NewJSConsumerInvalidSamplingError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1027,6 +1307,16 @@ func NewJSConsumerMaxWaitingNegativeError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerMaxWaitingNegativeErr]
 }
 
+// NewJSConsumerMultipleFiltersNotAllowedError creates a new JSConsumerMultipleFiltersNotAllowed error: "consumer cannot have both FilterSubject and FilterSubjects specified"
+func NewJSConsumerMultipleFiltersNotAllowedError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerMultipleFiltersNotAllowed]
+}
+
 // NewJSConsumerNameContainsPathSeparatorsError creates a new JSConsumerNameContainsPathSeparatorsErr error: "Consumer name can not contain path separators"
 func NewJSConsumerNameContainsPathSeparatorsError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1093,6 +1383,36 @@ func NewJSConsumerOnMappedError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerOnMappedErr]
 }
 
+// NewJSConsumerOverlappingSubjectFiltersError creates a new JSConsumerOverlappingSubjectFilters error: "consumer subject filters cannot overlap"
+func NewJSConsumerOverlappingSubjectFiltersError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerOverlappingSubjectFilters]
+}
+
+// NewJSConsumerPinnedTTLInvalidError creates a new JSConsumerPinnedTTLInvalid error: "priority timeout requires the pinned client policy and can not be negative"
+func NewJSConsumerPinnedTTLInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerPinnedTTLInvalid]
+}
+
+// NewJSConsumerPriorityGroupWithPolicyNoneError creates a new JSConsumerPriorityGroupWithPolicyNone error: "consumer can not have priority groups when policy is none"
+func NewJSConsumerPriorityGroupWithPolicyNoneError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerPriorityGroupWithPolicyNone]
+}
+
 // NewJSConsumerPullNotDurableError creates a new JSConsumerPullNotDurableErr error: "consumer in pull mode requires a durable name"
 func NewJSConsumerPullNotDurableError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1133,6 +1453,16 @@ func NewJSConsumerPushMaxWaitingError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerPushMaxWaitingErr]
 }
 
+// NewJSConsumerPushWithPriorityGroupError creates a new JSConsumerPushWithPriorityGroup error: "priority groups can not be used with push consumers"
+func NewJSConsumerPushWithPriorityGroupError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerPushWithPriorityGroup]
+}
+
 // NewJSConsumerReplacementWithDifferentNameError creates a new JSConsumerReplacementWithDifferentNameErr error: "consumer replacement durable config not the same"
 func NewJSConsumerReplacementWithDifferentNameError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1163,6 +1493,36 @@ func NewJSConsumerReplicasShouldMatchStreamError(opts ...ErrorOption) *ApiError
 	return ApiErrors[JSConsumerReplicasShouldMatchStream]
 }
 
+// NewJSConsumerResetInvalidRequestError creates a new JSConsumerResetInvalidRequest error: "consumer reset requires either a start sequence or a start time"
+func NewJSConsumerResetInvalidRequestError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerResetInvalidRequest]
+}
+
+// NewJSConsumerResetRequiresLimitsError creates a new JSConsumerResetRequiresLimits error: "consumer reset requires limits based retention"
+func NewJSConsumerResetRequiresLimitsError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerResetRequiresLimits]
+}
+
+// NewJSConsumerResetUnsupportedPeersError creates a new JSConsumerResetUnsupportedPeers error: "consumer reset not supported by all consumer peers"
+func NewJSConsumerResetUnsupportedPeersError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerResetUnsupportedPeers]
+}
+
 // NewJSConsumerSmallHeartbeatError creates a new JSConsumerSmallHeartbeatErr error: "consumer idle heartbeat needs to be >= 100ms"
 func NewJSConsumerSmallHeartbeatError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1289,6 +1649,46 @@ func NewJSMemoryResourcesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSMemoryResourcesExceededErr]
 }
 
+// NewJSMessageDeliverAtDisabledError creates a new JSMessageDeliverAtDisabledErr error: "message schedules are disabled"
+func NewJSMessageDeliverAtDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageDeliverAtDisabledErr]
+}
+
+// NewJSMessageDeliverAtInvalidError creates a new JSMessageDeliverAtInvalidErr error: "invalid message delivery time"
+func NewJSMessageDeliverAtInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageDeliverAtInvalidErr]
+}
+
+// NewJSMessageTTLDisabledError creates a new JSMessageTTLDisabledErr error: "per-message TTL is disabled"
+func NewJSMessageTTLDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageTTLDisabledErr]
+}
+
+// NewJSMessageTTLInvalidError creates a new JSMessageTTLInvalidErr error: "invalid per-message TTL"
+func NewJSMessageTTLInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageTTLInvalidErr]
+}
+
 // NewJSMirrorConsumerSetupFailedError creates a new JSMirrorConsumerSetupFailedErrF error: "{err}"
 func NewJSMirrorConsumerSetupFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1509,6 +1909,26 @@ func NewJSSourceConsumerSetupFailedError(err error, opts ...ErrorOption) *ApiErr
 	}
 }
 
+// NewJSSourceInvalidSubjectFilterError creates a new JSSourceInvalidSubjectFilter error: "source subject filter is invalid"
+func NewJSSourceInvalidSubjectFilterError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSSourceInvalidSubjectFilter]
+}
+
+// NewJSSourceInvalidTransformDestinationError creates a new JSSourceInvalidTransformDestination error: "source transform destination is invalid"
+func NewJSSourceInvalidTransformDestinationError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSSourceInvalidTransformDestination]
+}
+
 // NewJSSourceMaxMessageSizeTooBigError creates a new JSSourceMaxMessageSizeTooBigErr error: "stream source must have max message size >= target"
 func NewJSSourceMaxMessageSizeTooBigError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1519,6 +1939,26 @@ func NewJSSourceMaxMessageSizeTooBigError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSSourceMaxMessageSizeTooBigErr]
 }
 
+// NewJSSourceMultipleFiltersNotAllowedError creates a new JSSourceMultipleFiltersNotAllowed error: "source with multiple subject transforms cannot also have a single subject filter"
+func NewJSSourceMultipleFiltersNotAllowedError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSSourceMultipleFiltersNotAllowed]
+}
+
+// NewJSSourceOverlappingSubjectFiltersError creates a new JSSourceOverlappingSubjectFilters error: "source filters can not overlap"
+func NewJSSourceOverlappingSubjectFiltersError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSSourceOverlappingSubjectFilters]
+}
+
 // NewJSStorageResourcesExceededError creates a new JSStorageResourcesExceededErr error: "insufficient storage resources available"
 func NewJSStorageResourcesExceededError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -2037,6 +2477,38 @@ func NewJSStreamTemplateNotFoundError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamTemplateNotFoundErr]
 }
 
+// NewJSStreamTransformInvalidDestinationError creates a new JSStreamTransformInvalidDestinationErrF error: "stream transform: {err}"
+func NewJSStreamTransformInvalidDestinationError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamTransformInvalidDestinationErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSStreamTransformInvalidSourceError creates a new JSStreamTransformInvalidSourceErrF error: "stream transform source: {err}"
+func NewJSStreamTransformInvalidSourceError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamTransformInvalidSourceErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamUpdateError creates a new JSStreamUpdateErrF error: "{err}"
 func NewJSStreamUpdateError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -80,6 +80,18 @@ type JSConsumerActionAdvisory struct {
 
 const JSConsumerActionAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_action"
 
+// JSConsumerPauseAdvisory indicates that a consumer was paused or resumed
+type JSConsumerPauseAdvisory struct {
+	TypedEvent
+	Stream     string    `json:"stream"`
+	Consumer   string    `json:"consumer"`
+	Paused     bool      `json:"paused"`
+	PauseUntil time.Time `json:"pause_until,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+}
+
+const JSConsumerPauseAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_pause"
+
 // JSConsumerAckMetric is a metric published when a user acknowledges a message, the
 // number of these that will be published is dependent on SampleFrequency
 type JSConsumerAckMetric struct {
@@ -119,6 +131,7 @@ type JSConsumerDeliveryNakAdvisory struct {
 	ConsumerSeq uint64 `json:"consumer_seq"`
 	StreamSeq   uint64 `json:"stream_seq"`
 	Deliveries  uint64 `json:"deliveries"`
+	Reason      string `json:"reason,omitempty"`
 	Domain      string `json:"domain,omitempty"`
 }
 
@@ -134,6 +147,7 @@ type JSConsumerDeliveryTerminatedAdvisory struct {
 	ConsumerSeq uint64 `json:"consumer_seq"`
 	StreamSeq   uint64 `json:"stream_seq"`
 	Deliveries  uint64 `json:"deliveries"`
+	Reason      string `json:"reason,omitempty"`
 	Domain      string `json:"domain,omitempty"`
 }
 
@@ -190,6 +204,21 @@ type JSRestoreCompleteAdvisory struct {
 // JSRestoreCompleteAdvisoryType is the schema type for JSSnapshotCreateAdvisory
 const JSRestoreCompleteAdvisoryType = "io.nats.jetstream.advisory.v1.restore_complete"
 
+// JSStreamCorruptAdvisoryType is sent when a damaged range of messages is found in a stream's store.
+const JSStreamCorruptAdvisoryType = "io.nats.jetstream.advisory.v1.stream_corrupt"
+
+// JSStreamCorruptAdvisory indicates that a range of messages failed verification on a server.
+type JSStreamCorruptAdvisory struct {
+	TypedEvent
+	Account  string `json:"account,omitempty"`
+	Stream   string `json:"stream"`
+	Server   string `json:"server"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	Repair   bool   `json:"repair,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+}
+
 // Clustering specific.
 
 // JSStreamLeaderElectedAdvisoryType is sent when the system elects a leader for a stream.
@@ -659,7 +659,7 @@ func TestJetStreamConsumerMaxDeliveries(t *testing.T) {
 
 func TestJetStreamNextReqFromMsg(t *testing.T) {
 	bef := time.Now()
-	expires, _, _, _, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
+	expires, _, _, _, _, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
 	require_NoError(t, err)
 	now := time.Now()
 	if expires.Before(bef.Add(5*time.Second)) || expires.After(now.Add(5*time.Second)) {
@@ -12175,6 +12175,105 @@ func TestJetStreamServerEncryption(t *testing.T) {
 	}
 }
 
+func TestJetStreamServerEncryptionKeyRotation(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		jetstream: {key: %q, %s cipher: %s, store_dir: %q}
+	`
+	storeDir := t.TempDir()
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, "s3cr3t!!", _EMPTY_, "chacha", storeDir)))
+
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	// Persisted memory streams need to be rotated as well.
+	_, err = s.GlobalAccount().addStream(&StreamConfig{Name: "MEM", Subjects: []string{"bar"}, Storage: MemoryStorage, Persist: true})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("ENCRYPTED PAYLOAD!!"), 100)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+		_, err = js.Publish("bar", msg)
+		require_NoError(t, err)
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	for _, m := range fetchMsgs(t, sub, 10, 5*time.Second) {
+		m.AckSync()
+	}
+
+	// Rotate to a new key and cipher, this requires our current key as the previous key.
+	newConf := fmt.Sprintf(tmpl, "n3wS3cr3t", _EMPTY_, "aes", storeDir)
+	require_NoError(t, os.WriteFile(conf, []byte(newConf), 0666))
+	require_Error(t, s.Reload())
+
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, "n3wS3cr3t", `prev_key: "s3cr3t!!",`, "aes", storeDir))
+
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		jsz, err := s.Jsz(nil)
+		if err != nil {
+			return err
+		}
+		if jsz.KeyRotation == nil {
+			return fmt.Errorf("No key rotation info")
+		}
+		if kr := jsz.KeyRotation; kr.Error != _EMPTY_ || kr.Active || kr.Rotated != kr.Blocks {
+			return fmt.Errorf("Key rotation not done: %+v", kr)
+		}
+		return nil
+	})
+	// Our persisted memory stream counts as a single block.
+	jsz, err := s.Jsz(nil)
+	require_NoError(t, err)
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	require_True(t, jsz.KeyRotation.Blocks == mset.store.(*fileStore).keyRotationState().total+1)
+
+	// Can still use the stream after rotating.
+	_, err = js.Publish("foo", msg)
+	require_NoError(t, err)
+
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+
+	// Now restart with only our new key.
+	nc.Close()
+	s.Shutdown()
+	require_NoError(t, os.WriteFile(conf, []byte(newConf), 0666))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	si2, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == si2.State.Msgs)
+	require_True(t, si.State.LastSeq == si2.State.LastSeq)
+	ci2, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.AckFloor.Stream == ci2.AckFloor.Stream)
+
+	sm, err := js.GetMsg("TEST", 1)
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(sm.Data, msg))
+
+	si, err = js.StreamInfo("MEM")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 100)
+	sm, err = js.GetMsg("MEM", 100)
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(sm.Data, msg))
+}
+
 // User report of bug.
 func TestJetStreamConsumerBadNumPending(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
@@ -19425,3 +19524,2060 @@ func TestJetStreamConsumerFilterUpdate(t *testing.T) {
 	// and expect that numFilter reports correctly.
 	checkNumFilter(0)
 }
+
+func TestJetStreamMessageTTL(t *testing.T) {
+	for _, st := range []StorageType{FileStorage, MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			s := RunBasicJetStreamServer(t)
+			defer s.Shutdown()
+
+			mset, err := s.GlobalAccount().addStream(&StreamConfig{
+				Name:     "TEST",
+				Storage:  st,
+				Subjects: []string{"foo.*"},
+			})
+			require_NoError(t, err)
+
+			nc, _ := jsClientConnect(t, s)
+			defer nc.Close()
+
+			pubTTL := func(subj, ttl string) *JSPubAckResponse {
+				t.Helper()
+				m := nats.NewMsg(subj)
+				m.Header.Set(JSMessageTTL, ttl)
+				m.Data = []byte("OK")
+				resp, err := nc.RequestMsg(m, time.Second)
+				require_NoError(t, err)
+				pa := getPubAckResponse(resp.Data)
+				if pa == nil {
+					t.Fatalf("Unexpected response: %q", resp.Data)
+				}
+				return pa
+			}
+
+			// Not allowed by default.
+			pa := pubTTL("foo.bar", "1s")
+			if pa.Error == nil || pa.Error.ErrCode != uint16(JSMessageTTLDisabledErr) {
+				t.Fatalf("Expected TTL disabled error, got %+v", pa.Error)
+			}
+
+			// Enable and check we can not disable again.
+			cfg := mset.config()
+			cfg.AllowMsgTTL = true
+			require_NoError(t, mset.update(&cfg))
+			cfg.AllowMsgTTL = false
+			require_Error(t, mset.update(&cfg))
+
+			for _, ttl := range []string{"bad", "0", "-1s", "10ms"} {
+				pa = pubTTL("foo.bar", ttl)
+				if pa.Error == nil || pa.Error.ErrCode != uint16(JSMessageTTLInvalidErr) {
+					t.Fatalf("Expected TTL invalid error for %q, got %+v", ttl, pa.Error)
+				}
+			}
+
+			for i := 0; i < 5; i++ {
+				pa = pubTTL("foo.bar", "1")
+				require_True(t, pa.Error == nil)
+				pa = pubTTL("foo.baz", "1h")
+				require_True(t, pa.Error == nil)
+			}
+			sendStreamMsg(t, nc, "foo.keep", "OK")
+			require_True(t, mset.state().Msgs == 11)
+
+			checkFor(t, 3*time.Second, 100*time.Millisecond, func() error {
+				if state := mset.state(); state.Msgs != 6 {
+					return fmt.Errorf("Expected 6 msgs, got %d", state.Msgs)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestJetStreamMessageTTLOverflow(t *testing.T) {
+	// Seconds that do not fit in a duration are invalid, instead of wrapping around.
+	maxSecs := math.MaxInt64 / int64(time.Second)
+	ttl, err := parseMessageTTL(strconv.FormatInt(maxSecs, 10))
+	require_NoError(t, err)
+	require_True(t, ttl == time.Duration(maxSecs)*time.Second)
+	for _, v := range []string{
+		strconv.FormatInt(maxSecs+1, 10),
+		"9300000000000000000",
+		strconv.FormatInt(math.MaxInt64, 10),
+		"3000000h",
+	} {
+		if _, err := parseMessageTTL(v); err != errMsgTTLInvalid {
+			t.Fatalf("Expected %q to be invalid, got %v", v, err)
+		}
+	}
+
+	// Expirations saturate instead of overflowing.
+	hdr := genHeader(nil, JSMessageTTL, strconv.FormatInt(maxSecs, 10))
+	now := time.Now().UnixNano()
+	require_True(t, msgTTLExpires(hdr, now) == math.MaxInt64)
+	hdr = genHeader(nil, JSMessageTTL, "1h")
+	require_True(t, msgTTLExpires(hdr, now) == now+int64(time.Hour))
+}
+
+func TestJetStreamSubjectTransform(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+
+	// Check validation.
+	for _, st := range []*SubjectTransformConfig{
+		{Source: "foo.*", Destination: "bar.>"},
+		{Source: "foo.*", Destination: "bar.{{unknown(1)}}"},
+		{Source: "foo.*", Destination: "bar.{{wildcard(2)}}"},
+		{Source: "baz.*", Destination: "bar.{{wildcard(1)}}"},
+		{Source: "foo..", Destination: "bar"},
+	} {
+		_, err := acc.addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}, SubjectTransform: st})
+		require_Error(t, err)
+	}
+
+	mset, err := acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo.*", "keep"},
+		SubjectTransform: &SubjectTransformConfig{
+			Source:      "foo.*",
+			Destination: "bar.{{partition(2,1)}}.{{wildcard(1)}}",
+		},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, "foo.a", "OK")
+	sendStreamMsg(t, nc, "foo.b", "OK")
+	sendStreamMsg(t, nc, "keep", "OK")
+
+	ss := mset.store.SubjectsState(fwcs)
+	if len(ss) != 3 {
+		t.Fatalf("Expected 3 subjects, got %+v", ss)
+	}
+	for subj := range ss {
+		if subj != "keep" && !subjectIsSubsetMatch(subj, "bar.*.*") {
+			t.Fatalf("Unexpected subject stored: %q", subj)
+		}
+	}
+
+	// Consumers should be able to filter on transformed subjects.
+	sub, err := js.SubscribeSync("bar.*.a")
+	require_NoError(t, err)
+	m, err := sub.NextMsg(time.Second)
+	require_NoError(t, err)
+	require_True(t, strings.HasSuffix(m.Subject, ".a"))
+	require_True(t, strings.HasPrefix(m.Subject, "bar."))
+	sub.Unsubscribe()
+
+	// Update the transform and make sure it is applied.
+	cfg := mset.config()
+	cfg.SubjectTransform = &SubjectTransformConfig{Source: "foo.*", Destination: "baz.$1"}
+	require_NoError(t, mset.update(&cfg))
+	sendStreamMsg(t, nc, "foo.c", "OK")
+	sm, err := mset.store.LoadLastMsg(fwcs, nil)
+	require_NoError(t, err)
+	require_Equal(t, sm.subj, "baz.c")
+
+	// Remove it.
+	cfg.SubjectTransform = nil
+	require_NoError(t, mset.update(&cfg))
+	sendStreamMsg(t, nc, "foo.d", "OK")
+	sm, err = mset.store.LoadLastMsg(fwcs, nil)
+	require_NoError(t, err)
+	require_Equal(t, sm.subj, "foo.d")
+
+	// Mirrors can not have a subject transform.
+	_, err = acc.addStream(&StreamConfig{
+		Name:             "M",
+		Mirror:           &StreamSource{Name: "TEST"},
+		SubjectTransform: &SubjectTransformConfig{Destination: "bar.>"},
+	})
+	require_Error(t, err)
+}
+
+func TestJetStreamSourceSubjectTransforms(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	_, err := acc.addStream(&StreamConfig{Name: "ORIGIN", Subjects: []string{"orders.*", "events.*", "other"}})
+	require_NoError(t, err)
+
+	// Check validation.
+	for _, ssi := range []*StreamSource{
+		{Name: "ORIGIN", FilterSubject: "orders.*", SubjectTransforms: []SubjectTransformConfig{{Source: "events.*"}}},
+		{Name: "ORIGIN", SubjectTransforms: []SubjectTransformConfig{{Source: "orders.*"}, {Source: "orders.>"}}},
+		{Name: "ORIGIN", SubjectTransforms: []SubjectTransformConfig{{Source: "orders..bad"}}},
+		{Name: "ORIGIN", SubjectTransforms: []SubjectTransformConfig{{Source: "orders.*", Destination: "o.{{wildcard(2)}}"}}},
+	} {
+		_, err := acc.addStream(&StreamConfig{Name: "AGG", Sources: []*StreamSource{ssi}})
+		require_Error(t, err)
+		_, err = acc.addStream(&StreamConfig{Name: "MIRROR", Mirror: ssi})
+		require_Error(t, err)
+	}
+
+	agg, err := acc.addStream(&StreamConfig{
+		Name: "AGG",
+		Sources: []*StreamSource{{
+			Name: "ORIGIN",
+			SubjectTransforms: []SubjectTransformConfig{
+				{Source: "orders.*", Destination: "agg.orders.$1"},
+				{Source: "events.*"},
+			},
+		}},
+	})
+	require_NoError(t, err)
+
+	mirror, err := acc.addStream(&StreamConfig{
+		Name: "MIRROR",
+		Mirror: &StreamSource{
+			Name: "ORIGIN",
+			SubjectTransforms: []SubjectTransformConfig{
+				{Source: "orders.*", Destination: "m.orders.$1"},
+				{Source: "events.*", Destination: "m.events.$1"},
+			},
+		},
+	})
+	require_NoError(t, err)
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, "orders.1", "OK")
+	sendStreamMsg(t, nc, "other", "SKIP")
+	sendStreamMsg(t, nc, "events.1", "OK")
+	sendStreamMsg(t, nc, "orders.2", "OK")
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := agg.state(); state.Msgs != 3 {
+			return fmt.Errorf("Expected 3 sourced msgs, got %d", state.Msgs)
+		}
+		if state := mirror.state(); state.Msgs != 3 || state.LastSeq != 4 {
+			return fmt.Errorf("Expected 3 mirrored msgs with last seq 4, got %+v", state)
+		}
+		return nil
+	})
+
+	// The upstream consumers should be filtered on the origin by all of our transform sources.
+	origin, err := acc.lookupStream("ORIGIN")
+	require_NoError(t, err)
+	consumers := origin.getConsumers()
+	require_True(t, len(consumers) == 2)
+	for _, o := range consumers {
+		cfg := o.config()
+		require_Equal(t, cfg.FilterSubject, _EMPTY_)
+		if len(cfg.FilterSubjects) != 2 || cfg.FilterSubjects[0] != "orders.*" || cfg.FilterSubjects[1] != "events.*" {
+			t.Fatalf("Expected source consumer to use both filters, got %+v", cfg.FilterSubjects)
+		}
+	}
+
+	ss := agg.store.SubjectsState(fwcs)
+	if len(ss) != 3 || ss["agg.orders.1"].Msgs != 1 || ss["agg.orders.2"].Msgs != 1 || ss["events.1"].Msgs != 1 {
+		t.Fatalf("Unexpected sourced subjects: %+v", ss)
+	}
+	ss = mirror.store.SubjectsState(fwcs)
+	if len(ss) != 3 || ss["m.orders.1"].Msgs != 1 || ss["m.orders.2"].Msgs != 1 || ss["m.events.1"].Msgs != 1 {
+		t.Fatalf("Unexpected mirrored subjects: %+v", ss)
+	}
+	// Mirrors keep the origin sequences.
+	sm, err := mirror.store.LoadMsg(3, nil)
+	require_NoError(t, err)
+	require_Equal(t, sm.subj, "m.events.1")
+
+	// Now update the source to also pick up the other subject.
+	cfg := agg.config()
+	cfg.Sources = []*StreamSource{{
+		Name: "ORIGIN",
+		SubjectTransforms: []SubjectTransformConfig{
+			{Source: "orders.*", Destination: "agg.orders.$1"},
+			{Source: "events.*"},
+			{Source: "other", Destination: "agg.other"},
+		},
+	}}
+	require_NoError(t, agg.update(&cfg))
+	sendStreamMsg(t, nc, "other", "OK")
+
+	// Recreating the source consumer can be throttled.
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if ss := agg.store.SubjectsState("agg.other"); ss["agg.other"].Msgs != 1 {
+			return fmt.Errorf("Expected transformed msg for updated source, got %+v", ss)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamConsumerMultipleFilterSubjects(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"orders.>"}})
+	require_NoError(t, err)
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "orders.created.1", "OK")
+		sendStreamMsg(t, nc, "orders.updated.1", "OK")
+		sendStreamMsg(t, nc, "orders.cancelled.1", "OK")
+	}
+
+	// Check validation.
+	for _, cfg := range []*ConsumerConfig{
+		{FilterSubject: "orders.created.>", FilterSubjects: []string{"orders.cancelled.>"}},
+		{FilterSubjects: []string{"orders.created.>", "orders.*.1"}},
+		{FilterSubjects: []string{"orders.created.>", _EMPTY_}},
+		{FilterSubjects: []string{"orders.created.>", "bar"}},
+	} {
+		cfg.AckPolicy = AckExplicit
+		_, err := mset.addConsumer(cfg)
+		require_Error(t, err)
+	}
+
+	sub := natsSubSync(t, nc, nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: sub.Subject,
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.created.>", "orders.cancelled.>"},
+	})
+	require_NoError(t, err)
+	defer o.delete()
+
+	for i := 0; i < 20; i++ {
+		m := natsNexMsg(t, sub, time.Second)
+		if m.Subject == "orders.updated.1" {
+			t.Fatalf("Received unexpected subject: %q", m.Subject)
+		}
+		// Each delivery should be in order and skip the filtered out message.
+		meta, err := m.Metadata()
+		require_NoError(t, err)
+		if expected := uint64(i/2*3 + i%2*2 + 1); meta.Sequence.Stream != expected {
+			t.Fatalf("Expected stream sequence %d, got %d", expected, meta.Sequence.Stream)
+		}
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no more messages, got %v", err)
+	}
+
+	sendStreamMsg(t, nc, "orders.updated.2", "OK")
+	sendStreamMsg(t, nc, "orders.created.2", "OK")
+	m := natsNexMsg(t, sub, time.Second)
+	require_Equal(t, m.Subject, "orders.created.2")
+
+	// Check num pending with a new consumer.
+	o2, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "pull",
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.updated.>", "orders.cancelled.>"},
+	})
+	require_NoError(t, err)
+	defer o2.delete()
+	if np := o2.info().NumPending; np != 21 {
+		t.Fatalf("Expected 21 pending, got %d", np)
+	}
+
+	// Update filters and make sure num pending and delivery follow.
+	cfg := o2.config()
+	cfg.FilterSubjects = []string{"orders.created.>"}
+	require_NoError(t, o2.updateConfig(&cfg))
+	if np := o2.info().NumPending; np != 11 {
+		t.Fatalf("Expected 11 pending, got %d", np)
+	}
+
+	// Last per subject across multiple filters.
+	o3, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "lps",
+		AckPolicy:      AckExplicit,
+		DeliverPolicy:  DeliverLastPerSubject,
+		FilterSubjects: []string{"orders.created.>", "orders.updated.>"},
+	})
+	require_NoError(t, err)
+	defer o3.delete()
+	if np := o3.info().NumPending; np != 4 {
+		t.Fatalf("Expected 4 pending, got %d", np)
+	}
+}
+
+func TestJetStreamConsumerMultipleFilterSubjectsWorkQueue(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"orders.>"},
+		Retention: WorkQueuePolicy,
+	})
+	require_NoError(t, err)
+
+	_, err = mset.addConsumer(&ConsumerConfig{
+		Durable:        "A",
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.created.>", "orders.cancelled.>"},
+	})
+	require_NoError(t, err)
+
+	// Overlaps with one of the filters above.
+	_, err = mset.addConsumer(&ConsumerConfig{
+		Durable:        "B",
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.updated.>", "orders.cancelled.1"},
+	})
+	require_Error(t, err, NewJSConsumerWQConsumerNotUniqueError())
+
+	_, err = mset.addConsumer(&ConsumerConfig{
+		Durable:        "B",
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.updated.>", "orders.shipped.>"},
+	})
+	require_NoError(t, err)
+}
+
+func TestJetStreamConsumerMultipleFilterSubjectsUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"orders.>"},
+		Retention: InterestPolicy,
+	})
+	require_NoError(t, err)
+
+	cfg := ConsumerConfig{
+		Durable:        "A",
+		AckPolicy:      AckExplicit,
+		FilterSubjects: []string{"orders.created", "orders.cancelled"},
+	}
+	o, err := mset.addConsumer(&cfg)
+	require_NoError(t, err)
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	numFilter := func() int {
+		mset.mu.RLock()
+		defer mset.mu.RUnlock()
+		return mset.numFilter
+	}
+	// Returns whether a message on subj was kept for our consumer.
+	kept := func(subj string) bool {
+		t.Helper()
+		before := mset.state().Msgs
+		sendStreamMsg(t, nc, subj, "OK")
+		return mset.state().Msgs > before
+	}
+	require_True(t, numFilter() == 1)
+	require_True(t, kept("orders.created"))
+	require_False(t, kept("orders.shipped"))
+
+	// Our filters take effect for the stream as soon as we are updated.
+	cfg.FilterSubjects = []string{"orders.shipped"}
+	require_NoError(t, o.updateConfig(&cfg))
+	require_True(t, numFilter() == 1)
+	require_False(t, kept("orders.created"))
+	require_True(t, kept("orders.shipped"))
+
+	cfg.FilterSubjects = nil
+	require_NoError(t, o.updateConfig(&cfg))
+	require_True(t, numFilter() == 0)
+	require_True(t, kept("orders.created"))
+
+	cfg.FilterSubject = "orders.created"
+	require_NoError(t, o.updateConfig(&cfg))
+	require_True(t, numFilter() == 1)
+	require_False(t, kept("orders.shipped"))
+
+	// Filters can be swapped while messages are being stored.
+	qch := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-qch:
+				return
+			default:
+				nc.Publish("orders.created", []byte("OK"))
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		cfg.FilterSubject, cfg.FilterSubjects = _EMPTY_, []string{"orders.created", fmt.Sprintf("orders.%d", i)}
+		if i%2 == 0 {
+			cfg.FilterSubjects = nil
+		}
+		require_NoError(t, o.updateConfig(&cfg))
+	}
+	close(qch)
+	wg.Wait()
+	require_True(t, numFilter() == 1)
+}
+
+func TestJetStreamConsumerPause(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	asub := natsSubSync(t, nc, JSAdvisoryConsumerPausePre+".TEST.dlc")
+	defer asub.Unsubscribe()
+
+	pause := func(until time.Time) *JSApiConsumerPauseResponse {
+		t.Helper()
+		var req []byte
+		if !until.IsZero() {
+			req, err = json.Marshal(&JSApiConsumerPauseRequest{PauseUntil: until})
+			require_NoError(t, err)
+		}
+		msg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "dlc"), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerPauseResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		return &resp
+	}
+	checkAdvisory := func(paused bool) {
+		t.Helper()
+		var adv JSConsumerPauseAdvisory
+		require_NoError(t, json.Unmarshal(natsNexMsg(t, asub, 2*time.Second).Data, &adv))
+		if adv.Type != JSConsumerPauseAdvisoryType || adv.Paused != paused {
+			t.Fatalf("Unexpected advisory: %+v", adv)
+		}
+	}
+	fetch := func(expected int) {
+		t.Helper()
+		msg, err := nc.Request(fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc"), []byte(`{"batch":10,"expires":250000000}`), time.Second)
+		if expected == 0 {
+			if err == nil && msg.Header.Get("Status") == _EMPTY_ {
+				t.Fatalf("Expected no messages while paused, got %q", msg.Data)
+			}
+			return
+		}
+		require_NoError(t, err)
+		require_Equal(t, string(msg.Data), "OK")
+	}
+
+	// Unknown consumer.
+	msg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "bad"), nil, time.Second)
+	require_NoError(t, err)
+	var presp JSApiConsumerPauseResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &presp))
+	require_True(t, presp.Error != nil && presp.Error.ErrCode == uint16(JSConsumerNotFoundErr))
+
+	resp := pause(time.Now().Add(time.Hour))
+	require_True(t, resp.Paused)
+	require_True(t, resp.PauseRemaining > 59*time.Minute)
+	checkAdvisory(true)
+
+	sendStreamMsg(t, nc, "foo", "OK")
+	fetch(0)
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	ci := o.info()
+	require_True(t, ci.Paused)
+	require_True(t, ci.Config.PauseUntil != nil)
+	require_True(t, ci.NumPending == 1)
+
+	// Pause state should have been persisted with the consumer config.
+	require_True(t, o.store.(*consumerFileStore).cfg.PauseUntil != nil)
+
+	// Resume early with an empty request.
+	resp = pause(time.Time{})
+	require_False(t, resp.Paused)
+	checkAdvisory(false)
+	fetch(1)
+
+	// Now pause for a short time and make sure we resume on our own.
+	pause(time.Now().Add(500 * time.Millisecond))
+	checkAdvisory(true)
+	sendStreamMsg(t, nc, "foo", "OK")
+	checkAdvisory(false)
+	require_False(t, o.info().Paused)
+	fetch(1)
+}
+
+func TestJetStreamConsumerDeadLetter(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "DLQ", Subjects: []string{"dlq.>"}})
+	require_NoError(t, err)
+
+	createConsumer := func(cfg *ConsumerConfig) *ApiError {
+		t.Helper()
+		req, err := json.Marshal(&CreateConsumerRequest{Stream: "TEST", Config: *cfg})
+		require_NoError(t, err)
+		msg, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", cfg.Durable), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerCreateResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		return resp.Error
+	}
+
+	// Check config validation.
+	for _, test := range []struct {
+		cfg *ConsumerConfig
+		err ErrorIdentifier
+	}{
+		{&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, DeadLetter: &DeadLetter{Subject: "dlq.*"}}, JSConsumerDeadLetterInvalidSubject},
+		{&ConsumerConfig{Durable: "bad", AckPolicy: AckNone, DeadLetter: &DeadLetter{Subject: "dlq.foo"}}, JSConsumerDeadLetterRequiresAck},
+		{&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, DeadLetter: &DeadLetter{Subject: "foo"}}, JSConsumerDeadLetterCycle},
+	} {
+		if apiErr := createConsumer(test.cfg); apiErr == nil || apiErr.ErrCode != uint16(test.err) {
+			t.Fatalf("Expected error %d, got %+v", test.err, apiErr)
+		}
+	}
+
+	apiErr := createConsumer(&ConsumerConfig{
+		Durable:    "dlc",
+		AckPolicy:  AckExplicit,
+		MaxDeliver: 2,
+		DeadLetter: &DeadLetter{Subject: "dlq.TEST.dlc"},
+	})
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+
+	m := nats.NewMsg("foo")
+	m.Header.Set(JSMsgId, "1")
+	m.Header.Set("Custom", "OK")
+	m.Data = []byte("HELLO")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+	sendStreamMsg(t, nc, "foo", "BYE")
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+
+	// NAK the first message up to MaxDeliver and terminate the second.
+	msgs, err := sub.Fetch(2, nats.MaxWait(time.Second))
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 2)
+	require_NoError(t, msgs[0].Nak())
+	require_NoError(t, msgs[1].Term())
+	msgs, err = sub.Fetch(1, nats.MaxWait(time.Second))
+	require_NoError(t, err)
+	require_NoError(t, msgs[0].Respond([]byte(`-NAK {"reason":"bad payload"}`)))
+
+	// This will trip MaxDeliver.
+	_, err = sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+	require_Error(t, err)
+
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		si, err := js.StreamInfo("DLQ")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 2 {
+			return fmt.Errorf("Expected 2 dead letters, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+
+	dm, err := js.GetMsg("DLQ", 1)
+	require_NoError(t, err)
+	require_Equal(t, string(dm.Data), "BYE")
+	require_Equal(t, dm.Header.Get(JSDeadLetterReason), deadLetterTerminated)
+	require_Equal(t, dm.Header.Get(JSSequence), "2")
+	require_Equal(t, dm.Header.Get(JSDeadLetterDeliveries), "1")
+
+	dm, err = js.GetMsg("DLQ", 2)
+	require_NoError(t, err)
+	require_Equal(t, string(dm.Data), "HELLO")
+	require_Equal(t, dm.Header.Get(JSStream), "TEST")
+	require_Equal(t, dm.Header.Get(JSSubject), "foo")
+	require_Equal(t, dm.Header.Get(JSSequence), "1")
+	require_Equal(t, dm.Header.Get(JSDeadLetterConsumer), "dlc")
+	require_Equal(t, dm.Header.Get(JSDeadLetterDeliveries), "2")
+	require_Equal(t, dm.Header.Get(JSDeadLetterReason), deadLetterMaxDeliveries)
+	require_Equal(t, dm.Header.Get(JSDeadLetterNakReason), "bad payload")
+	require_Equal(t, dm.Header.Get("Custom"), "OK")
+	require_Equal(t, dm.Header.Get(JSMsgId), _EMPTY_)
+
+	// Now headers only with a reason on the TERM.
+	cfg := ConsumerConfig{
+		Durable:    "hdrs",
+		AckPolicy:  AckExplicit,
+		DeadLetter: &DeadLetter{Subject: "dlq.TEST.hdrs", HeadersOnly: true},
+	}
+	if apiErr = createConsumer(&cfg); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	sub, err = js.PullSubscribe("foo", "hdrs")
+	require_NoError(t, err)
+	msgs, err = sub.Fetch(1, nats.MaxWait(time.Second))
+	require_NoError(t, err)
+	require_NoError(t, msgs[0].Respond([]byte("+TERM not for us")))
+
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		_, err := js.GetMsg("DLQ", 3)
+		return err
+	})
+	dm, err = js.GetMsg("DLQ", 3)
+	require_NoError(t, err)
+	require_True(t, len(dm.Data) == 0)
+	require_Equal(t, dm.Subject, "dlq.TEST.hdrs")
+	require_Equal(t, dm.Header.Get(JSMsgSize), "5")
+	require_Equal(t, dm.Header.Get(JSDeadLetterTermReason), "not for us")
+}
+
+func TestJetStreamMessageSchedules(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:     "TEST",
+		Storage:  FileStorage,
+		Subjects: []string{"foo.*"},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	pubAt := func(subj, at string) *JSPubAckResponse {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSDeliverAt, at)
+		m.Header.Set(JSMsgId, subj+at)
+		m.Data = []byte("LATER")
+		resp, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		pa := getPubAckResponse(resp.Data)
+		if pa == nil {
+			t.Fatalf("Unexpected response: %q", resp.Data)
+		}
+		return pa
+	}
+
+	// Not allowed by default.
+	pa := pubAt("foo.bar", "1s")
+	if pa.Error == nil || pa.Error.ErrCode != uint16(JSMessageDeliverAtDisabledErr) {
+		t.Fatalf("Expected delivery time disabled error, got %+v", pa.Error)
+	}
+
+	// Enable and check we can not disable again.
+	cfg := mset.config()
+	cfg.AllowMsgSchedules = true
+	require_NoError(t, mset.update(&cfg))
+	cfg.AllowMsgSchedules = false
+	require_Error(t, mset.update(&cfg))
+
+	for _, at := range []string{"bad", "0", "-1s"} {
+		pa = pubAt("foo.bar", at)
+		if pa.Error == nil || pa.Error.ErrCode != uint16(JSMessageDeliverAtInvalidErr) {
+			t.Fatalf("Expected delivery time invalid error for %q, got %+v", at, pa.Error)
+		}
+	}
+
+	// A time in the past is delivered right away.
+	pa = pubAt("foo.past", time.Now().Add(-time.Hour).Format(time.RFC3339Nano))
+	require_True(t, pa.Error == nil)
+	pa = pubAt("foo.bar", "1s")
+	require_True(t, pa.Error == nil)
+	require_True(t, pa.Sequence == 2)
+	pa = pubAt("foo.baz", time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	require_True(t, pa.Error == nil)
+	sendStreamMsg(t, nc, "foo.now", "NOW")
+
+	sub, err := js.PullSubscribe("foo.*", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(10, nats.MaxWait(250*time.Millisecond))
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 2)
+	require_Equal(t, msgs[0].Subject, "foo.past")
+	require_Equal(t, msgs[1].Subject, "foo.now")
+	for _, m := range msgs {
+		require_NoError(t, m.AckSync())
+	}
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.NumPending == 0)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o.info().NumScheduled == 2)
+
+	// Once due a copy is placed back into the stream and the original is removed.
+	msgs, err = sub.Fetch(1, nats.MaxWait(3*time.Second))
+	require_NoError(t, err)
+	m := msgs[0]
+	require_Equal(t, m.Subject, "foo.bar")
+	require_Equal(t, string(m.Data), "LATER")
+	require_Equal(t, m.Header.Get(JSScheduledSequence), "2")
+	require_Equal(t, m.Header.Get(JSDeliverAt), _EMPTY_)
+	require_NoError(t, m.AckSync())
+	meta, err := m.Metadata()
+	require_NoError(t, err)
+	require_True(t, meta.Sequence.Stream == 5)
+	require_True(t, meta.NumDelivered == 1)
+
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if _, err := js.GetMsg("TEST", 2); err == nil {
+			return fmt.Errorf("Expected original to be removed")
+		}
+		return nil
+	})
+	require_True(t, o.info().NumScheduled == 1)
+
+	// Clients can not reference a scheduled message themselves.
+	fm := nats.NewMsg("foo.baz")
+	fm.Header.Set(JSScheduledSequence, "4")
+	fm.Data = []byte("FORGED")
+	resp, err := nc.RequestMsg(fm, time.Second)
+	require_NoError(t, err)
+	pa = getPubAckResponse(resp.Data)
+	require_True(t, pa != nil && pa.Error == nil)
+	sm, err := js.GetMsg("TEST", pa.Sequence)
+	require_NoError(t, err)
+	require_Equal(t, sm.Header.Get(JSScheduledSequence), _EMPTY_)
+	require_True(t, o.info().NumScheduled == 1)
+	msgs, err = sub.Fetch(1, nats.MaxWait(time.Second))
+	require_NoError(t, err)
+	require_Equal(t, string(msgs[0].Data), "FORGED")
+	require_NoError(t, msgs[0].AckSync())
+
+	// Make sure schedules survive a restart.
+	pa = pubAt("foo.bar", "2s")
+	require_True(t, pa.Error == nil)
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err = js.PullSubscribe("foo.*", "dlc")
+	require_NoError(t, err)
+	_, err = sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+	require_Error(t, err)
+	msgs, err = sub.Fetch(1, nats.MaxWait(3*time.Second))
+	require_NoError(t, err)
+	require_Equal(t, msgs[0].Header.Get(JSScheduledSequence), strconv.FormatUint(pa.Sequence, 10))
+}
+
+func TestJetStreamMessageSchedulesTrackedBeforeStore(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:              "TEST",
+		Storage:           FileStorage,
+		Subjects:          []string{"foo.*"},
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+
+	// Consumers may load a message as soon as it is stored, so it needs to be tracked by then.
+	var stored, scheduled atomic.Int64
+	mset.store.RegisterStorageUpdates(func(md, bd int64, seq uint64, subj string) {
+		mset.storeUpdates(md, bd, seq, subj)
+		if md > 0 {
+			stored.Add(1)
+			if mset.sched.isScheduled(seq) {
+				scheduled.Add(1)
+			}
+		}
+	})
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 10; i++ {
+		m := nats.NewMsg("foo.later")
+		m.Header.Set(JSDeliverAt, "1h")
+		_, err = js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+	require_True(t, stored.Load() == 10)
+	require_True(t, scheduled.Load() == 10)
+
+	// Messages we no longer track should not linger in our queue.
+	for seq := uint64(1); seq <= 10; seq++ {
+		_, err = mset.store.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	mset.sched.mu.Lock()
+	ql := len(mset.sched.q)
+	mset.sched.mu.Unlock()
+	require_True(t, ql == 0)
+}
+
+func TestJetStreamMessageSchedulesIndex(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	_, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:              "TEST",
+		Storage:           FileStorage,
+		Subjects:          []string{"foo.*"},
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	pubAt := func(subj string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			m := nats.NewMsg(subj)
+			m.Header.Set(JSDeliverAt, "1h")
+			_, err := js.PublishMsg(m)
+			require_NoError(t, err)
+		}
+	}
+	pubAt("foo.a", 5)
+	pubAt("foo.b", 3)
+	sendStreamMsg(t, nc, "foo.a", "OK")
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "A", FilterSubject: "foo.a", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	ci, err := js.ConsumerInfo("TEST", "A")
+	require_NoError(t, err)
+	require_True(t, ci.NumPending == 1)
+
+	u, _ := url.Parse(s.ClientURL())
+	port, _ := strconv.Atoi(u.Port())
+	sd := s.JetStreamConfig().StoreDir
+	fn := filepath.Join(sd, globalAccountName, streamsDir, "TEST", schedIndexFile)
+	restartServer := func() {
+		t.Helper()
+		nc.Close()
+		s.Shutdown()
+		s = RunJetStreamServerOnPort(port, sd)
+		nc, js = jsClientConnect(t, s)
+	}
+	scheduled := func() uint64 {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		return uint64(len(mset.sched.seqs()))
+	}
+
+	// Our schedules are written out when stopped and picked up again on recovery.
+	nc.Close()
+	s.Shutdown()
+	_, err = os.Stat(fn)
+	require_NoError(t, err)
+	old, err := os.ReadFile(fn)
+	require_NoError(t, err)
+	s = RunJetStreamServerOnPort(port, sd)
+	nc, js = jsClientConnect(t, s)
+	_, err = os.Stat(fn)
+	require_True(t, os.IsNotExist(err))
+	require_True(t, scheduled() == 8)
+	ci, err = js.ConsumerInfo("TEST", "A")
+	require_NoError(t, err)
+	require_True(t, ci.NumPending == 1)
+
+	// An index from before messages were added is not used.
+	pubAt("foo.b", 1)
+	nc.Close()
+	s.Shutdown()
+	require_NoError(t, os.WriteFile(fn, old, defaultFilePerms))
+	s = RunJetStreamServerOnPort(port, sd)
+	nc, js = jsClientConnect(t, s)
+	require_True(t, scheduled() == 9)
+
+	// Nor is a corrupt one.
+	restartServer()
+	old, err = os.ReadFile(fn)
+	require_True(t, os.IsNotExist(err))
+	nc.Close()
+	s.Shutdown()
+	buf, err := os.ReadFile(fn)
+	require_NoError(t, err)
+	buf[len(buf)/2] ^= 0xff
+	require_NoError(t, os.WriteFile(fn, buf, defaultFilePerms))
+	s = RunJetStreamServerOnPort(port, sd)
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+	require_True(t, scheduled() == 9)
+}
+
+func TestJetStreamMessageSchedulesWorkQueue(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:              "TEST",
+		Storage:           MemoryStorage,
+		Subjects:          []string{"foo"},
+		Retention:         WorkQueuePolicy,
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := js.PullSubscribe("foo", "wq")
+	require_NoError(t, err)
+
+	m := nats.NewMsg("foo")
+	m.Header.Set(JSDeliverAt, "500ms")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+
+	_, err = sub.Fetch(1, nats.MaxWait(100*time.Millisecond))
+	require_Error(t, err)
+	require_True(t, mset.state().Msgs == 1)
+
+	msgs, err := sub.Fetch(1, nats.MaxWait(2*time.Second))
+	require_NoError(t, err)
+	require_NoError(t, msgs[0].AckSync())
+
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != 0 {
+			return fmt.Errorf("Expected no msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamMessageSchedulesTTL(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:              "TEST",
+		Storage:           FileStorage,
+		Subjects:          []string{"foo.*"},
+		AllowMsgTTL:       true,
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	pub := func(subj, at, ttl string) {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSDeliverAt, at)
+		m.Header.Set(JSMessageTTL, ttl)
+		_, err := js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+	// Expires before it is due, so should never be delivered.
+	pub("foo.gone", "2s", "1s")
+	// The copy should only get what is left of the original TTL.
+	pub("foo.bar", "1s", "5s")
+
+	sub, err := js.PullSubscribe("foo.*", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(1, nats.MaxWait(2*time.Second))
+	require_NoError(t, err)
+	m := msgs[0]
+	require_Equal(t, m.Subject, "foo.bar")
+	require_NoError(t, m.AckSync())
+	ttl, err := parseMessageTTL(m.Header.Get(JSMessageTTL))
+	require_NoError(t, err)
+	if ttl > 4*time.Second || ttl < 3*time.Second {
+		t.Fatalf("Expected remaining TTL of about 4s, got %v", ttl)
+	}
+
+	_, err = sub.Fetch(1, nats.MaxWait(2*time.Second))
+	require_Error(t, err)
+
+	// The copy expires at the time the original would have.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != 0 {
+			return fmt.Errorf("Expected no msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamMessageSchedulesFilteredCounts(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:              "TEST",
+		Storage:           MemoryStorage,
+		Subjects:          []string{"foo.*"},
+		AllowMsgSchedules: true,
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for _, subj := range []string{"foo.a", "foo.a", "foo.b", "foo.c"} {
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSDeliverAt, "1h")
+		_, err := js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+
+	addConsumer := func(name string, filters ...string) *consumer {
+		t.Helper()
+		o, err := mset.addConsumer(&ConsumerConfig{Durable: name, AckPolicy: AckExplicit, FilterSubjects: filters})
+		require_NoError(t, err)
+		return o
+	}
+	all := addConsumer("all")
+	a := addConsumer("a", "foo.a")
+	ab := addConsumer("ab", "foo.a", "foo.b")
+	wc := addConsumer("wc", "foo.*")
+
+	require_True(t, all.info().NumScheduled == 4)
+	require_True(t, a.info().NumScheduled == 2)
+	require_True(t, ab.info().NumScheduled == 3)
+	require_True(t, wc.info().NumScheduled == 4)
+
+	// Counts follow messages being tracked and removed.
+	m := nats.NewMsg("foo.b")
+	m.Header.Set(JSDeliverAt, "1h")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+	require_NoError(t, js.DeleteMsg("TEST", 1))
+	require_True(t, all.info().NumScheduled == 4)
+	require_True(t, a.info().NumScheduled == 1)
+	require_True(t, ab.info().NumScheduled == 3)
+
+	// And filter updates.
+	_, err = js.UpdateConsumer("TEST", &nats.ConsumerConfig{Durable: "a", AckPolicy: nats.AckExplicitPolicy, FilterSubject: "foo.c"})
+	require_NoError(t, err)
+	require_True(t, a.info().NumScheduled == 1)
+	require_True(t, ab.info().NumScheduled == 3)
+
+	// Filters are only kept while consumers use them.
+	require_NoError(t, wc.delete())
+	require_NoError(t, all.delete())
+	mset.sched.mu.Lock()
+	_, wcOk := mset.sched.filters["foo.*"]
+	_, allOk := mset.sched.filters[fwcs]
+	nf := len(mset.sched.filters)
+	mset.sched.mu.Unlock()
+	require_False(t, wcOk)
+	require_False(t, allOk)
+	require_True(t, nf == 3)
+}
+
+func TestJetStreamConsumerReset(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "foo", "OK")
+	}
+	time.Sleep(50 * time.Millisecond)
+	mid := time.Now()
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "foo", "OK")
+	}
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(10)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 10)
+	for _, m := range msgs[:5] {
+		require_NoError(t, m.AckSync())
+	}
+
+	reset := func(req *JSApiConsumerResetRequest) *JSApiConsumerResetResponse {
+		t.Helper()
+		b, err := json.Marshal(req)
+		require_NoError(t, err)
+		msg, err := nc.Request(fmt.Sprintf(JSApiConsumerResetT, "TEST", "dlc"), b, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerResetResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		return &resp
+	}
+
+	// Need exactly one of sequence or time.
+	for _, req := range []*JSApiConsumerResetRequest{{}, {StartSeq: 1, StartTime: &mid}} {
+		if resp := reset(req); resp.Error == nil || resp.Error.ErrCode != uint16(JSConsumerResetInvalidRequest) {
+			t.Fatalf("Expected invalid request error, got %+v", resp.Error)
+		}
+	}
+
+	resp := reset(&JSApiConsumerResetRequest{StartSeq: 3})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	require_True(t, resp.ResetSeq == 3)
+	ci := resp.ConsumerInfo
+	require_True(t, ci.Delivered.Stream == 2)
+	require_True(t, ci.AckFloor.Stream == 2)
+	require_True(t, ci.Delivered.Consumer == 10)
+	require_True(t, ci.AckFloor.Consumer == 10)
+	require_True(t, ci.NumAckPending == 0)
+	require_True(t, ci.NumRedelivered == 0)
+	require_True(t, ci.NumPending == 8)
+
+	// Acks for earlier deliveries are ignored.
+	require_NoError(t, msgs[9].AckSync())
+	nci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, nci.AckFloor.Stream == 2)
+
+	// Same bound subscription continues from the new starting point.
+	msgs, err = sub.Fetch(1)
+	require_NoError(t, err)
+	meta, err := msgs[0].Metadata()
+	require_NoError(t, err)
+	require_True(t, meta.Sequence.Stream == 3)
+	require_True(t, meta.Sequence.Consumer == 11)
+	require_True(t, meta.NumDelivered == 1)
+
+	// By time.
+	resp = reset(&JSApiConsumerResetRequest{StartTime: &mid})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	require_True(t, resp.ResetSeq == 6)
+	require_True(t, resp.NumPending == 5)
+
+	// Past the end will deliver new messages only.
+	resp = reset(&JSApiConsumerResetRequest{StartSeq: 100})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	require_True(t, resp.ResetSeq == 11)
+	require_True(t, resp.NumPending == 0)
+
+	// Make sure the reset state was persisted.
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	state, err := mset.lookupConsumer("dlc").store.State()
+	require_NoError(t, err)
+	require_True(t, state.Delivered.Stream == 10)
+	require_True(t, state.AckFloor.Stream == 10)
+	require_True(t, len(state.Pending) == 0)
+
+	// Not allowed for work queues.
+	_, err = js.AddStream(&nats.StreamConfig{Name: "WQ", Subjects: []string{"wq"}, Retention: nats.WorkQueuePolicy})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("WQ", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	msg, err := nc.Request(fmt.Sprintf(JSApiConsumerResetT, "WQ", "dlc"), []byte(`{"start_seq":1}`), time.Second)
+	require_NoError(t, err)
+	var wqResp JSApiConsumerResetResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &wqResp))
+	if wqResp.Error == nil || wqResp.Error.ErrCode != uint16(JSConsumerResetRequiresLimits) {
+		t.Fatalf("Expected retention error, got %+v", wqResp.Error)
+	}
+}
+
+func TestJetStreamConsumerPriorityGroupPinned(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	createConsumer := func(cfg *ConsumerConfig) *ApiError {
+		t.Helper()
+		req, err := json.Marshal(&CreateConsumerRequest{Stream: "TEST", Config: *cfg})
+		require_NoError(t, err)
+		msg, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", cfg.Durable), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerCreateResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		return resp.Error
+	}
+
+	// Check config validation.
+	for _, test := range []struct {
+		cfg *ConsumerConfig
+		err ErrorIdentifier
+	}{
+		{&ConsumerConfig{Durable: "bad", DeliverSubject: "d", PriorityPolicy: PriorityPinnedClient, PriorityGroups: []string{"A"}}, JSConsumerPushWithPriorityGroup},
+		{&ConsumerConfig{Durable: "bad", PriorityGroups: []string{"A"}}, JSConsumerPriorityGroupWithPolicyNone},
+		{&ConsumerConfig{Durable: "bad", PriorityPolicy: PriorityPinnedClient}, JSConsumerInvalidPriorityGroup},
+		{&ConsumerConfig{Durable: "bad", PriorityPolicy: PriorityPinnedClient, PriorityGroups: []string{"A", "B"}}, JSConsumerInvalidPriorityGroup},
+		{&ConsumerConfig{Durable: "bad", PriorityPolicy: PriorityPinnedClient, PriorityGroups: []string{"A.B"}}, JSConsumerInvalidPriorityGroup},
+		{&ConsumerConfig{Durable: "bad", PriorityPolicy: PriorityOverflow, PriorityGroups: []string{"A"}, PinnedTTL: time.Second}, JSConsumerPinnedTTLInvalid},
+	} {
+		if apiErr := createConsumer(test.cfg); apiErr == nil || apiErr.ErrCode != uint16(test.err) {
+			t.Fatalf("Expected error %d, got %+v", test.err, apiErr)
+		}
+	}
+
+	apiErr := createConsumer(&ConsumerConfig{
+		Durable:        "dlc",
+		AckPolicy:      AckExplicit,
+		PriorityPolicy: PriorityPinnedClient,
+		PriorityGroups: []string{"A"},
+		PinnedTTL:      250 * time.Millisecond,
+	})
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	pull := func(reply string, pg PriorityGroup) {
+		t.Helper()
+		req, err := json.Marshal(&JSApiConsumerGetNextRequest{Batch: 1, Expires: 5 * time.Second, PriorityGroup: pg})
+		require_NoError(t, err)
+		require_NoError(t, nc.PublishRequest(rsubj, reply, req))
+		require_NoError(t, nc.Flush())
+	}
+
+	// Requests need to be for our group.
+	resp, err := nc.Request(rsubj, []byte(`{"batch":1,"expires":1000000000}`), time.Second)
+	require_NoError(t, err)
+	require_Equal(t, resp.Header.Get("Status"), "400")
+	resp, err = nc.Request(rsubj, []byte(`{"batch":1,"expires":1000000000,"group":"B"}`), time.Second)
+	require_NoError(t, err)
+	require_Equal(t, resp.Header.Get("Status"), "400")
+
+	subA := natsSubSync(t, nc, "A")
+	subB := natsSubSync(t, nc, "B")
+	pull("A", PriorityGroup{Group: "A"})
+	pull("B", PriorityGroup{Group: "A"})
+
+	// The first client gets pinned, the other one waits.
+	sendStreamMsg(t, nc, "foo", "1")
+	m := natsNexMsg(t, subA, time.Second)
+	pinId := m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, pinId != _EMPTY_)
+	_, err = subB.NextMsg(100 * time.Millisecond)
+	require_Error(t, err, nats.ErrTimeout)
+
+	// Pinned client keeps receiving as long as it is active.
+	pull("A", PriorityGroup{Group: "A", Id: pinId})
+	sendStreamMsg(t, nc, "foo", "2")
+	m = natsNexMsg(t, subA, time.Second)
+	require_Equal(t, m.Header.Get(JSPullRequestNatsPinId), pinId)
+	_, err = subB.NextMsg(100 * time.Millisecond)
+	require_Error(t, err, nats.ErrTimeout)
+
+	// Requests with the wrong id are rejected.
+	resp, err = nc.Request(rsubj, []byte(`{"batch":1,"expires":1000000000,"group":"A","id":"bogus"}`), time.Second)
+	require_NoError(t, err)
+	require_Equal(t, resp.Header.Get("Status"), "423")
+
+	// Once the pinned client goes inactive the waiting one gets pinned.
+	time.Sleep(300 * time.Millisecond)
+	sendStreamMsg(t, nc, "foo", "3")
+	m = natsNexMsg(t, subB, time.Second)
+	npinId := m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, npinId != _EMPTY_ && npinId != pinId)
+
+	// The old pin is no longer valid.
+	pull("A", PriorityGroup{Group: "A", Id: pinId})
+	m = natsNexMsg(t, subA, time.Second)
+	require_Equal(t, m.Header.Get("Status"), "423")
+
+	resp, err = nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	var ciResp JSApiConsumerInfoResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &ciResp))
+	require_True(t, ciResp.ConsumerInfo != nil)
+	require_True(t, len(ciResp.PriorityGroups) == 1)
+	require_Equal(t, ciResp.PriorityGroups[0].Group, "A")
+	require_Equal(t, ciResp.PriorityGroups[0].PinnedClientID, npinId)
+
+	// Unpin explicitly.
+	unpin := func(group string) *ApiError {
+		t.Helper()
+		req, err := json.Marshal(&JSApiConsumerUnpinRequest{Group: group})
+		require_NoError(t, err)
+		msg, err := nc.Request(fmt.Sprintf(JSApiConsumerUnpinT, "TEST", "dlc"), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerUnpinResponse
+		require_NoError(t, json.Unmarshal(msg.Data, &resp))
+		require_Equal(t, resp.Type, JSApiConsumerUnpinResponseType)
+		return resp.Error
+	}
+	if apiErr := unpin("B"); apiErr == nil || apiErr.ErrCode != uint16(JSConsumerInvalidPriorityGroup) {
+		t.Fatalf("Expected invalid priority group error, got %+v", apiErr)
+	}
+	if apiErr := unpin("A"); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	resp, err = nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	ciResp = JSApiConsumerInfoResponse{}
+	require_NoError(t, json.Unmarshal(resp.Data, &ciResp))
+	require_True(t, len(ciResp.PriorityGroups) == 1)
+	require_Equal(t, ciResp.PriorityGroups[0].PinnedClientID, _EMPTY_)
+
+	// The unpinned client is rejected and the next one gets pinned.
+	pull("B", PriorityGroup{Group: "A", Id: npinId})
+	m = natsNexMsg(t, subB, time.Second)
+	require_Equal(t, m.Header.Get("Status"), "423")
+	pull("A", PriorityGroup{Group: "A"})
+	sendStreamMsg(t, nc, "foo", "4")
+	m = natsNexMsg(t, subA, time.Second)
+	pinId = m.Header.Get(JSPullRequestNatsPinId)
+	require_True(t, pinId != _EMPTY_ && pinId != npinId)
+}
+
+func TestJetStreamConsumerPriorityGroupOverflow(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	req, err := json.Marshal(&CreateConsumerRequest{Stream: "TEST", Config: ConsumerConfig{
+		Durable:        "dlc",
+		AckPolicy:      AckExplicit,
+		PriorityPolicy: PriorityOverflow,
+		PriorityGroups: []string{"A"},
+	}})
+	require_NoError(t, err)
+	msg, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", "dlc"), req, time.Second)
+	require_NoError(t, err)
+	var ccResp JSApiConsumerCreateResponse
+	require_NoError(t, json.Unmarshal(msg.Data, &ccResp))
+	if ccResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", ccResp.Error)
+	}
+
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "foo", "OK")
+	}
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	pull := func(reply string, batch int, pg PriorityGroup) {
+		t.Helper()
+		req, err := json.Marshal(&JSApiConsumerGetNextRequest{Batch: batch, Expires: 250 * time.Millisecond, PriorityGroup: pg})
+		require_NoError(t, err)
+		require_NoError(t, nc.PublishRequest(rsubj, reply, req))
+		require_NoError(t, nc.Flush())
+	}
+	sub := natsSubSync(t, nc, "overflow")
+
+	// Enough pending to exceed the threshold.
+	pull("overflow", 3, PriorityGroup{Group: "A", MinPending: 5})
+	for i := 0; i < 3; i++ {
+		m := natsNexMsg(t, sub, time.Second)
+		require_Equal(t, m.Header.Get("Status"), _EMPTY_)
+	}
+
+	// Not enough pending now, so this one times out.
+	pull("overflow", 1, PriorityGroup{Group: "A", MinPending: 10})
+	m := natsNexMsg(t, sub, time.Second)
+	require_Equal(t, m.Header.Get("Status"), "408")
+
+	// But enough unacknowledged.
+	pull("overflow", 1, PriorityGroup{Group: "A", MinAckPending: 3})
+	m = natsNexMsg(t, sub, time.Second)
+	require_Equal(t, m.Header.Get("Status"), _EMPTY_)
+
+	// Requests without thresholds are always served.
+	pull("overflow", 1, PriorityGroup{Group: "A"})
+	m = natsNexMsg(t, sub, time.Second)
+	require_Equal(t, m.Header.Get("Status"), _EMPTY_)
+}
+
+func TestJetStreamAtomicBatchPublish(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "NOBATCH", Subjects: []string{"nb"}})
+	require_NoError(t, err)
+
+	req, err := json.Marshal(&StreamConfig{
+		Name:               "TEST",
+		Subjects:           []string{"foo.*"},
+		Storage:            FileStorage,
+		AllowAtomicPublish: true,
+	})
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var scResp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	batchMsg := func(subj, id string, seq int, commit bool) *nats.Msg {
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSBatchId, id)
+		m.Header.Set(JSBatchSeq, strconv.Itoa(seq))
+		if commit {
+			m.Header.Set(JSBatchCommit, "1")
+		}
+		m.Data = []byte("OK")
+		return m
+	}
+	commit := func(m *nats.Msg) *JSPubAckResponse {
+		t.Helper()
+		rmsg, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		var pa JSPubAckResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &pa))
+		return &pa
+	}
+	expectErr := func(pa *JSPubAckResponse, err ErrorIdentifier) {
+		t.Helper()
+		if pa.Error == nil || pa.Error.ErrCode != uint16(err) {
+			t.Fatalf("Expected error %d, got %+v", err, pa.Error)
+		}
+	}
+
+	// Streams need to allow batches.
+	expectErr(commit(batchMsg("nb", "bad", 1, true)), JSAtomicPublishDisabled)
+
+	// A regular message in between.
+	sendStreamMsg(t, nc, "foo.x", "OK")
+
+	// Messages are held back until the commit.
+	for i := 1; i < 5; i++ {
+		require_NoError(t, nc.PublishMsg(batchMsg("foo.a", "B1", i, false)))
+	}
+	require_NoError(t, nc.Flush())
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1)
+
+	pa := commit(batchMsg("foo.b", "B1", 5, true))
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_Equal(t, pa.BatchId, "B1")
+	require_True(t, pa.BatchSize == 5)
+	require_True(t, pa.Sequence == 6)
+	si, err = js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 6)
+	require_True(t, si.State.FirstSeq == 1 && si.State.LastSeq == 6)
+
+	// A gap in the batch sequence drops the batch.
+	require_NoError(t, nc.PublishMsg(batchMsg("foo.a", "B2", 1, false)))
+	expectErr(commit(batchMsg("foo.a", "B2", 3, true)), JSAtomicPublishIncompleteBatch)
+
+	// Headers that do not work with batches.
+	m := batchMsg("foo.a", "B3", 1, true)
+	m.Header.Set(JSMsgId, "dup")
+	expectErr(commit(m), JSAtomicPublishUnsupportedHeaderBatch)
+	require_NoError(t, nc.PublishMsg(batchMsg("foo.a", "B4", 1, false)))
+	m = batchMsg("foo.a", "B4", 2, true)
+	m.Header.Set(JSExpectedLastSeq, "6")
+	expectErr(commit(m), JSAtomicPublishUnsupportedHeaderBatch)
+	m = batchMsg("foo.a", "B5", 1, false)
+	m.Header.Set(JSBatchCommit, "yes")
+	expectErr(commit(m), JSAtomicPublishInvalidBatchCommit)
+	m = batchMsg("foo.a", "B6", 1, false)
+	m.Header.Del(JSBatchSeq)
+	expectErr(commit(m), JSAtomicPublishMissingSeq)
+
+	// Expected last sequence applies to the batch as a whole.
+	m = batchMsg("foo.a", "B7", 1, false)
+	m.Header.Set(JSExpectedLastSeq, "5")
+	require_NoError(t, nc.PublishMsg(m))
+	expectErr(commit(batchMsg("foo.a", "B7", 2, true)), JSStreamWrongLastSequenceErrF)
+
+	m = batchMsg("foo.a", "B8", 1, false)
+	m.Header.Set(JSExpectedLastSeq, "6")
+	require_NoError(t, nc.PublishMsg(m))
+	pa = commit(batchMsg("foo.a", "B8", 2, true))
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 8)
+
+	// None of the failed batches left anything behind.
+	si, err = js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 8)
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	mset.batches.mu.Lock()
+	inflight := len(mset.batches.group)
+	mset.batches.mu.Unlock()
+	require_True(t, inflight == 0)
+
+	// Limits are checked for the batch as a whole before anything is stored.
+	req, err = json.Marshal(&StreamConfig{
+		Name:               "PER",
+		Subjects:           []string{"per"},
+		Storage:            FileStorage,
+		MaxMsgsPer:         2,
+		Discard:            DiscardNew,
+		DiscardNewPer:      true,
+		AllowAtomicPublish: true,
+	})
+	require_NoError(t, err)
+	resp, err = nc.Request(fmt.Sprintf(JSApiStreamCreateT, "PER"), req, time.Second)
+	require_NoError(t, err)
+	scResp = JSApiStreamCreateResponse{}
+	require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	sendStreamMsg(t, nc, "per", "OK")
+	require_NoError(t, nc.PublishMsg(batchMsg("per", "P1", 1, false)))
+	expectErr(commit(batchMsg("per", "P1", 2, true)), JSStreamStoreFailedF)
+	si, err = js.StreamInfo("PER")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1)
+}
+
+func TestJetStreamMemoryStreamPersist(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	cfg := &StreamConfig{Name: "MEM", Subjects: []string{"foo"}, Storage: MemoryStorage, Persist: true}
+	mset, err := acc.addStream(cfg)
+	require_NoError(t, err)
+
+	// Persistence is only for memory streams.
+	_, err = acc.addStream(&StreamConfig{Name: "FILE", Storage: FileStorage, Persist: true})
+	require_Error(t, err)
+	// And only for streams that are not replicated.
+	_, apiErr := s.checkStreamCfg(&StreamConfig{Name: "R3", Storage: MemoryStorage, Persist: true, Replicas: 3}, acc)
+	require_True(t, apiErr != nil)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte(fmt.Sprintf("msg-%d", i)))
+		require_NoError(t, err)
+	}
+	nc.Close()
+	state := mset.state()
+	usage := acc.JetStreamUsage()
+
+	sr, err := mset.snapshot(5*time.Second, false, true)
+	require_NoError(t, err)
+	snapshot, err := io.ReadAll(sr.Reader)
+	require_NoError(t, err)
+	sr.Reader.Close()
+
+	// Restart and we should have our stream and messages back.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	acc = s.GlobalAccount()
+	mset, err = acc.lookupStream("MEM")
+	require_NoError(t, err)
+	require_True(t, mset.config().Storage == MemoryStorage)
+	if rstate := mset.state(); !reflect.DeepEqual(rstate, state) {
+		t.Fatalf("State does not match: %+v vs %+v", rstate, state)
+	}
+	if rusage := acc.JetStreamUsage(); rusage.Memory != usage.Memory {
+		t.Fatalf("Usage does not match: %+v vs %+v", rusage, usage)
+	}
+	sm, err := mset.getMsg(10)
+	require_NoError(t, err)
+	require_True(t, string(sm.Data) == "msg-9")
+
+	// Snapshots of memory streams can be restored as well.
+	require_NoError(t, mset.delete())
+	sdir := filepath.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir, "MEM")
+	_, err = os.Stat(sdir)
+	require_True(t, os.IsNotExist(err))
+
+	cfg.Persist = false
+	mset, err = acc.RestoreStream(cfg, bytes.NewReader(snapshot))
+	require_NoError(t, err)
+	require_True(t, mset.state().Msgs == 10)
+	require_True(t, mset.state().LastSeq == 10)
+	// Since we are not persisting nothing is left behind.
+	_, err = os.Stat(sdir)
+	require_True(t, os.IsNotExist(err))
+}
+
+// A store that fails once the given number of messages has been stored.
+type testFailingStore struct {
+	StreamStore
+	left int64
+}
+
+func (fs *testFailingStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	if atomic.AddInt64(&fs.left, -1) < 0 {
+		return 0, 0, errors.New("injected store failure")
+	}
+	return fs.StreamStore.StoreMsg(subj, hdr, msg)
+}
+
+func TestJetStreamAtomicBatchBytesLimit(t *testing.T) {
+	mb := newMsgBatches()
+	defer mb.clear()
+
+	m := &batchMsg{subj: "foo", msg: bytes.Repeat([]byte("Z"), 97)}
+	require_True(t, m.size() == 100)
+	expectTooLarge := func(apiErr *ApiError) {
+		t.Helper()
+		if apiErr == nil || apiErr.ErrCode != uint16(JSAtomicPublishTooLargeBatch) {
+			t.Fatalf("Expected too large batch error, got %+v", apiErr)
+		}
+	}
+
+	// A single batch can not go over the limit.
+	_, apiErr := mb.add("A", 1, m, false, 250)
+	require_True(t, apiErr == nil)
+	_, apiErr = mb.add("A", 2, m, false, 250)
+	require_True(t, apiErr == nil)
+	_, apiErr = mb.add("A", 3, m, false, 250)
+	expectTooLarge(apiErr)
+	require_True(t, mb.size == 0)
+	require_True(t, len(mb.group) == 0)
+
+	// Nor can all batches together.
+	_, apiErr = mb.add("A", 1, m, false, 250)
+	require_True(t, apiErr == nil)
+	_, apiErr = mb.add("B", 1, m, false, 250)
+	require_True(t, apiErr == nil)
+	_, apiErr = mb.add("B", 2, m, false, 250)
+	expectTooLarge(apiErr)
+	require_True(t, mb.size == 100)
+
+	// Committed batches no longer count.
+	msgs, apiErr := mb.add("A", 2, m, true, 250)
+	require_True(t, apiErr == nil)
+	require_True(t, len(msgs) == 2)
+	require_True(t, mb.size == 0)
+
+	// Neither do abandoned ones.
+	_, apiErr = mb.add("C", 1, m, false, 250)
+	require_True(t, apiErr == nil)
+	mb.remove("C")
+	require_True(t, mb.size == 0)
+}
+
+func TestJetStreamAtomicBatchPublishPartialStore(t *testing.T) {
+	var fs *testFailingStore
+	registerTestStreamStore(t, "failing", func(cfg *StreamConfig, dir string) (StreamStore, error) {
+		ms, err := newMemStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		fs = &testFailingStore{StreamStore: ms, left: math.MaxInt64}
+		return fs, nil
+	})
+
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:               "TEST",
+		Subjects:           []string{"foo"},
+		Storage:            MemoryStorage,
+		Backend:            "failing",
+		AllowAtomicPublish: true,
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "foo", "OK")
+
+	sub, err := js.SubscribeSync("foo", nats.DeliverNew())
+	require_NoError(t, err)
+
+	publishBatch := func(id string) *JSPubAckResponse {
+		t.Helper()
+		for i := 1; i <= 5; i++ {
+			m := nats.NewMsg("foo")
+			m.Header.Set(JSBatchId, id)
+			m.Header.Set(JSBatchSeq, strconv.Itoa(i))
+			m.Data = []byte("OK")
+			if i < 5 {
+				require_NoError(t, nc.PublishMsg(m))
+				continue
+			}
+			m.Header.Set(JSBatchCommit, "1")
+			rmsg, err := nc.RequestMsg(m, time.Second)
+			require_NoError(t, err)
+			var pa JSPubAckResponse
+			require_NoError(t, json.Unmarshal(rmsg.Data, &pa))
+			return &pa
+		}
+		return nil
+	}
+
+	// Fail in the middle of the batch.
+	atomic.StoreInt64(&fs.left, 2)
+	if pa := publishBatch("B1"); pa.Error == nil || pa.Error.ErrCode != uint16(JSStreamStoreFailedF) {
+		t.Fatalf("Expected a store failure, got %+v", pa)
+	}
+	// Nothing of the batch should remain, or be delivered.
+	state := mset.state()
+	require_True(t, state.Msgs == 1 && state.LastSeq == 1)
+	_, err = sub.NextMsg(100 * time.Millisecond)
+	require_Error(t, err, nats.ErrTimeout)
+
+	atomic.StoreInt64(&fs.left, math.MaxInt64)
+	pa := publishBatch("B2")
+	if pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	require_True(t, pa.Sequence == 6)
+	for i := 0; i < 5; i++ {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		meta, err := m.Metadata()
+		require_NoError(t, err)
+		require_True(t, meta.Sequence.Stream == uint64(i+2))
+	}
+}
+
+func TestJetStreamStreamStoreBackend(t *testing.T) {
+	var ts *testRegisteredStore
+	var sdir string
+	registerTestStreamStore(t, "kv", func(cfg *StreamConfig, dir string) (StreamStore, error) {
+		ms, err := newMemStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ts, sdir = &testRegisteredStore{StreamStore: ms}, dir
+		return ts, nil
+	})
+
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	_, err := acc.addStream(&StreamConfig{Name: "BAD", Storage: MemoryStorage, Backend: "unknown"})
+	require_Error(t, err)
+	// Features of our built-in stores are not available to backends.
+	_, err = acc.addStream(&StreamConfig{Name: "BAD", Storage: MemoryStorage, Backend: "kv", Persist: true})
+	require_Error(t, err)
+	_, err = acc.addStream(&StreamConfig{Name: "BAD", Storage: FileStorage, Backend: "kv", Compression: S2Compression})
+	require_Error(t, err)
+
+	cfg := &StreamConfig{Name: "KV", Subjects: []string{"foo"}, Storage: MemoryStorage, Backend: "kv"}
+	mset, err := acc.addStream(cfg)
+	require_NoError(t, err)
+	require_True(t, ts != nil)
+	require_Equal(t, filepath.Base(sdir), "KV")
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte(fmt.Sprintf("msg-%d", i)))
+		require_NoError(t, err)
+	}
+	require_True(t, mset.state().Msgs == 10)
+	require_True(t, acc.JetStreamUsage().Memory > 0)
+
+	sm, err := mset.getMsg(5)
+	require_NoError(t, err)
+	require_Equal(t, string(sm.Data), "msg-4")
+	require_True(t, ts.loads > 0)
+
+	// The backend can not be changed.
+	ncfg := mset.config()
+	ncfg.Backend = _EMPTY_
+	require_Error(t, mset.update(&ncfg))
+}
+
+func TestJetStreamCompactSparseBlocksJsz(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	// Keep our blocks small so we have sealed ones.
+	mset, err := acc.addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage, MaxBytes: 100 * 1024})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	msg := bytes.Repeat([]byte("Z"), 500)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+	for seq := uint64(1); seq <= 100; seq++ {
+		if seq%10 != 0 {
+			_, err := mset.removeMsg(seq)
+			require_NoError(t, err)
+		}
+	}
+
+	fs := mset.store.(*fileStore)
+	fs.compactBlocks()
+
+	jsz, err := s.Jsz(nil)
+	require_NoError(t, err)
+	require_True(t, jsz.Compaction != nil)
+	require_True(t, jsz.Compaction.Runs == 1)
+	require_True(t, jsz.Compaction.Blocks > 0)
+	require_True(t, jsz.Compaction.Reclaimed > 0)
+	require_True(t, mset.state().Msgs == 10)
+}
+
+func TestJetStreamStreamRecoveryJsz(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	_, err := js.AddStream(&nats.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish(fmt.Sprintf("kv.%d", i), nil)
+		require_NoError(t, err)
+	}
+	nc.Close()
+
+	// Restart and we should recover using our persisted subject index.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	jsz, err := s.Jsz(&JSzOptions{Accounts: true, Streams: true})
+	require_NoError(t, err)
+	require_True(t, len(jsz.AccountDetails) == 1)
+	require_True(t, len(jsz.AccountDetails[0].Streams) == 1)
+	sd0 := jsz.AccountDetails[0].Streams[0]
+	require_True(t, sd0.Recovery != nil)
+	require_True(t, sd0.Recovery.SubjectIndex)
+	require_True(t, sd0.Recovery.Duration > 0)
+	require_True(t, sd0.State.NumSubjects == 100)
+}
+
+func TestJetStreamRestorePointInTime(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}})
+	require_NoError(t, err)
+
+	var pit time.Time
+	for i := 1; i <= 20; i++ {
+		_, err := js.Publish(fmt.Sprintf("orders.%d", i), []byte("ok"))
+		require_NoError(t, err)
+		if i == 10 {
+			time.Sleep(10 * time.Millisecond)
+			pit = time.Now()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Delete one we will land on to make sure we keep our last sequence.
+	require_NoError(t, js.DeleteMsg("ORDERS", 12))
+
+	sub, err := js.PullSubscribe("orders.>", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(15)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 15)
+	for _, m := range msgs {
+		require_NoError(t, m.AckSync())
+	}
+
+	acc := s.GlobalAccount()
+	mset, err := acc.lookupStream("ORDERS")
+	require_NoError(t, err)
+	cfg := mset.config()
+	sr, err := mset.snapshot(5*time.Second, false, true)
+	require_NoError(t, err)
+	snapshot, err := io.ReadAll(sr.Reader)
+	require_NoError(t, err)
+	sr.Reader.Close()
+
+	restore := func(cfg StreamConfig, ropts *StreamRestoreOptions) *stream {
+		t.Helper()
+		mset, err := acc.restoreStream(&cfg, bytes.NewReader(snapshot), ropts)
+		require_NoError(t, err)
+		return mset
+	}
+
+	// Restore to a sequence, consumers should be rewound with the stream.
+	require_NoError(t, mset.delete())
+	mset = restore(cfg, &StreamRestoreOptions{Sequence: 12})
+	state := mset.state()
+	require_True(t, state.FirstSeq == 1)
+	require_True(t, state.LastSeq == 12)
+	require_True(t, state.Msgs == 11)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	ostate := o.info()
+	require_True(t, ostate.Delivered.Stream == 12)
+	require_True(t, ostate.AckFloor.Stream == 12)
+	require_True(t, ostate.NumPending == 0)
+
+	// New messages pick up after our restored sequence.
+	_, err = js.Publish("orders.new", []byte("ok"))
+	require_NoError(t, err)
+	require_True(t, mset.state().LastSeq == 13)
+
+	// Restore to a point in time.
+	require_NoError(t, mset.delete())
+	mset = restore(cfg, &StreamRestoreOptions{Time: &pit})
+	state = mset.state()
+	require_True(t, state.LastSeq == 10)
+	require_True(t, state.Msgs == 10)
+	ostate = mset.lookupConsumer("dlc").info()
+	require_True(t, ostate.Delivered.Stream == 10)
+	require_True(t, ostate.AckFloor.Stream == 10)
+
+	// Restore under a new name and subjects next to the original.
+	ncfg := cfg
+	ncfg.Name, ncfg.Subjects = "ORDERS-PIT", []string{"pit.>"}
+	pmset := restore(ncfg, &StreamRestoreOptions{Sequence: 5, Rename: true})
+	state = pmset.state()
+	require_True(t, state.LastSeq == 5)
+	require_True(t, state.Msgs == 5)
+	require_True(t, pmset.numConsumers() == 0)
+	require_Equal(t, pmset.config().Subjects[0], "pit.>")
+	sm, err := pmset.getMsg(5)
+	require_NoError(t, err)
+	require_Equal(t, sm.Subject, "orders.5")
+	require_True(t, mset.state().LastSeq == 10)
+
+	// Without rename the names still need to match.
+	_, err = acc.restoreStream(&ncfg, bytes.NewReader(snapshot), &StreamRestoreOptions{Sequence: 5})
+	require_Error(t, err)
+
+	// Sequence and time can not both be set.
+	req, err := json.Marshal(&JSApiStreamRestoreRequest{
+		Config:               cfg,
+		StreamRestoreOptions: StreamRestoreOptions{Sequence: 5, Time: &pit},
+	})
+	require_NoError(t, err)
+	require_NoError(t, mset.delete())
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamRestoreT, "ORDERS"), req, time.Second)
+	require_NoError(t, err)
+	var rresp JSApiStreamRestoreResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &rresp))
+	require_True(t, rresp.Error != nil)
+}
@@ -15,8 +15,12 @@ package server
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,7 +35,19 @@ type memStore struct {
 	maxp      int64
 	scb       StorageUpdateHandler
 	ageChk    *time.Timer
+	ttls      msgTTLs
+	ttlChk    *time.Timer
 	consumers int
+
+	// Used to persist our messages to disk across restarts, if configured.
+	pdir    string
+	prf     keyGen
+	oldprf  keyGen
+	sc      StoreCipher
+	created time.Time
+	pmu     sync.Mutex
+	ptmr    *time.Timer
+	rot     keyRotation
 }
 
 func newMemStore(cfg *StreamConfig) (*memStore, error) {
@@ -42,15 +58,34 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 		return nil, fmt.Errorf("memStore requires memory storage type in config")
 	}
 	ms := &memStore{
-		msgs: make(map[uint64]*StoreMsg),
-		fss:  make(map[string]*SimpleState),
-		maxp: cfg.MaxMsgsPer,
-		cfg:  *cfg,
+		msgs:    make(map[uint64]*StoreMsg),
+		fss:     make(map[string]*SimpleState),
+		maxp:    cfg.MaxMsgsPer,
+		cfg:     *cfg,
+		created: time.Now().UTC(),
 	}
 
 	return ms, nil
 }
 
+// Create a memory store that persists its messages to fcfg.StoreDir when configured to, and
+// restores any messages it finds there in the file store format, e.g. from a snapshot.
+// Our previous key, if any, is used for anything persisted before a key rotation.
+func newMemStoreWithPersistence(cfg *StreamConfig, fcfg FileStoreConfig, created time.Time, prf, oldprf keyGen) (*memStore, error) {
+	ms, err := newMemStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.pdir, ms.sc, ms.created, ms.prf, ms.oldprf = fcfg.StoreDir, fcfg.Cipher, created, prf, oldprf
+	if err := ms.recoverFileStore(); err != nil {
+		return nil, err
+	}
+	ms.resetPersistTimer()
+	return ms, nil
+}
+
 func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 	if cfg == nil {
 		return fmt.Errorf("config required")
@@ -60,7 +95,13 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 	}
 
 	ms.mu.Lock()
+	persisted := ms.cfg.Persist
 	ms.cfg = *cfg
+	// Remove anything we persisted if no longer needed.
+	if persisted && !ms.cfg.Persist && ms.pdir != _EMPTY_ {
+		removePersisted(ms.pdir)
+	}
+	ms.resetPersistTimer()
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
@@ -191,6 +232,16 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 		ms.startAgeChk()
 	}
 
+	// Track any per message TTL.
+	if ms.cfg.AllowMsgTTL {
+		if expires := msgTTLExpires(hdr, ts); expires > 0 {
+			ms.ttls.track(seq, expires)
+			if ms.ttlChk == nil || ms.ttls.next() == expires {
+				ms.resetTTLChk()
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -249,7 +300,12 @@ func (ms *memStore) SkipMsg() uint64 {
 func (ms *memStore) RegisterStorageUpdates(cb StorageUpdateHandler) {
 	ms.mu.Lock()
 	ms.scb = cb
+	bsz := ms.state.Bytes
 	ms.mu.Unlock()
+	// We may have restored messages.
+	if cb != nil && bsz > 0 {
+		cb(0, int64(bsz), 0, _EMPTY_)
+	}
 }
 
 // GetSeqFromTime looks for the first sequence number that has the message
@@ -440,6 +496,45 @@ func (ms *memStore) expireMsgs() {
 	}
 }
 
+// Will (re)arm the per message TTL timer for the next expiration.
+// Lock should be held.
+func (ms *memStore) resetTTLChk() {
+	next := ms.ttls.next()
+	if next == 0 {
+		if ms.ttlChk != nil {
+			ms.ttlChk.Stop()
+			ms.ttlChk = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - time.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if ms.ttlChk != nil {
+		ms.ttlChk.Reset(fireIn)
+	} else {
+		ms.ttlChk = time.AfterFunc(fireIn, ms.expireMsgTTLs)
+	}
+}
+
+// Will expire msgs whose individual TTL has passed.
+func (ms *memStore) expireMsgTTLs() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.msgs == nil {
+		return
+	}
+	for _, e := range ms.ttls.expired(time.Now().UnixNano()) {
+		// Make sure this is still the message we were tracking.
+		if sm, ok := ms.msgs[e.seq]; ok && msgTTLExpires(sm.hdr, sm.ts) == e.expires {
+			ms.removeMsg(e.seq, false)
+		}
+	}
+	ms.resetTTLChk()
+}
+
 // PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
 // Will return the number of purged messages.
 func (ms *memStore) PurgeEx(subject string, sequence, keep uint64) (purged uint64, err error) {
@@ -506,6 +601,7 @@ func (ms *memStore) Purge() (uint64, error) {
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.ttls.reset()
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -591,6 +687,7 @@ func (ms *memStore) reset() error {
 	// Reset msgs and fss.
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.ttls.reset()
 
 	ms.mu.Unlock()
 
@@ -769,6 +866,76 @@ func (ms *memStore) LoadNextMsg(filter string, wc bool, start uint64, smp *Store
 	return nil, ms.state.LastSeq, ErrStoreEOF
 }
 
+// LoadNextMsgMulti will find the next message matching any of the filter subjects starting at the start sequence.
+// The filters are expected to not overlap.
+func (ms *memStore) LoadNextMsgMulti(filters []string, start uint64, smp *StoreMsg) (*StoreMsg, uint64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if start < ms.state.FirstSeq {
+		start = ms.state.FirstSeq
+	}
+
+	// If past the end no results.
+	if start > ms.state.LastSeq {
+		return nil, ms.state.LastSeq, ErrStoreEOF
+	}
+
+	var wc bool
+	for _, filter := range filters {
+		if subjectHasWildcard(filter) {
+			wc = true
+			break
+		}
+	}
+
+	// Same heuristics as LoadNextMsg for when to skip the scan of ms.fss.
+	const linearScanMaxFSS = 256
+	doLinearScan := 2*int(ms.state.LastSeq-start) < len(ms.fss) || (wc && len(ms.fss) > linearScanMaxFSS)
+
+	// Initial setup.
+	fseq, lseq := start, ms.state.LastSeq
+
+	if !doLinearScan {
+		fseq, lseq = ms.state.LastSeq, uint64(0)
+		update := func(ss *SimpleState) {
+			if ss.First < fseq {
+				fseq = ss.First
+			}
+			if ss.Last > lseq {
+				lseq = ss.Last
+			}
+		}
+		if wc {
+			for fsubj, ss := range ms.fss {
+				if subjectIsSubsetMatchAny(fsubj, filters) {
+					update(ss)
+				}
+			}
+		} else {
+			for _, filter := range filters {
+				if ss := ms.fss[filter]; ss != nil {
+					update(ss)
+				}
+			}
+		}
+		if fseq < start {
+			fseq = start
+		}
+	}
+
+	for nseq := fseq; nseq <= lseq; nseq++ {
+		if sm, ok := ms.msgs[nseq]; ok && subjectIsSubsetMatchAny(sm.subj, filters) {
+			if smp == nil {
+				smp = new(StoreMsg)
+			}
+			sm.copy(smp)
+			return smp, nseq, nil
+		}
+	}
+	return nil, ms.state.LastSeq, ErrStoreEOF
+}
+
 // RemoveMsg will remove the message from this store.
 // Will return the number of bytes removed.
 func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
@@ -946,18 +1113,43 @@ func memStoreMsgSize(subj string, hdr, msg []byte) uint64 {
 // Delete is same as Stop for memory store.
 func (ms *memStore) Delete() error {
 	ms.Purge()
+	// Make sure we do not persist on stop and remove anything we had.
+	// Hold pmu so we wait on any persist that is in progress.
+	ms.pmu.Lock()
+	ms.mu.Lock()
+	pdir := ms.pdir
+	ms.pdir = _EMPTY_
+	ms.mu.Unlock()
+	if pdir != _EMPTY_ {
+		removePersisted(pdir)
+	}
+	ms.pmu.Unlock()
 	return ms.Stop()
 }
 
 func (ms *memStore) Stop() error {
+	// Persist our messages so they can be restored on startup.
+	err := ms.persist()
+	if err == ErrStoreClosed {
+		err = nil
+	}
+
 	ms.mu.Lock()
+	if ms.ptmr != nil {
+		ms.ptmr.Stop()
+		ms.ptmr = nil
+	}
 	if ms.ageChk != nil {
 		ms.ageChk.Stop()
 		ms.ageChk = nil
 	}
+	if ms.ttlChk != nil {
+		ms.ttlChk.Stop()
+		ms.ttlChk = nil
+	}
 	ms.msgs = nil
 	ms.mu.Unlock()
-	return nil
+	return err
 }
 
 func (ms *memStore) isClosed() bool {
@@ -1005,8 +1197,342 @@ func (ms *memStore) RemoveConsumer(o ConsumerStore) error {
 	return nil
 }
 
-func (ms *memStore) Snapshot(_ time.Duration, _, _ bool) (*SnapshotResult, error) {
-	return nil, fmt.Errorf("no impl")
+// Snapshot will write our messages in the file store format, so they can be restored to either type of stream.
+// We have no consumer state to include.
+func (ms *memStore) Snapshot(deadline time.Duration, checkMsgs, _ bool) (*SnapshotResult, error) {
+	dir, err := os.MkdirTemp(_EMPTY_, "memstore-snap-")
+	if err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	mc, state := ms.copyMsgs(), ms.state
+	ms.mu.RUnlock()
+	fs, err := mc.writeFileStore(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sr, err := fs.Snapshot(deadline, checkMsgs, false)
+	if err != nil {
+		fs.Stop()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	sr.Reader = &memStoreSnapshotReader{sr.Reader, func() {
+		fs.Stop()
+		os.RemoveAll(dir)
+	}}
+	sr.State = state
+	return sr, nil
+}
+
+// Removes the file store used for a snapshot once done.
+type memStoreSnapshotReader struct {
+	io.ReadCloser
+	cleanup func()
+}
+
+func (r *memStoreSnapshotReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cleanup()
+	return err
+}
+
+// Returns the config for a file store used to hold the messages of a memory stream.
+// Our messages are already within our limits, so we do not want them enforced again.
+func memStoreFileConfig(cfg StreamConfig) StreamConfig {
+	cfg.Storage, cfg.Discard = FileStorage, DiscardOld
+	cfg.MaxMsgs, cfg.MaxBytes, cfg.MaxMsgsPer, cfg.MaxAge = -1, -1, -1, 0
+	cfg.AllowMsgTTL = false
+	return cfg
+}
+
+// A copy of our messages, so we can write them out without holding our lock.
+type memStoreCopy struct {
+	cfg     StreamConfig
+	created time.Time
+	sc      StoreCipher
+	first   uint64
+	last    uint64
+	msgs    []StoreMsg
+}
+
+// Copy our messages in sequence order. The message data itself is not copied,
+// we never modify it in place.
+// Lock should be held.
+func (ms *memStore) copyMsgs() *memStoreCopy {
+	mc := &memStoreCopy{
+		cfg:     ms.cfg,
+		created: ms.created,
+		sc:      ms.sc,
+		first:   ms.state.FirstSeq,
+		last:    ms.state.LastSeq,
+		msgs:    make([]StoreMsg, 0, len(ms.msgs)),
+	}
+	for _, sm := range ms.msgs {
+		mc.msgs = append(mc.msgs, *sm)
+	}
+	sort.Slice(mc.msgs, func(i, j int) bool { return mc.msgs[i].seq < mc.msgs[j].seq })
+	return mc
+}
+
+// Write all of the messages with their sequences to a new file store in dir.
+// The file store is returned open and should be stopped by the caller.
+func (mc *memStoreCopy) writeFileStore(dir string, prf keyGen) (*fileStore, error) {
+	fcfg := FileStoreConfig{StoreDir: dir, Cipher: mc.sc, ScrubInterval: -1, CompactInterval: -1, SubjectIndexInterval: -1}
+	fs, err := newFileStoreWithKeys(fcfg, memStoreFileConfig(mc.cfg), mc.created, prf, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mc.first > 1 {
+		_, err = fs.Compact(mc.first)
+	}
+	// Skip any gaps as a whole, they can be large.
+	next := mc.first
+	for i := 0; err == nil && i < len(mc.msgs); i++ {
+		sm := &mc.msgs[i]
+		if sm.seq > next {
+			err = fs.skipMsgs(sm.seq - next)
+		}
+		if err == nil {
+			err = fs.StoreRawMsg(sm.subj, sm.hdr, sm.msg, sm.seq, sm.ts)
+		}
+		next = sm.seq + 1
+	}
+	if err == nil && mc.last > 0 && mc.last >= next {
+		err = fs.skipMsgs(mc.last - next + 1)
+	}
+	if err == nil {
+		err = fs.writeMemStreamMeta(mc.created, mc.cfg)
+	}
+	if err != nil {
+		fs.Stop()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Write our meta data with the config of the memory stream we hold messages for,
+// so we will be restored as one.
+func (fs *fileStore) writeMemStreamMeta(created time.Time, cfg StreamConfig) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.cfg = FileStreamInfo{Created: created, StreamConfig: cfg}
+	return fs.writeStreamMeta()
+}
+
+// Load any messages held in the file store format in our persist directory, which are
+// there from a previous shutdown or a restored snapshot.
+// Lock should be held.
+func (ms *memStore) recoverFileStore() error {
+	if ms.pdir == _EMPTY_ {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(ms.pdir, msgDir)); err != nil {
+		return nil
+	}
+	fcfg := FileStoreConfig{StoreDir: ms.pdir, Cipher: ms.sc, ScrubInterval: -1, CompactInterval: -1, SubjectIndexInterval: -1}
+	fs, err := newFileStoreWithKeys(fcfg, memStoreFileConfig(ms.cfg), ms.created, ms.prf, ms.oldprf)
+	if err != nil {
+		return err
+	}
+	var state StreamState
+	fs.FastState(&state)
+
+	var smv StoreMsg
+	for seq := state.FirstSeq; state.Msgs > 0 && seq <= state.LastSeq; {
+		sm, _, err := fs.LoadNextMsg(fwcs, true, seq, &smv)
+		if err == ErrStoreEOF {
+			break
+		} else if err != nil {
+			fs.Stop()
+			return err
+		}
+		// Account for any deleted messages before this one.
+		ms.state.LastSeq = sm.seq - 1
+		if err := ms.storeRawMsg(sm.subj, sm.hdr, sm.msg, sm.seq, sm.ts); err != nil {
+			fs.Stop()
+			return err
+		}
+		seq = sm.seq + 1
+	}
+	if state.LastSeq > ms.state.LastSeq {
+		ms.state.LastSeq, ms.state.LastTime = state.LastSeq, state.LastTime
+	}
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq, ms.state.FirstTime = ms.state.LastSeq+1, time.Time{}
+	}
+
+	// If we are not persisting we no longer need these.
+	if !ms.cfg.Persist {
+		fs.Stop()
+		return os.RemoveAll(ms.pdir)
+	}
+	// Opening may have rewritten our meta data, so make sure we will be restored as a memory stream.
+	err = fs.writeMemStreamMeta(ms.created, ms.cfg)
+	fs.Stop()
+	return err
+}
+
+// Persist our messages to our persist directory if configured to.
+// We write to a new file store first and swap it in once complete.
+func (ms *memStore) persist() error {
+	ms.pmu.Lock()
+	defer ms.pmu.Unlock()
+
+	ms.mu.RLock()
+	if ms.msgs == nil {
+		ms.mu.RUnlock()
+		return ErrStoreClosed
+	}
+	if !ms.cfg.Persist || ms.pdir == _EMPTY_ {
+		ms.mu.RUnlock()
+		return nil
+	}
+	pdir, prf, mc := ms.pdir, ms.prf, ms.copyMsgs()
+	ms.mu.RUnlock()
+
+	// Finish any swap that did not complete before we replace what was staged.
+	stage := persistStageDir(pdir)
+	if _, err := os.Stat(stage + persistSwapSuffix); err == nil {
+		if err := finishPersistSwap(stage, pdir); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stage, defaultDirPerms); err != nil {
+		return err
+	}
+	fs, err := mc.writeFileStore(stage, prf)
+	if err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	fs.Stop()
+
+	if err := os.MkdirAll(filepath.Dir(pdir), defaultDirPerms); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	// Once our marker is written the staged store is complete, and we will finish
+	// the swap on startup if we are interrupted.
+	if err := writeFileWithSync(stage+persistSwapSuffix, nil); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	return finishPersistSwap(stage, pdir)
+}
+
+const (
+	// Prefix of the staged file store for a persisted memory stream.
+	persistPrefix = "persist-"
+	// Suffix of the marker that says the staged store is complete and replaces the stream directory.
+	persistSwapSuffix = ".swap"
+)
+
+// Returns where we stage the file store for the memory stream persisted in pdir.
+// This is in our account's snapshots directory, anything in our streams directory would be recovered.
+func persistStageDir(pdir string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(pdir)), snapsDir, persistPrefix+filepath.Base(pdir))
+}
+
+// Replace the persisted stream directory pdir with the complete store in stage.
+// This can be repeated until it succeeds, since we only remove our marker at the end.
+func finishPersistSwap(stage, pdir string) error {
+	if _, err := os.Stat(stage); err == nil {
+		if err := os.RemoveAll(pdir); err != nil {
+			return err
+		}
+		if err := os.Rename(stage, pdir); err != nil {
+			return err
+		}
+	}
+	return os.Remove(stage + persistSwapSuffix)
+}
+
+// Remove the persisted stream directory pdir along with anything staged for it,
+// so an interrupted swap does not bring it back.
+func removePersisted(pdir string) {
+	os.RemoveAll(pdir)
+	stage := persistStageDir(pdir)
+	os.Remove(stage + persistSwapSuffix)
+	os.RemoveAll(stage)
+}
+
+// Finish any swap of a persisted memory stream that was interrupted in the account directory adir.
+// Should be called on startup before the streams are recovered.
+func recoverMemStorePersist(adir string) {
+	sdir := filepath.Join(adir, snapsDir)
+	fis, _ := os.ReadDir(sdir)
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, persistPrefix) || !strings.HasSuffix(name, persistSwapSuffix) {
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(name, persistPrefix), persistSwapSuffix)
+		finishPersistSwap(filepath.Join(sdir, persistPrefix+name), filepath.Join(adir, streamsDir, name))
+	}
+}
+
+// Rotate our encryption key and cipher. Anything we persisted is rewritten right away,
+// so it no longer depends on our previous key.
+func (ms *memStore) rotateEncryption(prf, oldprf keyGen, sc StoreCipher) error {
+	ms.mu.Lock()
+	if ms.msgs == nil {
+		ms.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if ms.prf == nil || prf == nil {
+		ms.mu.Unlock()
+		return errNoEncryption
+	}
+	ms.prf, ms.oldprf, ms.sc = prf, oldprf, sc
+	// Our persisted messages are rewritten as a whole, so we count them as a single block.
+	ms.rot.gen++
+	ms.rot.active, ms.rot.total, ms.rot.done, ms.rot.err = true, 1, 0, nil
+	gen := ms.rot.gen
+	ms.mu.Unlock()
+
+	err := ms.persist()
+
+	ms.mu.Lock()
+	if gen == ms.rot.gen {
+		ms.rot.active, ms.rot.err = false, err
+		if err == nil {
+			ms.rot.done = 1
+		}
+	}
+	ms.mu.Unlock()
+	return err
+}
+
+// Returns the progress of re-encrypting our persisted messages after a key rotation.
+func (ms *memStore) keyRotationState() keyRotation {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.rot
+}
+
+// Reset our timer to persist at intervals, if configured to.
+// Lock should be held.
+func (ms *memStore) resetPersistTimer() {
+	if ms.ptmr != nil {
+		ms.ptmr.Stop()
+		ms.ptmr = nil
+	}
+	if ms.cfg.Persist && ms.cfg.PersistInterval > 0 && ms.pdir != _EMPTY_ && ms.msgs != nil {
+		ms.ptmr = time.AfterFunc(ms.cfg.PersistInterval, ms.persistOnInterval)
+	}
+}
+
+func (ms *memStore) persistOnInterval() {
+	// We will try again on our next interval if this fails.
+	ms.persist()
+	ms.mu.Lock()
+	ms.resetPersistTimer()
+	ms.mu.Unlock()
 }
 
 func (o *consumerMemStore) Update(state *ConsumerState) error {
@@ -2652,6 +2652,13 @@ type StreamDetail struct {
 	Consumer []*ConsumerInfo     `json:"consumer_detail,omitempty"`
 	Mirror   *StreamSourceInfo   `json:"mirror,omitempty"`
 	Sources  []*StreamSourceInfo `json:"sources,omitempty"`
+	Recovery *StreamRecoveryInfo `json:"recovery,omitempty"`
+}
+
+// StreamRecoveryInfo shows how long a stream took to recover its store on startup.
+type StreamRecoveryInfo struct {
+	Duration     time.Duration `json:"duration"`
+	SubjectIndex bool          `json:"subject_index"`
 }
 
 type AccountDetail struct {
@@ -2663,11 +2670,14 @@ type AccountDetail struct {
 
 // MetaClusterInfo shows information about the meta group.
 type MetaClusterInfo struct {
-	Name     string      `json:"name,omitempty"`
-	Leader   string      `json:"leader,omitempty"`
-	Peer     string      `json:"peer,omitempty"`
-	Replicas []*PeerInfo `json:"replicas,omitempty"`
-	Size     int         `json:"cluster_size"`
+	Name             string                `json:"name,omitempty"`
+	Leader           string                `json:"leader,omitempty"`
+	Peer             string                `json:"peer,omitempty"`
+	Replicas         []*PeerInfo           `json:"replicas,omitempty"`
+	Size             int                   `json:"cluster_size"`
+	SnapshotTransfer *SnapshotTransferInfo `json:"snapshot_transfer,omitempty"`
+	// How many stream and consumer groups each server leads, only shown by the meta leader.
+	LeaderDistribution map[string]int `json:"leader_distribution,omitempty"`
 }
 
 // JSInfo has detailed information on JetStream.
@@ -2682,11 +2692,43 @@ type JSInfo struct {
 	Messages  uint64           `json:"messages"`
 	Bytes     uint64           `json:"bytes"`
 	Meta      *MetaClusterInfo `json:"meta_cluster,omitempty"`
+	// KeyRotation is the progress of re-encrypting our streams after the encryption key or cipher changed.
+	KeyRotation *KeyRotationInfo `json:"key_rotation,omitempty"`
+	// Scrub has the results of verifying the message blocks of our streams in the background.
+	Scrub *ScrubInfo `json:"scrub,omitempty"`
+	// Compaction has the results of rewriting sparse message blocks of our streams in the background.
+	Compaction *CompactionInfo `json:"compaction,omitempty"`
 
 	// aggregate raft info
 	AccountDetails []*AccountDetail `json:"account_details,omitempty"`
 }
 
+// ScrubInfo shows the results of verifying stream message blocks in the background.
+type ScrubInfo struct {
+	Runs        uint64    `json:"runs"`
+	Blocks      uint64    `json:"blocks"`
+	Corrupt     uint64    `json:"corrupt_ranges"`
+	CorruptMsgs uint64    `json:"corrupt_msgs"`
+	Repaired    uint64    `json:"repaired_msgs"`
+	Last        time.Time `json:"last,omitempty"`
+}
+
+// CompactionInfo shows the results of rewriting sparse stream message blocks in the background.
+type CompactionInfo struct {
+	Runs      uint64    `json:"runs"`
+	Blocks    uint64    `json:"blocks"`
+	Reclaimed uint64    `json:"reclaimed_bytes"`
+	Last      time.Time `json:"last,omitempty"`
+}
+
+// KeyRotationInfo shows the progress of re-encrypting stream message blocks with a new key.
+type KeyRotationInfo struct {
+	Active  bool   `json:"active"`
+	Blocks  int    `json:"blocks"`
+	Rotated int    `json:"rotated"`
+	Error   string `json:"error,omitempty"`
+}
+
 func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg bool) *AccountDetail {
 	jsa.mu.RLock()
 	acc := jsa.account
@@ -2733,13 +2775,14 @@ func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg
 				cfg = &c
 			}
 			sdet := StreamDetail{
-				Name:    stream.name(),
-				Created: stream.createdTime(),
-				State:   stream.state(),
-				Cluster: ci,
-				Config:  cfg,
-				Mirror:  stream.mirrorInfo(),
-				Sources: stream.sourcesInfo(),
+				Name:     stream.name(),
+				Created:  stream.createdTime(),
+				State:    stream.state(),
+				Cluster:  ci,
+				Config:   cfg,
+				Mirror:   stream.mirrorInfo(),
+				Sources:  stream.sourcesInfo(),
+				Recovery: stream.recoveryInfo(),
 			}
 			if optConsumers {
 				for _, consumer := range stream.getPublicConsumers() {
@@ -2849,7 +2892,9 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 			jsi.Meta = &MetaClusterInfo{Name: ci.Name, Leader: ci.Leader, Peer: getHash(ci.Leader), Size: mg.ClusterSize()}
 			if isLeader {
 				jsi.Meta.Replicas = ci.Replicas
+				jsi.Meta.LeaderDistribution = s.leaderDistribution(mg)
 			}
+			jsi.Meta.SnapshotTransfer = ci.SnapshotTransfer
 		}
 	}
 
@@ -2875,6 +2920,31 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 		}
 	}
 
+	if sc := s.jsScrubState(); sc.runs > 0 {
+		jsi.Scrub = &ScrubInfo{
+			Runs:        sc.runs,
+			Blocks:      sc.blocks,
+			Corrupt:     sc.ranges,
+			CorruptMsgs: sc.msgs,
+			Repaired:    sc.repaired,
+			Last:        sc.last,
+		}
+	}
+	if cs := s.jsCompactState(); cs.runs > 0 {
+		jsi.Compaction = &CompactionInfo{
+			Runs:      cs.runs,
+			Blocks:    cs.blocks,
+			Reclaimed: cs.reclaimed,
+			Last:      cs.last,
+		}
+	}
+	if rot := s.jsKeyRotationState(); rot.total > 0 || rot.err != nil {
+		jsi.KeyRotation = &KeyRotationInfo{Active: rot.active, Blocks: rot.total, Rotated: rot.done}
+		if rot.err != nil {
+			jsi.KeyRotation.Error = rot.err.Error()
+		}
+	}
+
 	// filter logic
 	if filterIdx != -1 {
 		accounts = []*jsAccount{accounts[filterIdx]}
@@ -2965,6 +3035,168 @@ func (s *Server) HandleJsz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// RaftzOptions are options passed to Raftz
+type RaftzOptions struct {
+	AccountFilter string `json:"account"`
+	StreamFilter  string `json:"stream"`
+	GroupFilter   string `json:"group"`
+}
+
+// Raftz shows the internal state of the raft groups running on this server.
+type Raftz struct {
+	ID     string        `json:"server_id"`
+	Now    time.Time     `json:"now"`
+	Groups []*RaftzGroup `json:"groups"`
+}
+
+// RaftzGroup is the internal state of a single raft group.
+type RaftzGroup struct {
+	Name             string                `json:"name"`
+	Account          string                `json:"account,omitempty"`
+	Stream           string                `json:"stream,omitempty"`
+	Consumer         string                `json:"consumer,omitempty"`
+	ID               string                `json:"id"`
+	State            string                `json:"state"`
+	Leader           string                `json:"leader,omitempty"`
+	Term             uint64                `json:"term"`
+	Vote             string                `json:"vote,omitempty"`
+	PTerm            uint64                `json:"pterm"`
+	PIndex           uint64                `json:"pindex"`
+	Commit           uint64                `json:"commit"`
+	Applied          uint64                `json:"applied"`
+	WALMsgs          uint64                `json:"wal_msgs"`
+	WALBytes         uint64                `json:"wal_bytes"`
+	Observer         bool                  `json:"observer,omitempty"`
+	Paused           bool                  `json:"paused,omitempty"`
+	CatchingUp       bool                  `json:"catching_up,omitempty"`
+	WriteErr         string                `json:"write_err,omitempty"`
+	Peers            []*RaftzPeer          `json:"peers,omitempty"`
+	Votes            []*RaftzVote          `json:"vote_history,omitempty"`
+	SnapshotIndex    uint64                `json:"snapshot_index,omitempty"`
+	SnapshotAge      time.Duration         `json:"snapshot_age,omitempty"`
+	SnapshotTransfer *SnapshotTransferInfo `json:"snapshot_transfer,omitempty"`
+}
+
+// RaftzPeer is what a raft group knows about one of its peers.
+type RaftzPeer struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name,omitempty"`
+	Index       uint64        `json:"index"`
+	Lag         uint64        `json:"lag"`
+	LastContact time.Duration `json:"last_contact,omitempty"`
+}
+
+// RaftzVote is a vote cast by a raft group.
+type RaftzVote struct {
+	Term      uint64    `json:"term"`
+	Candidate string    `json:"candidate"`
+	Granted   bool      `json:"granted"`
+	Time      time.Time `json:"time"`
+}
+
+// HandleRaftz process HTTP requests for raft group information.
+func (s *Server) HandleRaftz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[RaftzPath]++
+	s.mu.Unlock()
+
+	rz, err := s.Raftz(&RaftzOptions{
+		AccountFilter: r.URL.Query().Get("acc"),
+		StreamFilter:  r.URL.Query().Get("stream"),
+		GroupFilter:   r.URL.Query().Get("group"),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(rz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /raftz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Returns how many stream and consumer groups each server in the meta group leads.
+// For other servers this is what they last reported in their statsz.
+func (s *Server) leaderDistribution(mg RaftNode) map[string]int {
+	ld := make(map[string]int)
+	ourID := mg.ID()
+	for _, p := range mg.Peers() {
+		if p.ID == ourID {
+			ld[s.Name()] = s.numRaftLeaders()
+		} else if sir, ok := s.nodeToInfo.Load(p.ID); ok && sir != nil {
+			if ni := sir.(nodeInfo); !ni.offline && ni.stats != nil {
+				ld[ni.name] = ni.stats.HALeaders
+			}
+		}
+	}
+	return ld
+}
+
+// Raftz returns a Raftz structure containing the internal state of the raft groups on this server.
+func (s *Server) Raftz(opts *RaftzOptions) (*Raftz, error) {
+	if opts == nil {
+		opts = &RaftzOptions{}
+	}
+	now := time.Now().UTC()
+	rz := &Raftz{ID: s.ID(), Now: now, Groups: []*RaftzGroup{}}
+
+	// Map our groups to the assets they are for.
+	type asset struct{ acc, stream, consumer string }
+	assets := make(map[string]asset)
+	if js := s.getJetStream(); js != nil {
+		js.mu.RLock()
+		if cc := js.cluster; cc != nil {
+			for acc, asa := range cc.streams {
+				for stream, sa := range asa {
+					if sa.Group != nil {
+						assets[sa.Group.Name] = asset{acc, stream, _EMPTY_}
+					}
+					for consumer, ca := range sa.consumers {
+						if ca.Group != nil {
+							assets[ca.Group.Name] = asset{acc, stream, consumer}
+						}
+					}
+				}
+			}
+		}
+		js.mu.RUnlock()
+	}
+
+	s.rnMu.RLock()
+	nodes := make([]*raft, 0, len(s.raftNodes))
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n.(*raft))
+	}
+	s.rnMu.RUnlock()
+
+	for _, n := range nodes {
+		if opts.GroupFilter != _EMPTY_ && n.Group() != opts.GroupFilter {
+			continue
+		}
+		a := assets[n.Group()]
+		if opts.AccountFilter != _EMPTY_ && a.acc != opts.AccountFilter {
+			continue
+		}
+		if opts.StreamFilter != _EMPTY_ && a.stream != opts.StreamFilter {
+			continue
+		}
+		rg := n.raftz(now)
+		rg.Account, rg.Stream, rg.Consumer = a.acc, a.stream, a.consumer
+		for _, rp := range rg.Peers {
+			if sir, ok := s.nodeToInfo.Load(rp.ID); ok && sir != nil {
+				rp.Name = sir.(nodeInfo).name
+			}
+		}
+		rz.Groups = append(rz.Groups, rg)
+	}
+	sort.Slice(rz.Groups, func(i, j int) bool { return rz.Groups[i].Name < rz.Groups[j].Name })
+	return rz, nil
+}
+
 type HealthStatus struct {
 	Status string `json:"status"`
 	Error  string `json:"error,omitempty"`
@@ -0,0 +1,518 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of messages in a single atomic batch.
+	maxBatchSize = 1000
+	// Maximum number of batches a stream will hold before they are committed.
+	maxBatchInflight = 50
+	// Maximum length of a batch id.
+	maxBatchIdLen = 64
+	// Batches that see no new messages for this long are abandoned,
+	// e.g. when the publisher went away in the middle of a batch.
+	batchInactiveTimeout = 10 * time.Second
+)
+
+// Batches are replicated as a batchMsgOp entry, which servers before this version can not apply.
+var batchMinVersion = [3]int{2, 10, 0}
+
+var (
+	errBatchBadEncoding     = errors.New("bad batch encoding")
+	errBatchPartiallyStored = errors.New("atomic batch partially stored")
+)
+
+// A batchMsg is a single message of an atomic batch.
+// lseq and ts are only set when clustered.
+type batchMsg struct {
+	subj string
+	hdr  []byte
+	msg  []byte
+	lseq uint64
+	ts   int64
+}
+
+// Size of the message held in memory while its batch is not committed.
+func (m *batchMsg) size() uint64 {
+	return uint64(len(m.subj) + len(m.hdr) + len(m.msg))
+}
+
+// An atomicBatch holds the messages of a batch until its commit arrives.
+type atomicBatch struct {
+	msgs []*batchMsg
+	size uint64
+	tmr  *time.Timer
+}
+
+// msgBatches tracks the atomic batches for a stream that are not committed yet.
+// Only the stream leader receives batches, followers see them as a single entry.
+type msgBatches struct {
+	mu    sync.Mutex
+	group map[string]*atomicBatch
+	size  uint64
+}
+
+func newMsgBatches() *msgBatches {
+	return &msgBatches{}
+}
+
+// Add the message with the given batch sequence to its batch.
+// The bytes of all batches that are not committed yet are limited to maxBytes.
+// Returns all messages of the batch once it is committed.
+func (mb *msgBatches) add(id string, seq uint64, m *batchMsg, commit bool, maxBytes uint64) ([]*batchMsg, *ApiError) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	b := mb.group[id]
+	if seq == 1 {
+		// Starting over.
+		if b != nil {
+			mb.removeLocked(id)
+		} else if len(mb.group) >= maxBatchInflight {
+			return nil, NewJSAtomicPublishTooManyInflightError()
+		}
+		if mb.group == nil {
+			mb.group = make(map[string]*atomicBatch)
+		}
+		b = &atomicBatch{}
+		b.tmr = time.AfterFunc(batchInactiveTimeout, func() {
+			mb.mu.Lock()
+			if mb.group[id] == b {
+				mb.removeLocked(id)
+			}
+			mb.mu.Unlock()
+		})
+		mb.group[id] = b
+	} else if b == nil || seq != uint64(len(b.msgs))+1 {
+		// We missed a message or never saw the start.
+		mb.removeLocked(id)
+		return nil, NewJSAtomicPublishIncompleteBatchError()
+	}
+
+	if len(b.msgs) >= maxBatchSize {
+		mb.removeLocked(id)
+		return nil, NewJSAtomicPublishTooLargeBatchError(maxBatchSize)
+	}
+	// Uncommitted batches are held in memory, so we limit their combined size.
+	sz := m.size()
+	if mb.size+sz > maxBytes {
+		mb.removeLocked(id)
+		return nil, NewJSAtomicPublishTooLargeBatchError(friendlyBytes(int64(maxBytes)))
+	}
+	b.size += sz
+	mb.size += sz
+	b.msgs = append(b.msgs, m)
+
+	if !commit {
+		b.tmr.Reset(batchInactiveTimeout)
+		return nil, nil
+	}
+	mb.removeLocked(id)
+	return b.msgs, nil
+}
+
+// Drop a batch, e.g. when one of its messages was invalid.
+func (mb *msgBatches) remove(id string) {
+	mb.mu.Lock()
+	mb.removeLocked(id)
+	mb.mu.Unlock()
+}
+
+// Lock should be held.
+func (mb *msgBatches) removeLocked(id string) {
+	if b := mb.group[id]; b != nil {
+		b.tmr.Stop()
+		mb.size -= b.size
+		delete(mb.group, id)
+	}
+}
+
+// Drop all batches, used when the stream stops.
+func (mb *msgBatches) clear() {
+	if mb == nil {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for id := range mb.group {
+		mb.removeLocked(id)
+	}
+}
+
+// Returns the first header that can not be used with atomic batches, if any.
+// Expected last sequences are only allowed on the first message since they apply
+// to the batch as a whole.
+func unsupportedBatchHeader(hdr []byte, seq uint64) string {
+	keys := []string{JSMsgId, JSExpectedLastMsgId, JSMsgRollup}
+	if seq > 1 {
+		keys = append(keys, JSExpectedLastSeq, JSExpectedLastSubjSeq)
+	}
+	for _, key := range keys {
+		if len(getHeader(key, hdr)) > 0 {
+			return key
+		}
+	}
+	return _EMPTY_
+}
+
+// Process an inbound message that is part of an atomic batch. Messages are held
+// back until the one with the commit header arrives, at which point the batch
+// is stored as a whole or not at all.
+func (mset *stream) processInboundBatchMsg(subject, reply string, hdr, msg []byte, inline bool) {
+	mset.mu.RLock()
+	allowed, name, canRespond := mset.cfg.AllowAtomicPublish, mset.cfg.Name, !mset.cfg.NoAck && len(reply) > 0
+	outq := mset.outq
+	// Batches can hold no more than our stream or a client's pending bytes.
+	maxBytes := uint64(mset.srv.getOpts().MaxPending)
+	if mset.cfg.MaxBytes > 0 && uint64(mset.cfg.MaxBytes) < maxBytes {
+		maxBytes = uint64(mset.cfg.MaxBytes)
+	}
+	mset.mu.RUnlock()
+
+	respondErr := func(apiErr *ApiError) {
+		if canRespond {
+			b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+			outq.sendMsg(reply, b)
+		}
+	}
+
+	if !allowed {
+		respondErr(NewJSAtomicPublishDisabledError())
+		return
+	}
+	id := string(getHeader(JSBatchId, hdr))
+	if len(id) > maxBatchIdLen {
+		respondErr(NewJSAtomicPublishInvalidBatchIDError())
+		return
+	}
+	seq, err := strconv.ParseUint(string(getHeader(JSBatchSeq, hdr)), 10, 64)
+	if err != nil || seq == 0 {
+		mset.batches.remove(id)
+		respondErr(NewJSAtomicPublishMissingSeqError())
+		return
+	}
+	if key := unsupportedBatchHeader(hdr, seq); key != _EMPTY_ {
+		mset.batches.remove(id)
+		respondErr(NewJSAtomicPublishUnsupportedHeaderBatchError(key))
+		return
+	}
+	commit := getHeader(JSBatchCommit, hdr)
+	if len(commit) > 0 && string(commit) != "1" {
+		mset.batches.remove(id)
+		respondErr(NewJSAtomicPublishInvalidBatchCommitError())
+		return
+	}
+
+	// Only the stream itself can reference a scheduled message.
+	m := &batchMsg{subj: subject, hdr: removeHeaderIfPresent(copyBytes(hdr), JSScheduledSequence), msg: copyBytes(msg)}
+	msgs, apiErr := mset.batches.add(id, seq, m, len(commit) > 0, maxBytes)
+	if apiErr != nil {
+		respondErr(apiErr)
+		return
+	}
+	// Nothing else to do until we see the commit.
+	if msgs == nil {
+		return
+	}
+
+	// If we are not receiving directly from a client queue this up so it is committed
+	// in order with other inbound messages.
+	if inline {
+		mset.commitBatch(id, reply, msgs)
+	} else {
+		mset.msgs.push(&inMsg{subj: id, rply: reply, batch: msgs})
+	}
+}
+
+// Commit a complete batch, proposing it first if we are clustered.
+func (mset *stream) commitBatch(id, reply string, msgs []*batchMsg) {
+	if mset.isClustered() {
+		mset.processClusteredInboundBatch(id, reply, msgs)
+	} else if err := mset.processJetStreamBatch(id, reply, msgs); isOutOfSpaceErr(err) {
+		mset.srv.handleOutOfSpace(mset)
+	}
+}
+
+// Check if a batch can be stored as a whole, so we do not fail halfway through.
+// ingMu should be held.
+func (mset *stream) checkBatch(msgs []*batchMsg) *ApiError {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+
+	cfg, store := &mset.cfg, mset.store
+
+	// Expected last sequences were only allowed on the first message.
+	first := msgs[0]
+	if seq, exists := getExpectedLastSeq(first.hdr); exists && seq != mset.lseq {
+		return NewJSStreamWrongLastSequenceError(mset.lseq)
+	}
+	if seq, exists := getExpectedLastSeqPerSubject(first.hdr); exists {
+		var smv StoreMsg
+		var fseq uint64
+		sm, err := store.LoadLastMsg(first.subj, &smv)
+		if sm != nil {
+			fseq = sm.seq
+		}
+		if err == ErrStoreMsgNotFound && seq == 0 {
+			fseq, err = 0, nil
+		}
+		if err != nil || fseq != seq {
+			return NewJSStreamWrongLastSequenceError(fseq)
+		}
+	}
+
+	var sz uint64
+	for _, m := range msgs {
+		if sname := getExpectedStream(m.hdr); sname != _EMPTY_ && sname != cfg.Name {
+			return NewJSStreamNotMatchError()
+		}
+		if cfg.MaxMsgSize >= 0 && len(m.hdr)+len(m.msg) > int(cfg.MaxMsgSize) {
+			return NewJSStreamMessageExceedsMaximumError()
+		}
+		if len(m.hdr) > math.MaxUint16 {
+			return NewJSStreamHeaderExceedsMaximumError()
+		}
+		if ttl, err := getMessageTTL(m.hdr); err != nil {
+			return NewJSMessageTTLInvalidError()
+		} else if ttl > 0 && !cfg.AllowMsgTTL {
+			return NewJSMessageTTLDisabledError()
+		}
+		if apiErr := checkMsgDeliverAt(m.hdr, cfg.AllowMsgSchedules); apiErr != nil {
+			return apiErr
+		}
+		if cfg.Storage == MemoryStorage {
+			sz += memStoreMsgSize(m.subj, m.hdr, m.msg)
+		} else {
+			sz += fileStoreMsgSize(m.subj, m.hdr, m.msg)
+		}
+	}
+
+	// Server and account limits, these are not checked again per message.
+	if mset.js.wouldExceedLimits(cfg.Storage, int(sz)) {
+		mset.srv.resourcesExeededError()
+		return NewJSInsufficientResourcesError()
+	}
+	if mset.jsa != nil {
+		replicas := int64(cfg.Replicas)
+		if replicas < 1 {
+			replicas = 1
+		}
+		if exceeded, apiErr := mset.jsa.wouldExceedLimits(cfg.Storage, mset.tier, int64(sz)*replicas); exceeded {
+			if apiErr == nil {
+				apiErr = NewJSAccountResourcesExceededError()
+			}
+			return apiErr
+		}
+	}
+
+	// With discard new we would reject messages once we hit our limits.
+	if cfg.Discard == DiscardNew {
+		var state StreamState
+		store.FastState(&state)
+		if cfg.MaxMsgs > 0 && state.Msgs+uint64(len(msgs)) > uint64(cfg.MaxMsgs) {
+			return NewJSStreamStoreFailedError(ErrMaxMsgs, Unless(ErrMaxMsgs))
+		}
+		if cfg.MaxBytes > 0 && state.Bytes+sz > uint64(cfg.MaxBytes) {
+			return NewJSStreamStoreFailedError(ErrMaxBytes, Unless(ErrMaxBytes))
+		}
+		if cfg.DiscardNewPer && cfg.MaxMsgsPer > 0 {
+			perSubj := make(map[string]uint64)
+			for _, m := range msgs {
+				perSubj[m.subj]++
+			}
+			for subj, n := range perSubj {
+				if store.SubjectsState(subj)[subj].Msgs+n > uint64(cfg.MaxMsgsPer) {
+					return NewJSStreamStoreFailedError(ErrMaxMsgsPerSubject, Unless(ErrMaxMsgsPerSubject))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// processJetStreamBatch stores all messages of an atomic batch with consecutive
+// sequences. Used directly when not clustered and when applying a batch entry otherwise.
+func (mset *stream) processJetStreamBatch(id, reply string, msgs []*batchMsg) error {
+	mset.ingMu.Lock()
+	defer mset.ingMu.Unlock()
+
+	mset.mu.RLock()
+	name, outq, clustered := mset.cfg.Name, mset.outq, mset.isClustered()
+	canRespond := !mset.cfg.NoAck && len(reply) > 0 && mset.isLeader()
+	mset.mu.RUnlock()
+
+	// Account for messages that will not be stored, in case we are clustered.
+	skip := func(n int) {
+		mset.mu.Lock()
+		mset.clfs += uint64(n)
+		mset.mu.Unlock()
+	}
+	respondErr := func(apiErr *ApiError) {
+		if canRespond {
+			b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+			outq.sendMsg(reply, b)
+		}
+	}
+
+	if apiErr := mset.checkBatch(msgs); apiErr != nil {
+		skip(len(msgs))
+		respondErr(apiErr)
+		return apiErr
+	}
+
+	// Everything that could reject a message was checked above, so any error
+	// from here on is a store failure. When clustered we can not undo what was
+	// already stored without leaving gaps, so let the caller reset the stream instead.
+	// Otherwise we remove what we stored so the batch is not partially applied.
+	lseq := mset.lastSeq()
+	for i, m := range msgs {
+		if err := mset.storeJetStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, m.lseq, m.ts, true); err != nil {
+			mset.srv.Errorf("JetStream failed to store message %d of batch %q for '%s > %s': %v",
+				i+1, id, mset.account(), name, err)
+			skip(len(msgs) - i - 1)
+			respondErr(NewJSStreamStoreFailedError(err, Unless(err)))
+			if i > 0 && !clustered {
+				if terr := mset.truncateBatch(lseq); terr != nil {
+					mset.srv.Errorf("JetStream failed to remove partially stored batch %q for '%s > %s': %v",
+						id, mset.account(), name, terr)
+				}
+			}
+			if isOutOfSpaceErr(err) {
+				return err
+			}
+			return errBatchPartiallyStored
+		}
+	}
+
+	// Now that the batch is complete let our consumers know.
+	mset.mu.RLock()
+	numConsumers := len(mset.consumers)
+	mset.mu.RUnlock()
+	seq := mset.lastSeq()
+	if numConsumers > 0 {
+		first := seq - uint64(len(msgs)) + 1
+		for i, m := range msgs {
+			mset.sigq.push(newCMsg(m.subj, first+uint64(i)))
+		}
+		select {
+		case mset.sch <- struct{}{}:
+		default:
+		}
+	}
+
+	if canRespond {
+		b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{
+			Stream:    name,
+			Sequence:  seq,
+			Domain:    mset.srv.getOpts().JetStreamDomain,
+			BatchId:   id,
+			BatchSize: len(msgs),
+		}})
+		outq.sendMsg(reply, b)
+	}
+	return nil
+}
+
+// Remove any messages of a batch that were stored after lseq.
+// ingMu should be held.
+func (mset *stream) truncateBatch(lseq uint64) error {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if err := truncateStoreTo(mset.store, lseq); err != nil {
+		return err
+	}
+	mset.lseq = lseq
+	return nil
+}
+
+// Encode an atomic batch as a single entry. Each message is encoded
+// the same way as for a streamMsgOp.
+func encodeStreamBatch(id, reply string, msgs []*batchMsg) []byte {
+	var le = binary.LittleEndian
+	// Size for our header and the messages, each with its encoded lengths, sequence and timestamp.
+	hlen, elen := 1+2+len(id)+2+len(reply), binary.MaxVarintLen64
+	for _, m := range msgs {
+		elen += binary.MaxVarintLen64 + 8 + 8 + 2 + 2 + 2 + 4 + len(m.subj) + len(m.hdr) + len(m.msg)
+	}
+	buf := make([]byte, hlen, hlen+elen)
+	buf[0] = byte(batchMsgOp)
+	wi := 1
+	le.PutUint16(buf[wi:], uint16(len(id)))
+	wi += 2
+	copy(buf[wi:], id)
+	wi += len(id)
+	le.PutUint16(buf[wi:], uint16(len(reply)))
+	wi += 2
+	copy(buf[wi:], reply)
+
+	buf = binary.AppendUvarint(buf, uint64(len(msgs)))
+	for _, m := range msgs {
+		esm := encodeStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, m.lseq, m.ts)[1:]
+		buf = binary.AppendUvarint(buf, uint64(len(esm)))
+		buf = append(buf, esm...)
+	}
+	return buf
+}
+
+func decodeStreamBatch(buf []byte) (id, reply string, msgs []*batchMsg, err error) {
+	var le = binary.LittleEndian
+	if len(buf) < 2 {
+		return _EMPTY_, _EMPTY_, nil, errBatchBadEncoding
+	}
+	il := int(le.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < il+2 {
+		return _EMPTY_, _EMPTY_, nil, errBatchBadEncoding
+	}
+	id = string(buf[:il])
+	buf = buf[il:]
+	rl := int(le.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < rl {
+		return _EMPTY_, _EMPTY_, nil, errBatchBadEncoding
+	}
+	reply = string(buf[:rl])
+	buf = buf[rl:]
+
+	n, bn := binary.Uvarint(buf)
+	if bn <= 0 || n == 0 {
+		return _EMPTY_, _EMPTY_, nil, errBatchBadEncoding
+	}
+	buf = buf[bn:]
+	msgs = make([]*batchMsg, 0, n)
+	for i := uint64(0); i < n; i++ {
+		ml, bn := binary.Uvarint(buf)
+		if bn <= 0 || uint64(len(buf)-bn) < ml {
+			return _EMPTY_, _EMPTY_, nil, errBatchBadEncoding
+		}
+		buf = buf[bn:]
+		subj, _, hdr, msg, lseq, ts, err := decodeStreamMsg(buf[:ml])
+		if err != nil {
+			return _EMPTY_, _EMPTY_, nil, err
+		}
+		msgs = append(msgs, &batchMsg{subj, hdr, msg, lseq, ts})
+		buf = buf[ml:]
+	}
+	return id, reply, msgs, nil
+}
@@ -0,0 +1,627 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/highwayhash"
+)
+
+// How long the leader waits before trying to schedule in a message again
+// in case the first attempt did not make it into the stream.
+const msgScheduleRetry = 30 * time.Second
+
+// File in the stream's directory holding our tracked schedules while stopped.
+const schedIndexFile = "scheds.idx"
+
+var errMsgDeliverAtInvalid = errors.New("invalid message delivery time")
+
+// Returns the delivery time for a stored message in unix nanoseconds.
+// The header can either be an RFC3339 timestamp or a delay relative to ts, in which
+// case plain integers are treated as seconds and anything else needs to be a
+// valid Go duration string. Returns 0 with no error if the header is not present.
+func getMessageDeliverAt(hdr []byte, ts int64) (int64, error) {
+	v := getHeader(JSDeliverAt, hdr)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, string(v)); err == nil {
+		return t.UnixNano(), nil
+	}
+	var d time.Duration
+	if secs, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if d, err = time.ParseDuration(string(v)); err != nil {
+		return 0, errMsgDeliverAtInvalid
+	}
+	if d <= 0 {
+		return 0, errMsgDeliverAtInvalid
+	}
+	return ts + int64(d), nil
+}
+
+// Checks the delivery time header on an inbound message.
+func checkMsgDeliverAt(hdr []byte, allowed bool) *ApiError {
+	if len(hdr) == 0 {
+		return nil
+	}
+	if at, err := getMessageDeliverAt(hdr, time.Now().UnixNano()); err != nil {
+		return NewJSMessageDeliverAtInvalidError()
+	} else if at > 0 && !allowed {
+		return NewJSMessageDeliverAtDisabledError()
+	}
+	return nil
+}
+
+// Returns the sequence of the original message if this message was scheduled
+// back into the stream, 0 otherwise.
+func getScheduledSequence(hdr []byte) uint64 {
+	v := getHeader(JSScheduledSequence, hdr)
+	if len(v) == 0 {
+		return 0
+	}
+	seq, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// A msgSchedule is a single message held back from consumers.
+type msgSchedule struct {
+	subj string
+	at   int64
+}
+
+// msgSchedules tracks messages that carry a Nats-Deliver-At header.
+// Every replica tracks them so consumers can skip them, but only the
+// stream leader places them back into the stream once they are due.
+type msgSchedules struct {
+	mu   sync.Mutex
+	q    msgTTLs
+	msgs map[uint64]msgSchedule
+	// Tracked sequences per subject, in order.
+	subjs map[string][]uint64
+	// Tracked sequences, in order, per subject filter our consumers are
+	// interested in, so they can be counted without walking all subjects.
+	filters map[string]*schedFilter
+}
+
+// schedFilter holds the tracked sequences matching a consumer subject filter.
+type schedFilter struct {
+	refs int
+	seqs []uint64
+}
+
+func newMsgSchedules() *msgSchedules {
+	return &msgSchedules{}
+}
+
+// Track a message to be delivered at the given time.
+func (ms *msgSchedules) track(seq uint64, subj string, at int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.msgs == nil {
+		ms.msgs = make(map[uint64]msgSchedule)
+		ms.subjs = make(map[string][]uint64)
+	}
+	if m, ok := ms.msgs[seq]; ok {
+		ms.removeSubjSeq(m.subj, seq)
+	}
+	ms.msgs[seq] = msgSchedule{subj, at}
+	ms.addSubjSeq(subj, seq)
+	ms.q.track(seq, at)
+}
+
+// Insert seq into the ordered seqs.
+func insertSeq(seqs []uint64, seq uint64) []uint64 {
+	// Messages are almost always tracked in order.
+	if n := len(seqs); n == 0 || seqs[n-1] < seq {
+		return append(seqs, seq)
+	}
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= seq })
+	seqs = append(seqs, 0)
+	copy(seqs[i+1:], seqs[i:])
+	seqs[i] = seq
+	return seqs
+}
+
+// Remove seq from the ordered seqs if present.
+func deleteSeq(seqs []uint64, seq uint64) []uint64 {
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= seq })
+	if i == len(seqs) || seqs[i] != seq {
+		return seqs
+	}
+	return append(seqs[:i], seqs[i+1:]...)
+}
+
+// Lock should be held.
+func (ms *msgSchedules) addSubjSeq(subj string, seq uint64) {
+	ms.subjs[subj] = insertSeq(ms.subjs[subj], seq)
+	for filter, sf := range ms.filters {
+		if subjectIsSubsetMatch(subj, filter) {
+			sf.seqs = insertSeq(sf.seqs, seq)
+		}
+	}
+}
+
+// Lock should be held.
+func (ms *msgSchedules) removeSubjSeq(subj string, seq uint64) {
+	if seqs := deleteSeq(ms.subjs[subj], seq); len(seqs) == 0 {
+		delete(ms.subjs, subj)
+	} else {
+		ms.subjs[subj] = seqs
+	}
+	for filter, sf := range ms.filters {
+		if subjectIsSubsetMatch(subj, filter) {
+			sf.seqs = deleteSeq(sf.seqs, seq)
+		}
+	}
+}
+
+// Start keeping count of tracked messages for the given consumer filters.
+// An unfiltered consumer is counted under the full wildcard.
+func (ms *msgSchedules) watch(filters []string) {
+	if ms == nil {
+		return
+	}
+	if len(filters) == 0 {
+		filters = []string{fwcs}
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.filters == nil {
+		ms.filters = make(map[string]*schedFilter)
+	}
+	for _, filter := range filters {
+		if sf := ms.filters[filter]; sf != nil {
+			sf.refs++
+			continue
+		}
+		sf := &schedFilter{refs: 1}
+		for subj, seqs := range ms.subjs {
+			if subjectIsSubsetMatch(subj, filter) {
+				sf.seqs = append(sf.seqs, seqs...)
+			}
+		}
+		sort.Slice(sf.seqs, func(i, j int) bool { return sf.seqs[i] < sf.seqs[j] })
+		ms.filters[filter] = sf
+	}
+}
+
+// Stop keeping count for the given consumer filters once no consumer uses them anymore.
+func (ms *msgSchedules) unwatch(filters []string) {
+	if ms == nil {
+		return
+	}
+	if len(filters) == 0 {
+		filters = []string{fwcs}
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, filter := range filters {
+		if sf := ms.filters[filter]; sf != nil {
+			if sf.refs--; sf.refs <= 0 {
+				delete(ms.filters, filter)
+			}
+		}
+	}
+}
+
+// Stop tracking a message, e.g. when it was removed.
+func (ms *msgSchedules) forget(seq uint64) {
+	if ms == nil {
+		return
+	}
+	ms.mu.Lock()
+	if m, ok := ms.msgs[seq]; ok {
+		delete(ms.msgs, seq)
+		ms.removeSubjSeq(m.subj, seq)
+		ms.prune()
+	}
+	ms.mu.Unlock()
+}
+
+// Stop tracking the original message when its scheduled copy with timestamp ts
+// was stored. Returns true if the original should be removed.
+func (ms *msgSchedules) take(seq uint64, subj string, ts int64) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if m, ok := ms.msgs[seq]; !ok || m.subj != subj || m.at > ts {
+		return false
+	}
+	delete(ms.msgs, seq)
+	ms.removeSubjSeq(subj, seq)
+	ms.prune()
+	return true
+}
+
+// Drop queued entries for messages we no longer track. Only the leader pops due
+// entries off our queue, so we also compact it once most of it is stale.
+// Lock should be held.
+func (ms *msgSchedules) prune() {
+	for len(ms.q) > 0 {
+		if _, ok := ms.msgs[ms.q[0].seq]; ok {
+			break
+		}
+		heap.Pop(&ms.q)
+	}
+	if len(ms.q) <= 2*len(ms.msgs) {
+		return
+	}
+	q := ms.q[:0]
+	for _, e := range ms.q {
+		if _, ok := ms.msgs[e.seq]; ok {
+			q = append(q, e)
+		}
+	}
+	ms.q = q
+	heap.Init(&ms.q)
+}
+
+// Returns true if the message is currently held back from consumers.
+func (ms *msgSchedules) isScheduled(seq uint64) bool {
+	if ms == nil {
+		return false
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.msgs[seq]
+	return ok
+}
+
+// Returns the next delivery time or 0 if nothing is tracked.
+func (ms *msgSchedules) next() int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.q.next()
+}
+
+// Returns the sequences of all messages that are due as of now.
+// They stay tracked until their copy is stored, and will be returned
+// again after msgScheduleRetry if that does not happen.
+func (ms *msgSchedules) due(now int64) []uint64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var seqs []uint64
+	for _, e := range ms.q.expired(now) {
+		// Skip entries for messages that are gone or were re-tracked.
+		if m, ok := ms.msgs[e.seq]; !ok || m.at > now {
+			continue
+		}
+		seqs = append(seqs, e.seq)
+	}
+	for _, seq := range seqs {
+		ms.q.track(seq, now+int64(msgScheduleRetry))
+	}
+	return seqs
+}
+
+// Rebuild our ordered queue from all tracked messages.
+// Used when we become leader.
+func (ms *msgSchedules) reset() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.q.reset()
+	for seq, m := range ms.msgs {
+		ms.q = append(ms.q, msgTTL{seq, m.at})
+	}
+	heap.Init(&ms.q)
+}
+
+// Returns the number of tracked messages matching the consumer filters, and how many
+// of those are at or above sseq. The filters need to be watched, and since a consumer's
+// filters can not overlap, no message is counted twice.
+func (ms *msgSchedules) count(sseq uint64, filters []string) (total, above uint64) {
+	if ms == nil {
+		return 0, 0
+	}
+	if len(filters) == 0 {
+		filters = []string{fwcs}
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, filter := range filters {
+		if sf := ms.filters[filter]; sf != nil {
+			total += uint64(len(sf.seqs))
+			i := sort.Search(len(sf.seqs), func(i int) bool { return sf.seqs[i] >= sseq })
+			above += uint64(len(sf.seqs) - i)
+		}
+	}
+	return total, above
+}
+
+// Return the sequences of all tracked messages.
+func (ms *msgSchedules) seqs() []uint64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	seqs := make([]uint64, 0, len(ms.msgs))
+	for seq := range ms.msgs {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// Remove the original of a message that was scheduled back into the stream
+// once its copy with timestamp ts was stored.
+// Lock should not be held.
+func (mset *stream) takeScheduledMsg(subj string, hdr []byte, ts int64) {
+	if oseq := getScheduledSequence(hdr); oseq > 0 && mset.sched.take(oseq, subj, ts) {
+		mset.store.RemoveMsg(oseq)
+	}
+}
+
+// Returns the sequence and delivery time of all tracked messages.
+func (ms *msgSchedules) entries() []msgTTL {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	es := make([]msgTTL, 0, len(ms.msgs))
+	for seq, m := range ms.msgs {
+		es = append(es, msgTTL{seq, m.at})
+	}
+	return es
+}
+
+// Returns where we keep our tracked schedules while stopped, if our messages are kept on disk.
+func (mset *stream) scheduleIndexFile() string {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	if mset.jsa == nil || !mset.cfg.AllowMsgSchedules || mset.cfg.Mirror != nil {
+		return _EMPTY_
+	}
+	if mset.cfg.Storage != FileStorage && !mset.cfg.Persist {
+		return _EMPTY_
+	}
+	return filepath.Join(mset.jsa.storeDir, streamsDir, mset.cfg.Name, schedIndexFile)
+}
+
+// Hash used to detect a corrupt schedule index.
+func scheduleIndexHash(name string) hash.Hash64 {
+	key := sha256.Sum256([]byte(name))
+	hh, _ := highwayhash.New64(key[:])
+	return hh
+}
+
+// Encode our tracked schedules along with the last sequence of our store, which tells us on
+// recovery if any messages were added since. Subjects are not included, they are loaded
+// from the store so nothing beyond sequences and times is kept unencrypted.
+func (mset *stream) encodeScheduleIndex() []byte {
+	var state StreamState
+	mset.store.FastState(&state)
+	es := mset.sched.entries()
+
+	var scratch [2 * binary.MaxVarintLen64]byte
+	var b bytes.Buffer
+	b.WriteByte(magic)
+	b.WriteByte(version)
+	n := binary.PutUvarint(scratch[0:], state.LastSeq)
+	n += binary.PutUvarint(scratch[n:], uint64(len(es)))
+	b.Write(scratch[0:n])
+	for _, e := range es {
+		n := binary.PutUvarint(scratch[0:], e.seq)
+		n += binary.PutVarint(scratch[n:], e.expires)
+		b.Write(scratch[0:n])
+	}
+	hh := scheduleIndexHash(mset.name())
+	hh.Write(b.Bytes())
+	b.Write(hh.Sum(nil))
+	return b.Bytes()
+}
+
+// Write out an encoded schedule index. We write to a new file and rename it so a
+// partial write is never picked up.
+func writeScheduleIndex(fn string, buf []byte) error {
+	tmp := fn + ".tmp"
+	<-dios
+	err := os.WriteFile(tmp, buf, defaultFilePerms)
+	dios <- struct{}{}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Track the schedules we wrote out when we were last stopped. This is only trusted once, and only
+// if no messages were added since. Returns false if we need to scan our store instead.
+func (mset *stream) loadScheduleIndex() bool {
+	fn := mset.scheduleIndexFile()
+	if fn == _EMPTY_ {
+		return false
+	}
+	os.Remove(fn + ".tmp")
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return false
+	}
+	os.Remove(fn)
+
+	if len(buf) < hdrLen+checksumSize || checkHeader(buf) != nil {
+		return false
+	}
+	hh := scheduleIndexHash(mset.name())
+	hh.Write(buf[:len(buf)-checksumSize])
+	if !bytes.Equal(hh.Sum(nil), buf[len(buf)-checksumSize:]) {
+		return false
+	}
+	buf = buf[hdrLen : len(buf)-checksumSize]
+
+	lseq, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return false
+	}
+	buf = buf[n:]
+	var state StreamState
+	mset.store.FastState(&state)
+	if state.LastSeq != lseq {
+		return false
+	}
+	num, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return false
+	}
+	buf = buf[n:]
+	es := make([]msgTTL, 0, num)
+	for i := uint64(0); i < num; i++ {
+		seq, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return false
+		}
+		buf = buf[n:]
+		at, n := binary.Varint(buf)
+		if n <= 0 {
+			return false
+		}
+		buf = buf[n:]
+		es = append(es, msgTTL{seq, at})
+	}
+	if len(buf) != 0 {
+		return false
+	}
+
+	// Messages may have been removed since, e.g. when our store expired them on recovery.
+	var smv StoreMsg
+	for _, e := range es {
+		if sm, err := mset.store.LoadMsg(e.seq, &smv); err == nil {
+			mset.sched.track(e.seq, sm.subj, e.expires)
+		}
+	}
+	return true
+}
+
+// Recover our scheduled messages, scanning the store only if we have no valid index.
+func (mset *stream) rebuildSchedules() {
+	if mset.loadScheduleIndex() {
+		return
+	}
+	var smv StoreMsg
+	var state StreamState
+	mset.store.FastState(&state)
+	for seq := state.FirstSeq; seq <= state.LastSeq; seq++ {
+		sm, nseq, err := mset.store.LoadNextMsg(fwcs, true, seq, &smv)
+		if err != nil {
+			break
+		}
+		if len(sm.hdr) > 0 {
+			if at, _ := getMessageDeliverAt(sm.hdr, sm.ts); at > sm.ts {
+				mset.sched.track(sm.seq, sm.subj, at)
+			}
+		}
+		seq = nseq
+	}
+}
+
+// Drop tracked messages that are no longer in the store, e.g. after a purge.
+func (mset *stream) pruneSchedules() {
+	var smv StoreMsg
+	for _, seq := range mset.sched.seqs() {
+		if _, err := mset.store.LoadMsg(seq, &smv); err != nil {
+			mset.sched.forget(seq)
+		}
+	}
+}
+
+// Arm our timer for the next due scheduled message.
+// Only the leader schedules messages back into the stream.
+// Lock should be held.
+func (mset *stream) setScheduleTimer() {
+	next := mset.sched.next()
+	if next == 0 || !mset.isLeader() {
+		stopAndClearTimer(&mset.schedTmr)
+		return
+	}
+	fire := time.Duration(next - time.Now().UnixNano())
+	if fire < 0 {
+		fire = 0
+	}
+	if mset.schedTmr == nil {
+		mset.schedTmr = time.AfterFunc(fire, mset.processScheduledMsgs)
+	} else {
+		mset.schedTmr.Reset(fire)
+	}
+}
+
+// Called when scheduled messages are due. Each one is placed back into the stream
+// with its delivery time removed and a reference to the original, which will be
+// removed once the copy has been stored.
+//
+// The copy is a new message, so consumers see it with a new stream sequence and with
+// the time it was scheduled in as its timestamp. The sequence the publisher was acked
+// with no longer exists once the copy is stored. A per message TTL still counts from
+// the time the original was published, so the copy carries whatever is left of it.
+func (mset *stream) processScheduledMsgs() {
+	mset.mu.RLock()
+	if mset.client == nil || !mset.isLeader() {
+		mset.mu.RUnlock()
+		return
+	}
+	store, clustered := mset.store, mset.isClustered()
+	mset.mu.RUnlock()
+
+	var smv StoreMsg
+	now := time.Now().UnixNano()
+	for _, seq := range mset.sched.due(now) {
+		sm, err := store.LoadMsg(seq, &smv)
+		if err != nil {
+			mset.sched.forget(seq)
+			continue
+		}
+		// If the original expired before it was due, there is nothing to deliver.
+		// Our store will remove it and we forget about it then.
+		expires := msgTTLExpires(sm.hdr, sm.ts)
+		if expires > 0 && expires <= now {
+			continue
+		}
+		// Strip headers that would have the copy rejected or handled differently.
+		hdr := copyBytes(sm.hdr)
+		for _, key := range []string{JSDeliverAt, JSMsgId, JSExpectedStream, JSExpectedLastSeq, JSExpectedLastSubjSeq, JSExpectedLastMsgId, JSMsgRollup} {
+			hdr = removeHeaderIfPresent(hdr, key)
+		}
+		// The copy is timestamped now, so only give it what is left of the original TTL.
+		if expires > 0 {
+			ttl := time.Duration(expires - now)
+			if ttl < minMsgTTL {
+				ttl = minMsgTTL
+			}
+			hdr = genHeader(removeHeaderIfPresent(hdr, JSMessageTTL), JSMessageTTL, ttl.String())
+		}
+		hdr = genHeader(hdr, JSScheduledSequence, strconv.FormatUint(seq, 10))
+		// We bypass the inbound paths since they strip the reference to the original.
+		if clustered {
+			mset.proposeInboundMsg(sm.subj, _EMPTY_, hdr, copyBytes(sm.msg))
+		} else {
+			mset.ingMu.Lock()
+			mset.storeJetStreamMsg(sm.subj, _EMPTY_, hdr, copyBytes(sm.msg), 0, 0, false)
+			mset.ingMu.Unlock()
+		}
+	}
+
+	mset.mu.Lock()
+	mset.setScheduleTimer()
+	mset.mu.Unlock()
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Minimum per message TTL we will accept.
+const minMsgTTL = time.Second
+
+var errMsgTTLInvalid = errors.New("invalid per-message TTL")
+
+// Parse the per message TTL header value. Plain integers are treated as seconds,
+// anything else needs to be a valid Go duration string, e.g. "30s" or "1h".
+// Returns 0 with no error if the header is not present.
+func getMessageTTL(hdr []byte) (time.Duration, error) {
+	v := getHeader(JSMessageTTL, hdr)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	return parseMessageTTL(string(v))
+}
+
+func parseMessageTTL(v string) (time.Duration, error) {
+	var ttl time.Duration
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// Anything larger would overflow as a duration.
+		if secs > math.MaxInt64/int64(time.Second) {
+			return 0, errMsgTTLInvalid
+		}
+		ttl = time.Duration(secs) * time.Second
+	} else if ttl, err = time.ParseDuration(v); err != nil {
+		return 0, errMsgTTLInvalid
+	}
+	if ttl < minMsgTTL {
+		return 0, errMsgTTLInvalid
+	}
+	return ttl, nil
+}
+
+// Returns the expiration time for a stored message in unix nanoseconds, or 0 if
+// the message does not carry a valid TTL.
+func msgTTLExpires(hdr []byte, ts int64) int64 {
+	if len(hdr) == 0 {
+		return 0
+	}
+	if ttl, err := getMessageTTL(hdr); err == nil && ttl > 0 {
+		// Saturate instead of overflowing for very large TTLs.
+		if ts > math.MaxInt64-int64(ttl) {
+			return math.MaxInt64
+		}
+		return ts + int64(ttl)
+	}
+	return 0
+}
+
+// A msgTTL is a single tracked message expiration.
+type msgTTL struct {
+	seq     uint64
+	expires int64
+}
+
+// msgTTLs tracks per message expirations for a stream store and
+// implements heap.Interface ordered by expiration time.
+// Entries for messages removed by other means are not eagerly cleaned up,
+// so the stores are expected to verify a message on expiration.
+type msgTTLs []msgTTL
+
+func (q msgTTLs) Len() int { return len(q) }
+
+func (q msgTTLs) Less(i, j int) bool { return q[i].expires < q[j].expires }
+
+func (q msgTTLs) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *msgTTLs) Push(x interface{}) {
+	*q = append(*q, x.(msgTTL))
+}
+
+func (q *msgTTLs) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// Track a new expiration.
+func (q *msgTTLs) track(seq uint64, expires int64) {
+	heap.Push(q, msgTTL{seq, expires})
+}
+
+// Returns the next expiration time or 0 if nothing is tracked.
+func (q msgTTLs) next() int64 {
+	if len(q) == 0 {
+		return 0
+	}
+	return q[0].expires
+}
+
+// Removes and returns all entries that have expired as of now.
+func (q *msgTTLs) expired(now int64) []msgTTL {
+	var exp []msgTTL
+	for len(*q) > 0 && (*q)[0].expires <= now {
+		exp = append(exp, heap.Pop(q).(msgTTL))
+	}
+	return exp
+}
+
+// Clear all tracked expirations.
+func (q *msgTTLs) reset() {
+	*q = nil
+}
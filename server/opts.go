@@ -253,6 +253,8 @@ type Options struct {
 	JetStreamExtHint      string        `json:"-"`
 	JetStreamKey          string        `json:"-"`
 	JetStreamCipher       StoreCipher   `json:"-"`
+	JetStreamOldKey       string        `json:"-"`
+	JetStreamArchiveDir   string        `json:"-"`
 	JetStreamUniqueTag    string
 	JetStreamLimits       JSLimitOpts
 	JetStreamMaxCatchup   int64
@@ -305,6 +307,15 @@ type Options struct {
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
+	// InspectStore is a stream directory to inspect, after which the server exits.
+	InspectStore string `json:"-"`
+
+	// InspectRebuildIndex will rewrite the index files of the inspected stream.
+	InspectRebuildIndex bool `json:"-"`
+
+	// InspectTruncate will truncate a torn write at the end of the inspected stream's last block.
+	InspectTruncate bool `json:"-"`
+
 	// ConnectErrorReports specifies the number of failed attempts
 	// at which point server should report the failure of an initial
 	// connection to a route, gateway or leaf node.
@@ -319,6 +330,19 @@ type Options struct {
 	// and used as a filter criteria for some system requests.
 	Tags jwt.TagList `json:"-"`
 
+	// How often the JetStream meta leader rebalances stream and consumer leaders, and how many
+	// it moves each time. Rebalancing is disabled if the interval is not set.
+	JetStreamLeaderRebalance      time.Duration `json:"-"`
+	JetStreamLeaderRebalanceMoves int           `json:"-"`
+
+	// How often file based streams verify their sealed message blocks in the background.
+	// Uses the file store default if not set, and a negative value disables scrubbing.
+	JetStreamScrubInterval time.Duration `json:"-"`
+
+	// Maximum bytes per second file based streams will rewrite when compacting sparse blocks
+	// in the background. Uses the file store default if not set.
+	JetStreamCompactMaxRate int64 `json:"-"`
+
 	// OCSPConfig enables OCSP Stapling in the server.
 	OCSPConfig    *OCSPConfig
 	tlsConfigOpts *TLSConfigOpts
@@ -1915,6 +1939,8 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 					return &configErr{tk, "Duplicate 'store_dir' configuration"}
 				}
 				opts.StoreDir = mv.(string)
+			case "archive_dir", "archivedir":
+				opts.JetStreamArchiveDir = mv.(string)
 			case "max_memory_store", "max_mem_store", "max_mem":
 				s, err := getStorageSize(mv)
 				if err != nil {
@@ -1935,6 +1961,8 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				doEnable = mv.(bool)
 			case "key", "ek", "encryption_key":
 				opts.JetStreamKey = mv.(string)
+			case "prev_key", "prev_encryption_key":
+				opts.JetStreamOldKey = mv.(string)
 			case "cipher":
 				switch strings.ToLower(mv.(string)) {
 				case "chacha", "chachapoly":
@@ -1958,6 +1986,18 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
 				}
 				opts.JetStreamMaxCatchup = s
+			case "leader_rebalance_interval":
+				opts.JetStreamLeaderRebalance = parseDuration(mk, tk, mv, errors, warnings)
+			case "leader_rebalance_max_moves":
+				opts.JetStreamLeaderRebalanceMoves = int(mv.(int64))
+			case "scrub_interval":
+				opts.JetStreamScrubInterval = parseDuration(mk, tk, mv, errors, warnings)
+			case "compact_max_rate":
+				s, err := getStorageSize(mv)
+				if err != nil {
+					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+				}
+				opts.JetStreamCompactMaxRate = s
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -4679,6 +4719,9 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&configFile, "c", "", "Configuration file.")
 	fs.StringVar(&configFile, "config", "", "Configuration file.")
 	fs.BoolVar(&opts.CheckConfig, "t", false, "Check configuration and exit.")
+	fs.StringVar(&opts.InspectStore, "inspect", "", "Inspect a stream directory in the JetStream store and exit.")
+	fs.BoolVar(&opts.InspectRebuildIndex, "rebuild_index", false, "Rebuild the index files of the inspected stream.")
+	fs.BoolVar(&opts.InspectTruncate, "truncate_tail", false, "Truncate a torn write at the end of the inspected stream's last block.")
 	fs.StringVar(&signal, "sl", "", "Send signal to nats-server process (ldm, stop, quit, term, reopen, reload).")
 	fs.StringVar(&signal, "signal", "", "Send signal to nats-server process (ldm, stop, quit, term, reopen, reload).")
 	fs.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
@@ -4824,6 +4867,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		return nil, fmt.Errorf("must specify [-c, --config] option to check configuration file syntax")
 	}
 
+	if (opts.InspectRebuildIndex || opts.InspectTruncate) && opts.InspectStore == _EMPTY_ {
+		return nil, fmt.Errorf("must specify [--inspect] option to rebuild indexes or truncate a stream")
+	}
+
 	// Special handling of some flags
 	var (
 		flagErr     error
@@ -20,11 +20,14 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
+	"io"
 	"math"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -45,6 +48,9 @@ type RaftNode interface {
 	Progress() (index, commit, applied uint64)
 	Leader() bool
 	Quorum() bool
+	ReadIndex() (uint64, error)
+	QueueRead(f func(err error)) error
+	SnapshotTransfer() *SnapshotTransferInfo
 	Current() bool
 	Healthy() bool
 	Term() uint64
@@ -169,12 +175,24 @@ type raft struct {
 	asubj  string
 	areply string
 
+	// Heartbeats sent to confirm our leadership for a read, and the reads waiting on each.
+	rireply string
+	riseq   uint64
+	rireqs  map[uint64]*readIndexReq
+
+	// Reads queued to run once our leadership is confirmed, see QueueRead.
+	rdq []func(err error)
+	rdw bool
+
 	sq    *sendq
 	aesub *subscription
 
 	// Are we doing a leadership transfer.
 	lxfer bool
 
+	// Are we in the pre-vote phase of a campaign.
+	pvote bool
+
 	// For holding term and vote and peerstate to be written.
 	wtv   []byte
 	wps   []byte
@@ -184,6 +202,16 @@ type raft struct {
 	// For when we need to catch up as a follower.
 	catchup *catchupState
 
+	// For when we pull a large snapshot from our leader in chunks, and the last one we completed.
+	sxfer     *snapXfer
+	sxferLast *SnapshotTransferInfo
+	// Where followers request snapshot chunks from us, and the requests for each transfer we serve.
+	sreq  string
+	ssend map[string]chan snapChunkReq
+
+	// Recent votes we have cast, shown in raftz.
+	vhist []*RaftzVote
+
 	// For leader or server catching up a follower.
 	progress map[string]*ipQueue // of uint64
 
@@ -236,7 +264,7 @@ const (
 	hbIntervalDefault              = 1 * time.Second
 	lostQuorumIntervalDefault      = hbIntervalDefault * 10 // 10 seconds
 	lostQuorumCheckIntervalDefault = hbIntervalDefault * 10 // 10 seconds
-
+	readIndexTimeoutDefault        = hbIntervalDefault * 2  // 2 seconds
 )
 
 var (
@@ -247,6 +275,7 @@ var (
 	hbInterval         = hbIntervalDefault
 	lostQuorumInterval = lostQuorumIntervalDefault
 	lostQuorumCheck    = lostQuorumCheckIntervalDefault
+	readIndexTimeout   = readIndexTimeoutDefault
 )
 
 type RaftConfig struct {
@@ -275,6 +304,9 @@ var (
 	errLeaderLen         = fmt.Errorf("raft: leader should be exactly %d bytes", idLen)
 	errTooManyEntries    = errors.New("raft: append entry can contain a max of 64k entries")
 	errBadAppendEntry    = errors.New("raft: append entry corrupt")
+	errReadIndexTimeout  = errors.New("raft: timeout confirming leadership for read")
+	errReadQueueFull     = errors.New("raft: too many reads waiting to confirm leadership")
+	errBadSnapshotOffer  = errors.New("raft: snapshot offer corrupt")
 )
 
 // This will bootstrap a raftNode by writing its config into the store directory.
@@ -546,6 +578,26 @@ func (s *Server) numRaftNodes() int {
 	return len(s.raftNodes)
 }
 
+// Returns how many stream and consumer groups we are the leader of.
+func (s *Server) numRaftLeaders() int {
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	for group, n := range s.raftNodes {
+		if group != defaultMetaGroupName {
+			nodes = append(nodes, n)
+		}
+	}
+	s.rnMu.RUnlock()
+
+	var leaders int
+	for _, n := range nodes {
+		if n.Leader() {
+			leaders++
+		}
+	}
+	return leaders
+}
+
 func (s *Server) lookupRaftNode(group string) RaftNode {
 	s.rnMu.RLock()
 	defer s.rnMu.RUnlock()
@@ -858,6 +910,9 @@ func (n *raft) Applied(index uint64) (entries uint64, bytes uint64) {
 	// Ignore if already applied.
 	if index > n.applied {
 		n.applied = index
+		if len(n.rireqs) > 0 {
+			n.checkReadIndexes()
+		}
 	}
 	var state StreamState
 	n.wal.FastState(&state)
@@ -876,6 +931,8 @@ type snapshot struct {
 	lastIndex uint64
 	peerstate []byte
 	data      []byte
+	// Checksum when loaded.
+	hash []byte
 }
 
 const minSnapshotLen = 28
@@ -1096,10 +1153,20 @@ func (n *raft) loadLastSnapshot() (*snapshot, error) {
 		n.snapfile = _EMPTY_
 		return nil, err
 	}
-	if len(buf) < minSnapshotLen {
-		n.warn("Snapshot corrupt, too short")
+	snap, err := n.decodeSnapshot(buf)
+	if err != nil {
 		os.Remove(n.snapfile)
 		n.snapfile = _EMPTY_
+		return nil, err
+	}
+	return snap, nil
+}
+
+// decodeSnapshot will check and decode an encoded snapshot.
+// Lock should be held.
+func (n *raft) decodeSnapshot(buf []byte) (*snapshot, error) {
+	if len(buf) < minSnapshotLen {
+		n.warn("Snapshot corrupt, too short")
 		return nil, errSnapshotCorrupt
 	}
 
@@ -1110,8 +1177,6 @@ func (n *raft) loadLastSnapshot() (*snapshot, error) {
 	n.hh.Write(buf[:hoff])
 	if !bytes.Equal(lchk[:], n.hh.Sum(nil)) {
 		n.warn("Snapshot corrupt, checksums did not match")
-		os.Remove(n.snapfile)
-		n.snapfile = _EMPTY_
 		return nil, errSnapshotCorrupt
 	}
 
@@ -1122,14 +1187,13 @@ func (n *raft) loadLastSnapshot() (*snapshot, error) {
 		lastIndex: le.Uint64(buf[8:]),
 		peerstate: buf[20 : 20+lps],
 		data:      buf[20+lps : hoff],
+		hash:      lchk,
 	}
 
 	// We had a bug in 2.9.12 that would allow snapshots on last index of 0.
 	// Detect that here and return err.
 	if snap.lastIndex == 0 {
 		n.warn("Snapshot with last index 0 is invalid, cleaning up")
-		os.Remove(n.snapfile)
-		n.snapfile = _EMPTY_
 		return nil, errSnapshotCorrupt
 	}
 
@@ -1483,6 +1547,7 @@ func (n *raft) shutdown(shouldDelete bool) {
 		os.Remove(filepath.Join(n.sd, peerStateFile))
 		os.Remove(filepath.Join(n.sd, termVoteFile))
 		os.RemoveAll(filepath.Join(n.sd, snapshotsDir))
+		os.RemoveAll(filepath.Join(n.sd, snapXferDir))
 	}
 	// Unregistering ipQueues do not prevent them from push/pop
 	// just will remove them from the central monitoring map
@@ -1570,8 +1635,10 @@ func (n *raft) createInternalSubs() error {
 	defer n.Unlock()
 	n.vsubj, n.vreply = fmt.Sprintf(raftVoteSubj, n.group), n.newInbox()
 	n.asubj, n.areply = fmt.Sprintf(raftAppendSubj, n.group), n.newInbox()
+	n.rireply = n.newInbox()
 	n.psubj = fmt.Sprintf(raftPropSubj, n.group)
 	n.rpsubj = fmt.Sprintf(raftRemovePeerSubj, n.group)
+	n.sreq = n.newInbox()
 
 	// Votes
 	if _, err := n.subscribe(n.vreply, n.handleVoteResponse); err != nil {
@@ -1584,11 +1651,18 @@ func (n *raft) createInternalSubs() error {
 	if _, err := n.subscribe(n.areply, n.handleAppendEntryResponse); err != nil {
 		return err
 	}
+	if _, err := n.subscribe(n.rireply+".*.*", n.handleReadIndexResponse); err != nil {
+		return err
+	}
 	if sub, err := n.subscribe(n.asubj, n.handleAppendEntry); err != nil {
 		return err
 	} else {
 		n.aesub = sub
 	}
+	// Snapshot chunks
+	if _, err := n.subscribe(n.sreq, n.handleSnapshotChunkRequest); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -1812,6 +1886,7 @@ const (
 	EntryRemovePeer
 	EntryLeaderTransfer
 	EntrySnapshot
+	EntrySnapshotOffer
 )
 
 func (t EntryType) String() string {
@@ -1830,6 +1905,8 @@ func (t EntryType) String() string {
 		return "LeaderTransfer"
 	case EntrySnapshot:
 		return "Snapshot"
+	case EntrySnapshotOffer:
+		return "SnapshotOffer"
 	}
 	return fmt.Sprintf("Unknown [%d]", uint8(t))
 }
@@ -2139,6 +2216,158 @@ func (n *raft) Quorum() bool {
 	return false
 }
 
+// A read waiting to confirm our leadership, see ReadIndex.
+type readIndexReq struct {
+	// Index we need to have applied.
+	index uint64
+	// Peers that responded to our heartbeat.
+	acks map[string]struct{}
+	// Signalled once confirmed, or with the reason we could not.
+	done chan error
+}
+
+// ReadIndex confirms we are still the leader so reads can be linearizable. We send a heartbeat
+// and wait for a quorum to respond to it, and then wait until everything in our log at the time
+// of the call has been committed and applied. Returns that index.
+func (n *raft) ReadIndex() (uint64, error) {
+	n.Lock()
+	if n.state != Leader {
+		n.Unlock()
+		return 0, errNotLeader
+	}
+	term, ri := n.term, n.pindex
+	// Tag our heartbeat so we only count responses to it, and not ones that were already in flight.
+	n.riseq++
+	seq := n.riseq
+	if n.rireqs == nil {
+		n.rireqs = make(map[uint64]*readIndexReq)
+	}
+	req := &readIndexReq{index: ri, acks: map[string]struct{}{n.id: {}}, done: make(chan error, 1)}
+	n.rireqs[seq] = req
+	n.sendHeartbeatWithReply(fmt.Sprintf("%s.%d.%d", n.rireply, term, seq))
+	// We may be on our own.
+	n.checkReadIndexes()
+	n.Unlock()
+
+	timeout := time.NewTimer(readIndexTimeout)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case err = <-req.done:
+		if err == nil {
+			return ri, nil
+		}
+		return 0, err
+	case <-timeout.C:
+		err = errReadIndexTimeout
+	case <-n.quit:
+		err = errNodeClosed
+	}
+	n.Lock()
+	delete(n.rireqs, seq)
+	n.Unlock()
+	return 0, err
+}
+
+// Maximum number of reads we will queue waiting to confirm our leadership.
+const maxQueuedReads = 8192
+
+// QueueRead will call f once we have confirmed our leadership with ReadIndex, or with the
+// reason we could not. Reads are handled in order by a single Go routine per node, and all
+// reads queued while waiting on a confirmation are served by the next one.
+// Returns an error without calling f if too many reads are waiting or we are shutting down.
+func (n *raft) QueueRead(f func(err error)) error {
+	n.Lock()
+	defer n.Unlock()
+	if len(n.rdq) >= maxQueuedReads {
+		return errReadQueueFull
+	}
+	if !n.rdw {
+		if !n.s.startGoRoutine(n.runReads) {
+			return errNodeClosed
+		}
+		n.rdw = true
+	}
+	n.rdq = append(n.rdq, f)
+	return nil
+}
+
+// Confirm our leadership for our queued reads until we have none left.
+func (n *raft) runReads() {
+	defer n.s.grWG.Done()
+	for {
+		n.Lock()
+		reads := n.rdq
+		if len(reads) == 0 {
+			n.rdq, n.rdw = nil, false
+			n.Unlock()
+			return
+		}
+		n.rdq = nil
+		n.Unlock()
+
+		_, err := n.ReadIndex()
+		for _, f := range reads {
+			f(err)
+		}
+	}
+}
+
+// Signal any reads that have been confirmed by a quorum and whose index we have applied.
+// Lock should be held.
+func (n *raft) checkReadIndexes() {
+	for seq, req := range n.rireqs {
+		if len(req.acks) >= n.qn && n.applied >= req.index {
+			req.done <- nil
+			delete(n.rireqs, seq)
+		}
+	}
+}
+
+// Fail any reads that are waiting to confirm our leadership.
+// Lock should be held.
+func (n *raft) failReadIndexes(err error) {
+	for seq, req := range n.rireqs {
+		req.done <- err
+		delete(n.rireqs, seq)
+	}
+}
+
+// Responses to a heartbeat sent for ReadIndex. The subject holds the term and sequence of the heartbeat.
+func (n *raft) handleReadIndexResponse(sub *subscription, c *client, acc *Account, subject, reply string, msg []byte) {
+	ar := n.decodeAppendEntryResponse(msg)
+	if ar == nil {
+		return
+	}
+	// These are regular responses as well.
+	n.handleAppendEntryResponse(sub, c, acc, subject, reply, msg)
+	if !ar.success {
+		return
+	}
+	tsa := [32]string{}
+	tokens := tokenizeSubjectIntoSlice(tsa[:0], subject)
+	if len(tokens) < 2 {
+		return
+	}
+	term, seq := parseInt64([]byte(tokens[len(tokens)-2])), parseInt64([]byte(tokens[len(tokens)-1]))
+	if term < 0 || seq < 0 {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if n.state != Leader || n.term != uint64(term) {
+		return
+	}
+	if req := n.rireqs[uint64(seq)]; req != nil {
+		if _, ok := n.peers[ar.peer]; ok {
+			req.acks[ar.peer] = struct{}{}
+			n.checkReadIndexes()
+		}
+	}
+}
+
 func (n *raft) lostQuorum() bool {
 	n.RLock()
 	defer n.RUnlock()
@@ -2277,16 +2506,25 @@ func (n *raft) runCatchup(ar *appendEntryResponse, indexUpdatesQ *ipQueue /* of
 	}
 }
 
+// Returns true if we offered the snapshot for the follower to pull in chunks instead.
 // Lock should be held.
-func (n *raft) sendSnapshotToFollower(subject string) (uint64, error) {
+func (n *raft) sendSnapshotToFollower(peer, subject string) (uint64, bool, error) {
 	snap, err := n.loadLastSnapshot()
 	if err != nil {
 		// We need to stepdown here when this happens.
 		n.stepdown.push(noLeader)
-		return 0, err
+		return 0, false, err
 	}
 	// Go ahead and send the snapshot and peerstate here as first append entry to the catchup follower.
 	ae := n.buildAppendEntry([]*Entry{{EntrySnapshot, snap.data}, {EntryPeerState, snap.peerstate}})
+
+	// If this is too large to send in one go we offer it instead, as long as the follower knows how to pull it.
+	var offered bool
+	if size := minSnapshotLen + len(snap.peerstate) + len(snap.data); size > snapChunkSize && n.peerSupportsSnapshotOffer(peer) {
+		so := &snapshotOffer{term: snap.lastTerm, index: snap.lastIndex, size: uint64(size), hash: snap.hash, subj: n.sreq}
+		ae.entries[0] = &Entry{EntrySnapshotOffer, so.encode()}
+		offered = true
+	}
 	ae.pterm, ae.pindex = snap.lastTerm, snap.lastIndex
 	var state StreamState
 	n.wal.FastState(&state)
@@ -2299,10 +2537,567 @@ func (n *raft) sendSnapshotToFollower(subject string) (uint64, error) {
 
 	encoding, err := ae.encode(nil)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 	n.sendRPC(subject, n.areply, encoding)
-	return snap.lastIndex, nil
+	return snap.lastIndex, offered, nil
+}
+
+// Servers before this version do not understand snapshot offers.
+var snapOfferMinVersion = [3]int{2, 10, 0}
+
+// Returns true if the peer is known to be able to pull a snapshot we offer.
+func (n *raft) peerSupportsSnapshotOffer(peer string) bool {
+	return n.s != nil && n.s.peerVersionAtLeast(peer, snapOfferMinVersion[0], snapOfferMinVersion[1], snapOfferMinVersion[2])
+}
+
+const (
+	snapXferDir   = "snapxfer"
+	snapXferFileT = "snap.%d.%d.%d.%x"
+	// How many chunks we will have outstanding when pulling a snapshot.
+	snapChunkWindow = 4
+	// How many times we will retry a stalled snapshot transfer before giving up.
+	snapXferMaxRetries = 5
+)
+
+// snapChunkReq is a request from a follower for a chunk of our snapshot.
+type snapChunkReq struct {
+	term   uint64
+	index  uint64
+	offset uint64
+}
+
+var (
+	snapChunkSize    = 256 * 1024
+	snapChunkTimeout = 2 * time.Second
+)
+
+// SnapshotTransferInfo shows the progress of pulling a snapshot from our leader in chunks.
+type SnapshotTransferInfo struct {
+	Peer        string    `json:"peer"`
+	Term        uint64    `json:"term"`
+	Index       uint64    `json:"index"`
+	Size        uint64    `json:"size"`
+	Received    uint64    `json:"received"`
+	ResumedFrom uint64    `json:"resumed_from,omitempty"`
+	Started     time.Time `json:"started"`
+	Completed   time.Time `json:"completed,omitempty"`
+}
+
+// snapshotOffer is sent to a catching up follower in place of a large snapshot.
+// The follower will pull the encoded snapshot in chunks from subj.
+type snapshotOffer struct {
+	term  uint64
+	index uint64
+	size  uint64
+	hash  []byte
+	subj  string
+}
+
+const snapshotOfferBaseLen = 32
+
+func (so *snapshotOffer) encode() []byte {
+	var le = binary.LittleEndian
+	buf := make([]byte, snapshotOfferBaseLen+len(so.subj))
+	le.PutUint64(buf[0:], so.term)
+	le.PutUint64(buf[8:], so.index)
+	le.PutUint64(buf[16:], so.size)
+	copy(buf[24:32], so.hash)
+	copy(buf[32:], so.subj)
+	return buf
+}
+
+func decodeSnapshotOffer(buf []byte) (*snapshotOffer, error) {
+	if len(buf) <= snapshotOfferBaseLen {
+		return nil, errBadSnapshotOffer
+	}
+	var le = binary.LittleEndian
+	return &snapshotOffer{
+		term:  le.Uint64(buf[0:]),
+		index: le.Uint64(buf[8:]),
+		size:  le.Uint64(buf[16:]),
+		hash:  copyBytes(buf[24:32]),
+		subj:  string(buf[32:]),
+	}, nil
+}
+
+// A request for a chunk of the snapshot with the given term and index, and the response.
+const (
+	snapChunkRequestLen = 24
+	snapChunkHdrLen     = 12
+)
+
+func encodeSnapshotChunkRequest(term, index, offset uint64) []byte {
+	var buf [snapChunkRequestLen]byte
+	var le = binary.LittleEndian
+	le.PutUint64(buf[0:], term)
+	le.PutUint64(buf[8:], index)
+	le.PutUint64(buf[16:], offset)
+	return buf[:]
+}
+
+// Returns the offset and data for a chunk, and false if this is an error or corrupt.
+func decodeSnapshotChunk(buf []byte) (uint64, []byte, bool) {
+	if len(buf) <= snapChunkHdrLen {
+		return 0, nil, false
+	}
+	var le = binary.LittleEndian
+	offset, data := le.Uint64(buf[0:]), buf[snapChunkHdrLen:]
+	if crc32.ChecksumIEEE(data) != le.Uint32(buf[8:]) {
+		return 0, nil, false
+	}
+	return offset, data, true
+}
+
+// handleSnapshotChunkRequest is where a follower pulling a snapshot we offered asks for the next chunk.
+func (n *raft) handleSnapshotChunkRequest(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+	if len(msg) != snapChunkRequestLen || reply == _EMPTY_ {
+		return
+	}
+	var le = binary.LittleEndian
+	req := snapChunkReq{le.Uint64(msg[0:]), le.Uint64(msg[8:]), le.Uint64(msg[16:])}
+
+	// Do not block the caller on disk IO. Each transfer has its own reply subject, and we serve
+	// those with a single worker. Followers keep at most snapChunkWindow requests outstanding,
+	// anything beyond that is dropped and will be requested again.
+	n.Lock()
+	defer n.Unlock()
+	reqs := n.ssend[reply]
+	if reqs == nil {
+		reqs = make(chan snapChunkReq, snapChunkWindow)
+		if !n.s.startGoRoutine(func() { n.runSnapshotSender(reply, reqs) }) {
+			return
+		}
+		if n.ssend == nil {
+			n.ssend = make(map[string]chan snapChunkReq)
+		}
+		n.ssend[reply] = reqs
+	}
+	select {
+	case reqs <- req:
+	default:
+	}
+}
+
+// runSnapshotSender serves the chunk requests for a single snapshot transfer, and exits
+// once the follower stops asking.
+func (n *raft) runSnapshotSender(reply string, reqs chan snapChunkReq) {
+	defer n.s.grWG.Done()
+
+	idle := time.NewTimer(2 * snapChunkTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case req := <-reqs:
+			n.sendSnapshotChunk(req.term, req.index, req.offset, reply)
+			idle.Reset(2 * snapChunkTimeout)
+		case <-idle.C:
+			n.Lock()
+			// A request may have come in while we timed out.
+			if len(reqs) > 0 {
+				n.Unlock()
+				idle.Reset(2 * snapChunkTimeout)
+				continue
+			}
+			delete(n.ssend, reply)
+			n.Unlock()
+			return
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// Send a chunk of our snapshot. We send an empty response if this is no longer our snapshot.
+func (n *raft) sendSnapshotChunk(term, index, offset uint64, reply string) {
+	n.RLock()
+	sfile := n.snapfile
+	n.RUnlock()
+
+	var resp []byte
+	if st, si, err := termAndIndexFromSnapFile(sfile); err == nil && st == term && si == index {
+		if f, err := os.Open(sfile); err == nil {
+			buf := make([]byte, snapChunkHdrLen+snapChunkSize)
+			nr, err := f.ReadAt(buf[snapChunkHdrLen:], int64(offset))
+			f.Close()
+			if nr > 0 && (err == nil || err == io.EOF) {
+				var le = binary.LittleEndian
+				le.PutUint64(buf[0:], offset)
+				le.PutUint32(buf[8:], crc32.ChecksumIEEE(buf[snapChunkHdrLen:snapChunkHdrLen+nr]))
+				resp = buf[:snapChunkHdrLen+nr]
+			}
+		}
+	}
+	n.sendReply(reply, resp)
+}
+
+// snapXfer is the state for pulling a snapshot from our leader in chunks.
+type snapXfer struct {
+	offer     *snapshotOffer
+	path      string
+	f         *os.File
+	received  uint64
+	resumed   uint64
+	started   time.Time
+	leader    string
+	pterm     uint64
+	pindex    uint64
+	peerstate []byte
+	inbox     string
+	sub       *subscription
+	chunks    *ipQueue // of []byte
+	quit      chan struct{}
+}
+
+// Start pulling the snapshot our leader offered. If we have part of it from an earlier
+// attempt we resume from there.
+// Lock should be held.
+func (n *raft) startSnapshotTransfer(so *snapshotOffer, ae *appendEntry) {
+	if x := n.sxfer; x != nil {
+		if x.offer.term == so.term && x.offer.index == so.index && x.offer.size == so.size && bytes.Equal(x.offer.hash, so.hash) {
+			// Already pulling this one, our leader offered it again after we asked to catch up again.
+			x.offer.subj = so.subj
+			return
+		}
+		n.stopSnapshotTransfer()
+	}
+
+	dir := filepath.Join(n.sd, snapXferDir)
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		n.warn("Could not create snapshot transfer directory: %v", err)
+		n.cancelCatchup()
+		return
+	}
+	name := fmt.Sprintf(snapXferFileT, so.term, so.index, so.size, so.hash)
+	// Remove anything partial from another snapshot.
+	if fis, _ := os.ReadDir(dir); len(fis) > 0 {
+		for _, fi := range fis {
+			if fi.Name() != name {
+				os.Remove(filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, defaultFilePerms)
+	if err != nil {
+		n.warn("Could not create snapshot transfer file: %v", err)
+		n.cancelCatchup()
+		return
+	}
+	var received uint64
+	if fi, err := f.Stat(); err == nil && uint64(fi.Size()) <= so.size {
+		received = uint64(fi.Size())
+	} else {
+		f.Truncate(0)
+	}
+
+	x := &snapXfer{
+		offer:     so,
+		path:      path,
+		f:         f,
+		received:  received,
+		resumed:   received,
+		started:   time.Now().UTC(),
+		leader:    ae.leader,
+		pterm:     ae.pterm,
+		pindex:    ae.pindex,
+		peerstate: copyBytes(ae.entries[1].Data),
+		inbox:     n.newInbox(),
+		chunks:    n.s.newIPQueue(fmt.Sprintf("[ACC:%s] RAFT '%s' snapshot chunks", n.accName, n.group)),
+		quit:      make(chan struct{}),
+	}
+	x.sub, err = n.subscribe(x.inbox, func(_ *subscription, _ *client, _ *Account, _, _ string, msg []byte) {
+		x.chunks.push(copyBytes(msg))
+	})
+	if err != nil {
+		f.Close()
+		x.chunks.unregister()
+		n.cancelCatchup()
+		return
+	}
+	if received > 0 {
+		n.debug("Resuming snapshot transfer of %d bytes at offset %d", so.size, received)
+	} else {
+		n.debug("Starting snapshot transfer of %d bytes", so.size)
+	}
+	n.sxfer = x
+	if !n.s.startGoRoutine(func() { n.runSnapshotTransfer(x) }) {
+		// We are shutting down, nothing we have so far is of use.
+		n.stopSnapshotTransfer()
+		f.Close()
+		x.chunks.unregister()
+		os.Remove(path)
+		n.cancelCatchup()
+	}
+}
+
+// Stop a snapshot transfer. We keep what we have received so we can resume.
+// Lock should be held.
+func (n *raft) stopSnapshotTransfer() {
+	if x := n.sxfer; x != nil {
+		close(x.quit)
+		n.unsubscribe(x.sub)
+		n.sxfer = nil
+	}
+}
+
+// runSnapshotTransfer pulls the offered snapshot in chunks, keeping a window of requests
+// outstanding, and installs it once complete.
+func (n *raft) runSnapshotTransfer(x *snapXfer) {
+	defer n.s.grWG.Done()
+	defer func() {
+		x.f.Close()
+		x.chunks.unregister()
+		n.Lock()
+		if n.sxfer == x {
+			n.stopSnapshotTransfer()
+		}
+		n.Unlock()
+	}()
+
+	size, csz := x.offer.size, uint64(snapChunkSize)
+	n.RLock()
+	next, received := x.received, x.received
+	n.RUnlock()
+	pending := make(map[uint64][]byte)
+
+	request := func() {
+		n.RLock()
+		subj := x.offer.subj
+		n.RUnlock()
+		for next < size && next < received+snapChunkWindow*csz {
+			n.sendRPC(subj, x.inbox, encodeSnapshotChunkRequest(x.offer.term, x.offer.index, next))
+			next += csz
+		}
+	}
+	// Give up for now, we will resume when our leader offers this again.
+	abort := func() {
+		n.Lock()
+		if n.sxfer == x {
+			n.cancelCatchup()
+		}
+		n.Unlock()
+	}
+
+	request()
+
+	timeout := time.NewTimer(snapChunkTimeout)
+	defer timeout.Stop()
+	var retries int
+
+	for {
+		select {
+		case <-n.s.quitCh:
+			return
+		case <-n.quit:
+			return
+		case <-x.quit:
+			return
+		case <-timeout.C:
+			if retries++; retries > snapXferMaxRetries {
+				n.warn("Snapshot transfer stalled at %d of %d bytes", received, size)
+				abort()
+				return
+			}
+			// Request again from what we have written.
+			n.debug("Snapshot transfer stalled, resuming at offset %d", received)
+			pending, next = make(map[uint64][]byte), received
+			request()
+			timeout.Reset(snapChunkTimeout)
+		case <-x.chunks.ch:
+			chunks := x.chunks.pop()
+			for _, m := range chunks {
+				offset, data, ok := decodeSnapshotChunk(m.([]byte))
+				if !ok {
+					n.warn("Snapshot transfer received bad chunk, will retry")
+					x.chunks.recycle(&chunks)
+					abort()
+					return
+				}
+				if offset >= received && offset < size {
+					pending[offset] = data
+				}
+			}
+			x.chunks.recycle(&chunks)
+
+			// Write out what we can in order.
+			start := received
+			for data, ok := pending[received]; ok; data, ok = pending[received] {
+				if _, err := x.f.WriteAt(data, int64(received)); err != nil {
+					n.warn("Error writing snapshot transfer: %v", err)
+					abort()
+					return
+				}
+				delete(pending, received)
+				received += uint64(len(data))
+			}
+			if received == start {
+				continue
+			}
+			n.Lock()
+			x.received = received
+			// Let our catchup logic know we are making progress.
+			if n.catchup != nil {
+				n.catchup.active = time.Now()
+			}
+			n.Unlock()
+
+			if received >= size {
+				n.installSnapshotTransfer(x)
+				return
+			}
+			retries = 0
+			timeout.Reset(snapChunkTimeout)
+			request()
+		}
+	}
+}
+
+// Install a snapshot we have pulled, the same as if our leader had sent it to us directly.
+func (n *raft) installSnapshotTransfer(x *snapXfer) {
+	if err := x.f.Sync(); err != nil {
+		n.warn("Error syncing snapshot transfer: %v", err)
+	}
+	buf, err := os.ReadFile(x.path)
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.sxfer != x || n.catchup == nil {
+		return
+	}
+	var snap *snapshot
+	if err == nil {
+		snap, err = n.decodeSnapshot(buf)
+	}
+	if err == nil && !bytes.Equal(snap.hash, x.offer.hash) {
+		err = errSnapshotCorrupt
+	}
+	if err != nil {
+		n.warn("Snapshot transfer failed: %v", err)
+		os.Remove(x.path)
+		n.cancelCatchup()
+		return
+	}
+	ps, err := decodePeerState(x.peerstate)
+	if err != nil {
+		n.warn("Could not parse snapshot peerstate correctly")
+		n.cancelCatchup()
+		return
+	}
+	n.processPeerState(ps)
+
+	n.pindex = x.pindex
+	n.pterm = x.pterm
+	n.commit = x.pindex
+
+	if _, err := n.wal.Compact(n.pindex); err != nil {
+		n.setWriteErrLocked(err)
+		return
+	}
+	n.debug("Installing snapshot of %d bytes from transfer", x.offer.size)
+	n.apply.push(&CommittedEntry{n.commit, []*Entry{{EntrySnapshot, snap.data}}})
+
+	n.sxferLast = x.info()
+	n.sxferLast.Received, n.sxferLast.Completed = x.offer.size, time.Now().UTC()
+	os.Remove(x.path)
+
+	// Our leader will catch us up from here on its next append entry.
+	n.cancelCatchup()
+}
+
+// Lock should be held.
+func (x *snapXfer) info() *SnapshotTransferInfo {
+	return &SnapshotTransferInfo{
+		Peer:        x.leader,
+		Term:        x.offer.term,
+		Index:       x.offer.index,
+		Size:        x.offer.size,
+		Received:    x.received,
+		ResumedFrom: x.resumed,
+		Started:     x.started,
+	}
+}
+
+// raftz returns the internal state of this group for raftz.
+func (n *raft) raftz(now time.Time) *RaftzGroup {
+	n.RLock()
+	defer n.RUnlock()
+
+	var state StreamState
+	n.wal.FastState(&state)
+
+	rg := &RaftzGroup{
+		Name:     n.group,
+		ID:       n.id,
+		State:    n.state.String(),
+		Leader:   n.leader,
+		Term:     n.term,
+		Vote:     n.vote,
+		PTerm:    n.pterm,
+		PIndex:   n.pindex,
+		Commit:   n.commit,
+		Applied:  n.applied,
+		WALMsgs:  state.Msgs,
+		WALBytes: state.Bytes,
+		Observer: n.observer,
+		Paused:   n.paused,
+	}
+	if n.werr != nil {
+		rg.WriteErr = n.werr.Error()
+	}
+	if n.catchup != nil {
+		rg.CatchingUp = true
+	}
+	for id, ps := range n.peers {
+		if id == n.id {
+			continue
+		}
+		rp := &RaftzPeer{ID: id, Index: ps.li}
+		if n.commit > ps.li {
+			rp.Lag = n.commit - ps.li
+		}
+		if ps.ts > 0 {
+			rp.LastContact = now.Sub(time.Unix(0, ps.ts))
+		}
+		rg.Peers = append(rg.Peers, rp)
+	}
+	sort.Slice(rg.Peers, func(i, j int) bool { return rg.Peers[i].ID < rg.Peers[j].ID })
+	for _, v := range n.vhist {
+		vote := *v
+		rg.Votes = append(rg.Votes, &vote)
+	}
+	if n.snapfile != _EMPTY_ {
+		if _, si, err := termAndIndexFromSnapFile(n.snapfile); err == nil {
+			rg.SnapshotIndex = si
+		}
+		if fi, err := os.Stat(n.snapfile); err == nil {
+			rg.SnapshotAge = now.Sub(fi.ModTime())
+		}
+	}
+	if n.sxfer != nil {
+		rg.SnapshotTransfer = n.sxfer.info()
+	} else if n.sxferLast != nil {
+		sti := *n.sxferLast
+		rg.SnapshotTransfer = &sti
+	}
+	return rg
+}
+
+// SnapshotTransfer returns the progress of pulling a snapshot from our leader,
+// or the last one we completed.
+func (n *raft) SnapshotTransfer() *SnapshotTransferInfo {
+	n.RLock()
+	defer n.RUnlock()
+	if n.sxfer != nil {
+		return n.sxfer.info()
+	}
+	if n.sxferLast != nil {
+		sti := *n.sxferLast
+		return &sti
+	}
+	return nil
 }
 
 func (n *raft) catchupFollower(ar *appendEntryResponse) {
@@ -2323,10 +3118,15 @@ func (n *raft) catchupFollower(ar *appendEntryResponse) {
 
 	if start < state.FirstSeq || (state.Msgs == 0 && start <= state.LastSeq) {
 		n.debug("Need to send snapshot to follower")
-		if lastIndex, err := n.sendSnapshotToFollower(ar.reply); err != nil {
+		if lastIndex, offered, err := n.sendSnapshotToFollower(ar.peer, ar.reply); err != nil {
 			n.error("Error sending snapshot to follower [%s]: %v", ar.peer, err)
 			n.Unlock()
 			return
+		} else if offered {
+			// The follower will pull the snapshot in chunks, and ask us to catch it up again once installed.
+			n.debug("Offered snapshot to follower, will pull in chunks")
+			n.Unlock()
+			return
 		} else {
 			start = lastIndex + 1
 			// If no other entries, we can just return here.
@@ -2488,6 +3288,9 @@ func (n *raft) applyCommit(index uint64) error {
 	} else {
 		// If we processed inline update our applied index.
 		n.applied = index
+		if len(n.rireqs) > 0 {
+			n.checkReadIndexes()
+		}
 	}
 	return nil
 }
@@ -2619,14 +3422,26 @@ func (n *raft) runAsCandidate() {
 				continue
 			}
 			n.RLock()
-			nterm := n.term
+			nterm, pvote := n.term, n.pvote
 			n.RUnlock()
 
+			// Ignore responses for a phase of our campaign we are no longer in.
+			if vresp.prevote != pvote {
+				continue
+			}
+
 			if vresp.granted && nterm >= vresp.term {
 				// only track peers that would be our followers
 				n.trackPeer(vresp.peer)
 				votes++
 				if n.wonElection(votes) {
+					if pvote {
+						// A quorum would vote for us, so now we can bump our term and hold the real election.
+						n.startElection()
+						n.requestVote()
+						votes = 1
+						continue
+					}
 					// Become LEADER if we have won and gotten a quorum with everyone we should hear from.
 					n.switchToLeader()
 					return
@@ -2678,6 +3493,8 @@ func (n *raft) cancelCatchup() {
 		n.unsubscribe(n.catchup.sub)
 	}
 	n.catchup = nil
+	// Anything we have pulled of a snapshot is kept so we can resume.
+	n.stopSnapshotTransfer()
 }
 
 // catchupStalled will try to determine if we are stalled. This is called
@@ -2914,6 +3731,18 @@ func (n *raft) processAppendEntry(ae *appendEntry, sub *subscription) {
 				n.Unlock()
 				return
 			}
+			// Large snapshots are offered to us to pull in chunks.
+			if len(ae.entries) == 2 && ae.entries[0].Type == EntrySnapshotOffer && ae.entries[1].Type == EntryPeerState {
+				if so, err := decodeSnapshotOffer(ae.entries[0].Data); err == nil {
+					n.startSnapshotTransfer(so, ae)
+				} else {
+					n.warn("Could not parse snapshot offer correctly")
+					n.cancelCatchup()
+				}
+				n.Unlock()
+				return
+			}
+
 			// This means we already entered into a catchup state but what the leader sent us did not match what we expected.
 			// Snapshots and peerstate will always be together when a leader is catching us up in this fashion.
 			if len(ae.entries) != 2 || ae.entries[0].Type != EntrySnapshot || ae.entries[1].Type != EntryPeerState {
@@ -3086,9 +3915,11 @@ func (n *raft) handleAppendEntryResponse(sub *subscription, c *client, _ *Accoun
 	n.resp.push(ar)
 	if ar.success {
 		n.Lock()
-		// Update peer's last index.
-		if ps := n.peers[ar.peer]; ps != nil && ar.index > ps.li {
-			ps.li = ar.index
+		// Update peer's last index and last successful response.
+		if ps := n.peers[ar.peer]; ps != nil {
+			if ar.index > ps.li {
+				ps.li = ar.index
+			}
 		}
 		n.Unlock()
 	}
@@ -3251,30 +4082,51 @@ func (n *raft) sendHeartbeat() {
 	n.sendAppendEntry(nil)
 }
 
+// Send a heartbeat whose responses go to reply instead of our normal inbox.
+// Lock should be held.
+func (n *raft) sendHeartbeatWithReply(reply string) {
+	ae := n.buildAppendEntry(nil)
+	var scratch [1024]byte
+	buf, err := ae.encode(scratch[:])
+	if err != nil {
+		return
+	}
+	n.sendRPC(n.asubj, reply, buf)
+}
+
 type voteRequest struct {
 	term      uint64
 	lastTerm  uint64
 	lastIndex uint64
 	candidate string
+	// A pre-vote asks if a vote would be granted for term, without changing any state.
+	prevote bool
 	// internal only.
 	reply string
 }
 
 const voteRequestLen = 24 + idLen
 
+// Pre-votes carry an extra flag byte.
+const preVoteRequestLen = voteRequestLen + 1
+
 func (vr *voteRequest) encode() []byte {
-	var buf [voteRequestLen]byte
+	var buf [preVoteRequestLen]byte
 	var le = binary.LittleEndian
 	le.PutUint64(buf[0:], vr.term)
 	le.PutUint64(buf[8:], vr.lastTerm)
 	le.PutUint64(buf[16:], vr.lastIndex)
 	copy(buf[24:24+idLen], vr.candidate)
 
+	if vr.prevote {
+		buf[voteRequestLen] = 1
+		return buf[:preVoteRequestLen]
+	}
 	return buf[:voteRequestLen]
 }
 
 func (n *raft) decodeVoteRequest(msg []byte, reply string) *voteRequest {
-	if len(msg) != voteRequestLen {
+	if len(msg) != voteRequestLen && len(msg) != preVoteRequestLen {
 		return nil
 	}
 
@@ -3284,6 +4136,7 @@ func (n *raft) decodeVoteRequest(msg []byte, reply string) *voteRequest {
 		lastTerm:  le.Uint64(msg[8:]),
 		lastIndex: le.Uint64(msg[16:]),
 		candidate: string(copyBytes(msg[24 : 24+idLen])),
+		prevote:   len(msg) == preVoteRequestLen && msg[voteRequestLen] == 1,
 		reply:     reply,
 	}
 }
@@ -3440,12 +4293,16 @@ type voteResponse struct {
 	term    uint64
 	peer    string
 	granted bool
+	prevote bool
 }
 
 const voteResponseLen = 8 + 8 + 1
 
+// Responses to pre-votes carry an extra flag byte.
+const preVoteResponseLen = voteResponseLen + 1
+
 func (vr *voteResponse) encode() []byte {
-	var buf [voteResponseLen]byte
+	var buf [preVoteResponseLen]byte
 	var le = binary.LittleEndian
 	le.PutUint64(buf[0:], vr.term)
 	copy(buf[8:], vr.peer)
@@ -3454,16 +4311,21 @@ func (vr *voteResponse) encode() []byte {
 	} else {
 		buf[16] = 0
 	}
+	if vr.prevote {
+		buf[voteResponseLen] = 1
+		return buf[:preVoteResponseLen]
+	}
 	return buf[:voteResponseLen]
 }
 
 func (n *raft) decodeVoteResponse(msg []byte) *voteResponse {
-	if len(msg) != voteResponseLen {
+	if len(msg) != voteResponseLen && len(msg) != preVoteResponseLen {
 		return nil
 	}
 	var le = binary.LittleEndian
 	vr := &voteResponse{term: le.Uint64(msg[0:]), peer: string(msg[8:16])}
 	vr.granted = msg[16] == 1
+	vr.prevote = len(msg) == preVoteResponseLen && msg[voteResponseLen] == 1
 	return vr
 }
 
@@ -3496,9 +4358,19 @@ func (n *raft) processVoteRequest(vr *voteRequest) error {
 	}
 
 	n.Lock()
+
+	// Pre-votes do not change any of our state, including our election timer.
+	if vr.prevote {
+		vresp := &voteResponse{n.term, n.id, n.wouldGrantPreVote(vr), true}
+		n.Unlock()
+		n.debug("Sending a pre-voteResponse %+v -> %q", vresp, vr.reply)
+		n.sendReply(vr.reply, vresp.encode())
+		return nil
+	}
+
 	n.resetElectionTimeout()
 
-	vresp := &voteResponse{n.term, n.id, false}
+	vresp := &voteResponse{n.term, n.id, false, false}
 	defer n.debug("Sending a voteResponse %+v -> %q", vresp, vr.reply)
 
 	// Ignore if we are newer.
@@ -3526,6 +4398,7 @@ func (n *raft) processVoteRequest(vr *voteRequest) error {
 		n.vote = vr.candidate
 		n.writeTermVote()
 	}
+	n.recordVote(vr.term, vr.candidate, vresp.granted)
 	n.Unlock()
 
 	n.sendReply(vr.reply, vresp.encode())
@@ -3533,6 +4406,47 @@ func (n *raft) processVoteRequest(vr *voteRequest) error {
 	return nil
 }
 
+// How many of our most recent votes we keep for raftz.
+const raftzVoteHistory = 8
+
+// Lock should be held.
+func (n *raft) recordVote(term uint64, candidate string, granted bool) {
+	if len(n.vhist) >= raftzVoteHistory {
+		copy(n.vhist, n.vhist[1:])
+		n.vhist = n.vhist[:len(n.vhist)-1]
+	}
+	n.vhist = append(n.vhist, &RaftzVote{Term: term, Candidate: candidate, Granted: granted, Time: time.Now().UTC()})
+}
+
+// Determine if we would vote for the candidate of a pre-vote. Their log needs to be at least as
+// current as ours, and we must not have heard from another leader recently. The latter keeps a node
+// that was partitioned away from disrupting a healthy leader when it rejoins.
+// Lock should be held.
+func (n *raft) wouldGrantPreVote(vr *voteRequest) bool {
+	if vr.term <= n.term || vr.lastTerm < n.pterm || vr.lastIndex < n.pindex {
+		return false
+	}
+	// If this is from our leader it has stepped down.
+	if vr.candidate == n.leader {
+		return true
+	}
+	return !n.hasLeaderContact()
+}
+
+// Returns true if we are a leader with quorum or have heard from our leader within the
+// minimum election timeout.
+// Lock should be held.
+func (n *raft) hasLeaderContact() bool {
+	if n.state == Leader {
+		return !n.lostQuorumLocked()
+	}
+	if n.leader == noLeader {
+		return false
+	}
+	ps := n.peers[n.leader]
+	return ps != nil && time.Since(time.Unix(0, ps.ts)) < minElectionTimeout
+}
+
 func (n *raft) handleVoteRequest(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
 	vr := n.decodeVoteRequest(msg, reply)
 	if vr == nil {
@@ -3548,9 +4462,15 @@ func (n *raft) requestVote() {
 		n.Unlock()
 		return
 	}
-	n.vote = n.id
-	n.writeTermVote()
-	vr := voteRequest{n.term, n.pterm, n.pindex, n.id, _EMPTY_}
+	vr := voteRequest{n.term, n.pterm, n.pindex, n.id, n.pvote, _EMPTY_}
+	if n.pvote {
+		// Ask for the term we would campaign for, leaving ours and our vote untouched.
+		vr.term++
+	} else {
+		n.vote = n.id
+		n.writeTermVote()
+		n.recordVote(n.term, n.id, true)
+	}
 	subj, reply := n.vsubj, n.vreply
 	n.Unlock()
 
@@ -3616,6 +4536,8 @@ func (n *raft) switchState(state RaftState) {
 		n.updateLeadChange(false)
 		// Drain the response queue.
 		n.resp.drain()
+		// We can no longer confirm reads.
+		n.failReadIndexes(errNotLeader)
 	} else if state == Leader && n.state != Leader {
 		if len(n.pae) > 0 {
 			n.pae = make(map[uint64]*appendEntry)
@@ -3623,6 +4545,11 @@ func (n *raft) switchState(state RaftState) {
 		n.updateLeadChange(true)
 	}
 
+	// Pre-votes only apply while we are a candidate.
+	if state != Candidate {
+		n.pvote = false
+	}
+
 	n.state = state
 	n.writeTermVote()
 }
@@ -3665,13 +4592,50 @@ func (n *raft) switchToCandidate() {
 			n.llqrt = time.Now()
 		}
 	}
-	// Increment the term.
-	n.term++
+	// Unless we are taking over as part of a leadership transfer, we first make sure a quorum
+	// would vote for us before incrementing the term, so we can not force a healthy leader to stepdown.
+	// Older servers drop pre-votes, so we only use them when all of our peers understand them.
+	n.pvote = !n.lxfer && n.peersSupportPreVote()
+	if !n.pvote {
+		// Increment the term.
+		n.term++
+	}
 	// Clear current Leader.
 	n.updateLeader(noLeader)
 	n.switchState(Candidate)
 }
 
+// Servers before this version do not understand pre-votes.
+var preVoteMinVersion = [3]int{2, 10, 0}
+
+// Returns true if all of our peers are known to understand pre-votes.
+// Lock should be held.
+func (n *raft) peersSupportPreVote() bool {
+	if n.s == nil {
+		return false
+	}
+	for peer := range n.peers {
+		if peer != n.id && !n.s.peerVersionAtLeast(peer, preVoteMinVersion[0], preVoteMinVersion[1], preVoteMinVersion[2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// startElection is called once a quorum has granted our pre-vote.
+func (n *raft) startElection() {
+	n.Lock()
+	defer n.Unlock()
+	if n.state != Candidate || !n.pvote {
+		return
+	}
+	n.debug("Won pre-vote, starting election")
+	n.pvote = false
+	// Increment the term.
+	n.term++
+	n.resetElectionTimeout()
+}
+
 func (n *raft) switchToLeader() {
 	n.Lock()
 	if n.state == Closed {
@@ -14,9 +14,13 @@
 package server
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
 )
 
 func TestNRGAppendEntryEncode(t *testing.T) {
@@ -91,3 +95,236 @@ func TestNRGAppendEntryDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestNRGPreVoteEncoding(t *testing.T) {
+	var node *raft
+
+	vr := &voteRequest{term: 22, lastTerm: 21, lastIndex: 100, candidate: "DEREK123"}
+	buf := vr.encode()
+	require_True(t, len(buf) == voteRequestLen)
+	dvr := node.decodeVoteRequest(buf, _EMPTY_)
+	require_True(t, dvr != nil && !dvr.prevote)
+	require_True(t, *dvr == *vr)
+
+	vr.prevote = true
+	buf = vr.encode()
+	require_True(t, len(buf) == preVoteRequestLen)
+	dvr = node.decodeVoteRequest(buf, _EMPTY_)
+	require_True(t, dvr != nil && dvr.prevote)
+	require_True(t, *dvr == *vr)
+	require_True(t, node.decodeVoteRequest(buf[:len(buf)-2], _EMPTY_) == nil)
+
+	vresp := &voteResponse{term: 22, peer: "DEREK123", granted: true}
+	buf = vresp.encode()
+	require_True(t, len(buf) == voteResponseLen)
+	dvresp := node.decodeVoteResponse(buf)
+	require_True(t, dvresp != nil && *dvresp == *vresp)
+
+	vresp.prevote = true
+	buf = vresp.encode()
+	require_True(t, len(buf) == preVoteResponseLen)
+	dvresp = node.decodeVoteResponse(buf)
+	require_True(t, dvresp != nil && *dvresp == *vresp)
+}
+
+func TestNRGPreVoteLeaderStickiness(t *testing.T) {
+	n := &raft{
+		id:     "AAAAAAAA",
+		state:  Follower,
+		term:   5,
+		pterm:  5,
+		pindex: 10,
+		qn:     2,
+		leader: "BBBBBBBB",
+		peers: map[string]*lps{
+			"BBBBBBBB": {ts: time.Now().UnixNano(), kp: true},
+			"CCCCCCCC": {ts: time.Now().UnixNano(), kp: true},
+		},
+	}
+	vr := &voteRequest{term: 6, lastTerm: 5, lastIndex: 10, candidate: "CCCCCCCC", prevote: true}
+
+	// We have heard from our leader recently, so should not grant.
+	require_False(t, n.wouldGrantPreVote(vr))
+
+	// Unless the candidate is our leader, which means it has stepped down.
+	require_True(t, n.wouldGrantPreVote(&voteRequest{term: 6, lastTerm: 5, lastIndex: 10, candidate: "BBBBBBBB", prevote: true}))
+
+	// Lose contact with our leader.
+	n.peers["BBBBBBBB"].ts = time.Now().Add(-2 * minElectionTimeout).UnixNano()
+	require_True(t, n.wouldGrantPreVote(vr))
+
+	// Same with no leader at all.
+	n.leader = noLeader
+	require_True(t, n.wouldGrantPreVote(vr))
+
+	// Candidates behind us in their log or term should not get our vote.
+	require_False(t, n.wouldGrantPreVote(&voteRequest{term: 6, lastTerm: 5, lastIndex: 9, prevote: true}))
+	require_False(t, n.wouldGrantPreVote(&voteRequest{term: 6, lastTerm: 4, lastIndex: 10, prevote: true}))
+	require_False(t, n.wouldGrantPreVote(&voteRequest{term: 5, lastTerm: 5, lastIndex: 10, prevote: true}))
+
+	// A leader with quorum will not grant.
+	n.state, n.leader = Leader, n.id
+	require_False(t, n.wouldGrantPreVote(vr))
+
+	// Once a leader loses quorum it will.
+	n.peers["CCCCCCCC"].ts = time.Now().Add(-2 * lostQuorumInterval).UnixNano()
+	require_True(t, n.wouldGrantPreVote(vr))
+
+	// Processing pre-votes should never change our term, vote or election timer.
+	n.state, n.leader = Follower, noLeader
+	require_NoError(t, n.processVoteRequest(vr))
+	require_True(t, n.term == 5)
+	require_True(t, n.vote == noVote)
+	require_True(t, n.elect == nil)
+
+	// Whereas a real vote does.
+	vr.prevote = false
+	require_NoError(t, n.processVoteRequest(vr))
+	require_True(t, n.term == 6)
+	require_True(t, n.vote == "CCCCCCCC")
+	require_True(t, n.elect != nil)
+	n.elect.Stop()
+}
+
+func TestNRGPreVoteMixedVersions(t *testing.T) {
+	s := &Server{}
+	n := &raft{
+		s:     s,
+		id:    "AAAAAAAA",
+		state: Follower,
+		term:  5,
+		qn:    2,
+		llqrt: time.Now(),
+		peers: map[string]*lps{
+			"AAAAAAAA": {kp: true},
+			"BBBBBBBB": {kp: true},
+			"CCCCCCCC": {kp: true},
+		},
+	}
+	for id := range n.peers {
+		s.nodeToInfo.Store(id, nodeInfo{version: VERSION})
+	}
+	defer func() {
+		if n.elect != nil {
+			n.elect.Stop()
+		}
+	}()
+
+	// All peers understand pre-votes, so our term stays as is until we win one.
+	n.switchToCandidate()
+	require_True(t, n.pvote)
+	require_True(t, n.term == 5)
+
+	// An older peer would drop our pre-vote, so we hold a regular election instead.
+	// This is the version servers report that do not know about pre-votes.
+	s.nodeToInfo.Store("CCCCCCCC", nodeInfo{version: "2.9.15-beta"})
+	n.switchToCandidate()
+	require_False(t, n.pvote)
+	require_True(t, n.term == 6)
+
+	// Same for a peer we know nothing about.
+	s.nodeToInfo.Store("CCCCCCCC", nodeInfo{version: VERSION})
+	n.switchToCandidate()
+	require_True(t, n.pvote)
+	require_True(t, n.term == 6)
+	s.nodeToInfo.Delete("BBBBBBBB")
+	n.switchToCandidate()
+	require_False(t, n.pvote)
+	require_True(t, n.term == 7)
+}
+
+// Cut the node off from its peers. It no longer receives anything, and its vote requests go nowhere.
+// Everything else a follower sends is in response to what it receives.
+func partitionRaftNode(n *raft) {
+	n.Lock()
+	defer n.Unlock()
+	n.vsubj = n.newInbox()
+	n.c.mu.Lock()
+	sids := make([][]byte, 0, len(n.c.subs))
+	for _, sub := range n.c.subs {
+		sids = append(sids, sub.sid)
+	}
+	n.c.mu.Unlock()
+	for _, sid := range sids {
+		n.c.processUnsub(sid)
+	}
+}
+
+// Reconnect a node that was cut off with partitionRaftNode.
+func healRaftNode(t *testing.T, n *raft) {
+	t.Helper()
+	require_NoError(t, n.createInternalSubs())
+}
+
+func TestNRGPreVotePartitionedFollowerRejoins(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	raftNode := func(s *Server) *raft {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		return mset.raftNode().(*raft)
+	}
+	ln := raftNode(c.streamLeader(globalAccountName, "TEST"))
+	fn := raftNode(c.randomNonStreamLeader(globalAccountName, "TEST"))
+	term := ln.Term()
+
+	partitionRaftNode(fn)
+
+	// Without hearing from its leader our follower campaigns, but it can not win a pre-vote
+	// so its term stays as is however many elections it holds.
+	checkFor(t, 2*maxElectionTimeout, 50*time.Millisecond, func() error {
+		if state := fn.State(); state != Candidate {
+			return fmt.Errorf("Expected follower to become a candidate, got %v", state)
+		}
+		return nil
+	})
+	time.Sleep(2 * maxElectionTimeout)
+	require_True(t, fn.State() == Candidate)
+	require_True(t, fn.Term() == term)
+
+	healRaftNode(t, fn)
+
+	// Once it hears from our leader again it rejoins as a follower, without a new election.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := fn.State(); state != Follower {
+			return fmt.Errorf("Expected candidate to become a follower, got %v", state)
+		}
+		if leader := fn.GroupLeader(); leader != ln.ID() {
+			return fmt.Errorf("Expected leader %q, got %q", ln.ID(), leader)
+		}
+		return nil
+	})
+	require_True(t, ln.Leader())
+	for _, s := range c.servers {
+		if n := raftNode(s); n.Term() != term {
+			t.Fatalf("Expected term %d on %q, got %d", term, s.Name(), n.Term())
+		}
+	}
+
+	// The stream keeps working under the same leader.
+	sendStreamMsg(t, nc, "foo", "OK")
+	require_True(t, ln.Leader())
+	require_True(t, ln.Term() == term)
+}
+
+func TestNRGSnapshotOfferMixedVersions(t *testing.T) {
+	s := &Server{}
+	n := &raft{s: s, id: "AAAAAAAA"}
+	s.nodeToInfo.Store("BBBBBBBB", nodeInfo{version: VERSION})
+	// This is the version servers report that do not know about snapshot offers.
+	s.nodeToInfo.Store("CCCCCCCC", nodeInfo{version: "2.9.15-beta"})
+
+	// Only followers we know can pull a snapshot get it offered, all others get it in full.
+	require_True(t, n.peerSupportsSnapshotOffer("BBBBBBBB"))
+	require_False(t, n.peerSupportsSnapshotOffer("CCCCCCCC"))
+	require_False(t, n.peerSupportsSnapshotOffer("DDDDDDDD"))
+}
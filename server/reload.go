@@ -608,6 +608,18 @@ func (jso jetStreamOption) IsStatszChange() bool {
 	return true
 }
 
+// jetStreamKeyOption implements the option interface for the JetStream
+// encryption key and cipher.
+type jetStreamKeyOption struct {
+	noopOption
+}
+
+// Apply the new key and cipher by rotating the encryption of all file based stores.
+func (jko *jetStreamKeyOption) Apply(s *Server) {
+	s.Noticef("Reloaded: JetStream encryption key")
+	s.rotateJetStreamKeys()
+}
+
 type ocspOption struct {
 	noopOption
 	newValue *OCSPConfig
@@ -973,6 +985,7 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		jsMemLimitsChanged  bool
 		jsFileLimitsChanged bool
 		jsStoreDirChanged   bool
+		jsKeyChanged        bool
 	)
 	for i := 0; i < oldConfig.NumField(); i++ {
 		field := oldConfig.Type().Field(i)
@@ -1267,6 +1280,19 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 					return nil, fmt.Errorf("config reload not supported for jetstream max memory and store")
 				}
 			}
+		case "jetstreamkey", "jetstreamcipher":
+			// We only support rotating an existing key or switching ciphers here,
+			// not enabling or disabling encryption.
+			if jsEnabled && (s.getOpts().JetStreamKey == _EMPTY_ || newOpts.JetStreamKey == _EMPTY_) {
+				return nil, fmt.Errorf("config reload not supported for %s: encryption can not be enabled or disabled", field.Name)
+			}
+			// Anything not yet re-encrypted still needs the previous key.
+			if optName == "jetstreamkey" && newOpts.JetStreamOldKey != oldValue.(string) {
+				return nil, fmt.Errorf("config reload not supported for %s: previous key needs to be set to the current key", field.Name)
+			}
+			jsKeyChanged = true
+		case "jetstreamoldkey":
+			// Only used when rotating or recovering, so nothing to do here.
 		case "websocket":
 			// Similar to gateways
 			tmpOld := oldValue.(WebsocketOpts)
@@ -1358,6 +1384,11 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		}
 	}
 
+	// Only rotate our keys once, even if both key and cipher changed.
+	if jsKeyChanged && jsEnabled && !disableJS {
+		diffOpts = append(diffOpts, &jetStreamKeyOption{})
+	}
+
 	// If not disabling JS but limits have changed then it is an error.
 	if !disableJS {
 		if jsMemLimitsChanged || jsFileLimitsChanged {
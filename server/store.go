@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -109,6 +110,88 @@ type StreamStore interface {
 	Utilization() (total, reported uint64, err error)
 }
 
+// multiFilterStore is implemented by stores that can find the next message matching
+// any of several filter subjects in a single pass. The filters are expected to not overlap.
+type multiFilterStore interface {
+	LoadNextMsgMulti(filters []string, start uint64, smp *StoreMsg) (sm *StoreMsg, skip uint64, err error)
+}
+
+// loadNextMsgMulti will find the next message matching any of the filter subjects starting at
+// the start sequence. Stores that do not implement multiFilterStore are asked for the next
+// message of each filter, and the lowest sequence found wins.
+func loadNextMsgMulti(ss StreamStore, filters []string, start uint64, smp *StoreMsg) (*StoreMsg, uint64, error) {
+	if mfs, ok := ss.(multiFilterStore); ok {
+		return mfs.LoadNextMsgMulti(filters, start, smp)
+	}
+	var best StoreMsg
+	var found bool
+	var last uint64
+	for _, filter := range filters {
+		var smv StoreMsg
+		sm, sseq, err := ss.LoadNextMsg(filter, subjectHasWildcard(filter), start, &smv)
+		if err == ErrStoreEOF {
+			if sseq > last {
+				last = sseq
+			}
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if !found || sm.seq < best.seq {
+			best, found = *sm, true
+		}
+	}
+	if !found {
+		return nil, last, ErrStoreEOF
+	}
+	if smp == nil {
+		smp = new(StoreMsg)
+	}
+	*smp = best
+	return smp, smp.seq, nil
+}
+
+// StreamStoreFactory creates the StreamStore for a stream that selected a registered backend.
+// The dir is reserved for the stream and may be used or ignored by the backend. The store's Type
+// should report cfg.Storage, which the server uses for limits and resource accounting.
+type StreamStoreFactory func(cfg *StreamConfig, dir string) (StreamStore, error)
+
+// Registered stream store backends.
+var streamStores = struct {
+	sync.RWMutex
+	m map[string]StreamStoreFactory
+}{m: make(map[string]StreamStoreFactory)}
+
+// RegisterStreamStore registers a custom StreamStore backend under name. Streams select
+// it by setting Backend in their config. Backends should be registered before any server
+// that recovers streams using them is started, and all servers in a cluster need the same backends.
+// Streams using a backend can not set Persist, ArchiveAfter or Compression. Encryption at rest and
+// key rotation, background scrubbing and compaction, and the persisted subject index are features
+// of the built-in file store and are up to the backend to provide. Backends should pass
+// the conformance suite in the storetest package from their own tests.
+func RegisterStreamStore(name string, factory StreamStoreFactory) error {
+	if name == _EMPTY_ {
+		return errors.New("stream store backend name required")
+	}
+	if factory == nil {
+		return errors.New("stream store backend factory required")
+	}
+	streamStores.Lock()
+	defer streamStores.Unlock()
+	if _, ok := streamStores.m[name]; ok {
+		return fmt.Errorf("stream store backend %q already registered", name)
+	}
+	streamStores.m[name] = factory
+	return nil
+}
+
+// Returns the factory registered for the named backend, nil if none.
+func lookupStreamStore(name string) StreamStoreFactory {
+	streamStores.RLock()
+	defer streamStores.RUnlock()
+	return streamStores.m[name]
+}
+
 // RetentionPolicy determines how messages in a set are retained.
 type RetentionPolicy int
 
@@ -135,18 +218,19 @@ const (
 
 // StreamState is information about the given stream.
 type StreamState struct {
-	Msgs        uint64            `json:"messages"`
-	Bytes       uint64            `json:"bytes"`
-	FirstSeq    uint64            `json:"first_seq"`
-	FirstTime   time.Time         `json:"first_ts"`
-	LastSeq     uint64            `json:"last_seq"`
-	LastTime    time.Time         `json:"last_ts"`
-	NumSubjects int               `json:"num_subjects,omitempty"`
-	Subjects    map[string]uint64 `json:"subjects,omitempty"`
-	NumDeleted  int               `json:"num_deleted,omitempty"`
-	Deleted     []uint64          `json:"deleted,omitempty"`
-	Lost        *LostStreamData   `json:"lost,omitempty"`
-	Consumers   int               `json:"consumer_count"`
+	Msgs          uint64            `json:"messages"`
+	Bytes         uint64            `json:"bytes"`
+	ArchivedBytes uint64            `json:"archived_bytes,omitempty"`
+	FirstSeq      uint64            `json:"first_seq"`
+	FirstTime     time.Time         `json:"first_ts"`
+	LastSeq       uint64            `json:"last_seq"`
+	LastTime      time.Time         `json:"last_ts"`
+	NumSubjects   int               `json:"num_subjects,omitempty"`
+	Subjects      map[string]uint64 `json:"subjects,omitempty"`
+	NumDeleted    int               `json:"num_deleted,omitempty"`
+	Deleted       []uint64          `json:"deleted,omitempty"`
+	Lost          *LostStreamData   `json:"lost,omitempty"`
+	Consumers     int               `json:"consumer_count"`
 }
 
 // SimpleState for filtered subject specific state.
@@ -411,6 +495,55 @@ func (st *StorageType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// StoreCompression determines how sealed message blocks are compressed on disk.
+type StoreCompression uint8
+
+const (
+	// NoCompression stores message blocks as is.
+	NoCompression StoreCompression = iota
+	// S2Compression compresses sealed message blocks with S2.
+	S2Compression
+)
+
+const (
+	noCompressionString = "none"
+	s2CompressionString = "s2"
+)
+
+func (alg StoreCompression) String() string {
+	switch alg {
+	case NoCompression:
+		return "None"
+	case S2Compression:
+		return "S2"
+	default:
+		return "Unknown StoreCompression"
+	}
+}
+
+func (alg StoreCompression) MarshalJSON() ([]byte, error) {
+	switch alg {
+	case NoCompression:
+		return json.Marshal(noCompressionString)
+	case S2Compression:
+		return json.Marshal(s2CompressionString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", alg)
+	}
+}
+
+func (alg *StoreCompression) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(noCompressionString):
+		*alg = NoCompression
+	case jsonString(s2CompressionString):
+		*alg = S2Compression
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	ackNonePolicyString     = "none"
 	ackAllPolicyString      = "all"
@@ -472,6 +605,39 @@ func (rp *ReplayPolicy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	priorityNonePolicyString         = "none"
+	priorityPinnedClientPolicyString = "pinned_client"
+	priorityOverflowPolicyString     = "overflow"
+)
+
+func (pp PriorityPolicy) MarshalJSON() ([]byte, error) {
+	switch pp {
+	case PriorityNone:
+		return json.Marshal(priorityNonePolicyString)
+	case PriorityPinnedClient:
+		return json.Marshal(priorityPinnedClientPolicyString)
+	case PriorityOverflow:
+		return json.Marshal(priorityOverflowPolicyString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", pp)
+	}
+}
+
+func (pp *PriorityPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(priorityNonePolicyString):
+		*pp = PriorityNone
+	case jsonString(priorityPinnedClientPolicyString):
+		*pp = PriorityPinnedClient
+	case jsonString(priorityOverflowPolicyString):
+		*pp = PriorityOverflow
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	deliverAllPolicyString       = "all"
 	deliverLastPolicyString      = "last"
@@ -530,7 +696,7 @@ func isOutOfSpaceErr(err error) bool {
 var errFirstSequenceMismatch = errors.New("first sequence mismatch")
 
 func isClusterResetErr(err error) bool {
-	return err == errLastSeqMismatch || err == ErrStoreEOF || err == errFirstSequenceMismatch
+	return err == errLastSeqMismatch || err == ErrStoreEOF || err == errFirstSequenceMismatch || err == errBatchPartiallyStored
 }
 
 // Copy all fields.
@@ -544,6 +710,33 @@ func (smo *StoreMsg) copy(sm *StoreMsg) {
 	sm.subj, sm.seq, sm.ts = smo.subj, smo.seq, smo.ts
 }
 
+// Set will fill in all fields, copying hdr and msg into the underlying buffer which will be reused.
+// This allows StreamStore implementations outside of this package to return messages.
+func (sm *StoreMsg) Set(subj string, hdr, msg []byte, seq uint64, ts int64) {
+	if sm.buf != nil {
+		sm.buf = sm.buf[:0]
+	}
+	sm.buf = append(sm.buf, hdr...)
+	sm.buf = append(sm.buf, msg...)
+	sm.hdr, sm.msg = sm.buf[:len(hdr):len(hdr)], sm.buf[len(hdr):]
+	sm.subj, sm.seq, sm.ts = subj, seq, ts
+}
+
+// Subject returns the subject of the message.
+func (sm *StoreMsg) Subject() string { return sm.subj }
+
+// Header returns the headers of the message, if any.
+func (sm *StoreMsg) Header() []byte { return sm.hdr }
+
+// Data returns the payload of the message.
+func (sm *StoreMsg) Data() []byte { return sm.msg }
+
+// Sequence returns the stream sequence of the message.
+func (sm *StoreMsg) Sequence() uint64 { return sm.seq }
+
+// Timestamp returns the time the message was stored in nanoseconds since the epoch.
+func (sm *StoreMsg) Timestamp() int64 { return sm.ts }
+
 // Clear all fields except underlying buffer but reset that if present to [:0].
 func (sm *StoreMsg) clear() {
 	if sm == nil {
@@ -0,0 +1,71 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/server/storetest"
+)
+
+func TestFileStoreConformance(t *testing.T) {
+	// Our stored size includes the record header, any headers length and the checksum.
+	subj, hdr, msg := "foo", []byte("name:derek"), []byte("Hello World")
+	if sz := int(server.FileStoreMsgSize(subj, hdr, msg)); sz != 22+len(subj)+4+len(hdr)+len(msg)+8 {
+		t.Fatalf("Wrong size for stored msg with header")
+	}
+	for _, cipher := range []server.StoreCipher{server.ChaCha, server.AES} {
+		t.Run(cipher.String(), func(t *testing.T) {
+			factory := server.FileStoreFactory(server.FileStoreConfig{Cipher: cipher})
+			storetest.StreamStoreConformance(t, server.FileStorage, factory, server.FileStoreMsgSize)
+		})
+	}
+}
+
+func TestMemStoreConformance(t *testing.T) {
+	subj, hdr, msg := "foo", []byte("name:derek"), []byte("Hello World")
+	if sz := int(server.MemStoreMsgSize(subj, hdr, msg)); sz != len(subj)+len(hdr)+len(msg)+16 {
+		t.Fatalf("Wrong size for stored msg with header")
+	}
+	storetest.StreamStoreConformance(t, server.MemoryStorage, server.MemStoreFactory, server.MemStoreMsgSize)
+}
+
+// A backend as an embedder would write it, that only uses exported API.
+// It wraps the memory store and copies messages it loads.
+type copyingStore struct {
+	server.StreamStore
+}
+
+func (cs *copyingStore) LoadMsg(seq uint64, sm *server.StoreMsg) (*server.StoreMsg, error) {
+	msm, err := cs.StreamStore.LoadMsg(seq, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sm == nil {
+		sm = new(server.StoreMsg)
+	}
+	sm.Set(msm.Subject(), msm.Header(), msm.Data(), msm.Sequence(), msm.Timestamp())
+	return sm, nil
+}
+
+func TestRegisteredStreamStoreConformance(t *testing.T) {
+	storetest.StreamStoreConformance(t, server.MemoryStorage, func(cfg *server.StreamConfig, dir string) (server.StreamStore, error) {
+		ss, err := server.MemStoreFactory(cfg, dir)
+		if err != nil {
+			return nil, err
+		}
+		return &copyingStore{StreamStore: ss}, nil
+	}, nil)
+}
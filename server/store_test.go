@@ -0,0 +1,132 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The built-in stores and their stored message sizes, exported for the storetest
+// conformance suite that runs from package server_test.
+var (
+	FileStoreMsgSize = fileStoreMsgSize
+	MemStoreMsgSize  = memStoreMsgSize
+)
+
+func FileStoreFactory(fcfg FileStoreConfig) StreamStoreFactory {
+	return func(cfg *StreamConfig, dir string) (StreamStore, error) {
+		fcfg.StoreDir = dir
+		fs, err := newFileStore(fcfg, *cfg)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+}
+
+func MemStoreFactory(cfg *StreamConfig, _ string) (StreamStore, error) {
+	ms, err := newMemStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// A backend registered by name, as an embedder would, that only uses exported API.
+// It wraps the memory store, whose own behavior is covered by the storetest conformance suite.
+type testRegisteredStore struct {
+	StreamStore
+	loads int
+}
+
+func (ts *testRegisteredStore) LoadMsg(seq uint64, sm *StoreMsg) (*StoreMsg, error) {
+	ts.loads++
+	msm, err := ts.StreamStore.LoadMsg(seq, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sm == nil {
+		sm = new(StoreMsg)
+	}
+	sm.Set(msm.Subject(), msm.Header(), msm.Data(), msm.Sequence(), msm.Timestamp())
+	return sm, nil
+}
+
+func registerTestStreamStore(t *testing.T, name string, factory StreamStoreFactory) {
+	t.Helper()
+	require_NoError(t, RegisterStreamStore(name, factory))
+	t.Cleanup(func() {
+		streamStores.Lock()
+		delete(streamStores.m, name)
+		streamStores.Unlock()
+	})
+}
+
+func TestRegisterStreamStore(t *testing.T) {
+	registerTestStreamStore(t, "test", func(cfg *StreamConfig, dir string) (StreamStore, error) {
+		ms, err := newMemStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &testRegisteredStore{StreamStore: ms}, nil
+	})
+	require_True(t, lookupStreamStore("test") != nil)
+	require_True(t, lookupStreamStore("other") == nil)
+	require_Error(t, RegisterStreamStore("test", func(*StreamConfig, string) (StreamStore, error) { return nil, nil }))
+	require_Error(t, RegisterStreamStore(_EMPTY_, func(*StreamConfig, string) (StreamStore, error) { return nil, nil }))
+	require_Error(t, RegisterStreamStore("nofactory", nil))
+}
+
+func TestLoadNextMsgMultiFallback(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo.*", "bar.*"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+	// Without its own multi filter lookup the store is asked for each filter.
+	ss := &testRegisteredStore{StreamStore: ms}
+	_, ok := StreamStore(ss).(multiFilterStore)
+	require_False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		_, _, err := ms.StoreMsg(fmt.Sprintf("foo.%d", i%10), nil, nil)
+		require_NoError(t, err)
+		if i%25 == 0 {
+			_, _, err = ms.StoreMsg(fmt.Sprintf("bar.%d", i), nil, nil)
+			require_NoError(t, err)
+		}
+	}
+
+	for _, filters := range [][]string{
+		{"foo.3", "foo.5"},
+		{"foo.3", "bar.*"},
+		{"bar.*", "foo.9"},
+		{"foo.9", "baz.*"},
+	} {
+		for start := uint64(0); start <= 106; start++ {
+			esm, eskip, eerr := ms.LoadNextMsgMulti(filters, start, nil)
+			var smv StoreMsg
+			sm, skip, err := loadNextMsgMulti(ss, filters, start, &smv)
+			if err != eerr || skip != eskip {
+				t.Fatalf("Filters %v from %d: expected %d and %v, got %d and %v", filters, start, eskip, eerr, skip, err)
+			}
+			if esm == nil {
+				require_True(t, sm == nil)
+				continue
+			}
+			require_True(t, sm == &smv)
+			require_True(t, sm.seq == esm.seq)
+			require_Equal(t, sm.subj, esm.subj)
+		}
+	}
+}
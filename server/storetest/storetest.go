@@ -0,0 +1,595 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest provides the conformance suite server.StreamStore backends registered with
+// server.RegisterStreamStore should pass.
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// StreamStoreConformance runs the behavior every server.StreamStore backend must provide as subtests of t.
+// The factory is called with a new directory for each store and a config using the given storage type.
+// When msgSize is set stored bytes are checked exactly, otherwise only that they are reported.
+func StreamStoreConformance(t *testing.T, storage server.StorageType, factory server.StreamStoreFactory, msgSize func(subj string, hdr, msg []byte) uint64) {
+	requireNoError := func(t *testing.T, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	requireTrue := func(t *testing.T, ok bool) {
+		t.Helper()
+		if !ok {
+			t.Fatalf("Expected condition to be true")
+		}
+	}
+	requireError := func(t *testing.T, err, expected error) {
+		t.Helper()
+		if err != expected {
+			t.Fatalf("Expected error %v, got %v", expected, err)
+		}
+	}
+	newStore := func(t *testing.T, cfg server.StreamConfig) server.StreamStore {
+		t.Helper()
+		if cfg.Name == "" {
+			cfg.Name = "zzz"
+		}
+		cfg.Storage = storage
+		ss, err := factory(&cfg, t.TempDir())
+		requireNoError(t, err)
+		t.Cleanup(func() { ss.Stop() })
+		return ss
+	}
+	checkBytes := func(t *testing.T, state server.StreamState, subj string, hdr, msg []byte, n uint64) {
+		t.Helper()
+		if msgSize == nil {
+			if n > 0 && state.Bytes == 0 {
+				t.Fatalf("Expected bytes to be reported")
+			}
+			return
+		}
+		if expected := msgSize(subj, hdr, msg) * n; state.Bytes != expected {
+			t.Fatalf("Expected %d bytes, got %d", expected, state.Bytes)
+		}
+	}
+
+	t.Run("Basics", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+
+		subj, msg := "foo", []byte("Hello World")
+		now := time.Now().UnixNano()
+		for i := 1; i <= 5; i++ {
+			if seq, ts, err := ss.StoreMsg(subj, nil, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			} else if seq != uint64(i) {
+				t.Fatalf("Expected sequence to be %d, got %d", i, seq)
+			} else if ts < now || ts > now+int64(time.Millisecond) {
+				t.Fatalf("Expected timestamp to be current, got %v", ts-now)
+			}
+		}
+
+		state := ss.State()
+		if state.Msgs != 5 {
+			t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+		}
+		checkBytes(t, state, subj, nil, msg, 5)
+		var smv server.StoreMsg
+		sm, err := ss.LoadMsg(2, &smv)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if sm.Subject() != subj {
+			t.Fatalf("Subjects don't match, original %q vs %q", subj, sm.Subject())
+		}
+		if !bytes.Equal(sm.Data(), msg) {
+			t.Fatalf("Msgs don't match, original %q vs %q", msg, sm.Data())
+		}
+		if _, err := ss.LoadMsg(6, nil); err != server.ErrStoreEOF {
+			t.Fatalf("Expected %v looking up seq 6, got %v", server.ErrStoreEOF, err)
+		}
+
+		remove := func(seq, expectedMsgs uint64) {
+			t.Helper()
+			removed, err := ss.RemoveMsg(seq)
+			if err != nil {
+				t.Fatalf("Got an error on remove of %d: %v", seq, err)
+			}
+			if !removed {
+				t.Fatalf("Expected remove to return true for %d", seq)
+			}
+			if state := ss.State(); state.Msgs != expectedMsgs {
+				t.Fatalf("Expected %d msgs, got %d", expectedMsgs, state.Msgs)
+			}
+		}
+		// Remove first
+		remove(1, 4)
+		// Remove last
+		remove(5, 3)
+		// Remove a middle
+		remove(3, 2)
+	})
+
+	t.Run("MsgLimit", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{MaxMsgs: 10})
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		state := ss.State()
+		if state.Msgs != 10 {
+			t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
+		}
+		if _, _, err := ss.StoreMsg(subj, nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+		state = ss.State()
+		if state.Msgs != 10 {
+			t.Fatalf("Expected %d msgs, got %d", 10, state.Msgs)
+		}
+		if state.LastSeq != 11 {
+			t.Fatalf("Expected the last sequence to be 11 now, but got %d", state.LastSeq)
+		}
+		if state.FirstSeq != 2 {
+			t.Fatalf("Expected the first sequence to be 2 now, but got %d", state.FirstSeq)
+		}
+		// Make sure we can not lookup seq 1.
+		if _, err := ss.LoadMsg(1, nil); err == nil {
+			t.Fatalf("Expected error looking up seq 1 but got none")
+		}
+	})
+
+	t.Run("BytesLimit", func(t *testing.T) {
+		subj, msg := "foo", make([]byte, 512)
+		// Without a known message size use what the backend reports for a single message.
+		var storedMsgSize uint64
+		if msgSize != nil {
+			storedMsgSize = msgSize(subj, nil, msg)
+		} else {
+			ss := newStore(t, server.StreamConfig{})
+			_, _, err := ss.StoreMsg(subj, nil, msg)
+			requireNoError(t, err)
+			storedMsgSize = ss.State().Bytes
+			requireTrue(t, storedMsgSize > 0)
+		}
+
+		toStore := uint64(1024)
+		maxBytes := storedMsgSize * toStore
+
+		ss := newStore(t, server.StreamConfig{MaxBytes: int64(maxBytes)})
+		for i := uint64(0); i < toStore; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		state := ss.State()
+		if state.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+		}
+		if state.Bytes != storedMsgSize*toStore {
+			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, state.Bytes)
+		}
+
+		// Now send 10 more and check that bytes limit enforced.
+		for i := 0; i < 10; i++ {
+			if _, _, err := ss.StoreMsg(subj, nil, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+		}
+		state = ss.State()
+		if state.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+		}
+		if state.Bytes != storedMsgSize*toStore {
+			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, state.Bytes)
+		}
+		if state.FirstSeq != 11 {
+			t.Fatalf("Expected first sequence to be 11, got %d", state.FirstSeq)
+		}
+		if state.LastSeq != toStore+10 {
+			t.Fatalf("Expected last sequence to be %d, got %d", toStore+10, state.LastSeq)
+		}
+	})
+
+	t.Run("AgeLimit", func(t *testing.T) {
+		maxAge := 10 * time.Millisecond
+		ss := newStore(t, server.StreamConfig{MaxAge: maxAge})
+		// Store some messages. Does not really matter how many.
+		subj, msg := "foo", []byte("Hello World")
+		toStore := 100
+		for i := 0; i < toStore; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		state := ss.State()
+		if state.Msgs != uint64(toStore) {
+			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+		}
+		checkExpired := func(t *testing.T) {
+			t.Helper()
+			for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(maxAge) {
+				if state = ss.State(); state.Msgs == 0 && state.Bytes == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected no msgs or bytes, got %d and %d", state.Msgs, state.Bytes)
+				}
+			}
+		}
+		// Let them expire
+		checkExpired(t)
+		// Now add some more and make sure that timer will fire again.
+		for i := 0; i < toStore; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		state = ss.State()
+		if state.Msgs != uint64(toStore) {
+			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+		}
+		checkExpired(t)
+	})
+
+	t.Run("TimeStamps", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		last := time.Now().UnixNano()
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			time.Sleep(5 * time.Microsecond)
+			ss.StoreMsg(subj, nil, msg)
+		}
+		var smv server.StoreMsg
+		for seq := uint64(1); seq <= 10; seq++ {
+			sm, err := ss.LoadMsg(seq, &smv)
+			if err != nil {
+				t.Fatalf("Unexpected error looking up msg: %v", err)
+			}
+			// These should be different
+			if sm.Timestamp() <= last {
+				t.Fatalf("Expected different timestamps, got %v", sm.Timestamp())
+			}
+			last = sm.Timestamp()
+		}
+		if seq := ss.GetSeqFromTime(time.Unix(0, last+1)); seq != 11 {
+			t.Fatalf("Expected seq 11 for a time after the last msg, got %d", seq)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		if state := ss.State(); state.Msgs != 10 {
+			t.Fatalf("Expected 10 msgs, got %d", state.Msgs)
+		}
+		if n, err := ss.Purge(); err != nil || n != 10 {
+			t.Fatalf("Expected to purge 10 msgs, got %d and %v", n, err)
+		}
+		state := ss.State()
+		if state.Msgs != 0 {
+			t.Fatalf("Expected no msgs, got %d", state.Msgs)
+		}
+		checkBytes(t, state, subj, nil, msg, 0)
+		// Sequences continue after a purge.
+		if seq, _, err := ss.StoreMsg(subj, nil, msg); err != nil || seq != 11 {
+			t.Fatalf("Expected seq 11 after purge, got %d and %v", seq, err)
+		}
+	})
+
+	t.Run("PurgeExWithSubject", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{Subjects: []string{"foo", "bar"}})
+		for i := 0; i < 100; i++ {
+			_, _, err := ss.StoreMsg("foo", nil, nil)
+			requireNoError(t, err)
+		}
+		_, _, err := ss.StoreMsg("bar", nil, nil)
+		requireNoError(t, err)
+
+		// This should purge all of foo.
+		n, err := ss.PurgeEx("foo", 1, 0)
+		requireNoError(t, err)
+		requireTrue(t, n == 100)
+		requireTrue(t, ss.State().Msgs == 1)
+
+		// Keep is mutually exclusive with a sequence.
+		_, err = ss.PurgeEx("bar", 2, 1)
+		requireError(t, err, server.ErrPurgeArgMismatch)
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			ss.StoreMsg(subj, nil, msg)
+		}
+		if state := ss.State(); state.Msgs != 10 {
+			t.Fatalf("Expected 10 msgs, got %d", state.Msgs)
+		}
+		n, err := ss.Compact(6)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if n != 5 {
+			t.Fatalf("Expected to have purged 5 msgs, got %d", n)
+		}
+		state := ss.State()
+		if state.Msgs != 5 {
+			t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+		}
+		if state.FirstSeq != 6 {
+			t.Fatalf("Expected first seq of 6, got %d", state.FirstSeq)
+		}
+		// Now test that compact will also reset first if seq > last
+		n, err = ss.Compact(100)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if n != 5 {
+			t.Fatalf("Expected to have purged 5 msgs, got %d", n)
+		}
+		if state = ss.State(); state.FirstSeq != 100 {
+			t.Fatalf("Expected first seq of 100, got %d", state.FirstSeq)
+		}
+	})
+
+	t.Run("EraseMsg", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		subj, msg := "foo", []byte("Hello World")
+		ss.StoreMsg(subj, nil, msg)
+		sm, err := ss.LoadMsg(1, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if !bytes.Equal(msg, sm.Data()) {
+			t.Fatalf("Expected same msg, got %q vs %q", sm.Data(), msg)
+		}
+		if removed, _ := ss.EraseMsg(1); !removed {
+			t.Fatalf("Expected erase msg to return success")
+		}
+		if _, err := ss.LoadMsg(1, nil); err == nil {
+			t.Fatalf("Expected error looking up erased msg")
+		}
+	})
+
+	t.Run("MsgHeaders", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		subj, hdr, msg := "foo", []byte("name:derek"), []byte("Hello World")
+		ss.StoreMsg(subj, hdr, msg)
+		sm, err := ss.LoadMsg(1, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if !bytes.Equal(msg, sm.Data()) {
+			t.Fatalf("Expected same msg, got %q vs %q", sm.Data(), msg)
+		}
+		if !bytes.Equal(hdr, sm.Header()) {
+			t.Fatalf("Expected same hdr, got %q vs %q", sm.Header(), hdr)
+		}
+		checkBytes(t, ss.State(), subj, hdr, msg, 1)
+		if removed, _ := ss.EraseMsg(1); !removed {
+			t.Fatalf("Expected erase msg to return success")
+		}
+	})
+
+	t.Run("StreamStateDeleted", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		subj, toStore := "foo", uint64(10)
+		for i := uint64(1); i <= toStore; i++ {
+			msg := []byte(fmt.Sprintf("[%08d] Hello World!", i))
+			if _, _, err := ss.StoreMsg(subj, nil, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+		}
+		state := ss.State()
+		if len(state.Deleted) != 0 {
+			t.Fatalf("Expected deleted to be empty")
+		}
+		// Now remove some interior messages.
+		var expected []uint64
+		for seq := uint64(2); seq < toStore; seq += 2 {
+			ss.RemoveMsg(seq)
+			expected = append(expected, seq)
+		}
+		state = ss.State()
+		if !reflect.DeepEqual(state.Deleted, expected) {
+			t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
+		}
+		// Now fill the gap by deleting 1 and 3
+		ss.RemoveMsg(1)
+		ss.RemoveMsg(3)
+		expected = expected[2:]
+		state = ss.State()
+		if !reflect.DeepEqual(state.Deleted, expected) {
+			t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
+		}
+		if state.FirstSeq != 5 {
+			t.Fatalf("Expected first seq to be 5, got %d", state.FirstSeq)
+		}
+		ss.Purge()
+		if state = ss.State(); len(state.Deleted) != 0 {
+			t.Fatalf("Expected no deleted after purge, got %+v\n", state.Deleted)
+		}
+	})
+
+	t.Run("StreamTruncate", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{Subjects: []string{"foo", "bar"}})
+
+		tseq := uint64(50)
+
+		subj, toStore := "foo", uint64(100)
+		for i := uint64(1); i < tseq; i++ {
+			_, _, err := ss.StoreMsg(subj, nil, []byte("ok"))
+			requireNoError(t, err)
+		}
+		subj = "bar"
+		for i := tseq; i <= toStore; i++ {
+			_, _, err := ss.StoreMsg(subj, nil, []byte("ok"))
+			requireNoError(t, err)
+		}
+
+		if state := ss.State(); state.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+		}
+
+		// Check that sequence has to be interior.
+		if err := ss.Truncate(toStore + 1); err != server.ErrInvalidSequence {
+			t.Fatalf("Expected err of '%v', got '%v'", server.ErrInvalidSequence, err)
+		}
+
+		if err := ss.Truncate(tseq); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if state := ss.State(); state.Msgs != tseq {
+			t.Fatalf("Expected %d msgs, got %d", tseq, state.Msgs)
+		}
+
+		// Now make sure we report properly if we have some deleted interior messages.
+		ss.RemoveMsg(10)
+		ss.RemoveMsg(20)
+		ss.RemoveMsg(30)
+		ss.RemoveMsg(40)
+
+		tseq = uint64(25)
+		if err := ss.Truncate(tseq); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		state := ss.State()
+		if state.Msgs != tseq-2 {
+			t.Fatalf("Expected %d msgs, got %d", tseq-2, state.Msgs)
+		}
+		if state.NumSubjects != 1 {
+			t.Fatalf("Expected only 1 subject, got %d", state.NumSubjects)
+		}
+		expected := []uint64{10, 20}
+		if !reflect.DeepEqual(state.Deleted, expected) {
+			t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
+		}
+	})
+
+	t.Run("LoadNextAndLast", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{Subjects: []string{"foo.*"}})
+		for i := 0; i < 10; i++ {
+			subj := "foo.a"
+			if i%2 == 1 {
+				subj = "foo.b"
+			}
+			_, _, err := ss.StoreMsg(subj, nil, []byte(fmt.Sprintf("msg-%d", i+1)))
+			requireNoError(t, err)
+		}
+		var smv server.StoreMsg
+		sm, _, err := ss.LoadNextMsg("foo.b", false, 1, &smv)
+		requireNoError(t, err)
+		requireTrue(t, sm.Sequence() == 2)
+		sm, _, err = ss.LoadNextMsg("foo.*", true, 5, &smv)
+		requireNoError(t, err)
+		requireTrue(t, sm.Sequence() == 5)
+		_, _, err = ss.LoadNextMsg("foo.b", false, 11, &smv)
+		requireError(t, err, server.ErrStoreEOF)
+
+		// Looking up several filters at once is optional.
+		if mfs, ok := ss.(interface {
+			LoadNextMsgMulti(filters []string, start uint64, smp *server.StoreMsg) (*server.StoreMsg, uint64, error)
+		}); ok {
+			sm, _, err = mfs.LoadNextMsgMulti([]string{"foo.x", "foo.b"}, 3, &smv)
+			requireNoError(t, err)
+			requireTrue(t, sm.Sequence() == 4)
+		}
+
+		sm, err = ss.LoadLastMsg("foo.a", &smv)
+		requireNoError(t, err)
+		requireTrue(t, sm.Sequence() == 9)
+		requireTrue(t, string(sm.Data()) == "msg-9")
+		_, err = ss.LoadLastMsg("foo.x", &smv)
+		requireError(t, err, server.ErrStoreMsgNotFound)
+	})
+
+	t.Run("FilteredAndSubjectsState", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{Subjects: []string{"foo.*"}})
+		for _, subj := range []string{"foo.a", "foo.b", "foo.a", "foo.c", "foo.a"} {
+			_, _, err := ss.StoreMsg(subj, nil, nil)
+			requireNoError(t, err)
+		}
+		fss := ss.FilteredState(1, "foo.a")
+		requireTrue(t, fss.Msgs == 3)
+		requireTrue(t, fss.First == 1)
+		requireTrue(t, fss.Last == 5)
+		fss = ss.FilteredState(2, "foo.a")
+		requireTrue(t, fss.Msgs == 2)
+		requireTrue(t, fss.First == 3)
+
+		st := ss.SubjectsState("foo.*")
+		requireTrue(t, len(st) == 3)
+		requireTrue(t, st["foo.a"].Msgs == 3)
+		requireTrue(t, st["foo.b"].Msgs == 1)
+		requireTrue(t, st["foo.c"].First == 4)
+		requireTrue(t, ss.State().NumSubjects == 3)
+	})
+
+	t.Run("SkipAndRawMsgs", func(t *testing.T) {
+		ss := newStore(t, server.StreamConfig{})
+		requireTrue(t, ss.SkipMsg() == 1)
+		ts := time.Now().UnixNano()
+		requireNoError(t, ss.StoreRawMsg("foo", nil, []byte("raw"), 2, ts))
+		requireTrue(t, ss.SkipMsg() == 3)
+
+		state := ss.State()
+		requireTrue(t, state.Msgs == 1)
+		requireTrue(t, state.FirstSeq == 2)
+		requireTrue(t, state.LastSeq == 3)
+		sm, err := ss.LoadMsg(2, nil)
+		requireNoError(t, err)
+		requireTrue(t, sm.Timestamp() == ts)
+		requireTrue(t, sm.Subject() == "foo")
+
+		// Sequences continue after the skipped one.
+		seq, _, err := ss.StoreMsg("foo", nil, nil)
+		requireNoError(t, err)
+		requireTrue(t, seq == 4)
+	})
+
+	t.Run("UpdateMaxMsgsPerSubject", func(t *testing.T) {
+		cfg := server.StreamConfig{Subjects: []string{"foo"}, MaxMsgsPer: 10}
+		ss := newStore(t, cfg)
+
+		// Make sure this is honored on an update.
+		cfg.Name, cfg.Storage, cfg.MaxMsgsPer = "zzz", ss.Type(), 50
+		err := ss.UpdateConfig(&cfg)
+		requireNoError(t, err)
+
+		numStored := 22
+		for i := 0; i < numStored; i++ {
+			_, _, err = ss.StoreMsg("foo", nil, nil)
+			requireNoError(t, err)
+		}
+
+		ssm := ss.SubjectsState("foo")["foo"]
+		if ssm.Msgs != uint64(numStored) {
+			t.Fatalf("Expected to have %d stored, got %d", numStored, ssm.Msgs)
+		}
+
+		// Now make sure we trunk if setting to lower value.
+		cfg.MaxMsgsPer = 10
+		err = ss.UpdateConfig(&cfg)
+		requireNoError(t, err)
+
+		ssm = ss.SubjectsState("foo")["foo"]
+		if ssm.Msgs != 10 {
+			t.Fatalf("Expected to have %d stored, got %d", 10, ssm.Msgs)
+		}
+	})
+}
@@ -58,6 +58,9 @@ type StreamConfig struct {
 	Mirror       *StreamSource   `json:"mirror,omitempty"`
 	Sources      []*StreamSource `json:"sources,omitempty"`
 
+	// Allow applying a subject transform to incoming messages before storing them.
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+
 	// Allow republish of the message after being sequenced and stored.
 	RePublish *RePublish `json:"republish,omitempty"`
 
@@ -69,6 +72,26 @@ type StreamConfig struct {
 	// Allow KV like semantics to also discard new on a per subject basis
 	DiscardNewPer bool `json:"discard_new_per_subject,omitempty"`
 
+	// Compression used for message blocks once they are sealed. Only applies to file storage
+	// and can be changed, in which case only newly sealed blocks will use the new setting.
+	Compression StoreCompression `json:"compression,omitempty"`
+
+	// Move sealed message blocks whose messages are all older than this to the server's
+	// archive directory. Only applies to file storage.
+	ArchiveAfter time.Duration `json:"archive_after,omitempty"`
+
+	// Persist the messages of a memory stream to disk on shutdown and restore them on startup.
+	Persist bool `json:"persist,omitempty"`
+	// Also persist at this interval, limiting what can be lost when not shut down cleanly.
+	PersistInterval time.Duration `json:"persist_interval,omitempty"`
+
+	// Backend selects a stream store registered with RegisterStreamStore instead of the
+	// built-in store for the storage type. This can not be changed once set.
+	Backend string `json:"backend,omitempty"`
+
+	// Exclude this stream and its consumers from automatic leader rebalancing.
+	NoLeaderRebalance bool `json:"no_leader_rebalance,omitempty"`
+
 	// Optional qualifiers. These can not be modified after set to true.
 
 	// Sealed will seal a stream so no messages can get out or in.
@@ -80,6 +103,26 @@ type StreamConfig struct {
 	// AllowRollup allows messages to be placed into the system and purge
 	// all older messages using a special msg header.
 	AllowRollup bool `json:"allow_rollup_hdrs"`
+
+	// AllowMsgTTL allows individual messages to expire using the Nats-TTL header.
+	// This can not be disabled once set.
+	AllowMsgTTL bool `json:"allow_msg_ttl,omitempty"`
+
+	// AllowMsgSchedules allows messages to be held back from consumers until the
+	// time set in the Nats-Deliver-At header. Once due, such a message is stored again
+	// with a new sequence and timestamp and the original is removed.
+	// This can not be disabled once set.
+	AllowMsgSchedules bool `json:"allow_msg_schedules,omitempty"`
+
+	// AllowAtomicPublish allows publishers to store several messages at once
+	// using the Nats-Batch-Id, Nats-Batch-Sequence and Nats-Batch-Commit headers.
+	AllowAtomicPublish bool `json:"allow_atomic,omitempty"`
+}
+
+// SubjectTransformConfig is for applying a subject transform to matching messages.
+type SubjectTransformConfig struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
 }
 
 // RePublish is for republishing messages once committed to a stream.
@@ -111,6 +154,8 @@ type PubAck struct {
 	Sequence  uint64 `json:"seq"`
 	Domain    string `json:"domain,omitempty"`
 	Duplicate bool   `json:"duplicate,omitempty"`
+	BatchId   string `json:"batch,omitempty"`
+	BatchSize int    `json:"count,omitempty"`
 }
 
 // StreamInfo shows config and current state for this stream.
@@ -134,9 +179,10 @@ type StreamAlternate struct {
 // ClusterInfo shows information about the underlying set of servers
 // that make up the stream or consumer.
 type ClusterInfo struct {
-	Name     string      `json:"name,omitempty"`
-	Leader   string      `json:"leader,omitempty"`
-	Replicas []*PeerInfo `json:"replicas,omitempty"`
+	Name             string                `json:"name,omitempty"`
+	Leader           string                `json:"leader,omitempty"`
+	Replicas         []*PeerInfo           `json:"replicas,omitempty"`
+	SnapshotTransfer *SnapshotTransferInfo `json:"snapshot_transfer,omitempty"`
 }
 
 // PeerInfo shows information about all the peers in the cluster that
@@ -154,11 +200,13 @@ type PeerInfo struct {
 
 // StreamSourceInfo shows information about an upstream stream source.
 type StreamSourceInfo struct {
-	Name     string          `json:"name"`
-	External *ExternalStream `json:"external,omitempty"`
-	Lag      uint64          `json:"lag"`
-	Active   time.Duration   `json:"active"`
-	Error    *ApiError       `json:"error,omitempty"`
+	Name              string                   `json:"name"`
+	External          *ExternalStream          `json:"external,omitempty"`
+	Lag               uint64                   `json:"lag"`
+	Active            time.Duration            `json:"active"`
+	Error             *ApiError                `json:"error,omitempty"`
+	FilterSubject     string                   `json:"filter_subject,omitempty"`
+	SubjectTransforms []SubjectTransformConfig `json:"subject_transforms,omitempty"`
 }
 
 // StreamSource dictates how streams can source from other streams.
@@ -169,6 +217,10 @@ type StreamSource struct {
 	FilterSubject string          `json:"filter_subject,omitempty"`
 	External      *ExternalStream `json:"external,omitempty"`
 
+	// Allows multiple subject filters, each with an optional subject transform.
+	// Can not be combined with FilterSubject.
+	SubjectTransforms []SubjectTransformConfig `json:"subject_transforms,omitempty"`
+
 	// Internal
 	iname string // For indexing when stream names are the same for multiple sources.
 }
@@ -223,6 +275,18 @@ type stream struct {
 	// For republishing.
 	tr *transform
 
+	// For ingest subject transforms.
+	itr *transform
+
+	// For messages scheduled for later delivery.
+	sched    *msgSchedules
+	schedTmr *time.Timer
+
+	// For atomic batches that are not committed yet.
+	batches *msgBatches
+	// Serializes storing messages so batches get consecutive sequences.
+	ingMu sync.Mutex
+
 	// For processing consumers without main stream lock.
 	clsMu sync.RWMutex
 	cList []*consumer
@@ -257,6 +321,8 @@ type sourceInfo struct {
 	name  string
 	iname string
 	cname string
+	sfs   []string     // Subject filters
+	trs   []*transform // Subject transforms, nil if a filter has none
 	sub   *subscription
 	dsub  *subscription
 	lbsub *subscription
@@ -293,6 +359,12 @@ const (
 	JSMsgRollup           = "Nats-Rollup"
 	JSMsgSize             = "Nats-Msg-Size"
 	JSResponseType        = "Nats-Response-Type"
+	JSMessageTTL          = "Nats-TTL"
+	JSDeliverAt           = "Nats-Deliver-At"
+	JSScheduledSequence   = "Nats-Scheduled-Sequence"
+	JSBatchId             = "Nats-Batch-Id"
+	JSBatchSeq            = "Nats-Batch-Sequence"
+	JSBatchCommit         = "Nats-Batch-Commit"
 )
 
 // Headers for republished messages and direct gets.
@@ -304,6 +376,16 @@ const (
 	JSLastSequence = "Nats-Last-Sequence"
 )
 
+// Headers for dead lettered messages.
+// The NAK reason is best effort and may be missing after a consumer leader change.
+const (
+	JSDeadLetterConsumer   = "Nats-Dead-Letter-Consumer"
+	JSDeadLetterDeliveries = "Nats-Dead-Letter-Deliveries"
+	JSDeadLetterReason     = "Nats-Dead-Letter-Reason"
+	JSDeadLetterNakReason  = "Nats-Dead-Letter-Nak-Reason"
+	JSDeadLetterTermReason = "Nats-Dead-Letter-Term-Reason"
+)
+
 // Rollups, can be subject only or all messages.
 const (
 	JSMsgRollupSubject = "sub"
@@ -443,6 +525,8 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		qch:       make(chan struct{}),
 		uch:       make(chan struct{}, 4),
 		sch:       make(chan struct{}, 1),
+		sched:     newMsgSchedules(),
+		batches:   newMsgBatches(),
 	}
 
 	// Start our signaling routine to process consumers.
@@ -469,6 +553,16 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		mset.tr = tr
 	}
 
+	// Check for an ingest subject transform.
+	if cfg.SubjectTransform != nil {
+		itr, err := cfg.SubjectTransform.transform()
+		if err != nil {
+			jsa.mu.Unlock()
+			return nil, NewJSStreamTransformInvalidDestinationError(err)
+		}
+		mset.itr = itr
+	}
+
 	jsa.streams[cfg.Name] = mset
 	storeDir := filepath.Join(jsa.storeDir, streamsDir, cfg.Name)
 	jsa.mu.Unlock()
@@ -491,6 +585,15 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	fsCfg.StoreDir = storeDir
 	fsCfg.AsyncFlush = false
 	fsCfg.SyncInterval = 2 * time.Minute
+	if fsCfg.ScrubInterval == 0 {
+		fsCfg.ScrubInterval = s.getOpts().JetStreamScrubInterval
+	}
+	if fsCfg.CompactMaxRate == 0 {
+		fsCfg.CompactMaxRate = s.getOpts().JetStreamCompactMaxRate
+	}
+	if adir := s.getOpts().JetStreamArchiveDir; adir != _EMPTY_ {
+		fsCfg.ArchiveDir = filepath.Join(adir, JetStreamStoreDir, a.Name, streamsDir, cfg.Name)
+	}
 
 	if err := mset.setupStore(fsCfg); err != nil {
 		mset.stop(true, false)
@@ -515,6 +618,11 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	mset.lseq = state.LastSeq
 	mset.mu.Unlock()
 
+	// Recover any messages scheduled for later delivery.
+	if cfg.AllowMsgSchedules && cfg.Mirror == nil {
+		mset.rebuildSchedules()
+	}
+
 	// If no msgs (new stream), set dedupe state loaded to true.
 	if state.Msgs == 0 {
 		mset.ddloaded = true
@@ -563,6 +671,44 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	return mset, nil
 }
 
+// Creates the transform for this subject transform config. An empty source matches all subjects.
+func (st *SubjectTransformConfig) transform() (*transform, error) {
+	src := st.Source
+	if src == _EMPTY_ {
+		src = fwcs
+	}
+	return newTransform(src, st.Destination)
+}
+
+// Returns the subject space the transform destination can produce. Placeholders and
+// mapping functions that produce a single token are replaced with a partial wildcard,
+// and functions that can produce multiple tokens terminate the subject with a full wildcard.
+func (st *SubjectTransformConfig) destinationSubject() string {
+	tokens := strings.Split(st.Destination, tsep)
+	for i, token := range tokens {
+		switch {
+		case len(token) > 1 && token[0] == '$':
+			tokens[i] = pwcs
+		case partitionMappingFunctionRegEx.MatchString(token), wildcardMappingFunctionRegEx.MatchString(token):
+			tokens[i] = pwcs
+		case strings.HasPrefix(token, "{{"):
+			tokens[i] = fwcs
+			return strings.Join(tokens[:i+1], tsep)
+		}
+	}
+	return strings.Join(tokens, tsep)
+}
+
+// Returns all subjects messages for this stream can be stored under, which
+// includes what an ingest subject transform can produce.
+func (cfg *StreamConfig) storedSubjects() []string {
+	subjects := copyStrings(cfg.Subjects)
+	if cfg.SubjectTransform != nil {
+		subjects = append(subjects, cfg.SubjectTransform.destinationSubject())
+	}
+	return subjects
+}
+
 // Sets the index name. Usually just the stream name but when the stream is external we will
 // use additional information in case the stream names are the same.
 func (ssi *StreamSource) setIndexName() {
@@ -573,6 +719,104 @@ func (ssi *StreamSource) setIndexName() {
 	}
 }
 
+// Returns the subject filters for this source, if any.
+// An empty filter in a subject transform is returned as a full wildcard.
+func (ssi *StreamSource) filters() []string {
+	if len(ssi.SubjectTransforms) == 0 {
+		if ssi.FilterSubject == _EMPTY_ {
+			return nil
+		}
+		return []string{ssi.FilterSubject}
+	}
+	filters := make([]string, 0, len(ssi.SubjectTransforms))
+	for _, st := range ssi.SubjectTransforms {
+		if st.Source == _EMPTY_ {
+			filters = append(filters, fwcs)
+		} else {
+			filters = append(filters, st.Source)
+		}
+	}
+	return filters
+}
+
+// Checks the subject filters and transforms for this source.
+func (ssi *StreamSource) checkSubjectTransforms() *ApiError {
+	if len(ssi.SubjectTransforms) == 0 {
+		return nil
+	}
+	if ssi.FilterSubject != _EMPTY_ {
+		return NewJSSourceMultipleFiltersNotAllowedError()
+	}
+	filters := ssi.filters()
+	for i, st := range ssi.SubjectTransforms {
+		if !IsValidSubject(filters[i]) {
+			return NewJSSourceInvalidSubjectFilterError()
+		}
+		// Filters can not overlap, otherwise which transform applies is ambiguous.
+		for _, filter := range filters[:i] {
+			if SubjectsCollide(filter, filters[i]) {
+				return NewJSSourceOverlappingSubjectFiltersError()
+			}
+		}
+		if st.Destination == _EMPTY_ {
+			continue
+		}
+		if err := ValidateMappingDestination(st.Destination); err != nil {
+			return NewJSSourceInvalidTransformDestinationError()
+		}
+		if _, err := st.transform(); err != nil {
+			return NewJSSourceInvalidTransformDestinationError()
+		}
+	}
+	return nil
+}
+
+// Sets the subject filters and transforms from the source config.
+// The config has been validated already.
+func (si *sourceInfo) setFilters(ssi *StreamSource) {
+	si.sfs, si.trs = ssi.filters(), nil
+	for i := range ssi.SubjectTransforms {
+		var tr *transform
+		if st := &ssi.SubjectTransforms[i]; st.Destination != _EMPTY_ {
+			tr, _ = st.transform()
+		}
+		si.trs = append(si.trs, tr)
+	}
+}
+
+// Sets the filters for the upstream consumer. A single filter is passed as the filter subject
+// and multiple filters as filter subjects. We still filter as messages arrive in case the
+// origin does not support multiple filters.
+func (si *sourceInfo) setConsumerFilters(cfg *ConsumerConfig) {
+	cfg.FilterSubject, cfg.FilterSubjects = _EMPTY_, nil
+	switch {
+	case len(si.sfs) == 1 && si.sfs[0] != fwcs:
+		cfg.FilterSubject = si.sfs[0]
+	case len(si.sfs) > 1:
+		cfg.FilterSubjects = append([]string(nil), si.sfs...)
+	}
+}
+
+// Checks the subject of an inbound message against our filters and applies any
+// matching transform. Returns false if the message should not be stored.
+func (si *sourceInfo) transformSubject(subject string) (string, bool) {
+	if len(si.sfs) == 0 {
+		return subject, true
+	}
+	for i, filter := range si.sfs {
+		if !subjectIsSubsetMatch(subject, filter) {
+			continue
+		}
+		if i < len(si.trs) && si.trs[i] != nil {
+			if tsubj, err := si.trs[i].Match(subject); err == nil {
+				return tsubj, true
+			}
+		}
+		return subject, true
+	}
+	return _EMPTY_, false
+}
+
 func (mset *stream) streamAssignment() *streamAssignment {
 	mset.mu.RLock()
 	defer mset.mu.RUnlock()
@@ -659,6 +903,11 @@ func (mset *stream) setLeader(isLeader bool) error {
 	} else {
 		mset.leader = _EMPTY_
 	}
+	// Only the leader schedules messages back into the stream.
+	if isLeader {
+		mset.sched.reset()
+	}
+	mset.setScheduleTimer()
 	mset.mu.Unlock()
 	return nil
 }
@@ -1046,13 +1295,15 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		return exists, cfg.MaxMsgSize, cfg.Subjects
 	}
 
-	hasFilterSubjectOverlap := func(filter string, streamSubs []string) bool {
-		if filter == _EMPTY_ || len(streamSubs) == 0 {
+	hasFilterSubjectOverlap := func(filters []string, streamSubs []string) bool {
+		if len(filters) == 0 || len(streamSubs) == 0 {
 			return true
 		}
-		for _, sub := range streamSubs {
-			if SubjectsCollide(sub, filter) {
-				return true
+		for _, filter := range filters {
+			for _, sub := range streamSubs {
+				if SubjectsCollide(sub, filter) {
+					return true
+				}
 			}
 		}
 		return false
@@ -1077,6 +1328,9 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		if len(cfg.Sources) > 0 {
 			return StreamConfig{}, NewJSMirrorWithSourcesError()
 		}
+		if err := cfg.Mirror.checkSubjectTransforms(); err != nil {
+			return StreamConfig{}, err
+		}
 		// We do not require other stream to exist anymore, but if we can see it check payloads.
 		exists, maxMsgSize, subs := hasStream(cfg.Mirror.Name)
 		if len(subs) > 0 {
@@ -1086,10 +1340,10 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 			if cfg.MaxMsgSize > 0 && maxMsgSize > 0 && cfg.MaxMsgSize < maxMsgSize {
 				return StreamConfig{}, NewJSMirrorMaxMessageSizeTooBigError()
 			}
-			if !isRecovering && !hasFilterSubjectOverlap(cfg.Mirror.FilterSubject, subs) {
+			if filters := cfg.Mirror.filters(); !isRecovering && !hasFilterSubjectOverlap(filters, subs) {
 				return StreamConfig{}, NewJSStreamInvalidConfigError(
 					fmt.Errorf("mirror '%s' filter subject '%s' does not overlap with any origin stream subject",
-						cfg.Mirror.Name, cfg.Mirror.FilterSubject))
+						cfg.Mirror.Name, strings.Join(filters, ", ")))
 			}
 		}
 		if cfg.Mirror.External != nil {
@@ -1118,6 +1372,9 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 	}
 	if len(cfg.Sources) > 0 {
 		for _, src := range cfg.Sources {
+			if err := src.checkSubjectTransforms(); err != nil {
+				return StreamConfig{}, err
+			}
 			exists, maxMsgSize, subs := hasStream(src.Name)
 			if len(subs) > 0 {
 				streamSubs = append(streamSubs, subs...)
@@ -1126,10 +1383,10 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 				if cfg.MaxMsgSize > 0 && maxMsgSize > 0 && cfg.MaxMsgSize < maxMsgSize {
 					return StreamConfig{}, NewJSSourceMaxMessageSizeTooBigError()
 				}
-				if !isRecovering && !hasFilterSubjectOverlap(src.FilterSubject, streamSubs) {
+				if filters := src.filters(); !isRecovering && !hasFilterSubjectOverlap(filters, streamSubs) {
 					return StreamConfig{}, NewJSStreamInvalidConfigError(
 						fmt.Errorf("source '%s' filter subject '%s' does not overlap with any origin stream subject",
-							src.Name, src.FilterSubject))
+							src.Name, strings.Join(filters, ", ")))
 				}
 			}
 			if src.External == nil {
@@ -1168,13 +1425,15 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 	// cycle check for source cycle
 	toVisit := []*StreamConfig{&cfg}
 	visited := make(map[string]struct{})
-	overlaps := func(subjects []string, filter string) bool {
-		if filter == _EMPTY_ {
+	overlaps := func(subjects []string, filters []string) bool {
+		if len(filters) == 0 {
 			return true
 		}
-		for _, subject := range subjects {
-			if SubjectsCollide(subject, filter) {
-				return true
+		for _, filter := range filters {
+			for _, subject := range subjects {
+				if SubjectsCollide(subject, filter) {
+					return true
+				}
 			}
 		}
 		return false
@@ -1191,7 +1450,7 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 			// We can detect a cycle between streams, but let's double check that the
 			// subjects actually form a cycle.
 			if _, ok := visited[src.Name]; ok {
-				if overlaps(cfg.Subjects, src.FilterSubject) {
+				if overlaps(cfg.Subjects, src.filters()) {
 					return StreamConfig{}, NewJSStreamInvalidConfigError(errors.New("detected cycle"))
 				}
 			} else if exists, cfg := getStream(src.Name); exists {
@@ -1264,6 +1523,80 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		}
 	}
 
+	if cfg.AllowAtomicPublish && cfg.Mirror != nil {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream mirrors can not allow atomic publish"))
+	}
+
+	if cfg.Compression != NoCompression && cfg.Compression != S2Compression {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("unknown compression %v", cfg.Compression))
+	}
+
+	if cfg.Persist && cfg.Storage != MemoryStorage {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream persistence requires memory storage"))
+	}
+	if cfg.Persist && cfg.Replicas > 1 {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream persistence requires a replication factor of 1"))
+	}
+	if cfg.PersistInterval < 0 {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("persist interval can not be negative"))
+	}
+	if cfg.PersistInterval > 0 && !cfg.Persist {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("persist interval requires persist"))
+	}
+
+	if cfg.ArchiveAfter < 0 {
+		return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("archive after can not be negative"))
+	}
+	if cfg.ArchiveAfter > 0 {
+		if cfg.Storage != FileStorage {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream archiving requires file storage"))
+		}
+		if s.getOpts().JetStreamArchiveDir == _EMPTY_ {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream archiving requires an archive directory"))
+		}
+	}
+
+	if cfg.Backend != _EMPTY_ {
+		if lookupStreamStore(cfg.Backend) == nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("unknown stream store backend %q", cfg.Backend))
+		}
+		// These are implemented by our built-in stores.
+		if cfg.Persist || cfg.ArchiveAfter > 0 || cfg.Compression != NoCompression {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream store backend does not support persist, archive after or compression"))
+		}
+	}
+
+	// If we have a subject transform check that it is valid and applies to our subjects.
+	if cfg.SubjectTransform != nil {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream mirrors can not have a subject transform"))
+		}
+		src := cfg.SubjectTransform.Source
+		if src == _EMPTY_ {
+			src = fwcs
+		}
+		if !IsValidSubject(src) {
+			return StreamConfig{}, NewJSStreamTransformInvalidSourceError(ErrBadSubject)
+		}
+		var srcValid bool
+		for _, subj := range cfg.Subjects {
+			if SubjectsCollide(src, subj) {
+				srcValid = true
+				break
+			}
+		}
+		if !srcValid && len(cfg.Subjects) > 0 {
+			return StreamConfig{}, NewJSStreamTransformInvalidSourceError(
+				fmt.Errorf("source %q does not overlap with any stream subject", src))
+		}
+		if err := ValidateMappingDestination(cfg.SubjectTransform.Destination); err != nil {
+			return StreamConfig{}, NewJSStreamTransformInvalidDestinationError(err)
+		}
+		if _, err := cfg.SubjectTransform.transform(); err != nil {
+			return StreamConfig{}, NewJSStreamTransformInvalidDestinationError(err)
+		}
+	}
+
 	// If we have a republish directive check if we can create a transform here.
 	if cfg.RePublish != nil {
 		// Check to make sure source is a valid subset of the subjects we have.
@@ -1307,6 +1640,18 @@ func (mset *stream) config() StreamConfig {
 	return mset.cfg
 }
 
+// Returns how long our store took to recover on startup, nil if not a file store.
+func (mset *stream) recoveryInfo() *StreamRecoveryInfo {
+	mset.mu.RLock()
+	fs, ok := mset.store.(*fileStore)
+	mset.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	d, sidx := fs.recoveryState()
+	return &StreamRecoveryInfo{Duration: d, SubjectIndex: sidx}
+}
+
 func (mset *stream) fileStoreConfig() (FileStoreConfig, error) {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
@@ -1336,6 +1681,10 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 	if cfg.Storage != old.Storage {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change storage type"))
 	}
+	// Can't change the store backend.
+	if cfg.Backend != old.Backend {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change store backend"))
+	}
 	// Can't change retention.
 	if cfg.Retention != old.Retention {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change retention policy"))
@@ -1359,6 +1708,13 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 	if !cfg.DenyPurge && old.DenyPurge {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not cancel deny purge"))
 	}
+	// Can not change from true to false.
+	if !cfg.AllowMsgTTL && old.AllowMsgTTL {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not disable message TTL"))
+	}
+	if !cfg.AllowMsgSchedules && old.AllowMsgSchedules {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not disable message schedules"))
+	}
 	// Check for mirror changes which are not allowed.
 	if !reflect.DeepEqual(cfg.Mirror, old.Mirror) {
 		return nil, NewJSStreamMirrorNotUpdatableError()
@@ -1512,30 +1868,37 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 
 		// Check for Sources.
 		if len(cfg.Sources) > 0 || len(ocfg.Sources) > 0 {
-			current := make(map[string]string)
+			current := make(map[string]*StreamSource)
 			for _, s := range ocfg.Sources {
-				current[s.iname] = s.FilterSubject
+				current[s.iname] = s
 			}
 			for _, s := range cfg.Sources {
 				s.setIndexName()
-				if oFilter, ok := current[s.iname]; !ok {
+				if osrc, ok := current[s.iname]; !ok {
 					if mset.sources == nil {
 						mset.sources = make(map[string]*sourceInfo)
 					}
 					mset.cfg.Sources = append(mset.cfg.Sources, s)
 					si := &sourceInfo{name: s.Name, iname: s.iname}
+					si.setFilters(s)
 					mset.sources[s.iname] = si
 					mset.setStartingSequenceForSource(s.iname)
 					mset.setSourceConsumer(s.iname, si.sseq+1, time.Time{})
-				} else if oFilter != s.FilterSubject {
+				} else if osrc.FilterSubject != s.FilterSubject || !reflect.DeepEqual(osrc.SubjectTransforms, s.SubjectTransforms) {
 					if si, ok := mset.sources[s.iname]; ok {
+						si.setFilters(s)
 						filterOverlap := true
-						if oFilter != _EMPTY_ && s.FilterSubject != _EMPTY_ {
-							newFilter := strings.Split(s.FilterSubject, tsep)
-							oldFilter := strings.Split(oFilter, tsep)
-							if !isSubsetMatchTokenized(oldFilter, newFilter) &&
-								!isSubsetMatchTokenized(newFilter, oldFilter) {
-								filterOverlap = false
+						if oFilters, nFilters := osrc.filters(), s.filters(); len(oFilters) > 0 && len(nFilters) > 0 {
+							filterOverlap = false
+							for _, oFilter := range oFilters {
+								oldFilter := strings.Split(oFilter, tsep)
+								for _, nFilter := range nFilters {
+									newFilter := strings.Split(nFilter, tsep)
+									if isSubsetMatchTokenized(oldFilter, newFilter) ||
+										isSubsetMatchTokenized(newFilter, oldFilter) {
+										filterOverlap = true
+									}
+								}
 							}
 						}
 						if filterOverlap {
@@ -1588,6 +1951,15 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 		// a subsequent update to an existing tier will then move from existing past tier to existing new tier
 	}
 
+	// Check for a change in our ingest subject transform.
+	if !reflect.DeepEqual(cfg.SubjectTransform, ocfg.SubjectTransform) {
+		mset.itr = nil
+		if cfg.SubjectTransform != nil {
+			// This has been validated already.
+			mset.itr, _ = cfg.SubjectTransform.transform()
+		}
+	}
+
 	// Now update config and store's version of our config.
 	mset.cfg = *cfg
 
@@ -1642,6 +2014,9 @@ func (mset *stream) purge(preq *JSApiStreamPurgeRequest) (purged uint64, err err
 		return purged, err
 	}
 
+	// Drop any scheduled messages that were purged.
+	mset.pruneSchedules()
+
 	// Purge consumers.
 	var state StreamState
 	store.FastState(&state)
@@ -1659,11 +2034,9 @@ func (mset *stream) purge(preq *JSApiStreamPurgeRequest) (purged uint64, err err
 		// no subject was specified, we can purge all consumers sequences
 		if preq == nil ||
 			preq.Subject == _EMPTY_ ||
-			// or consumer filter subject is equal to purged subject
-			preq.Subject == o.cfg.FilterSubject ||
-			// or consumer subject is subset of purged subject,
-			// but not the other way around.
-			subjectIsSubsetMatch(o.cfg.FilterSubject, preq.Subject) {
+			// or all consumer filter subjects are equal to or
+			// a subset of purged subject, but not the other way around.
+			o.isFilteredSubsetOf(preq.Subject) {
 			o.purge(fseq, lseq)
 		}
 	}
@@ -1773,9 +2146,7 @@ func (js *jetStream) streamSourceSubjectsClustered(accountName, streamName strin
 
 	js.mu.RLock()
 	cfg := sa.Config
-	if len(cfg.Subjects) > 0 {
-		subjects = append(subjects, cfg.Subjects...)
-	}
+	subjects = append(subjects, cfg.storedSubjects()...)
 
 	// Check if we need to keep going.
 	var sources []*StreamSource
@@ -1816,9 +2187,7 @@ func (a *Account) streamSourceSubjectsNotClustered(streamName string, seen map[s
 	seen[streamName] = true
 
 	cfg := mset.config()
-	if len(cfg.Subjects) > 0 {
-		subjects = append(subjects, cfg.Subjects...)
-	}
+	subjects = append(subjects, cfg.storedSubjects()...)
 
 	var subjs []string
 	if cfg.Mirror != nil {
@@ -1855,11 +2224,17 @@ func (mset *stream) sourceInfo(si *sourceInfo) *StreamSourceInfo {
 		ssi.Active = time.Since(si.last)
 	}
 
-	var ext *ExternalStream
+	var ss *StreamSource
 	if mset.cfg.Mirror != nil {
-		ext = mset.cfg.Mirror.External
-	} else if ss := mset.streamSource(si.iname); ss != nil && ss.External != nil {
+		ss = mset.cfg.Mirror
+	} else {
+		ss = mset.streamSource(si.iname)
+	}
+	var ext *ExternalStream
+	if ss != nil {
 		ext = ss.External
+		ssi.FilterSubject = ss.FilterSubject
+		ssi.SubjectTransforms = append(ssi.SubjectTransforms, ss.SubjectTransforms...)
 	}
 	if ext != nil {
 		ssi.External = &ExternalStream{
@@ -2028,6 +2403,15 @@ func (mset *stream) processInboundMirrorMsg(m *inMsg) bool {
 		mset.mirror.lag = pending - 1
 	}
 
+	// Check our subject filters and transforms. Messages we filter out locally
+	// still need to occupy their sequence to keep us in sync with the origin.
+	subj, ok := mset.mirror.transformSubject(m.subj)
+	if !ok {
+		mset.skipMsgs(sseq, sseq)
+		mset.mu.Unlock()
+		return true
+	}
+
 	// Check if we allow mirror direct here. If so check they we have mostly caught up.
 	// The reason we do not require 0 is if the source is active we may always be slightly behind.
 	if mset.cfg.MirrorDirect && mset.mirror.dsub == nil && pending < dgetCaughtUpThresh {
@@ -2047,10 +2431,10 @@ func (mset *stream) processInboundMirrorMsg(m *inMsg) bool {
 			s.resourcesExeededError()
 			err = ApiErrors[JSInsufficientResourcesErr]
 		} else {
-			err = node.Propose(encodeStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts))
+			err = node.Propose(encodeStreamMsg(subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts))
 		}
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts)
+		err = mset.processJetStreamMsg(subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts)
 	}
 	if err != nil {
 		if strings.Contains(err.Error(), "no space left") {
@@ -2182,6 +2566,7 @@ func (mset *stream) setupMirrorConsumer() error {
 	// If this is the first time
 	if mset.mirror == nil {
 		mset.mirror = &sourceInfo{name: mset.cfg.Mirror.Name}
+		mset.mirror.setFilters(mset.cfg.Mirror)
 	} else {
 		mset.cancelSourceInfo(mset.mirror)
 		mset.mirror.sseq = mset.lseq
@@ -2248,9 +2633,7 @@ func (mset *stream) setupMirrorConsumer() error {
 	}
 
 	// Filters
-	if mset.cfg.Mirror.FilterSubject != _EMPTY_ {
-		req.Config.FilterSubject = mset.cfg.Mirror.FilterSubject
-	}
+	mirror.setConsumerFilters(&req.Config)
 
 	respCh := make(chan *JSApiConsumerCreateResponse, 1)
 	reply := infoReplySubject()
@@ -2553,9 +2936,7 @@ func (mset *stream) setSourceConsumer(iname string, seq uint64, startTime time.T
 		req.Config.DeliverPolicy = DeliverByStartSequence
 	}
 	// Filters
-	if ssi.FilterSubject != _EMPTY_ {
-		req.Config.FilterSubject = ssi.FilterSubject
-	}
+	si.setConsumerFilters(&req.Config)
 
 	respCh := make(chan *JSApiConsumerCreateResponse, 1)
 	reply := infoReplySubject()
@@ -2831,6 +3212,13 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	} else {
 		si.lag = pending - 1
 	}
+
+	// Check our subject filters and transforms.
+	subj, ok := si.transformSubject(m.subj)
+	if !ok {
+		mset.mu.Unlock()
+		return true
+	}
 	mset.mu.Unlock()
 
 	hdr, msg := m.hdr, m.msg
@@ -2845,9 +3233,9 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	var err error
 	// If we are clustered we need to propose this message to the underlying raft group.
 	if node != nil {
-		err = mset.processClusteredInboundMsg(m.subj, _EMPTY_, hdr, msg)
+		err = mset.processClusteredInboundMsg(subj, _EMPTY_, hdr, msg)
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, hdr, msg, 0, 0)
+		err = mset.processJetStreamMsg(subj, _EMPTY_, hdr, msg, 0, 0)
 	}
 
 	if err != nil {
@@ -2978,6 +3366,7 @@ func (mset *stream) startingSequenceForSources() {
 			ssi.setIndexName()
 		}
 		si := &sourceInfo{name: ssi.Name, iname: ssi.iname}
+		si.setFilters(ssi)
 		mset.sources[ssi.iname] = si
 	}
 
@@ -3285,9 +3674,32 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 	mset.mu.Lock()
 	mset.created = time.Now().UTC()
 
+	if mset.cfg.Backend != _EMPTY_ {
+		factory := lookupStreamStore(mset.cfg.Backend)
+		if factory == nil {
+			mset.mu.Unlock()
+			return fmt.Errorf("unknown stream store backend %q", mset.cfg.Backend)
+		}
+		ss, err := factory(&mset.cfg, fsCfg.StoreDir)
+		if err != nil {
+			mset.mu.Unlock()
+			return err
+		}
+		mset.store = ss
+		mset.mu.Unlock()
+		mset.store.RegisterStorageUpdates(mset.storeUpdates)
+		return nil
+	}
+
 	switch mset.cfg.Storage {
 	case MemoryStorage:
-		ms, err := newMemStore(&mset.cfg)
+		s := mset.srv
+		prf := s.jsKeyGen(mset.acc.Name)
+		if prf != nil {
+			fsCfg.Cipher = s.getOpts().JetStreamCipher
+		}
+		// We may have messages persisted or restored in our store directory.
+		ms, err := newMemStoreWithPersistence(&mset.cfg, *fsCfg, mset.created, prf, s.jsOldKeyGen(mset.acc.Name))
 		if err != nil {
 			mset.mu.Unlock()
 			return err
@@ -3300,12 +3712,15 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 			// We are encrypted here, fill in correct cipher selection.
 			fsCfg.Cipher = s.getOpts().JetStreamCipher
 		}
-		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, prf)
+		// Pass along our previous key, if any, so blocks still encrypted with it can be rotated.
+		fs, err := newFileStoreWithKeys(*fsCfg, mset.cfg, mset.created, prf, s.jsOldKeyGen(mset.acc.Name))
 		if err != nil {
 			mset.mu.Unlock()
 			return err
 		}
 		mset.store = fs
+		fs.registerCorruptHandler(mset.handleCorruptRange)
+		fs.registerErrorHandler(mset.handleStoreError)
 	}
 	mset.mu.Unlock()
 
@@ -3322,6 +3737,7 @@ func (mset *stream) storeUpdates(md, bd int64, seq uint64, subj string) {
 	// If we have a single negative update then we will process our consumers for stream pending.
 	// Purge and Store handled separately inside individual calls.
 	if md == -1 && seq > 0 {
+		mset.sched.forget(seq)
 		// We use our consumer list mutex here instead of the main stream lock since it may be held already.
 		mset.clsMu.RLock()
 		for _, o := range mset.cList {
@@ -3335,6 +3751,62 @@ func (mset *stream) storeUpdates(md, bd int64, seq uint64, subj string) {
 	}
 }
 
+// Called by our file store for errors from its background work.
+// Lock should not be held.
+func (mset *stream) handleStoreError(err error) {
+	mset.mu.RLock()
+	s, acc, name := mset.srv, mset.acc, mset.cfg.Name
+	mset.mu.RUnlock()
+	s.Warnf("JetStream stream '%s > %s' store error: %v", acc.Name, name, err)
+}
+
+// Called by our file store when scrubbing finds a damaged range of messages.
+// Clustered streams will repair the range from the leader. The leader can not
+// repair from itself, so its damaged ranges are left for a later scrub once it
+// is no longer the leader.
+// Lock should not be held.
+func (mset *stream) handleCorruptRange(first, last uint64) {
+	mset.mu.RLock()
+	s, acc, name := mset.srv, mset.acc, mset.cfg.Name
+	clustered := mset.isClustered() && !mset.isLeader()
+	mset.mu.RUnlock()
+
+	s.Warnf("JetStream stream '%s > %s' has corrupt messages from sequence %d to %d", acc.Name, name, first, last)
+
+	subj := JSAdvisoryStreamCorruptPre + "." + name
+	adv := &JSStreamCorruptAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamCorruptAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   name,
+		Server:   s.Name(),
+		FirstSeq: first,
+		LastSeq:  last,
+		Repair:   clustered,
+		Domain:   s.getOpts().JetStreamDomain,
+	}
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.Name
+	s.publishAdvisory(nil, subj, adv)
+
+	if clustered {
+		s.startGoRoutine(func() {
+			defer s.grWG.Done()
+			if err := mset.repairRange(first, last); err != nil {
+				s.Warnf("JetStream stream '%s > %s' could not repair sequences %d to %d: %v", acc.Name, name, first, last, err)
+			} else {
+				s.Noticef("JetStream stream '%s > %s' repaired sequences %d to %d", acc.Name, name, first, last)
+			}
+		})
+	}
+}
+
 // NumMsgIds returns the number of message ids being tracked for duplicate suppression.
 func (mset *stream) numMsgIds() int {
 	mset.mu.Lock()
@@ -3483,10 +3955,12 @@ type inMsg struct {
 	rply string
 	hdr  []byte
 	msg  []byte
+	// A committed atomic batch, subj holds the batch id.
+	batch []*batchMsg
 }
 
 func (mset *stream) queueInbound(ib *ipQueue, subj, rply string, hdr, msg []byte) {
-	ib.push(&inMsg{subj, rply, hdr, msg})
+	ib.push(&inMsg{subj, rply, hdr, msg, nil})
 }
 
 func (mset *stream) queueInboundMsg(subj, rply string, hdr, msg []byte) {
@@ -3535,6 +4009,12 @@ func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Accou
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
 	}
+	// Any replica can answer a direct get, so these can not be linearizable.
+	if req.Linearizable {
+		hdr := []byte("NATS/1.0 400 Linearizable Not Supported For Direct Get\r\n\r\n")
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		return
+	}
 
 	inlineOk := c.kind != ROUTER && c.kind != GATEWAY && c.kind != LEAF
 	if !inlineOk {
@@ -3642,7 +4122,7 @@ func (mset *stream) getDirectRequest(req *JSApiMsgGetRequest, reply string) {
 // processInboundJetStreamMsg handles processing messages bound for a stream.
 func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	mset.mu.RLock()
-	isLeader, isClustered, isSealed := mset.isLeader(), mset.isClustered(), mset.cfg.Sealed
+	isLeader, isClustered, isSealed, itr := mset.isLeader(), mset.isClustered(), mset.cfg.Sealed, mset.itr
 	mset.mu.RUnlock()
 
 	// If we are not the leader just ignore.
@@ -3662,6 +4142,20 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Ac
 
 	hdr, msg := c.msgParts(rmsg)
 
+	// Apply any ingest subject transform. Subjects that do not match the source are stored as is.
+	// We do this before proposing so the stored subject is part of the replicated entry.
+	if itr != nil {
+		if tsubj, err := itr.Match(subject); err == nil {
+			subject = tsubj
+		}
+	}
+
+	// Messages that are part of an atomic batch are held back until the batch is committed.
+	if len(hdr) > 0 && len(getHeader(JSBatchId, hdr)) > 0 {
+		mset.processInboundBatchMsg(subject, reply, hdr, msg, c.kind == CLIENT)
+		return
+	}
+
 	// If we are not receiving directly from a client we should move this to another Go routine.
 	if c.kind != CLIENT {
 		mset.queueInboundMsg(subject, reply, hdr, msg)
@@ -3683,6 +4177,21 @@ var (
 
 // processJetStreamMsg is where we try to actually process the stream msg.
 func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64) error {
+	// Only the stream itself can reference a scheduled message, so strip this from anything
+	// inbound. Replicated entries were proposed by our leader and keep it.
+	if lseq == 0 && len(hdr) > 0 {
+		hdr = removeHeaderIfPresent(hdr, JSScheduledSequence)
+	}
+	mset.ingMu.Lock()
+	defer mset.ingMu.Unlock()
+	return mset.storeJetStreamMsg(subject, reply, hdr, msg, lseq, ts, false)
+}
+
+// storeJetStreamMsg does the actual processing for processJetStreamMsg.
+// When batched the resource limits were checked for the batch as a whole and
+// the caller signals consumers once the complete batch has been stored.
+// ingMu should be held.
+func (mset *stream) storeJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64, batched bool) error {
 	mset.mu.Lock()
 	c, s, store := mset.client, mset.srv, mset.store
 	if c == nil {
@@ -3843,6 +4352,40 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 				return fmt.Errorf("last msgid mismatch: %q vs %q", lmsgId, last)
 			}
 		}
+		// Check for per message TTL. Mirrored and sourced messages simply keep the header
+		// and will only be tracked for expiration if we allow TTLs ourselves.
+		if mset.cfg.Mirror == nil && len(getHeader(JSStreamSource, hdr)) == 0 {
+			if ttl, err := getMessageTTL(hdr); err != nil || (ttl > 0 && !mset.cfg.AllowMsgTTL) {
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					if err != nil {
+						resp.Error = NewJSMessageTTLInvalidError()
+					} else {
+						resp.Error = NewJSMessageTTLDisabledError()
+					}
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				if err == nil {
+					err = errors.New("message TTL disabled")
+				}
+				return err
+			}
+			// Same for delivery times.
+			if apiErr := checkMsgDeliverAt(hdr, mset.cfg.AllowMsgSchedules); apiErr != nil {
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					resp.Error = apiErr
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				return apiErr
+			}
+		}
 		// Check for any rollups.
 		if rollup := getRollup(hdr); rollup != _EMPTY_ {
 			if !mset.cfg.AllowRollup || mset.cfg.DenyPurge {
@@ -3901,7 +4444,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	}
 
 	// Check to see if we have exceeded our limits.
-	if js.limitsExceeded(stype) {
+	if !batched && js.limitsExceeded(stype) {
 		s.resourcesExeededError()
 		mset.clfs++
 		mset.mu.Unlock()
@@ -3929,7 +4472,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 			noInterest = true
 			mset.clsMu.RLock()
 			for _, o := range mset.cList {
-				if o.cfg.FilterSubject == _EMPTY_ || subjectIsSubsetMatch(subject, o.cfg.FilterSubject) {
+				if o.isFilteredMatch(subject) {
 					noInterest = false
 					break
 				}
@@ -3988,6 +4531,23 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		}
 	}
 
+	// Track messages for later delivery before we store them, so consumers never see them as deliverable.
+	var schedSeq uint64
+	var schedAt int64
+	if len(hdr) > 0 && mset.cfg.AllowMsgSchedules && mset.cfg.Mirror == nil {
+		sseq, sts := mset.lseq, ts
+		if lseq != 0 || ts != 0 {
+			sseq = lseq + 1 - clfs
+		}
+		if sts == 0 {
+			sts = time.Now().UnixNano()
+		}
+		if at, _ := getMessageDeliverAt(hdr, sts); at > sts {
+			schedSeq, schedAt = sseq, at
+			mset.sched.track(schedSeq, subject, schedAt)
+		}
+	}
+
 	// Store actual msg.
 	if lseq == 0 && ts == 0 {
 		seq, ts, err = store.StoreMsg(subject, hdr, msg)
@@ -3997,6 +4557,19 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		err = store.StoreRawMsg(subject, hdr, msg, seq, ts)
 	}
 
+	if schedAt > 0 {
+		if err != nil {
+			mset.sched.forget(schedSeq)
+		} else {
+			// Relative delivery times are based on the timestamp we stored.
+			if at, _ := getMessageDeliverAt(hdr, ts); seq != schedSeq || at != schedAt {
+				mset.sched.forget(schedSeq)
+				mset.sched.track(seq, subject, at)
+			}
+			mset.setScheduleTimer()
+		}
+	}
+
 	if err != nil {
 		// If we did not succeed put those values back and increment clfs in case we are clustered.
 		var state StreamState
@@ -4023,7 +4596,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		return err
 	}
 
-	if exceeded, apiErr := jsa.limitsExceeded(stype, tierName); exceeded {
+	if exceeded, apiErr := jsa.limitsExceeded(stype, tierName); exceeded && !batched {
 		s.RateLimitWarnf("JetStream resource limits exceeded for account: %q", accName)
 		if canRespond {
 			resp.PubAck = &PubAck{Stream: name}
@@ -4050,9 +4623,16 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		mset.storeMsgIdLocked(&ddentry{msgId, seq, ts})
 	}
 
+	// Check if this is a scheduled copy whose original we need to remove.
+	takeSched := len(hdr) > 0 && schedAt == 0 && mset.cfg.AllowMsgSchedules && mset.cfg.Mirror == nil
+
 	// If here we succeeded in storing the message.
 	mset.mu.Unlock()
 
+	if takeSched {
+		mset.takeScheduledMsg(subject, hdr, ts)
+	}
+
 	// No errors, this is the normal path.
 	if rollupSub {
 		mset.purge(&JSApiStreamPurgeRequest{Subject: subject, Keep: 1})
@@ -4095,7 +4675,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	}
 
 	// Signal consumers for new messages.
-	if numConsumers > 0 {
+	if numConsumers > 0 && !batched {
 		mset.sigq.push(newCMsg(subject, seq))
 		select {
 		case mset.sch <- struct{}{}:
@@ -4392,6 +4972,12 @@ func (mset *stream) internalLoop() {
 			for _, imi := range ims {
 				im := imi.(*inMsg)
 
+				// Committed batches are queued in order with other inbound messages.
+				if im.batch != nil {
+					mset.commitBatch(im.subj, im.rply, im.batch)
+					continue
+				}
+
 				// If we are clustered we need to propose this message to the underlying raft group.
 				if isClustered {
 					mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
@@ -4504,6 +5090,8 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		close(mset.qch)
 		mset.qch = nil
 	}
+	stopAndClearTimer(&mset.schedTmr)
+	mset.batches.clear()
 
 	c := mset.client
 	mset.client = nil
@@ -4539,6 +5127,15 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	// Clustered cleanup.
 	mset.mu.Unlock()
 
+	// Remember our scheduled messages so we do not need to scan for them on recovery.
+	var sfn string
+	var sbuf []byte
+	if store != nil && !deleteFlag {
+		if sfn = mset.scheduleIndexFile(); sfn != _EMPTY_ {
+			sbuf = mset.encodeScheduleIndex()
+		}
+	}
+
 	// Check if the stream assignment has the group node specified.
 	// We need this cleared for if the stream gets reassigned here.
 	if sa != nil {
@@ -4572,6 +5169,9 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		os.Remove(accDir)
 	} else if err := store.Stop(); err != nil {
 		return err
+	} else if sbuf != nil {
+		// Written once stopped since a persisted memory store replaces our directory when it stops.
+		writeScheduleIndex(sfn, sbuf)
 	}
 
 	return nil
@@ -4629,12 +5229,13 @@ func (mset *stream) numConsumers() int {
 // Lock should be held.
 func (mset *stream) setConsumer(o *consumer) {
 	mset.consumers[o.name] = o
-	if o.cfg.FilterSubject != _EMPTY_ {
+	if len(o.subjf) > 0 {
 		mset.numFilter++
 	}
 	if o.cfg.Direct {
 		mset.directs++
 	}
+	mset.sched.watch(o.subjf)
 	// Now update consumers list as well
 	mset.clsMu.Lock()
 	mset.cList = append(mset.cList, o)
@@ -4643,13 +5244,16 @@ func (mset *stream) setConsumer(o *consumer) {
 
 // Lock should be held.
 func (mset *stream) removeConsumer(o *consumer) {
-	if o.cfg.FilterSubject != _EMPTY_ && mset.numFilter > 0 {
+	if len(o.subjf) > 0 && mset.numFilter > 0 {
 		mset.numFilter--
 	}
 	if o.cfg.Direct && mset.directs > 0 {
 		mset.directs--
 	}
 	if mset.consumers != nil {
+		if mset.consumers[o.name] == o {
+			mset.sched.unwatch(o.subjf)
+		}
 		delete(mset.consumers, o.name)
 		// Now update consumers list as well
 		mset.clsMu.Lock()
@@ -4661,7 +5265,9 @@ func (mset *stream) removeConsumer(o *consumer) {
 		}
 		// Always remove from the leader sublist.
 		if mset.csl != nil {
-			mset.csl.Remove(o.signalSub())
+			for _, sub := range o.signalSubs() {
+				mset.csl.Remove(sub)
+			}
 		}
 		mset.clsMu.Unlock()
 	}
@@ -4675,7 +5281,9 @@ func (mset *stream) setConsumerAsLeader(o *consumer) {
 	if mset.csl == nil {
 		mset.csl = NewSublistWithCache()
 	}
-	mset.csl.Insert(o.signalSub())
+	for _, sub := range o.signalSubs() {
+		mset.csl.Insert(sub)
+	}
 }
 
 // Remove the consumer as a leader. This will update signaling sublist.
@@ -4683,37 +5291,44 @@ func (mset *stream) removeConsumerAsLeader(o *consumer) {
 	mset.clsMu.Lock()
 	defer mset.clsMu.Unlock()
 	if mset.csl != nil {
-		mset.csl.Remove(o.signalSub())
+		for _, sub := range o.signalSubs() {
+			mset.csl.Remove(sub)
+		}
 	}
 }
 
-// swapSigSubs will update signal Subs for a new subject filter.
+// swapSigSubs will update the consumer's subject filters and signal Subs for them.
+// The filters are swapped while holding our consumer list lock, since we check them
+// under it when storing messages without holding the consumer lock.
 // consumer lock should not be held.
-func (mset *stream) swapSigSubs(o *consumer, newFilter string) {
+func (mset *stream) swapSigSubs(o *consumer, newFilters []string) {
 	mset.clsMu.Lock()
 	o.mu.Lock()
 
-	if o.sigSub != nil {
+	wasFiltered := len(o.subjf) > 0
+	mset.sched.watch(newFilters)
+	mset.sched.unwatch(o.subjf)
+	o.setSubjectFilters(newFilters)
+
+	if o.sigSubs != nil {
 		if mset.csl != nil {
-			mset.csl.Remove(o.sigSub)
+			for _, sub := range o.sigSubs {
+				mset.csl.Remove(sub)
+			}
 		}
-		o.sigSub = nil
+		o.sigSubs = nil
 	}
 
 	if o.isLeader() {
-		subject := newFilter
-		if subject == _EMPTY_ {
-			subject = fwcs
-		}
-		o.sigSub = &subscription{subject: []byte(subject), icb: o.processStreamSignal}
+		o.sigSubs = o.newSignalSubs(newFilters)
 		if mset.csl == nil {
 			mset.csl = NewSublistWithCache()
 		}
-		mset.csl.Insert(o.sigSub)
+		for _, sub := range o.sigSubs {
+			mset.csl.Insert(sub)
+		}
 	}
 
-	oldFilter := o.cfg.FilterSubject
-
 	o.mu.Unlock()
 	mset.clsMu.Unlock()
 
@@ -4722,10 +5337,10 @@ func (mset *stream) swapSigSubs(o *consumer, newFilter string) {
 	defer mset.mu.Unlock()
 
 	// Decrement numFilter if old filter was an actual filter.
-	if oldFilter != _EMPTY_ && mset.numFilter > 0 {
+	if wasFiltered && mset.numFilter > 0 {
 		mset.numFilter--
 	}
-	if newFilter != _EMPTY_ {
+	if len(newFilters) > 0 {
 		mset.numFilter++
 	}
 }
@@ -4780,16 +5395,20 @@ func (mset *stream) Store() StreamStore {
 	return mset.store
 }
 
-// Determines if the new proposed partition is unique amongst all consumers.
+// Determines if the new proposed partitions are unique amongst all consumers.
 // Lock should be held.
-func (mset *stream) partitionUnique(partition string) bool {
+func (mset *stream) partitionUnique(partitions []string) bool {
 	for _, o := range mset.consumers {
-		if o.cfg.FilterSubject == _EMPTY_ {
+		if len(o.subjf) == 0 {
 			return false
 		}
-		if subjectIsSubsetMatch(partition, o.cfg.FilterSubject) ||
-			subjectIsSubsetMatch(o.cfg.FilterSubject, partition) {
-			return false
+		for _, partition := range partitions {
+			for _, filter := range o.subjf {
+				if subjectIsSubsetMatch(partition, filter) ||
+					subjectIsSubsetMatch(filter, partition) {
+					return false
+				}
+			}
 		}
 	}
 	return true
@@ -4880,8 +5499,28 @@ func (mset *stream) snapshot(deadline time.Duration, checkMsgs, includeConsumers
 
 const snapsDir = "__snapshots__"
 
+// StreamRestoreOptions select the point in time and identity of a restored stream.
+type StreamRestoreOptions struct {
+	// Sequence truncates the restored stream after this sequence.
+	Sequence uint64 `json:"seq,omitempty"`
+	// Time truncates the restored stream after the last message stored at or before this time.
+	Time *time.Time `json:"time,omitempty"`
+	// Rename restores the snapshot under the name and subjects of the given config, so it can be
+	// inspected next to the original. Messages keep their subjects and consumers are not restored.
+	Rename bool `json:"rename,omitempty"`
+}
+
+// Returns true if these options change what we restore from the snapshot.
+func (ro *StreamRestoreOptions) isSet() bool {
+	return ro != nil && (ro.Sequence > 0 || ro.Time != nil || ro.Rename)
+}
+
 // RestoreStream will restore a stream from a snapshot.
 func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error) {
+	return a.restoreStream(ncfg, r, nil)
+}
+
+func (a *Account) restoreStream(ncfg *StreamConfig, r io.Reader, ropts *StreamRestoreOptions) (*stream, error) {
 	if ncfg == nil {
 		return nil, errors.New("nil config on stream restore")
 	}
@@ -4963,11 +5602,19 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 		return nil, err
 	}
 
-	// Check to make sure names match.
-	if fcfg.Name != cfg.Name {
+	// Check to make sure names match, unless we are restoring under a new one.
+	if fcfg.Name != cfg.Name && (ropts == nil || !ropts.Rename) {
 		return nil, errors.New("stream names do not match")
 	}
 
+	// Truncate to our point in time and take on our new identity if requested.
+	var truncated bool
+	if ropts.isSet() {
+		if truncated, err = a.prepareRestore(s, sdir, &fcfg, &cfg, ropts); err != nil {
+			return nil, err
+		}
+	}
+
 	// See if this stream already exists.
 	if _, err := a.lookupStream(cfg.Name); err == nil {
 		return nil, NewJSStreamNameExistRestoreFailedError()
@@ -5050,7 +5697,13 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 			obs.setCreatedTime(cfg.Created)
 		}
 		obs.mu.Lock()
-		err = obs.readStoredState(lseq)
+		// Restored to a point in time, so make sure we are not ahead of the stream.
+		if truncated {
+			err = obs.rewindStoredState(lseq)
+		}
+		if err == nil {
+			err = obs.readStoredState(lseq)
+		}
 		obs.mu.Unlock()
 		if err != nil {
 			mset.stop(true, false)
@@ -5060,6 +5713,153 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 	return mset, nil
 }
 
+// Prepare the snapshot staged in sdir for our restore options. We truncate it to the requested
+// point in time, and when renaming we rewrite its messages into a new store with our config.
+// Returns true if any messages were truncated.
+func (a *Account) prepareRestore(s *Server, sdir string, fcfg *FileStreamInfo, cfg *StreamConfig, ropts *StreamRestoreOptions) (bool, error) {
+	prf, oldprf := s.jsKeyGen(a.Name), s.jsOldKeyGen(a.Name)
+	var sc StoreCipher
+	if prf != nil {
+		sc = s.getOpts().JetStreamCipher
+	}
+	// Open what we staged without any limits, those will apply once restored.
+	scfg := fcfg.StreamConfig
+	scfg.Storage, scfg.Discard = FileStorage, DiscardOld
+	scfg.MaxMsgs, scfg.MaxBytes, scfg.MaxMsgsPer, scfg.MaxAge = -1, -1, -1, 0
+	scfg.AllowMsgTTL = false
+	fsCfg := FileStoreConfig{StoreDir: sdir, Cipher: sc, ScrubInterval: -1, CompactInterval: -1, SubjectIndexInterval: -1}
+	fs, err := newFileStoreWithKeys(fsCfg, scfg, fcfg.Created, prf, oldprf)
+	if err != nil {
+		return false, err
+	}
+
+	var state StreamState
+	fs.FastState(&state)
+	last := state.LastSeq
+	if ropts.Sequence > 0 && ropts.Sequence < last {
+		last = ropts.Sequence
+	}
+	// Anything stored after our time is gone.
+	if ropts.Time != nil {
+		if seq := fs.GetSeqFromTime(ropts.Time.Add(time.Nanosecond)); seq > 0 && seq-1 < last {
+			last = seq - 1
+		}
+	}
+
+	truncated := last < state.LastSeq
+	if truncated {
+		err = truncateStoreTo(fs, last)
+	}
+	// Write our messages to a new store for our config.
+	var rdir string
+	if err == nil && ropts.Rename {
+		rdir, err = copyRestoredStore(fs, filepath.Dir(sdir), cfg, sc, prf)
+	}
+	// We need to be stopped before we can swap anything in.
+	fs.Stop()
+	if err != nil {
+		return false, err
+	}
+	if rdir == _EMPTY_ {
+		return truncated, nil
+	}
+
+	// Swap in the new store for what we staged.
+	defer os.RemoveAll(rdir)
+	if err := os.RemoveAll(sdir); err != nil {
+		return false, err
+	}
+	if err := os.Rename(rdir, sdir); err != nil {
+		return false, err
+	}
+	*fcfg = FileStreamInfo{StreamConfig: *cfg}
+	return truncated, nil
+}
+
+// Copy all messages from fs into a new store for cfg in a temporary directory within dir.
+// Returns the directory of the new store, which is stopped.
+func copyRestoredStore(fs *fileStore, dir string, cfg *StreamConfig, sc StoreCipher, prf keyGen) (string, error) {
+	rdir, err := os.MkdirTemp(dir, "snap-")
+	if err != nil {
+		return _EMPTY_, err
+	}
+	ncfg := *cfg
+	ncfg.Storage = FileStorage
+	fsCfg := FileStoreConfig{StoreDir: rdir, BlockSize: dynBlkSize(ncfg.Retention, ncfg.MaxBytes), Cipher: sc, ScrubInterval: -1, CompactInterval: -1, SubjectIndexInterval: -1}
+	nfs, err := newFileStoreWithKeys(fsCfg, ncfg, time.Now().UTC(), prf, nil)
+	if err != nil {
+		os.RemoveAll(rdir)
+		return _EMPTY_, err
+	}
+	err = copyStoreMsgs(fs, nfs)
+	if serr := nfs.Stop(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		os.RemoveAll(rdir)
+		return _EMPTY_, err
+	}
+	return rdir, nil
+}
+
+// Truncate a store so it holds nothing after seq, keeping seq as its last sequence.
+func truncateStoreTo(ss StreamStore, seq uint64) error {
+	var state StreamState
+	ss.FastState(&state)
+
+	// Find the last message we keep.
+	var smv StoreMsg
+	var lseq uint64
+	for n := seq; n >= state.FirstSeq && n > 0; n-- {
+		if _, err := ss.LoadMsg(n, &smv); err == nil {
+			lseq = n
+			break
+		}
+	}
+	if lseq == 0 {
+		// Nothing to keep, reset and start after seq.
+		if err := ss.Truncate(0); err != nil {
+			return err
+		}
+		_, err := ss.Compact(seq + 1)
+		return err
+	}
+	if err := ss.Truncate(lseq); err != nil {
+		return err
+	}
+	// Anything between was deleted at the time.
+	for n := lseq; n < seq; n++ {
+		ss.SkipMsg()
+	}
+	return nil
+}
+
+// Copy all messages from src to an empty dst, keeping their sequences and timestamps.
+func copyStoreMsgs(src, dst StreamStore) error {
+	var state StreamState
+	src.FastState(&state)
+	first, last := state.FirstSeq, state.LastSeq
+	if first > 1 {
+		if _, err := dst.Compact(first); err != nil {
+			return err
+		}
+	}
+	var smv StoreMsg
+	for seq := first; first > 0 && seq <= last; seq++ {
+		sm, err := src.LoadMsg(seq, &smv)
+		if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+			dst.SkipMsg()
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := dst.StoreRawMsg(sm.subj, sm.hdr, sm.msg, seq, sm.ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // This is to check for dangling messages.
 // Issue https://github.com/nats-io/nats-server/issues/3612
 func (mset *stream) checkForOrphanMsgs() {
@@ -1298,6 +1298,19 @@ func subjectIsSubsetMatch(subject, test string) bool {
 	return isSubsetMatch(tts, test)
 }
 
+// Checks if the subject is a subset match of any of the filters.
+// The subject is only tokenized once.
+func subjectIsSubsetMatchAny(subject string, filters []string) bool {
+	tsa := [32]string{}
+	tts := tokenizeSubjectIntoSlice(tsa[:0], subject)
+	for _, filter := range filters {
+		if subject == filter || isSubsetMatch(tts, filter) {
+			return true
+		}
+	}
+	return false
+}
+
 // This will test a subject as an array of tokens against a test subject
 // Calls into the function isSubsetMatchTokenized
 func isSubsetMatch(tokens []string, test string) bool {